@@ -6,26 +6,38 @@
 package api
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
-	"net/url"
-	"strings"
+	"strconv"
 
+	"github.com/gdotgordon/produce-demo/reqctx"
 	"github.com/gdotgordon/produce-demo/service"
-	"github.com/gdotgordon/produce-demo/store"
 	"github.com/gdotgordon/produce-demo/types"
 	"go.uber.org/zap"
 )
 
 // Definitions for the supported URLs.
 const (
-	statusURL  = "/v1/status"
-	produceURL = "/v1/produce"
-	resetURL   = "/v1/reset"
+	statusURL         = "/v1/status"
+	produceURL        = "/v1/produce"
+	importURL         = "/v1/produce/import"
+	bulkURL           = "/v1/produce/bulk"
+	resetURL          = "/v1/reset"
+	categoriesURL     = "/v1/categories"
+	categoryCountsURL = "/v1/categories/counts"
+	attributesURL     = "/v1/attributes"
+	graphqlURL        = "/v1/graphql"
+	openAPIURL        = "/v1/openapi.json"
+
+	// The routes of single resources, whose last segment is the code or
+	// name of the resource.
+	produceItemURL = produceURL + "/{code}"
+	categoryURL    = categoriesURL + "/{name}"
+	attributeURL   = attributesURL + "/{name}"
 )
 
 // API is the item that dispatches to the endpoint implementations
@@ -36,56 +48,65 @@ type apiImpl struct {
 
 // Init sets up the endpoint processing.  There is nothing returned, other
 // than potntial errors, because the endpoint handling is configured in
-// the passed-in muxer.
+// the passed-in muxer, which hands every path to the API's router, so
+// even the paths it doesn't know get a problem response.
 func Init(ctx context.Context, mux *http.ServeMux, service service.Service,
 	log *zap.SugaredLogger) error {
 	ap := apiImpl{service: service, log: log}
-	mux.Handle(statusURL, wrapContext(ctx, ap.getStatus))
-	mux.Handle(produceURL, wrapContext(ctx, ap.handleProduce))
-	mux.Handle(produceURL+"/", wrapContext(ctx, ap.handleProduce))
-	mux.Handle(resetURL, wrapContext(ctx, ap.handleReset))
+	rt, err := ap.routes(ctx)
+	if err != nil {
+		return err
+	}
+	mux.Handle("/", rt)
 	return nil
 }
 
+// routes returns the router for all of the endpoints, with the context
+// woven into each request, along with the deadline of its endpoint.  HEAD
+// and OPTIONS are handled by the router for every route.
+func (a apiImpl) routes(ctx context.Context) (*router, error) {
+	schema, err := a.newGraphQLSchema()
+	if err != nil {
+		return nil, err
+	}
+	rt := newRouter()
+	for _, v := range []struct {
+		method  string
+		pattern string
+		hf      http.HandlerFunc
+	}{
+		{http.MethodGet, statusURL, a.getStatus},
+		{http.MethodGet, produceURL, a.handleGet},
+		{http.MethodPost, produceURL, a.handleAdd},
+		{http.MethodPost, importURL, a.handleImport},
+		{http.MethodPost, bulkURL, a.handleBulk},
+		{http.MethodGet, produceItemURL, a.handleGetItem},
+		{http.MethodDelete, produceItemURL, a.handleDelete},
+		{http.MethodGet, resetURL, a.handleReset},
+		{http.MethodPost, resetURL, a.handleReset},
+		{http.MethodGet, categoriesURL, a.handleListCategories},
+		{http.MethodPost, categoriesURL, a.handleAddCategory},
+		{http.MethodDelete, categoryURL, a.handleDeleteCategory},
+		{http.MethodGet, categoryCountsURL, a.handleCategoryCounts},
+		{http.MethodGet, attributesURL, a.handleListAttributes},
+		{http.MethodPost, attributesURL, a.handleAddAttribute},
+		{http.MethodDelete, attributeURL, a.handleDeleteAttribute},
+		{http.MethodPost, graphqlURL, a.graphQLHandler(schema)},
+		{http.MethodGet, openAPIURL, a.getOpenAPI},
+	} {
+		rt.handle(v.method, v.pattern, wrapContext(ctx,
+			withDeadline(v.method, v.pattern, v.hf)))
+	}
+	return rt, nil
+}
+
 // Liveness check endpoint
 func (a apiImpl) getStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Body != nil {
 		defer r.Body.Close()
 	}
-
-	// Where is Gorilla mux when I need it?
-	if r.Method != http.MethodGet {
-		http.NotFound(w, r)
-		return
-	}
 	sr := types.StatusResponse{Status: "produce service is up and running"}
-	b, err := json.MarshalIndent(sr, "", "  ")
-	if err != nil {
-		a.notifyInternalServerError(w, "json marshal failed", err)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write(b)
-}
-
-// Handle all produce endpoints.  with the Go built-in muxer, we need to
-// manually work with the dispatch of the "/v1/produce" endpoint.
-func (a *apiImpl) handleProduce(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodPost:
-		a.handleAdd(w, r)
-	case http.MethodGet:
-		a.handleGet(w, r)
-	case http.MethodDelete:
-		a.handleDelete(w, r)
-	default:
-		if r.Body != nil {
-			r.Body.Close()
-		}
-		http.NotFound(w, r)
-		return
-	}
+	a.writeOKResponse(w, r, sr)
 }
 
 // Handler for POST/add new produce.  We are asked to add mutliple items
@@ -103,113 +124,167 @@ func (a *apiImpl) handleProduce(w http.ResponseWriter, r *http.Request) {
 //
 // An attempt to add an item already present generates HTTP 409 (Conflict).
 //
+// An item may be added without a code, in which case one is generated.
+// A single item that succeeds has its URL in the Location header, and if
+// its code was generated, it is returned in the payload as well.  When
+// multiple items all succeed and any codes were generated, the individual
+// results are returned with HTTP 201, so the caller can learn the codes.
+//
 // For individual items added, we do support incoming JSON for a single
 // Produce item not enclosed in an array.
 //
+// An invalid item has all of its problems reported, each with the field
+// at fault, including a unit price that can't be parsed, and if they are
+// rejected, any fields that aren't known.
+//
 // Since this API is arguably not purely Restful, it is a topic where ten
 // different sources propose ten different ways of doing it, so I picked a
 // reasonable one that somewhat stays within REST semantics.
 func (a apiImpl) handleAdd(w http.ResponseWriter, r *http.Request) {
 	if r.Body == nil {
-		writeBadRequestResponse(w, errors.New("No body for POST"))
+		writeBadRequestResponse(w, r, errors.New("No body for POST"))
 		return
 	}
 	defer r.Body.Close()
 
 	a.log.Debugw("handling POST request", "url", r.URL.String())
 
-	// Ensure the URL path is exactly the produce base URL.
-	_, ok := a.extractPath(w, r, produceURL)
-	if !ok {
+	if !acceptable(w, r) {
 		return
 	}
 
 	// Unmarshal the request item.  Note adding 0 items is deemed an error.
-	var items types.ProduceAddRequest
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		a.notifyInternalServerError(w, "error reading request body", err)
+	var inputs []types.ProduceInput
+	codec, b, ok := a.readBody(w, r)
+	if !ok {
 		return
 	}
 
 	// Unmarshal the payload either into a produce item slice, or if not,
-	// then try as a single item.
-	if err = json.Unmarshal(b, &items); err != nil {
+	// then try as a single item.  A price that can't be parsed doesn't
+	// fail the request, but is reported with the other problems of its
+	// item.
+	if err := codec.Unmarshal(b, &inputs); err != nil {
 		// See if this is in fact a single produce item.
-		var prod types.Produce
-		serr := json.Unmarshal(b, &prod)
+		var prod types.ProduceInput
+		serr := codec.Unmarshal(b, &prod)
 		if serr == nil {
-			items = []types.Produce{prod}
+			inputs = []types.ProduceInput{prod}
 		} else {
-			writeBadRequestResponse(w, err)
+			writeMalformedBody(w, r, err)
 			return
 		}
 	}
 
-	if len(items) == 0 {
-		writeBadRequestResponse(w,
+	if len(inputs) == 0 {
+		writeBadRequestResponse(w, r,
 			errors.New("At least one item must be specifed to add"))
 		return
 	}
 
 	// Invoke the service to do the add
-	addRes, err := a.service.Add(r.Context(), items)
+	items, problems := decodeInputs(inputs)
+	addRes, err := a.addItems(r.Context(), items, problems)
 
 	if err != nil {
-		a.notifyInternalServerError(w, "server error from Add", err)
+		a.notifyInternalServerError(w, r, "server error from Add", err)
 		return
 	}
 
 	// If there was only one item to add, handle that without the mass response.
 	if len(items) == 1 {
 		if addRes[0].Err == nil {
-			w.WriteHeader(http.StatusCreated)
-		} else {
-			sc := errorToStatusCode(addRes[0].Err, http.StatusCreated)
-			if sc == http.StatusBadRequest {
-				writeBadRequestResponse(w, addRes[0].Err)
-			} else {
-				w.WriteHeader(sc)
+			w.Header().Set("Location", produceURL+"/"+addRes[0].Code)
+			if !addRes[0].Generated {
+				w.WriteHeader(http.StatusCreated)
+				return
 			}
+			a.writeCreatedResponse(w, r, types.ProduceAddItemResponse{
+				Code: addRes[0].Code, StatusCode: http.StatusCreated})
+		} else {
+			a.writeError(w, r, addRes[0].Err)
 		}
 		return
 	}
 	// If there is more than one add, and at least one failure, we'll return
 	// HTTP 200 (multi-status) and return a JSON object with the results of each
 	// individual add.  If there are no failures, we'll return HTTP 201 with
-	// no payload.
+	// no payload.  If some of the items weren't added as the service was
+	// too busy, Retry-After says when to try them again.
 	restResp := make([]types.ProduceAddItemResponse, len(addRes))
-	failures := 0
+	generated := false
 	for i, v := range addRes {
-		restResp[i].Code = v.Code
-		if v.Err != nil {
+		restResp[i] = addItemResponse(v)
+		generated = generated || v.Generated
+		setRetryAfter(w, v.Err)
+	}
+	a.writeAddResponse(w, r, restResp, generated)
+}
+
+// addItemResponse converts the result of a single add to its REST form.
+func addItemResponse(res service.AddResult) types.ProduceAddItemResponse {
+	resp := types.ProduceAddItemResponse{
+		Code:       res.Code,
+		StatusCode: http.StatusCreated,
+	}
+	if res.Err != nil {
+		resp.StatusCode, resp.ErrorCode, _ = problemFor(res.Err)
+		resp.Error = res.Err.Error()
+		resp.Errors = fieldErrors(res.Err)
+	}
+	return resp
+}
+
+// writeAddResponse writes the response to an add of multiple items, given
+// the result of each and whether any were added without a code.
+func (a apiImpl) writeAddResponse(w http.ResponseWriter, r *http.Request,
+	restResp []types.ProduceAddItemResponse, generated bool) {
+	failures := 0
+	for _, v := range restResp {
+		if v.StatusCode != http.StatusCreated {
 			failures++
-			restResp[i].Error = v.Err.Error()
 		}
-		restResp[i].StatusCode = errorToStatusCode(v.Err, http.StatusCreated)
 	}
 
-	// If no failures, return a single created response.
+	// If no failures, return a single created response.  The individual
+	// results are only needed if the caller has to learn assigned codes,
+	// which is the case whenever an item was added without one.
 	if failures == 0 {
-		w.WriteHeader(http.StatusCreated)
+		if generated {
+			a.writeCreatedResponse(w, r, restResp)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
 		return
 	}
 
 	// At least one failuire, so we're going to return HTTP 200 along with
 	// the descritpive JSON.
-	b, err = json.Marshal(restResp)
-	if err != nil {
-		a.notifyInternalServerError(w, "JSON marshal error", err)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write(b)
+	a.writeOKResponse(w, r, restResp)
 }
 
-// The Get Rest handler simply lists all the items in the database.
+// The Get Rest handler lists all the items in the database.
 // It is valid and meaningful to return an empty array.  It normally
 // returns HTTP 200.
+//
+// The list may be filtered with the "category" query parameter, which
+// selects the items in that category's subtree, and any number of "tag"
+// query parameters, all of which an item must carry to be listed.  An
+// unknown category yields HTTP 404, and an invalid one HTTP 400.
+//
+// Each item's name is localized to best match the Accept-Language header,
+// falling back to the default name.  With "all_names=true", the default
+// name and all of the translations are returned instead.
+//
+// The items are written in the representation that best matches the
+// Accept header, which may be any of the registered ones, such as JSON,
+// XML or YAML.  With "text/csv", they are exported as CSV, in the form
+// accepted by the import endpoint.  If none are acceptable, HTTP 406 is
+// returned.
+//
+// For large catalogs, the items can be streamed rather than built up in
+// memory, either as NDJSON if the Accept header prefers
+// "application/x-ndjson", or as the usual JSON array with "stream=true".
 func (a apiImpl) handleGet(w http.ResponseWriter, r *http.Request) {
 	if r.Body != nil {
 		defer r.Body.Close()
@@ -217,30 +292,237 @@ func (a apiImpl) handleGet(w http.ResponseWriter, r *http.Request) {
 
 	a.log.Debugw("handling GET request", "url", r.URL.String())
 
-	// The last part of the request URL should have the ID to delete.
-	_, ok := a.extractPath(w, r, produceURL)
-	if !ok {
+	// Invoke the service list items call, filtered if requested.
+	filter := types.ProduceFilter{
+		Category: r.URL.Query().Get("category"),
+		Tags:     r.URL.Query()["tag"],
+	}
+	w.Header().Set("Vary", "Accept, Accept-Language")
+	mt := negotiate(r.Header.Get("Accept"),
+		append(codecMediaTypes(), mediaTypeCSV, mediaTypeNDJSON))
+	if mt == "" {
+		writeNotAcceptable(w, r)
+		return
+	}
+	stream, _ := strconv.ParseBool(r.URL.Query().Get("stream"))
+	if mt == mediaTypeNDJSON || (mt == mediaTypeJSON && stream) {
+		a.streamList(w, r, filter, mt == mediaTypeNDJSON)
 		return
 	}
 
-	// Invoke the service list items call
-	items, err := a.service.ListAll(r.Context())
-	switch err.(type) {
-	case service.InternalError:
-		a.notifyInternalServerError(w, "error listing items", err)
-	case nil:
-		// List was successful - write HTTP 200
-		b, err := json.MarshalIndent(items, "", "  ")
+	var items []types.Produce
+	var err error
+	if filter.IsEmpty() {
+		items, err = a.service.ListAll(r.Context())
+	} else {
+		items, err = a.service.List(r.Context(), filter)
+	}
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+
+	// List was successful - write HTTP 200
+	allNames, _ := strconv.ParseBool(r.URL.Query().Get("all_names"))
+	localizeNames(items,
+		parseAcceptLanguage(r.Header.Get("Accept-Language")), allNames)
+	if mt == mediaTypeCSV {
+		a.writeCSVResponse(w, r, items)
+		return
+	}
+	codec, _ := codecFor(mt)
+	a.writeEncoded(w, r, codec, http.StatusOK, items)
+}
+
+// Handler for GET of a single produce item, whose code is the last part of
+// the URL path.  The item is written as for a list, with its name localized
+// to best match the Accept-Language header, or with all of its names if
+// "all_names=true".  HTTP 404 is returned if there is no such item, and 400
+// if the code is invalid.
+func (a apiImpl) handleGetItem(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	a.log.Debugw("handling item GET request", "url", r.URL.String())
+
+	if !acceptable(w, r) {
+		return
+	}
+	item, err := a.service.Get(r.Context(), pathParam(r, "code"))
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	allNames, _ := strconv.ParseBool(r.URL.Query().Get("all_names"))
+	items := []types.Produce{item}
+	localizeNames(items,
+		parseAcceptLanguage(r.Header.Get("Accept-Language")), allNames)
+	w.Header().Set("Vary", "Accept, Accept-Language")
+	a.writeOKResponse(w, r, items[0])
+}
+
+// writeCSVResponse writes the items as CSV, using the delimiter from the
+// query parameters.
+func (a apiImpl) writeCSVResponse(w http.ResponseWriter, r *http.Request,
+	items []types.Produce) {
+	opts, err := parseCSVOptions(r.URL.Query())
+	if err != nil {
+		writeBadRequestResponse(w, r, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, items, opts.delimiter); err != nil {
+		a.notifyInternalServerError(w, r, "CSV write error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// Handler for POST/import of produce items from CSV.  The body must be
+// "text/csv" with a header row naming the columns, which are the produce
+// fields "code", "name", "unit_price", "category" and "tags" (separated
+// by semicolons), plus "attr:{name}" for attributes and "name:{tag}" for
+// localized names.  Columns with other headers can be mapped to these
+// with "map" query parameters, such as "map=Description:name", or mapped
+// to "-" to be ignored.  The delimiter is set with "delimiter".
+//
+// The rows are added the same way as for a batch add, and the response
+// is the same, with each result also carrying its row number.  By default
+// the valid rows are added even if some are invalid.  With
+// "on_error=abort", the rows are added all or none: if any is invalid, or
+// can't be added, such as for a code already in the store or given twice
+// in the file, none are added, and HTTP 400 is returned with the results,
+// in which the other rows have the status 424 (Failed Dependency).
+func (a apiImpl) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		writeBadRequestResponse(w, r, errors.New("No body for POST"))
+		return
+	}
+	defer r.Body.Close()
+
+	a.log.Debugw("handling import request", "url", r.URL.String())
+
+	if !acceptable(w, r) {
+		return
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != mediaTypeCSV {
+		writeUnsupportedMediaType(w, r)
+		return
+	}
+	opts, err := parseCSVOptions(r.URL.Query())
+	if err != nil {
+		writeBadRequestResponse(w, r, err)
+		return
+	}
+
+	// The schema is needed to convert the attribute values from text.
+	defs, err := a.service.ListAttributes(r.Context())
+	if err != nil {
+		if !a.writeAbandoned(w, r, err) {
+			a.notifyInternalServerError(w, r, "error listing attributes", err)
+		}
+		return
+	}
+	items, problems, err := readCSV(r.Body, opts,
+		types.NewAttributeSchema(defs))
+	if err != nil {
+		writeBadRequestResponse(w, r, err)
+		return
+	}
+	if len(items) == 0 {
+		writeBadRequestResponse(w, r,
+			errors.New("At least one row must be specifed to import"))
+		return
+	}
+
+	// Report the rows that couldn't be read, and gather the rest, noting
+	// which row each one came from.  The problems with the fields of a row,
+	// such as a bad price, are reported along with the rest of its
+	// problems.
+	restResp := make([]types.ProduceAddItemResponse, len(items))
+	var valid []types.Produce
+	var fieldProblems []types.FieldErrors
+	var rows []int
+	for i, v := range problems {
+		restResp[i].Row = i + 1
+		restResp[i].Code = items[i].Code
+		errs, ok := v.(types.FieldErrors)
+		if v != nil && !ok {
+			fe := service.FormatError{Message: v.Error()}
+			restResp[i].StatusCode, restResp[i].ErrorCode, _ = problemFor(fe)
+			restResp[i].Error = fe.Error()
+			continue
+		}
+		valid = append(valid, items[i])
+		fieldProblems = append(fieldProblems, errs)
+		rows = append(rows, i)
+	}
+
+	var addRes []service.AddResult
+	if opts.abort {
+		verrs, err := a.validateItems(r.Context(), valid, fieldProblems)
 		if err != nil {
-			a.notifyInternalServerError(w, "JSON marshal error", err)
+			a.notifyInternalServerError(w, r, "server error from Validate", err)
+			return
+		}
+		aborted := len(valid) != len(items) || hasError(verrs)
+		if !aborted {
+			// The rows are checked against the store and each other as
+			// they are added, all together, so another request can't add
+			// a clashing code in between.
+			addRes, err = a.service.AddAll(r.Context(), valid)
+			if err != nil {
+				a.notifyInternalServerError(w, r, "server error from Add", err)
+				return
+			}
+			for i, v := range addRes {
+				verrs[i] = v.Err
+				aborted = aborted || v.Err != nil
+			}
+		}
+		for i, v := range verrs {
+			if v != nil {
+				row := rows[i]
+				restResp[row].Code = valid[i].Code
+				restResp[row].StatusCode, restResp[row].ErrorCode, _ =
+					problemFor(v)
+				restResp[row].Error = v.Error()
+				restResp[row].Errors = fieldErrors(v)
+			}
+		}
+		if aborted {
+			for i := range restResp {
+				if restResp[i].StatusCode == 0 {
+					restResp[i].StatusCode = http.StatusFailedDependency
+					restResp[i].ErrorCode = types.ProblemImportAborted
+					restResp[i].Error = "not added, as the import was aborted"
+				}
+			}
+			a.writeResponse(w, r, http.StatusBadRequest, restResp)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		w.Write(b)
-	default:
-		a.notifyInternalServerError(w, "an unexpected problem occurred", err)
 	}
+
+	if addRes == nil {
+		addRes, err = a.addItems(r.Context(), valid, fieldProblems)
+		if err != nil {
+			a.notifyInternalServerError(w, r, "server error from Add", err)
+			return
+		}
+	}
+	generated := false
+	for i, v := range addRes {
+		row := rows[i]
+		restResp[row] = addItemResponse(v)
+		restResp[row].Row = row + 1
+		generated = generated || v.Generated
+		setRetryAfter(w, v.Err)
+	}
+	a.writeAddResponse(w, r, restResp, generated)
 }
 
 // The delete endpoint contains the proudce code as the last part of the
@@ -257,103 +539,272 @@ func (a apiImpl) handleDelete(w http.ResponseWriter, r *http.Request) {
 
 	a.log.Debugw("handling DELETE request", "url", r.URL.String())
 
-	// The last part of the request URL should have the ID to delete.
-	path := r.URL.EscapedPath()
-	path, err := url.PathUnescape(path)
+	// Invoke the service delete call
+	err := a.service.Delete(r.Context(), pathParam(r, "code"))
 	if err != nil {
-		a.notifyInternalServerError(w, "URL unescape error", err)
+		a.writeError(w, r, err)
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// Extract the code from the request URL and validate it
-	if strings.HasSuffix(path, "/") {
-		path = path[:len(path)-1]
+// Handler for POST/add new category.  The payload is a single category,
+// whose parent, if specified, must already exist.  HTTP 201 is returned on
+// success, 400 if the category is invalid, 404 if the parent is unknown,
+// and 409 if the category already exists.
+func (a apiImpl) handleAddCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		writeBadRequestResponse(w, r, errors.New("No body for POST"))
+		return
+	}
+	defer r.Body.Close()
+
+	a.log.Debugw("handling category POST request", "url", r.URL.String())
+
+	codec, b, ok := a.readBody(w, r)
+	if !ok {
+		return
 	}
-	if strings.Count(path, "/") != 3 {
-		writeBadRequestResponse(w, fmt.Errorf("invalid URL for delete: %s",
-			r.URL.String()))
+	var cat types.Category
+	if err := codec.Unmarshal(b, &cat); err != nil {
+		writeMalformedBody(w, r, err)
 		return
 	}
-	code := path[strings.LastIndex(path, "/")+1:]
 
-	// Invoke the service delete call
-	err = a.service.Delete(r.Context(), code)
-	sc := errorToStatusCode(err, http.StatusNoContent)
-	if sc == http.StatusBadRequest {
-		writeBadRequestResponse(w, err)
-	} else {
-		w.WriteHeader(sc)
+	err := a.service.AddCategory(r.Context(), cat)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Handler for GET/list categories.  It is valid to return an empty array.
+func (a apiImpl) handleListCategories(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
 	}
+
+	a.log.Debugw("handling category GET request", "url", r.URL.String())
+
+	cats, err := a.service.ListCategories(r.Context())
+	if err != nil {
+		if !a.writeAbandoned(w, r, err) {
+			a.notifyInternalServerError(w, r, "error listing categories", err)
+		}
+		return
+	}
+	a.writeOKResponse(w, r, types.CategoryListResponse(cats))
 }
 
-// extractPath extracts and unescapes the path component.  If an
-// error occurs, it writes the proper response channel data and
-// sets a false boolean result.
-func (a apiImpl) extractPath(w http.ResponseWriter, r *http.Request,
-	expURL string) (string, bool) {
-	// The last part of the request URL should have the ID to delete.
-	path := r.URL.EscapedPath()
-	path, err := url.PathUnescape(path)
+// Handler for DELETE category.  A 204 code (No Content) is returned if
+// successful, 404 if not found, 409 if the category still has children
+// or produce items and 400 if the syntax is incorrect.
+func (a apiImpl) handleDeleteCategory(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	a.log.Debugw("handling category DELETE request", "url", r.URL.String())
+
+	err := a.service.DeleteCategory(r.Context(), pathParam(r, "name"))
 	if err != nil {
-		a.notifyInternalServerError(w, "cannot unescape URL", err)
-		return "", false
+		a.writeError(w, r, err)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// Make sure it is the correct URL
-	if path != expURL && path != expURL+"/" {
-		a.log.Errorw("received unexpected URL", "url", path)
-		writeBadRequestResponse(w, fmt.Errorf("invalid URL: %s", path))
-		return "", false
+// Handler for GET category counts.  The response has the direct and
+// subtree item counts for every category.
+func (a apiImpl) handleCategoryCounts(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	counts, err := a.service.CategoryCounts(r.Context())
+	if err != nil {
+		if !a.writeAbandoned(w, r, err) {
+			a.notifyInternalServerError(w, r, "error counting categories", err)
+		}
+		return
 	}
-	return path, true
+	a.writeOKResponse(w, r, types.CategoryCountResponse(counts))
 }
 
-func (a apiImpl) handleReset(w http.ResponseWriter, r *http.Request) {
+// Handler for POST/add new attribute definition.  HTTP 201 is returned on
+// success, 400 if the definition is invalid, and 409 if the attribute is
+// already defined.
+func (a apiImpl) handleAddAttribute(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		writeBadRequestResponse(w, r, errors.New("No body for POST"))
+		return
+	}
+	defer r.Body.Close()
+
+	a.log.Debugw("handling attribute POST request", "url", r.URL.String())
+
+	codec, b, ok := a.readBody(w, r)
+	if !ok {
+		return
+	}
+	var def types.AttributeDef
+	if err := codec.Unmarshal(b, &def); err != nil {
+		writeMalformedBody(w, r, err)
+		return
+	}
+
+	err := a.service.AddAttribute(r.Context(), def)
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Handler for GET/list attribute definitions.  It is valid to return an
+// empty array.
+func (a apiImpl) handleListAttributes(w http.ResponseWriter,
+	r *http.Request) {
 	if r.Body != nil {
 		defer r.Body.Close()
 	}
-	code := errorToStatusCode(a.service.Clear(r.Context()), http.StatusOK)
-	w.WriteHeader(code)
+
+	a.log.Debugw("handling attribute GET request", "url", r.URL.String())
+
+	defs, err := a.service.ListAttributes(r.Context())
+	if err != nil {
+		if !a.writeAbandoned(w, r, err) {
+			a.notifyInternalServerError(w, r, "error listing attributes", err)
+		}
+		return
+	}
+	a.writeOKResponse(w, r, types.AttributeListResponse(defs))
+}
+
+// Handler for DELETE attribute definition.  A 204 code (No Content) is
+// returned if successful, 404 if not found, 409 if produce items still
+// carry the attribute and 400 if the syntax is incorrect.
+func (a apiImpl) handleDeleteAttribute(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	a.log.Debugw("handling attribute DELETE request", "url", r.URL.String())
+
+	err := a.service.DeleteAttribute(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeOKResponse marshals the item and writes it with HTTP 200.
+func (a apiImpl) writeOKResponse(w http.ResponseWriter, r *http.Request,
+	item interface{}) {
+	a.writeResponse(w, r, http.StatusOK, item)
 }
 
-func (a apiImpl) notifyInternalServerError(w http.ResponseWriter, msg string,
-	err error) {
-	a.log.Errorw(msg, "error", err)
-	w.WriteHeader(http.StatusInternalServerError)
+// writeCreatedResponse marshals the item and writes it with HTTP 201.
+func (a apiImpl) writeCreatedResponse(w http.ResponseWriter, r *http.Request,
+	item interface{}) {
+	a.writeResponse(w, r, http.StatusCreated, item)
 }
 
-// Map a Go eror to an HTTP status type
-func errorToStatusCode(err error, nilCode int) int {
-	switch err.(type) {
-	case service.InternalError:
-		return http.StatusInternalServerError
-	case service.FormatError:
-		return http.StatusBadRequest
-	case store.AlreadyExistsError:
-		return http.StatusConflict
-	case store.NotFoundError:
-		return http.StatusNotFound
-	case nil:
-		return nilCode
-	default:
-		return http.StatusInternalServerError
+// writeResponse marshals the item in the representation that best matches
+// the Accept header and writes it with the status code.  If none of the
+// representations are acceptable, HTTP 406 (Not Acceptable) is written.
+func (a apiImpl) writeResponse(w http.ResponseWriter, r *http.Request,
+	sc int, item interface{}) {
+	codec, ok := responseCodec(r.Header.Get("Accept"))
+	if !ok {
+		writeNotAcceptable(w, r)
+		return
 	}
+	a.writeEncoded(w, r, codec, sc, item)
 }
 
-// For HTTP bad request repsonses, serialize a JSON status message with
-// the cause.
-func writeBadRequestResponse(w http.ResponseWriter, err error) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusBadRequest)
-	b, _ := json.MarshalIndent(types.StatusResponse{Status: err.Error()}, "", "  ")
+// writeEncoded marshals the item with the codec and writes it with the
+// status code.
+func (a apiImpl) writeEncoded(w http.ResponseWriter, r *http.Request,
+	codec Codec, sc int, item interface{}) {
+	b, err := codec.Marshal(item)
+	if err != nil {
+		a.notifyInternalServerError(w, r, "marshal error", err)
+		return
+	}
+	if w.Header().Get("Vary") == "" {
+		w.Header().Set("Vary", "Accept")
+	}
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.WriteHeader(sc)
 	w.Write(b)
 }
 
-// Weave the context into the incoming request in case there is anything
-// of use stored in it.
+// acceptable returns whether the response can be written in one of the
+// representations the Accept header allows, and if not, writes HTTP 406
+// (Not Acceptable).  Handlers that make changes check this first, so a
+// request isn't carried out only to fail when its response is written.
+func acceptable(w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := responseCodec(r.Header.Get("Accept")); !ok {
+		writeNotAcceptable(w, r)
+		return false
+	}
+	return true
+}
+
+// readBody reads the request body and gets the codec for its media type.
+// If there is no codec for it, HTTP 415 (Unsupported Media Type) is
+// written, and false is returned, as it is if the body can't be read.
+func (a apiImpl) readBody(w http.ResponseWriter, r *http.Request) (Codec,
+	[]byte, bool) {
+	codec, err := requestCodec(r.Header.Get("Content-Type"))
+	if err != nil {
+		a.log.Debugw("unsupported request content type", "error", err)
+		writeUnsupportedMediaType(w, r)
+		return nil, nil, false
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		a.notifyInternalServerError(w, r, "error reading request body", err)
+		return nil, nil, false
+	}
+	return codec, b, true
+}
+
+// Handler for reset, which deletes everything, with either GET or POST.
+// A HEAD request, which the router hands to the GET handler, only checks
+// the endpoint, as HEAD must never change anything.
+func (a apiImpl) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := a.service.Clear(r.Context()); err != nil {
+		a.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Weave the server's context into the incoming request, so the work of the
+// request is cancelled either when the client goes away, or when the server
+// shuts down.  The request's ID and client address are added.
 func wrapContext(ctx context.Context, hf http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rc := r.WithContext(ctx)
+		rctx, cancel := mergeCancel(r.Context(), ctx)
+		defer cancel()
+		info := newRequestInfo(r)
+		w.Header().Set(RequestIDHeader, info.ID)
+		rc := r.WithContext(reqctx.WithRequestInfo(rctx, info))
 		hf(w, rc)
 	})
 }
@@ -9,7 +9,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gdotgordon/produce-demo/service"
 	"github.com/gdotgordon/produce-demo/store"
@@ -46,8 +50,15 @@ var (
 		Name:      "Green-Pepper",
 		UnitPrice: types.USD(79),
 	}
+
+	// The problems with the fields of secondProduceBadName.
+	badNameErrors = types.FieldErrors{{Field: "name", Value: "Green-Pepper",
+		Rule: types.RuleNamePattern, Message: "invalid name: 'Green-Pepper'"}}
 )
 
+// The code the dummy service assigns to items added without one.
+const generatedCode = "GEN0-0000-0000-0001"
+
 func TestStatusEndpoint(t *testing.T) {
 	api := apiImpl{log: newLogger(t)}
 	req, err := http.NewRequest(http.MethodGet, statusURL, nil)
@@ -84,7 +95,7 @@ func TestAddEndpoint(t *testing.T) {
 	}{
 		{
 			url:       produceURL + "/hello",
-			expStatus: http.StatusBadRequest,
+			expStatus: http.StatusMethodNotAllowed,
 		},
 		{
 			url:       produceURL,
@@ -121,6 +132,7 @@ func TestAddEndpoint(t *testing.T) {
 				types.ProduceAddItemResponse{Code: "A12T-4GH7-QPL9-3N4M", StatusCode: 201},
 				types.ProduceAddItemResponse{Code: "A12T-4GH7-QPL9-3N4M",
 					StatusCode: http.StatusConflict,
+					ErrorCode:  types.ProblemProduceExists,
 					Error:      "produce code 'Dup' already exists",
 				},
 			},
@@ -133,7 +145,9 @@ func TestAddEndpoint(t *testing.T) {
 				types.ProduceAddItemResponse{Code: "A12T-4GH7-QPL9-3N4M", StatusCode: 201},
 				types.ProduceAddItemResponse{Code: "DRT6-72AS-K736-L4AR",
 					StatusCode: http.StatusBadRequest,
+					ErrorCode:  types.ProblemInvalidRequest,
 					Error:      "invalid item format: invalid name: 'Green-Pepper'",
+					Errors:     badNameErrors,
 				},
 			},
 		},
@@ -158,7 +172,7 @@ func TestAddEndpoint(t *testing.T) {
 		}
 		api := apiImpl{service: d, log: newLogger(t)}
 		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(api.handleProduce)
+		handler := newTestRouter(t, api)
 
 		// Setup the incoming payload
 		var rdr io.Reader
@@ -200,7 +214,7 @@ func TestAddEndpoint(t *testing.T) {
 					len(items))
 			}
 			for i, p := range items {
-				if v.expRes[i] != p {
+				if !reflect.DeepEqual(v.expRes[i], p) {
 					t.Fatalf("(%d) unexpected return item: %+v", i, p)
 				}
 			}
@@ -218,7 +232,7 @@ func TestDeleteEndpoint(t *testing.T) {
 	}{
 		{
 			url:       produceURL,
-			expStatus: http.StatusBadRequest,
+			expStatus: http.StatusMethodNotAllowed,
 		},
 		{
 			url:       produceURL + "/YRT6-72AS-K736-L4AR",
@@ -237,7 +251,7 @@ func TestDeleteEndpoint(t *testing.T) {
 		}
 		api := apiImpl{service: d, log: newLogger(t)}
 		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(api.handleDelete)
+		handler := newTestRouter(t, api)
 
 		// Bad request: we need the code in the url
 		req, err := http.NewRequest(http.MethodDelete, v.url, nil)
@@ -258,6 +272,63 @@ func TestDeleteEndpoint(t *testing.T) {
 	}
 }
 
+func TestGetItemEndpoint(t *testing.T) {
+	item := dfltProduce
+	item.Names = map[string]string{"fr": "Laitue"}
+	for i, v := range []struct {
+		url       string
+		lang      string
+		servErr   error
+		expStatus int
+		expBody   string
+	}{
+		{
+			url:       produceURL + "/a12t-4gh7-qpl9-3n4m",
+			expStatus: http.StatusOK,
+			expBody: "{\n" + `  "code": "A12T-4GH7-QPL9-3N4M",` + "\n" +
+				`  "name": "Lettuce",` + "\n" + `  "unit_price": "$3.46"` + "\n}",
+		},
+		{
+			url:       produceURL + "/A12T-4GH7-QPL9-3N4M",
+			lang:      "fr",
+			expStatus: http.StatusOK,
+			expBody: "{\n" + `  "code": "A12T-4GH7-QPL9-3N4M",` + "\n" +
+				`  "name": "Laitue",` + "\n" + `  "unit_price": "$3.46"` + "\n}",
+		},
+		{
+			url:       produceURL + "/YRT6-72AS-K736-L4AR",
+			expStatus: http.StatusNotFound,
+		},
+		{
+			url:       produceURL + "/A12T-4GH7",
+			expStatus: http.StatusBadRequest,
+		},
+		{
+			url:       produceURL + "/A12T-4GH7-QPL9-3N4M",
+			servErr:   service.InternalError{Message: "channel closed"},
+			expStatus: http.StatusInternalServerError,
+		},
+	} {
+		api := apiImpl{service: DummyService{existing: []types.Produce{item},
+			err: v.servErr}, log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Language", v.lang)
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if v.expBody != "" && rr.Body.String() != v.expBody {
+			t.Fatalf("(%d) unexpected body: %s, expected %s", i,
+				rr.Body.String(), v.expBody)
+		}
+	}
+}
+
 func TestListEndpoint(t *testing.T) {
 	for i, v := range []struct {
 		url       string
@@ -292,7 +363,7 @@ func TestListEndpoint(t *testing.T) {
 		}
 		api := apiImpl{service: d, log: newLogger(t)}
 		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(api.handleProduce)
+		handler := newTestRouter(t, api)
 
 		// Bad request: we need the code in the url
 		req, err := http.NewRequest(http.MethodGet, v.url, nil)
@@ -329,7 +400,7 @@ func TestListEndpoint(t *testing.T) {
 			cnt := 0
 			for _, v := range v.expRes {
 				for _, w := range ap {
-					if v == w {
+					if reflect.DeepEqual(v, w) {
 						cnt++
 						break
 					}
@@ -353,13 +424,21 @@ func TestInvalidMethod(t *testing.T) {
 
 	// Call the handler for status
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(wrapContext(context.Background(), api.handleProduce))
+	handler := newTestRouter(t, api)
 	handler.ServeHTTP(rr, req)
 
-	// Verify the code and expected body
-	if status := rr.Code; status != http.StatusNotFound {
+	// Verify the code, the allowed methods and the problem
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
 		t.Fatalf("handler returned wrong status code: got %d, expected %d",
-			rr.Code, http.StatusNotFound)
+			rr.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := rr.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS, POST" {
+		t.Fatalf("unexpected Allow header: '%s'", allow)
+	}
+	p := decodeProblem(t, rr)
+	if p.Code != types.ProblemMethodNotAllowed ||
+		p.Detail != "PUT is not allowed for /v1/produce" {
+		t.Fatalf("unexpected problem: %+v", p)
 	}
 }
 
@@ -411,6 +490,819 @@ func TestInit(t *testing.T) {
 	}
 }
 
+func TestCategoryEndpoints(t *testing.T) {
+	for i, v := range []struct {
+		method    string
+		url       string
+		body      string
+		servErr   error
+		expStatus int
+	}{
+		{
+			method:    http.MethodPost,
+			url:       categoriesURL,
+			body:      `{"name": "apples", "parent": "fruit"}`,
+			expStatus: http.StatusCreated,
+		},
+		{
+			method:    http.MethodPost,
+			url:       categoriesURL,
+			body:      `{"name": "apples!"}`,
+			expStatus: http.StatusBadRequest,
+		},
+		{
+			method:    http.MethodPost,
+			url:       categoriesURL,
+			body:      `{"name": "Apples"}`,
+			servErr:   store.CategoryExistsError{Name: "Apples"},
+			expStatus: http.StatusConflict,
+		},
+		{
+			method:    http.MethodPost,
+			url:       categoriesURL,
+			body:      `{"name": "Kale", "parent": "Greens"}`,
+			servErr:   store.CategoryNotFoundError{Name: "Greens"},
+			expStatus: http.StatusNotFound,
+		},
+		{
+			method:    http.MethodGet,
+			url:       categoriesURL,
+			expStatus: http.StatusOK,
+		},
+		{
+			method:    http.MethodDelete,
+			url:       categoriesURL + "/Stone%20Fruit",
+			expStatus: http.StatusNoContent,
+		},
+		{
+			method:    http.MethodDelete,
+			url:       categoriesURL + "/Fruit",
+			servErr:   store.CategoryInUseError{Name: "Fruit"},
+			expStatus: http.StatusConflict,
+		},
+		{
+			method:    http.MethodDelete,
+			url:       categoriesURL,
+			expStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			method:    http.MethodPut,
+			url:       categoriesURL,
+			expStatus: http.StatusMethodNotAllowed,
+		},
+	} {
+		d := DummyService{err: v.servErr}
+		api := apiImpl{service: d, log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		handler := newTestRouter(t, api)
+
+		var rdr io.Reader
+		if v.body != "" {
+			rdr = bytes.NewReader([]byte(v.body))
+		}
+		req, err := http.NewRequest(v.method, v.url, rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+	}
+}
+
+func TestListFilterEndpoint(t *testing.T) {
+	gala := types.Produce{Code: "TQ4C-VV6T-75ZX-1RMR", Name: "Gala Apple",
+		UnitPrice: 359, Category: "Apples", Tags: []string{"Local"}}
+	for i, v := range []struct {
+		url       string
+		servErr   error
+		expStatus int
+		expCount  int
+	}{
+		{
+			url:       produceURL + "?tag=Local",
+			expStatus: http.StatusOK,
+			expCount:  1,
+		},
+		{
+			url:       produceURL + "?tag=Local&tag=Seasonal",
+			expStatus: http.StatusOK,
+			expCount:  0,
+		},
+		{
+			url:       produceURL + "?category=Herbs",
+			servErr:   store.CategoryNotFoundError{Name: "Herbs"},
+			expStatus: http.StatusNotFound,
+		},
+		{
+			url:       produceURL + "?tag=%21",
+			servErr:   service.FormatError{Message: "invalid tag: '!'"},
+			expStatus: http.StatusBadRequest,
+		},
+	} {
+		d := DummyService{err: v.servErr,
+			existing: []types.Produce{gala, dfltProduce}}
+		api := apiImpl{service: d, log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		handler := newTestRouter(t, api)
+
+		req, err := http.NewRequest(http.MethodGet, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if v.expStatus == http.StatusOK {
+			var ap types.ProduceListResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &ap); err != nil {
+				t.Fatal(err)
+			}
+			if len(ap) != v.expCount {
+				t.Fatalf("(%d) expected %d items, got %d", i, v.expCount, len(ap))
+			}
+		}
+	}
+}
+
+func TestCategoryCountsEndpoint(t *testing.T) {
+	gala := types.Produce{Code: "TQ4C-VV6T-75ZX-1RMR", Name: "Gala Apple",
+		UnitPrice: 359, Category: "Apples"}
+	d := DummyService{existing: []types.Produce{gala},
+		categories: []types.Category{{Name: "Apples"}}}
+	api := apiImpl{service: d, log: newLogger(t)}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(api.handleCategoryCounts)
+
+	req, err := http.NewRequest(http.MethodGet, categoryCountsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %d, expected %d",
+			rr.Code, http.StatusOK)
+	}
+	var counts types.CategoryCountResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &counts); err != nil {
+		t.Fatal(err)
+	}
+	exp := types.CategoryCount{Name: "Apples", Count: 1, TotalCount: 1}
+	if len(counts) != 1 || counts[0] != exp {
+		t.Fatalf("unexpected counts: %+v", counts)
+	}
+}
+
+func TestAddGeneratedCodeEndpoint(t *testing.T) {
+	for i, v := range []struct {
+		req         string
+		expStatus   int
+		expLocation string
+		expRes      types.ProduceAddResponse
+	}{
+		{
+			req:         `{"name": "Lettuce", "unit_price": "$3.46"}`,
+			expStatus:   http.StatusCreated,
+			expLocation: produceURL + "/" + generatedCode,
+			expRes: types.ProduceAddResponse{{Code: generatedCode,
+				StatusCode: http.StatusCreated}},
+		},
+		{
+			req:         `{"code": "A12T-4GH7-QPL9-3N4M", "name": "Lettuce", "unit_price": "$3.46"}`,
+			expStatus:   http.StatusCreated,
+			expLocation: produceURL + "/A12T-4GH7-QPL9-3N4M",
+		},
+		{
+			req: `[{"name": "Lettuce", "unit_price": "$3.46"},
+				{"code": "YRT6-72AS-K736-L4AR", "name": "Green Pepper", "unit_price": "$0.79"}]`,
+			expStatus: http.StatusCreated,
+			expRes: types.ProduceAddResponse{
+				{Code: generatedCode, StatusCode: http.StatusCreated},
+				{Code: "YRT6-72AS-K736-L4AR", StatusCode: http.StatusCreated}},
+		},
+		{
+			req:       `{"name": "Lettuce!", "unit_price": "$3.46"}`,
+			expStatus: http.StatusBadRequest,
+		},
+	} {
+		api := apiImpl{service: DummyService{}, log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, produceURL,
+			bytes.NewReader([]byte(v.req)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if loc := rr.Header().Get("Location"); loc != v.expLocation {
+			t.Fatalf("(%d) unexpected location: '%s'", i, loc)
+		}
+
+		if v.expRes == nil {
+			if v.expStatus == http.StatusCreated && rr.Body.Len() != 0 {
+				t.Fatalf("(%d) unexpected body: %s", i, rr.Body.String())
+			}
+			continue
+		}
+
+		// A single add gets back a single result.
+		var res types.ProduceAddResponse
+		if len(v.expRes) == 1 {
+			var item types.ProduceAddItemResponse
+			err = json.Unmarshal(rr.Body.Bytes(), &item)
+			res = types.ProduceAddResponse{item}
+		} else {
+			err = json.Unmarshal(rr.Body.Bytes(), &res)
+		}
+		if err != nil {
+			t.Fatalf("(%d) error unmarshaling response: %v", i, err)
+		}
+		if !reflect.DeepEqual(res, v.expRes) {
+			t.Fatalf("(%d) unexpected response: %+v", i, res)
+		}
+	}
+}
+
+func TestAttributeEndpoints(t *testing.T) {
+	for i, v := range []struct {
+		method    string
+		url       string
+		body      string
+		servErr   error
+		expStatus int
+	}{
+		{
+			method:    http.MethodPost,
+			url:       attributesURL,
+			body:      `{"name": "plu", "type": "int", "min": 3000}`,
+			expStatus: http.StatusCreated,
+		},
+		{
+			method:    http.MethodPost,
+			url:       attributesURL,
+			body:      `{"name": "plu", "type": "float"}`,
+			expStatus: http.StatusBadRequest,
+		},
+		{
+			method:    http.MethodPost,
+			url:       attributesURL,
+			body:      `{"name": "plu", "type": "int"}`,
+			servErr:   store.AttributeExistsError{Name: "plu"},
+			expStatus: http.StatusConflict,
+		},
+		{
+			method:    http.MethodGet,
+			url:       attributesURL,
+			expStatus: http.StatusOK,
+		},
+		{
+			method:    http.MethodDelete,
+			url:       attributesURL + "/plu",
+			expStatus: http.StatusNoContent,
+		},
+		{
+			method:    http.MethodDelete,
+			url:       attributesURL + "/plu",
+			servErr:   store.AttributeInUseError{Name: "plu"},
+			expStatus: http.StatusConflict,
+		},
+		{
+			method:    http.MethodDelete,
+			url:       attributesURL + "/grade",
+			servErr:   store.AttributeNotFoundError{Name: "grade"},
+			expStatus: http.StatusNotFound,
+		},
+	} {
+		d := DummyService{err: v.servErr}
+		api := apiImpl{service: d, log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		handler := newTestRouter(t, api)
+
+		var rdr io.Reader
+		if v.body != "" {
+			rdr = bytes.NewReader([]byte(v.body))
+		}
+		req, err := http.NewRequest(v.method, v.url, rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+	}
+}
+
+func TestImportEndpoint(t *testing.T) {
+	const header = "code,name,unit_price\n"
+	for i, v := range []struct {
+		url         string
+		contentType string
+		body        string
+		existing    []types.Produce
+		expStatus   int
+		expRes      types.ProduceAddResponse
+	}{
+		{
+			url:         importURL,
+			contentType: "application/json",
+			body:        header,
+			expStatus:   http.StatusUnsupportedMediaType,
+		},
+		{
+			url:         importURL,
+			contentType: "text/csv",
+			body:        header,
+			expStatus:   http.StatusBadRequest,
+		},
+		{
+			url:         importURL,
+			contentType: "text/csv",
+			body:        "code,description\n",
+			expStatus:   http.StatusBadRequest,
+		},
+		{
+			url:         importURL + "?delimiter=abc",
+			contentType: "text/csv",
+			body:        header + "A12T-4GH7-QPL9-3N4M,Lettuce,$3.46\n",
+			expStatus:   http.StatusBadRequest,
+		},
+		{
+			url:         importURL,
+			contentType: "text/csv; charset=UTF-8",
+			body: header + "A12T-4GH7-QPL9-3N4M,Lettuce,$3.46\n" +
+				"YRT6-72AS-K736-L4AR,Green Pepper,$0.79\n",
+			expStatus: http.StatusCreated,
+		},
+		{
+			url:         importURL,
+			contentType: "text/csv",
+			body:        header + ",Lettuce,$3.46\n",
+			expStatus:   http.StatusCreated,
+			expRes: types.ProduceAddResponse{{Row: 1, Code: generatedCode,
+				StatusCode: http.StatusCreated}},
+		},
+		{
+			url:         importURL + "?delimiter=tab&map=PLU:code&map=Notes:-",
+			contentType: "text/csv",
+			body: "PLU\tName\tUnit_Price\tNotes\n" +
+				"A12T-4GH7-QPL9-3N4M\tLettuce\t$3.46\tcrisp\n",
+			expStatus: http.StatusCreated,
+		},
+		{
+			url:         importURL,
+			contentType: "text/csv",
+			body: header + "A12T-4GH7-QPL9-3N4M,Lettuce,$3.46\n" +
+				"YRT6-72AS-K736-L4AR,Green Pepper,cheap\n" +
+				"DRT6-72AS-K736-L4AR,Green-Pepper,$0.79\n" +
+				"B12T-4GH7-QPL9-3N4M,Peas\n",
+			existing:  []types.Produce{dfltProduce},
+			expStatus: http.StatusOK,
+			expRes: types.ProduceAddResponse{
+				{Row: 1, Code: "A12T-4GH7-QPL9-3N4M",
+					StatusCode: http.StatusConflict,
+					ErrorCode:  types.ProblemProduceExists,
+					Error:      "produce code 'Dup' already exists"},
+				{Row: 2, Code: "YRT6-72AS-K736-L4AR",
+					StatusCode: http.StatusBadRequest,
+					ErrorCode:  types.ProblemInvalidRequest,
+					Error:      "invalid item format: invalid unit price: 'cheap'",
+					Errors: types.FieldErrors{{Field: "unit_price", Value: "cheap",
+						Rule:    types.RulePriceFormat,
+						Message: "invalid unit price: 'cheap'"}}},
+				{Row: 3, Code: "DRT6-72AS-K736-L4AR",
+					StatusCode: http.StatusBadRequest,
+					ErrorCode:  types.ProblemInvalidRequest,
+					Error:      "invalid item format: invalid name: 'Green-Pepper'",
+					Errors:     badNameErrors},
+				{Row: 4, StatusCode: http.StatusBadRequest,
+					ErrorCode: types.ProblemInvalidRequest,
+					Error:     "invalid item format: row has 2 fields, expected 3"},
+			},
+		},
+		{
+			url:         importURL + "?on_error=abort",
+			contentType: "text/csv",
+			body: header + "A12T-4GH7-QPL9-3N4M,Lettuce,$3.46\n" +
+				"DRT6-72AS-K736-L4AR,Green-Pepper,$0.79\n",
+			expStatus: http.StatusBadRequest,
+			expRes: types.ProduceAddResponse{
+				{Row: 1, Code: "A12T-4GH7-QPL9-3N4M",
+					StatusCode: http.StatusFailedDependency,
+					ErrorCode:  types.ProblemImportAborted,
+					Error:      "not added, as the import was aborted"},
+				{Row: 2, Code: "DRT6-72AS-K736-L4AR",
+					StatusCode: http.StatusBadRequest,
+					ErrorCode:  types.ProblemInvalidRequest,
+					Error:      "invalid item format: invalid name: 'Green-Pepper'",
+					Errors:     badNameErrors},
+			},
+		},
+		{
+			url:         importURL + "?on_error=abort",
+			contentType: "text/csv",
+			body:        header + "A12T-4GH7-QPL9-3N4M,Lettuce,$3.46\n",
+			expStatus:   http.StatusCreated,
+		},
+	} {
+		api := apiImpl{service: DummyService{existing: v.existing},
+			log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, v.url,
+			bytes.NewReader([]byte(v.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", v.contentType)
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if v.expRes == nil {
+			continue
+		}
+		var res types.ProduceAddResponse
+		if err = json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatalf("(%d) error unmarshaling response: %v", i, err)
+		}
+		if !reflect.DeepEqual(res, v.expRes) {
+			t.Fatalf("(%d) unexpected response: %+v", i, res)
+		}
+	}
+}
+
+func TestImportAbortClash(t *testing.T) {
+	// An aborted import adds none of the rows, even if they are only found
+	// to clash with the store, or each other, as they are added.
+	svc := service.New(store.New(), newLogger(t))
+	if _, err := svc.Add(context.Background(),
+		[]types.Produce{dfltProduce}); err != nil {
+		t.Fatal(err)
+	}
+	api := apiImpl{service: svc, log: newLogger(t)}
+	req, err := http.NewRequest(http.MethodPost, importURL+"?on_error=abort",
+		strings.NewReader("code,name,unit_price\n"+
+			"YRT6-72AS-K736-L4AR,Green Pepper,$0.79\n"+
+			"A12T-4GH7-QPL9-3N4M,Lettuce,$3.46\n"+
+			"YRT6-72AS-K736-L4AR,Red Pepper,$0.89\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/csv")
+	rr := httptest.NewRecorder()
+	newTestRouter(t, api).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: %d", rr.Code)
+	}
+	var res types.ProduceAddResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("error unmarshaling response: %v", err)
+	}
+	for i, v := range []struct {
+		status int
+		code   string
+	}{
+		{http.StatusFailedDependency, types.ProblemImportAborted},
+		{http.StatusConflict, types.ProblemProduceExists},
+		{http.StatusConflict, types.ProblemProduceExists},
+	} {
+		if res[i].Row != i+1 || res[i].StatusCode != v.status ||
+			res[i].ErrorCode != v.code {
+			t.Fatalf("(%d) unexpected result: %+v", i, res[i])
+		}
+	}
+	if all, _ := svc.ListAll(context.Background()); len(all) != 1 {
+		t.Fatalf("unexpected item count: %d", len(all))
+	}
+}
+
+func TestBulkEndpoint(t *testing.T) {
+	for i, v := range []struct {
+		contentType string
+		body        string
+		servErr     error
+		existing    []types.Produce
+		expStatus   int
+		expRes      types.ProduceAddResponse
+	}{
+		{
+			contentType: "application/json",
+			body:        `{"code": "A12T-4GH7-QPL9-3N4M"}`,
+			expStatus:   http.StatusUnsupportedMediaType,
+		},
+		{
+			contentType: "application/x-ndjson",
+			body:        "\n  \n",
+			expStatus:   http.StatusBadRequest,
+		},
+		{
+			contentType: "application/x-ndjson",
+			body:        `{"code": "A12T-4GH7-QPL9-3N4M"}`,
+			servErr:     errors.New("hiya"),
+			expStatus:   http.StatusInternalServerError,
+		},
+		{
+			contentType: "application/x-ndjson",
+			body: `{"code": "A12T-4GH7-QPL9-3N4M", "name": "Lettuce", "unit_price": "$3.46"}` +
+				"\n\n" +
+				`{"code": "YRT6-72AS-K736-L4AR", "name": "Green Pepper", "unit_price": "$0.79"}` +
+				"\n" + `{"code": "DRT6-72AS-K736-L4AR", "unit_price": 79}` +
+				"\n" + `{"code": "DRT6-72AS-K736-L4AR", "name": "Green-Pepper", "unit_price": "$0.79"}` +
+				"\n" + `{"name": "Peas", "unit_price": "$1.20"}`,
+			existing:  []types.Produce{secondProduce},
+			expStatus: http.StatusOK,
+			expRes: types.ProduceAddResponse{
+				{Row: 1, Code: "A12T-4GH7-QPL9-3N4M", StatusCode: http.StatusCreated},
+				{Row: 3, Code: "YRT6-72AS-K736-L4AR",
+					StatusCode: http.StatusConflict,
+					ErrorCode:  types.ProblemProduceExists,
+					Error:      "produce code 'Dup' already exists"},
+				{Row: 4, Code: "DRT6-72AS-K736-L4AR",
+					StatusCode: http.StatusBadRequest,
+					ErrorCode:  types.ProblemInvalidRequest,
+					Error: "invalid item format: invalid name: '', " +
+						"invalid unit price: '79'",
+					Errors: types.FieldErrors{
+						{Field: "name", Rule: types.RuleNamePattern,
+							Message: "invalid name: ''"},
+						{Field: "unit_price", Value: "79",
+							Rule:    types.RulePriceFormat,
+							Message: "invalid unit price: '79'"},
+					}},
+				{Row: 5, Code: "DRT6-72AS-K736-L4AR",
+					StatusCode: http.StatusBadRequest,
+					ErrorCode:  types.ProblemInvalidRequest,
+					Error:      "invalid item format: invalid name: 'Green-Pepper'",
+					Errors:     badNameErrors},
+				{Row: 6, Code: generatedCode, StatusCode: http.StatusCreated},
+			},
+		},
+		{
+			contentType: "application/x-ndjson",
+			body: `{"code": "A12T-4GH7-QPL9-3N4M", "name": "Lettuce", "unit_price": "$3.46"}` +
+				"\n" + strings.Repeat(" ", maxBulkLine+1) + "\n" +
+				`{"code": "YRT6-72AS-K736-L4AR", "name": "Green Pepper", "unit_price": "$0.79"}`,
+			expStatus: http.StatusOK,
+			expRes: types.ProduceAddResponse{
+				{Row: 1, Code: "A12T-4GH7-QPL9-3N4M", StatusCode: http.StatusCreated},
+				{Row: 2, StatusCode: http.StatusBadRequest,
+					ErrorCode: types.ProblemInvalidRequest,
+					Error:     "invalid item format: line is longer than 1048576 bytes"},
+			},
+		},
+	} {
+		d := DummyService{err: v.servErr, existing: v.existing}
+		api := apiImpl{service: d, log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, bulkURL,
+			strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", v.contentType)
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if v.expRes == nil {
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Fatalf("(%d) unexpected content type: '%s'", i, ct)
+		}
+
+		// The results may be out of order, so sort them by line.
+		var res types.ProduceAddResponse
+		dec := json.NewDecoder(rr.Body)
+		for dec.More() {
+			var item types.ProduceAddItemResponse
+			if err := dec.Decode(&item); err != nil {
+				t.Fatalf("(%d) error decoding result: %v", i, err)
+			}
+			res = append(res, item)
+		}
+		sort.Slice(res, func(j, k int) bool { return res[j].Row < res[k].Row })
+		if !reflect.DeepEqual(res, v.expRes) {
+			t.Fatalf("(%d) unexpected response: %+v", i, res)
+		}
+	}
+}
+
+func TestStreamListEndpoint(t *testing.T) {
+	item := dfltProduce
+	item.Names = map[string]string{"fr": "Laitue"}
+	items := []types.Produce{item, secondProduce}
+
+	for i, v := range []struct {
+		url       string
+		accept    string
+		existing  []types.Produce
+		servErr   error
+		expStatus int
+		expType   string
+		expBody   string
+	}{
+		{
+			// The streamed array must match the regular list byte for byte.
+			url:       produceURL + "?stream=true&all_names=true",
+			existing:  items,
+			expStatus: http.StatusOK,
+			expType:   "application/json; charset=UTF-8",
+		},
+		{
+			url:       produceURL + "?stream=true",
+			existing:  []types.Produce{},
+			expStatus: http.StatusOK,
+			expType:   "application/json; charset=UTF-8",
+		},
+		{
+			url:       produceURL,
+			accept:    "application/x-ndjson",
+			existing:  items,
+			expStatus: http.StatusOK,
+			expType:   "application/x-ndjson",
+			expBody: `{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","unit_price":"$3.46"}` +
+				"\n" + `{"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","unit_price":"$0.79"}` +
+				"\n",
+		},
+		{
+			url:       produceURL + "?category=Fruit",
+			accept:    "application/x-ndjson",
+			servErr:   store.CategoryNotFoundError{Name: "Fruit"},
+			expStatus: http.StatusNotFound,
+		},
+		{
+			url:       produceURL + "?stream=true",
+			servErr:   errors.New("hiya"),
+			expStatus: http.StatusInternalServerError,
+		},
+	} {
+		api := apiImpl{service: DummyService{existing: v.existing,
+			err: v.servErr}, log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", v.accept)
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if v.expStatus != http.StatusOK {
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != v.expType {
+			t.Fatalf("(%d) unexpected content type: '%s'", i, ct)
+		}
+		expBody := v.expBody
+		if expBody == "" {
+			b, err := json.MarshalIndent(v.existing, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expBody = string(b)
+		}
+		if rr.Body.String() != expBody {
+			t.Fatalf("(%d) unexpected body: '%s'", i, rr.Body.String())
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "application/xml", "text/csv"}
+	for i, v := range []struct {
+		header string
+		exp    string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/csv", "text/csv"},
+		{"application/json;q=0.9, TEXT/CSV", "text/csv"},
+		{"text/csv, application/json", "text/csv"},
+		{"text/csv;q=0", ""},
+		{"text/*", "text/csv"},
+		{"text/*, application/xml;q=0.5", "text/csv"},
+		{"*/*;q=0.1, application/xml", "application/xml"},
+		{"application/xml;q=0, */*", "application/json"},
+		{"image/png", ""},
+	} {
+		if res := negotiate(v.header, offers); res != v.exp {
+			t.Fatalf("(%d) unexpected result for '%s': '%s'", i, v.header, res)
+		}
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	item := dfltProduce
+	item.Category = "Vegetables"
+	item.Tags = []string{"Leafy", "Local"}
+	item.Attributes = map[string]interface{}{"organic": true}
+	item.Names = map[string]string{"fr": "Laitue"}
+	d := DummyService{existing: []types.Produce{item, secondProduce}}
+	api := apiImpl{service: d, log: newLogger(t)}
+
+	for i, v := range []struct {
+		url       string
+		accept    string
+		expStatus int
+		expType   string
+		expBody   string
+	}{
+		{
+			url:       produceURL + "?all_names=true",
+			accept:    "text/csv",
+			expStatus: http.StatusOK,
+			expType:   "text/csv; charset=UTF-8",
+			expBody: "code,name,unit_price,category,tags,attr:organic,name:fr\n" +
+				"A12T-4GH7-QPL9-3N4M,Lettuce,$3.46,Vegetables,Leafy;Local,true,Laitue\n" +
+				"YRT6-72AS-K736-L4AR,Green Pepper,$0.79,,,,\n",
+		},
+		{
+			url:       produceURL + "?delimiter=%3B",
+			accept:    "application/json;q=0.5, text/csv",
+			expStatus: http.StatusOK,
+			expType:   "text/csv; charset=UTF-8",
+			expBody: "code;name;unit_price;category;tags;attr:organic\n" +
+				"A12T-4GH7-QPL9-3N4M;Lettuce;$3.46;Vegetables;\"Leafy;Local\";true\n" +
+				"YRT6-72AS-K736-L4AR;Green Pepper;$0.79;;;\n",
+		},
+		{
+			url:       produceURL,
+			accept:    "text/csv;q=0, application/json",
+			expStatus: http.StatusOK,
+			expType:   "application/json; charset=UTF-8",
+		},
+		{
+			url:       produceURL + "?delimiter=%22",
+			accept:    "text/csv",
+			expStatus: http.StatusBadRequest,
+		},
+	} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", v.accept)
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if v.expStatus != http.StatusOK {
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != v.expType {
+			t.Fatalf("(%d) unexpected content type: '%s'", i, ct)
+		}
+		if v.expBody != "" && rr.Body.String() != v.expBody {
+			t.Fatalf("(%d) unexpected body: '%s'", i, rr.Body.String())
+		}
+	}
+}
+
+// newTestRouter returns the router for all of the endpoints of the API.
+func TestAddOverloaded(t *testing.T) {
+	// An add the service is too busy for can be retried later.
+	d := DummyService{err: service.OverloadedError{RetryAfter: 5 * time.Second}}
+	api := apiImpl{service: d, log: newLogger(t)}
+	req, err := http.NewRequest(http.MethodPost, produceURL,
+		strings.NewReader(`[{"code": "A12T-4GH7-QPL9-3N4M", "name": "Lettuce", "unit_price": "$3.46"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	newTestRouter(t, api).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable ||
+		rr.Header().Get("Retry-After") != "5" {
+		t.Fatalf("unexpected response: %d, '%s'", rr.Code,
+			rr.Header().Get("Retry-After"))
+	}
+	if p := decodeProblem(t, rr); p.Code != types.ProblemOverloaded {
+		t.Fatalf("unexpected problem: %+v", p)
+	}
+}
+
+func newTestRouter(t *testing.T, api apiImpl) http.Handler {
+	rt, err := api.routes(context.Background())
+	if err != nil {
+		t.Fatalf("cannot create router: %v", err)
+	}
+	return rt
+}
+
 func newLogger(t *testing.T) *zap.SugaredLogger {
 	lg, err := zap.NewDevelopment()
 	if err != nil {
@@ -420,8 +1312,10 @@ func newLogger(t *testing.T) *zap.SugaredLogger {
 }
 
 type DummyService struct {
-	err      error
-	existing []types.Produce
+	err        error
+	existing   []types.Produce
+	categories []types.Category
+	attributes []types.AttributeDef
 }
 
 func (d DummyService) Add(ctx context.Context, items []types.Produce) ([]service.AddResult, error) {
@@ -430,10 +1324,13 @@ func (d DummyService) Add(ctx context.Context, items []types.Produce) ([]service
 	}
 	res := make([]service.AddResult, len(items))
 	for i, v := range items {
+		if v.Code == "" {
+			v.Code = generatedCode
+			res[i].Generated = true
+		}
 		res[i].Code = v.Code
-		str := types.ValidateAndConvertProduce(&v)
-		if str != "" {
-			res[i].Err = service.FormatError{Message: str}
+		if errs := types.ValidateAndConvertProduce(&v); errs != nil {
+			res[i].Err = service.NewFormatError(errs)
 			continue
 		}
 		for _, w := range d.existing {
@@ -447,12 +1344,68 @@ func (d DummyService) Add(ctx context.Context, items []types.Produce) ([]service
 	return res, nil
 }
 
+// AddAll adds the items with Add, as the dummy doesn't keep them anyway.
+func (d DummyService) AddAll(ctx context.Context,
+	items []types.Produce) ([]service.AddResult, error) {
+	return d.Add(ctx, items)
+}
+
+// AddBulk adds the items one at a time, reusing Add.
+func (d DummyService) AddBulk(ctx context.Context,
+	items <-chan service.BulkItem, results chan<- service.BulkResult) error {
+	if d.err != nil {
+		return d.err
+	}
+	for bi := range items {
+		res, _ := d.Add(ctx, []types.Produce{bi.Item})
+		results <- service.BulkResult{Seq: bi.Seq, AddResult: res[0]}
+	}
+	return nil
+}
+
+// Validate validates the items without adding them.
+func (d DummyService) Validate(ctx context.Context,
+	items []types.Produce) ([]error, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	res := make([]error, len(items))
+	for i, v := range items {
+		if v.Code == "" {
+			v.Code = generatedCode
+		}
+		if errs := types.ValidateAndConvertProduce(&v); errs != nil {
+			res[i] = service.NewFormatError(errs)
+		}
+	}
+	return res, nil
+}
+
 // Delete deletes single produce item from the store or returns an error
 // if it fails.
 func (d DummyService) Delete(ctx context.Context, code string) error {
 	return d.err
 }
 
+// Get fetches the existing item with the code.
+func (d DummyService) Get(ctx context.Context, code string) (types.Produce,
+	error) {
+	if d.err != nil {
+		return types.Produce{}, d.err
+	}
+	code, msg := types.ValidateAndConvertProduceCode(code)
+	if msg != "" {
+		return types.Produce{}, service.FormatError{Message: msg,
+			Field: "code"}
+	}
+	for _, v := range d.existing {
+		if v.Code == code {
+			return v, nil
+		}
+	}
+	return types.Produce{}, store.NotFoundError{Code: code}
+}
+
 // ListAll fetches all produce items from the store or returns an error
 // if it fails.
 func (d DummyService) ListAll(context.Context) ([]types.Produce, error) {
@@ -463,3 +1416,119 @@ func (d DummyService) ListAll(context.Context) ([]types.Produce, error) {
 func (d DummyService) Clear(context.Context) error {
 	return d.err
 }
+
+// List fetches the produce items matching the filter, which the dummy
+// only applies to tags.
+func (d DummyService) List(ctx context.Context,
+	filter types.ProduceFilter) ([]types.Produce, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	var res []types.Produce
+	for _, v := range d.existing {
+		if filter.Category != "" && v.Category != filter.Category {
+			continue
+		}
+		match := true
+		for _, t := range filter.Tags {
+			found := false
+			for _, u := range v.Tags {
+				if t == u {
+					found = true
+				}
+			}
+			match = match && found
+		}
+		if match {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+// Iterate calls the function for each item List would return.
+func (d DummyService) Iterate(ctx context.Context, filter types.ProduceFilter,
+	fn func(types.Produce) error) error {
+	items, err := d.List(ctx, filter)
+	if err != nil {
+		return err
+	}
+	for _, v := range items {
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddCategory adds a category to the hierarchy or returns an error
+// if it fails.
+func (d DummyService) AddCategory(ctx context.Context,
+	cat types.Category) error {
+	if d.err != nil {
+		return d.err
+	}
+	if msg := types.ValidateAndConvertCategory(&cat); msg != "" {
+		return service.FormatError{Message: msg}
+	}
+	return nil
+}
+
+// DeleteCategory deletes an unused category or returns an error
+// if it fails.
+func (d DummyService) DeleteCategory(ctx context.Context, name string) error {
+	return d.err
+}
+
+// ListCategories fetches all categories or returns an error if it fails.
+func (d DummyService) ListCategories(ctx context.Context) ([]types.Category,
+	error) {
+	return d.categories, d.err
+}
+
+// CategoryCounts fetches the item counts for each category or returns
+// an error if it fails.
+func (d DummyService) CategoryCounts(ctx context.Context) (
+	[]types.CategoryCount, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	var res []types.CategoryCount
+	for _, c := range d.categories {
+		cc := types.CategoryCount{Name: c.Name, Parent: c.Parent}
+		for _, v := range d.existing {
+			if v.Category == c.Name {
+				cc.Count++
+				cc.TotalCount++
+			}
+		}
+		res = append(res, cc)
+	}
+	return res, nil
+}
+
+// AddAttribute adds an attribute definition to the schema or returns
+// an error if it fails.
+func (d DummyService) AddAttribute(ctx context.Context,
+	def types.AttributeDef) error {
+	if d.err != nil {
+		return d.err
+	}
+	if msg := types.ValidateAndConvertAttributeDef(&def); msg != "" {
+		return service.FormatError{Message: msg}
+	}
+	return nil
+}
+
+// DeleteAttribute deletes an unused attribute definition or returns
+// an error if it fails.
+func (d DummyService) DeleteAttribute(ctx context.Context, name string) error {
+	return d.err
+}
+
+// ListAttributes fetches all attribute definitions or returns an error
+// if it fails.
+func (d DummyService) ListAttributes(ctx context.Context) (
+	[]types.AttributeDef, error) {
+	return d.attributes, d.err
+}
@@ -0,0 +1,362 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+)
+
+// APIKeyHeader is the request header that carries the API key.
+const APIKeyHeader = "X-API-Key"
+
+// hashPrefix marks a key entry that holds the SHA-256 hash of the key in
+// hex, rather than the key itself, so the keys needn't be kept in the
+// clear.
+const hashPrefix = "sha256:"
+
+// keyHash is the SHA-256 hash of an API key.  Only the hashes are kept in
+// memory, and a key is looked up by its hash.
+type keyHash [sha256.Size]byte
+
+// KeyStore holds the API keys that may make changes through the API.  The
+// keys are read from a file, with one entry per line, and from a list of
+// entries, such as the value of an environment variable, separated by
+// commas.  An entry is either the key itself, or a name for the key, a
+// colon and the key, such as "ci:2b7e1516", so the logs can say which key
+// was used.  In place of the key, its hash may be given as
+// "sha256:<hex digest>".  In the file, blank lines and lines starting with
+// '#' are ignored.
+//
+// The keys may be rotated without a restart by editing the file and calling
+// Reload, which Watch does whenever the file changes.
+type KeyStore struct {
+	file    string
+	entries string
+
+	mu      sync.RWMutex
+	keys    map[keyHash]string
+	modTime time.Time
+	size    int64
+}
+
+// NewKeyStore creates a store with the keys from the file, if it isn't
+// empty, and from the comma-separated entries.
+func NewKeyStore(file, entries string) (*KeyStore, error) {
+	ks := &KeyStore{file: file, entries: entries}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload reads the keys again, replacing the current ones.  If the keys
+// can't be read, the current ones are kept.
+func (ks *KeyStore) Reload() error {
+	keys := make(map[keyHash]string)
+	var modTime time.Time
+	var size int64
+	if ks.file != "" {
+		f, err := os.Open(ks.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		modTime, size = fi.ModTime(), fi.Size()
+		if err := readKeys(f, keys); err != nil {
+			return fmt.Errorf("%s: %v", ks.file, err)
+		}
+	}
+	for _, v := range strings.Split(ks.entries, ",") {
+		if err := addKey(keys, strings.TrimSpace(v), len(keys)); err != nil {
+			return err
+		}
+	}
+
+	ks.mu.Lock()
+	ks.keys, ks.modTime, ks.size = keys, modTime, size
+	ks.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the keys whenever the file changes, checking at the
+// interval, until the context is done.  If the new keys can't be read,
+// the current ones are kept, and the problem is logged.
+func (ks *KeyStore) Watch(ctx context.Context, interval time.Duration,
+	log *zap.SugaredLogger) {
+	if ks.file == "" {
+		return
+	}
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+	for {
+		select {
+		case <-tkr.C:
+		case <-ctx.Done():
+			return
+		}
+		fi, err := os.Stat(ks.file)
+		if err != nil {
+			log.Warnw("cannot check API key file", "file", ks.file, "error", err)
+			continue
+		}
+		ks.mu.RLock()
+		changed := !fi.ModTime().Equal(ks.modTime) || fi.Size() != ks.size
+		ks.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := ks.Reload(); err != nil {
+			log.Errorw("cannot reload API keys", "error", err)
+			continue
+		}
+		log.Infow("reloaded API keys", "count", ks.Len())
+	}
+}
+
+// Lookup returns the name of the key, and whether it is a valid one.
+func (ks *KeyStore) Lookup(key string) (string, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	name, ok := ks.keys[sha256.Sum256([]byte(key))]
+	return name, ok
+}
+
+// Len returns the number of keys.
+func (ks *KeyStore) Len() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.keys)
+}
+
+// readKeys reads the key entries, one per line, into the map.
+func readKeys(r io.Reader, keys map[keyHash]string) error {
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		entry := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if err := addKey(keys, entry, len(keys)); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return sc.Err()
+}
+
+// addKey adds the hash of the key in the entry to the map, under the name
+// in the entry, or else one made from its position.  Empty entries are
+// skipped.
+func addKey(keys map[keyHash]string, entry string, ndx int) error {
+	if entry == "" {
+		return nil
+	}
+	name := fmt.Sprintf("key%d", ndx+1)
+	key := entry
+	if n := strings.Index(entry, ":"); n > 0 && entry[:n]+":" != hashPrefix {
+		name, key = entry[:n], entry[n+1:]
+	}
+	if key == "" {
+		return fmt.Errorf("no key for '%s'", name)
+	}
+
+	var h keyHash
+	if strings.HasPrefix(key, hashPrefix) {
+		b, err := hex.DecodeString(strings.TrimPrefix(key, hashPrefix))
+		if err != nil || len(b) != len(h) {
+			return fmt.Errorf("invalid key hash for '%s'", name)
+		}
+		copy(h[:], b)
+	} else {
+		h = sha256.Sum256([]byte(key))
+	}
+	keys[h] = name
+	return nil
+}
+
+// UnauthenticatedError is returned when a request has no credentials, but
+// needs them, or its bearer token isn't valid.  It maps to HTTP 401.
+type UnauthenticatedError struct {
+	Message string
+}
+
+func (ue UnauthenticatedError) Error() string {
+	return ue.Message
+}
+
+// ForbiddenError is returned when the API key of a request isn't valid, or
+// the principal doesn't have the role the request needs.  It maps to HTTP
+// 403.
+type ForbiddenError struct {
+	Message string
+}
+
+func (fe ForbiddenError) Error() string {
+	return fe.Message
+}
+
+// Authenticator checks the credentials of requests against the API keys,
+// the bearer tokens or both, whichever are set, and authorizes them by
+// role.
+//
+// Credentials are optional for the requests that need no role, and, if
+// there are no bearer tokens to give the viewer role, for those that need
+// only that.  Any credentials that are given must be valid, though.
+type Authenticator struct {
+	Keys   *KeyStore
+	Tokens *TokenVerifier
+}
+
+// Authorize checks the bearer token or API key, either of which may be
+// empty, for a request that needs the role.  It returns the principal,
+// which is the zero value for an anonymous request, and an
+// UnauthenticatedError or ForbiddenError if the request isn't allowed.  A
+// principal without the role is returned along with the ForbiddenError.
+func (a Authenticator) Authorize(role reqctx.Role, token,
+	key string) (reqctx.Principal, error) {
+	var p reqctx.Principal
+	switch {
+	case token != "" && a.Tokens != nil:
+		var err error
+		if p, err = a.Tokens.Verify(token); err != nil {
+			return reqctx.Principal{}, UnauthenticatedError{
+				Message: "the bearer token is not valid: " + err.Error()}
+		}
+	case key != "" && a.Keys != nil:
+		name, ok := a.Keys.Lookup(key)
+		if !ok {
+			return reqctx.Principal{}, ForbiddenError{
+				Message: "the API key is not valid"}
+		}
+		p = reqctx.Principal{Subject: name,
+			Roles:  []reqctx.Role{reqctx.RoleAdmin},
+			Scheme: reqctx.SchemeAPIKey}
+	case role == "" || (role == reqctx.RoleViewer && a.Tokens == nil):
+		return reqctx.Principal{}, nil
+	default:
+		return reqctx.Principal{}, UnauthenticatedError{Message: a.required()}
+	}
+	if !p.HasRole(role) {
+		return p, ForbiddenError{
+			Message: fmt.Sprintf("the '%s' role is required", role)}
+	}
+	return p, nil
+}
+
+// required returns the message for a request without credentials.
+func (a Authenticator) required() string {
+	switch {
+	case a.Keys != nil && a.Tokens != nil:
+		return "an API key or bearer token is required"
+	case a.Tokens != nil:
+		return "a bearer token is required"
+	}
+	return "an API key is required"
+}
+
+// requiredRole returns the role a request with the method and path needs.
+// The status, the API description and OPTIONS, which only lists the
+// methods of a path, need none, the other GETs need a viewer, reset needs
+// an admin, and everything else, which makes changes, needs an editor.
+// GraphQL is POSTed whether or not it makes changes, so it needs a viewer
+// here, and RequireAuth asks for an editor for a mutation.
+func requiredRole(method, path string) reqctx.Role {
+	path = strings.TrimSuffix(path, "/")
+	if method == http.MethodOptions {
+		return ""
+	}
+	if path == resetURL {
+		return reqctx.RoleAdmin
+	}
+	if method == http.MethodPost && path == graphqlURL {
+		return reqctx.RoleViewer
+	}
+	if method != http.MethodGet && method != http.MethodHead {
+		return reqctx.RoleEditor
+	}
+	if path == statusURL || path == openAPIURL {
+		return ""
+	}
+	return reqctx.RoleViewer
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header, or
+// an empty string for any other header.
+func BearerToken(auth string) string {
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// RequireAuth wraps the handler, so each request must be authorized by the
+// authenticator, with an API key in the X-API-Key header or a bearer token
+// in the Authorization header.  HTTP 401 (Unauthorized) is returned for an
+// UnauthenticatedError, and HTTP 403 (Forbidden) for a ForbiddenError,
+// with a problem+json body.  The principal of an authorized request is
+// added to its context.
+func RequireAuth(auth Authenticator, next http.Handler,
+	log *zap.SugaredLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := BearerToken(r.Header.Get("Authorization"))
+		key := r.Header.Get(APIKeyHeader)
+		p, err := auth.Authorize(requiredRole(r.Method, r.URL.Path), token,
+			key)
+		// A GraphQL request is only read once it is known to come from at
+		// least a viewer, and if it runs a mutation, needs an editor.
+		if err == nil && graphQLMutation(r) {
+			p, err = auth.Authorize(reqctx.RoleEditor, token, key)
+		}
+		switch err.(type) {
+		case nil:
+		case UnauthenticatedError:
+			if auth.Keys != nil {
+				w.Header().Add("WWW-Authenticate", `ApiKey header="`+
+					APIKeyHeader+`"`)
+			}
+			if auth.Tokens != nil {
+				challenge := `Bearer realm="produce"`
+				if token != "" {
+					challenge += `, error="invalid_token"`
+				}
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+			log.Debugw("unauthenticated request", "method", r.Method,
+				"url", r.URL.String(), "error", err)
+			writeProblem(w, r, http.StatusUnauthorized,
+				types.ProblemUnauthenticated, "", err.Error())
+			return
+		default:
+			log.Warnw("forbidden request", "method", r.Method,
+				"url", r.URL.String(), "subject", p.Subject,
+				"remote", r.RemoteAddr, "error", err)
+			writeProblem(w, r, http.StatusForbidden, types.ProblemForbidden,
+				"", err.Error())
+			return
+		}
+
+		if p.Subject != "" {
+			log.Debugw("authenticated request", "subject", p.Subject,
+				"scheme", p.Scheme, "method", r.Method, "url", r.URL.String())
+			r = r.WithContext(reqctx.WithPrincipal(r.Context(), p))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
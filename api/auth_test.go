@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyStore(t *testing.T) {
+	hash := sha256.Sum256([]byte("s3cret"))
+	file := filepath.Join(t.TempDir(), "keys")
+	err := ioutil.WriteFile(file, []byte("# operators\nops:0p3r4t0r\n\n"+
+		"ci:sha256:"+hex.EncodeToString(hash[:])+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := NewKeyStore(file, "abc123, deploy:d3pl0y")
+	if err != nil {
+		t.Fatalf("cannot load keys: %v", err)
+	}
+	for i, v := range []struct {
+		key     string
+		expName string
+	}{
+		{key: "0p3r4t0r", expName: "ops"},
+		{key: "s3cret", expName: "ci"},
+		{key: "abc123", expName: "key3"},
+		{key: "d3pl0y", expName: "deploy"},
+		{key: "sha256:" + hex.EncodeToString(hash[:])},
+		{key: "ops:0p3r4t0r"},
+	} {
+		name, ok := ks.Lookup(v.key)
+		if ok != (v.expName != "") || name != v.expName {
+			t.Fatalf("(%d) unexpected lookup: '%s', %t", i, name, ok)
+		}
+	}
+
+	for i, v := range []string{"ops:", "ci:sha256:abcd", "ci:sha256:xyz"} {
+		if _, err := NewKeyStore("", v); err == nil {
+			t.Fatalf("(%d) expected error for '%s'", i, v)
+		}
+	}
+	if _, err := NewKeyStore(file+".missing", ""); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(file, []byte("old:0ld\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := NewKeyStore(file, "")
+	if err != nil {
+		t.Fatalf("cannot load keys: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ks.Watch(ctx, 5*time.Millisecond, newLogger(t))
+
+	// A file that can't be read leaves the keys as they were.
+	if err := ioutil.WriteFile(file, []byte("bad:sha256:00\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := ks.Lookup("0ld"); !ok {
+		t.Fatal("the old key was dropped")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("new:n3w\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is seen, even if the time stamp is the same.
+	os.Chtimes(file, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, oldOK := ks.Lookup("0ld")
+		_, newOK := ks.Lookup("n3w")
+		if !oldOK && newOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the keys weren't rotated")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRequireAuthWithKeys(t *testing.T) {
+	ks, err := NewKeyStore("", "ops:0p3r4t0r")
+	if err != nil {
+		t.Fatalf("cannot load keys: %v", err)
+	}
+	handler := RequireAuth(Authenticator{Keys: ks}, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), newLogger(t))
+
+	for i, v := range []struct {
+		method    string
+		url       string
+		key       string
+		expStatus int
+		expDetail string
+	}{
+		{method: http.MethodGet, url: produceURL, expStatus: http.StatusTeapot},
+		{method: http.MethodGet, url: statusURL, expStatus: http.StatusTeapot},
+		{method: http.MethodGet, url: produceURL, key: "0p3r4t0r",
+			expStatus: http.StatusTeapot},
+		{method: http.MethodGet, url: produceURL, key: "guess",
+			expStatus: http.StatusForbidden,
+			expDetail: "the API key is not valid"},
+		{method: http.MethodPost, url: produceURL,
+			expStatus: http.StatusUnauthorized,
+			expDetail: "an API key is required"},
+		{method: http.MethodPost, url: produceURL, key: "guess",
+			expStatus: http.StatusForbidden},
+		{method: http.MethodPost, url: produceURL, key: "0p3r4t0r",
+			expStatus: http.StatusTeapot},
+		{method: http.MethodDelete, url: produceURL + "/A12T-4GH7-QPL9-3N4M",
+			expStatus: http.StatusUnauthorized},
+		{method: http.MethodGet, url: resetURL, expStatus: http.StatusUnauthorized},
+		{method: http.MethodGet, url: resetURL + "/", key: "0p3r4t0r",
+			expStatus: http.StatusTeapot},
+		{method: http.MethodOptions, url: resetURL, expStatus: http.StatusTeapot},
+	} {
+		req, err := http.NewRequest(v.method, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(APIKeyHeader, v.key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if v.expDetail != "" && decodeProblem(t, rr).Detail != v.expDetail {
+			t.Fatalf("(%d) unexpected body: %s", i, rr.Body.String())
+		}
+		if v.expStatus == http.StatusUnauthorized &&
+			rr.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("(%d) no WWW-Authenticate header", i)
+		}
+	}
+}
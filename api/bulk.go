@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+const (
+	// bulkBuffer is the number of items, and of results, of a bulk add
+	// that are buffered between the decoder, the service and the writer.
+	// Together with the items the service has in flight, this bounds the
+	// number held in memory, however large the input is.
+	bulkBuffer = 8
+
+	// maxBulkLine is the length of the longest line accepted in a bulk add.
+	maxBulkLine = 1 << 20
+)
+
+// Handler for POST/bulk add of produce items as NDJSON (newline-delimited
+// JSON), which is meant for feeds too large to send as a single array.
+// Each line holds a single produce item, and blank lines are skipped.
+//
+// The lines are decoded as they arrive and added by the service's pool of
+// workers, shared with the other adds, so an item the pool has no room for
+// has the overloaded status, 503, in its result, as for a batch add.  The
+// results are streamed back as NDJSON as the items complete, so they may
+// be out of order, but each carries the line number of its item in "row",
+// as well as the code and status of the add, as for a batch add.  As the
+// results are streamed, the request itself returns HTTP 200 as long as it
+// can be processed at all.
+func (a apiImpl) handleBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		writeBadRequestResponse(w, r, errors.New("No body for POST"))
+		return
+	}
+	defer r.Body.Close()
+
+	a.log.Debugw("handling bulk request", "url", r.URL.String())
+
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != mediaTypeNDJSON {
+		writeUnsupportedMediaType(w, r)
+		return
+	}
+
+	// The context is cancelled if the response can't be written, so the
+	// decoding and the workers stop early.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	items := make(chan service.BulkItem, bulkBuffer)
+	results := make(chan service.BulkResult, bulkBuffer)
+
+	// Both the decoder and the workers send results, so the results are
+	// only closed once they have both finished.
+	var wg sync.WaitGroup
+	var addErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(items)
+		a.decodeBulk(ctx, r.Body, items, results)
+	}()
+	go func() {
+		defer wg.Done()
+		addErr = a.service.AddBulk(ctx, items, results)
+		if addErr != nil {
+			cancel()
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Write each result as it arrives, flushing whenever there are none
+	// waiting, so the client sees progress without a flush per line.
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	started := false
+	var writeErr error
+	for res := range results {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if writeErr != nil {
+			continue
+		}
+		resp := addItemResponse(res.AddResult)
+		resp.Row = res.Seq
+		if writeErr = enc.Encode(resp); writeErr != nil {
+			a.log.Warnw("error writing bulk result", "error", writeErr)
+			cancel()
+			continue
+		}
+		if flusher != nil && len(results) == 0 {
+			flusher.Flush()
+		}
+	}
+
+	switch {
+	case addErr != nil && !started:
+		a.notifyInternalServerError(w, r, "server error from AddBulk", addErr)
+	case addErr != nil:
+		a.log.Errorw("server error from AddBulk", "error", addErr)
+	case !started:
+		writeBadRequestResponse(w, r,
+			errors.New("At least one item must be specifed to add"))
+	}
+}
+
+// decodeBulk reads the produce items from NDJSON, one per line, and sends
+// them to the items channel, numbered by line.  Blank lines are skipped,
+// and lines that can't be decoded are reported straight to the results,
+// as are items with problems found decoding them, such as a bad price,
+// once they have been validated for the rest of their problems.
+func (a apiImpl) decodeBulk(ctx context.Context, body io.Reader,
+	items chan<- service.BulkItem, results chan<- service.BulkResult) {
+	reject := rejectUnknownFields()
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 0, 64*1024), maxBulkLine)
+	line := 0
+	for sc.Scan() {
+		line++
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		var input types.ProduceInput
+		err := json.Unmarshal(b, &input)
+		item, problems := input.Decode(reject)
+		if err != nil || problems != nil {
+			res := service.BulkResult{Seq: line}
+			if err != nil {
+				res.Err = service.FormatError{Message: err.Error()}
+			} else {
+				res.Code = item.Code
+				res.Err = a.validateBulkItem(ctx, item, problems)
+			}
+			select {
+			case results <- res:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case items <- service.BulkItem{Seq: line, Item: item}:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	// A line that is too long ends the input, as there is no telling
+	// where the next line starts without reading all of this one.
+	switch err := sc.Err(); err {
+	case nil:
+	case bufio.ErrTooLong:
+		res := service.BulkResult{Seq: line + 1}
+		res.Err = service.FormatError{
+			Message: fmt.Sprintf("line is longer than %d bytes", maxBulkLine)}
+		select {
+		case results <- res:
+		case <-ctx.Done():
+		}
+	default:
+		a.log.Warnw("error reading bulk request", "error", err)
+	}
+}
+
+// validateBulkItem returns the error for an item of a bulk add with the
+// problems found decoding it, along with the rest of its problems.
+func (a apiImpl) validateBulkItem(ctx context.Context, item types.Produce,
+	problems types.FieldErrors) error {
+	verrs, err := a.validateItems(ctx, []types.Produce{item},
+		[]types.FieldErrors{problems})
+	if err != nil {
+		return err
+	}
+	return verrs[0]
+}
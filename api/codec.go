@@ -0,0 +1,545 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gdotgordon/produce-demo/types"
+	"github.com/vmihailenco/msgpack"
+	"gopkg.in/yaml.v2"
+)
+
+// Codec encodes and decodes request and response payloads in a single
+// representation, such as JSON or XML.  The codec used for a request is
+// chosen from the registry by the media type in the Content-Type header,
+// and the one for the response by the Accept header, so new
+// representations can be plugged in with RegisterCodec.
+type Codec interface {
+	// ContentType returns the Content-Type header for encoded payloads.
+	ContentType() string
+
+	// Marshal encodes the value.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes the data into the value, which is a pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// The media types of the default representation, and of the list formats
+// that are handled outside the registry.
+const (
+	mediaTypeJSON   = "application/json"
+	mediaTypeCSV    = "text/csv"
+	mediaTypeNDJSON = "application/x-ndjson"
+)
+
+var (
+	// The codecs, keyed by media type, and the media types in the order
+	// they are preferred when the Accept header doesn't decide between them.
+	codecLock   sync.RWMutex
+	codecs      = make(map[string]Codec)
+	codecOffers []string
+)
+
+func init() {
+	RegisterCodec(mediaTypeJSON, jsonCodec{})
+	xc := xmlCodec{contentType: "application/xml; charset=UTF-8"}
+	RegisterCodec("application/xml", xc)
+	RegisterCodec("text/xml", xc)
+	yc := yamlCodec{contentType: "application/yaml; charset=UTF-8"}
+	RegisterCodec("application/yaml", yc)
+	RegisterCodec("application/x-yaml", yc)
+	RegisterCodec("text/yaml", yc)
+	mc := msgpackCodec{contentType: "application/msgpack"}
+	RegisterCodec("application/msgpack", mc)
+	RegisterCodec("application/x-msgpack", mc)
+}
+
+// RegisterCodec makes a codec available for the media type, which is
+// matched case insensitively and without parameters.  Registering a codec
+// for the media type of an existing one replaces it.
+func RegisterCodec(mediaType string, c Codec) {
+	mediaType = strings.ToLower(mediaType)
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	if _, ok := codecs[mediaType]; !ok {
+		codecOffers = append(codecOffers, mediaType)
+	}
+	codecs[mediaType] = c
+}
+
+// codecFor returns the codec for the media type, if there is one.
+func codecFor(mediaType string) (Codec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	c, ok := codecs[mediaType]
+	return c, ok
+}
+
+// codecMediaTypes returns the media types that have codecs, in order of
+// preference.
+func codecMediaTypes() []string {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	return append([]string(nil), codecOffers...)
+}
+
+// requestCodec returns the codec for the media type in the Content-Type
+// header.  A missing header means JSON, for compatibility with clients
+// that don't set it.  An error is returned if there is no codec for it.
+func requestCodec(header string) (Codec, error) {
+	if header == "" {
+		c, _ := codecFor(mediaTypeJSON)
+		return c, nil
+	}
+	mt, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := codecFor(mt)
+	if !ok {
+		return nil, fmt.Errorf("unsupported media type: '%s'", mt)
+	}
+	return c, nil
+}
+
+// responseCodec returns the codec for the representation that best
+// matches the Accept header, or false if none of them are acceptable.
+func responseCodec(header string) (Codec, bool) {
+	mt := negotiate(header, codecMediaTypes())
+	if mt == "" {
+		return nil, false
+	}
+	return codecFor(mt)
+}
+
+// negotiate returns the offered media type that best matches the Accept
+// header, or the empty string if none are acceptable.  The offer with the
+// highest quality wins, and ties go to the offer matched by the most
+// specific media range, then the one listed first in the header, and then
+// the earliest offer.  A missing header accepts anything.
+func negotiate(header string, offers []string) string {
+	if strings.TrimSpace(header) == "" {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+
+	type mediaRange struct {
+		mediaType   string
+		q           float64
+		specificity int
+	}
+	var ranges []mediaRange
+	for _, v := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(v)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		spec := 2
+		switch {
+		case mt == "*/*":
+			spec = 0
+		case strings.HasSuffix(mt, "/*"):
+			spec = 1
+		}
+		ranges = append(ranges, mediaRange{mediaType: mt, q: q, specificity: spec})
+	}
+
+	best, bestQ, bestSpec, bestPos := "", 0.0, -1, 0
+	for _, offer := range offers {
+		// The quality of an offer comes from the most specific range
+		// that matches it.
+		q, spec, pos := 0.0, -1, 0
+		for i, v := range ranges {
+			match := v.mediaType == offer || v.specificity == 0 ||
+				(v.specificity == 1 &&
+					strings.HasPrefix(offer, strings.TrimSuffix(v.mediaType, "*")))
+			if match && v.specificity > spec {
+				q, spec, pos = v.q, v.specificity, i
+			}
+		}
+		if q == 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && (spec > bestSpec ||
+			(spec == bestSpec && pos < bestPos))) {
+			best, bestQ, bestSpec, bestPos = offer, q, spec, pos
+		}
+	}
+	return best
+}
+
+// jsonCodec is the default representation, indented for readability.
+type jsonCodec struct{}
+
+// ContentType returns the JSON content type.
+func (jsonCodec) ContentType() string {
+	return "application/json; charset=UTF-8"
+}
+
+// Marshal encodes the value as indented JSON.
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// Unmarshal decodes the JSON into the value.
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// xmlListElement is the root element of a list in XML, as XML documents
+// must have a single root.
+const xmlListElement = "list"
+
+// xmlNames are the element names for the types in XML, where they differ
+// from the snake case form of the type name.
+var xmlNames = map[reflect.Type]string{
+	reflect.TypeOf(types.ProduceAddItemResponse{}): "result",
+	reflect.TypeOf(types.StatusResponse{}):         "status",
+	reflect.TypeOf(types.AttributeDef{}):           "attribute",
+}
+
+// xmlCodec is the XML representation.  Lists are encoded as a <list>
+// element holding an element per item, such as <produce>.
+type xmlCodec struct {
+	contentType string
+}
+
+// ContentType returns the XML content type.
+func (xc xmlCodec) ContentType() string {
+	return xc.contentType
+}
+
+// Marshal encodes the value as indented XML.
+func (xc xmlCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Slice {
+		start := xml.StartElement{Name: xml.Name{Local: xmlElementName(rv.Type())}}
+		if err := enc.EncodeElement(v, start); err != nil {
+			return nil, err
+		}
+	} else {
+		list := xml.StartElement{Name: xml.Name{Local: xmlListElement}}
+		if err := enc.EncodeToken(list); err != nil {
+			return nil, err
+		}
+		start := xml.StartElement{
+			Name: xml.Name{Local: xmlElementName(rv.Type().Elem())}}
+		for i := 0; i < rv.Len(); i++ {
+			if err := enc.EncodeElement(rv.Index(i).Interface(), start); err != nil {
+				return nil, err
+			}
+		}
+		if err := enc.EncodeToken(list.End()); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the XML into the value.  Lists must have the <list>
+// root element, whatever their items are named.
+func (xc xmlCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return xml.Unmarshal(data, v)
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	root, err := xmlNextElement(dec)
+	if err != nil {
+		return err
+	}
+	if root.Name.Local != xmlListElement {
+		return fmt.Errorf("expected XML element <%s>, found <%s>",
+			xmlListElement, root.Name.Local)
+	}
+
+	list := reflect.MakeSlice(rv.Elem().Type(), 0, 0)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			item := reflect.New(list.Type().Elem())
+			if err := dec.DecodeElement(item.Interface(), &t); err != nil {
+				return err
+			}
+			list = reflect.Append(list, item.Elem())
+		case xml.EndElement:
+			rv.Elem().Set(list)
+			return nil
+		}
+	}
+}
+
+// xmlNextElement skips to the start of the next element.
+func xmlNextElement(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return xml.StartElement{}, errors.New("no XML element found")
+		}
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			return se, nil
+		}
+	}
+}
+
+// xmlElementName returns the element name for a type, which is the snake
+// case form of the type name, such as "category_count", unless it is
+// listed in xmlNames.
+func xmlElementName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if name, ok := xmlNames[t]; ok {
+		return name
+	}
+	var sb strings.Builder
+	for i, r := range t.Name() {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	if sb.Len() == 0 {
+		return "item"
+	}
+	return sb.String()
+}
+
+// yamlCodec is the YAML representation.  The values go through JSON on
+// the way in and out, so YAML has exactly the same fields and formats as
+// JSON, including prices as "$x.yy" strings, and the field order is kept.
+// Note that codes that look like numbers must be quoted in YAML payloads.
+type yamlCodec struct {
+	contentType string
+}
+
+// ContentType returns the YAML content type.
+func (yc yamlCodec) ContentType() string {
+	return yc.contentType
+}
+
+// Marshal encodes the value as YAML.
+func (yc yamlCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	gen, err := yamlValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(gen)
+}
+
+// Unmarshal decodes the YAML into the value.
+func (yc yamlCodec) Unmarshal(data []byte, v interface{}) error {
+	var gen interface{}
+	if err := yaml.Unmarshal(data, &gen); err != nil {
+		return err
+	}
+	b, err := json.Marshal(jsonValue(gen))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// yamlValue reads the next JSON value from the decoder, converting objects
+// to ordered YAML maps, and numbers to integers where possible.
+func yamlValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			var ms yaml.MapSlice
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				val, err := yamlValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				ms = append(ms, yaml.MapItem{Key: key, Value: val})
+			}
+			_, err = dec.Token()
+			return ms, err
+		case '[':
+			list := []interface{}{}
+			for dec.More() {
+				val, err := yamlValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, val)
+			}
+			_, err = dec.Token()
+			return list, err
+		}
+		return nil, fmt.Errorf("unexpected JSON delimiter: %v", t)
+	case json.Number:
+		return jsonNumber(t)
+	default:
+		return t, nil
+	}
+}
+
+// jsonValue converts a generic value decoded from YAML or MessagePack to
+// one that can be encoded as JSON, whose objects must have string keys.
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			res[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return res
+	case map[string]interface{}:
+		for k, val := range t {
+			t[k] = jsonValue(val)
+		}
+		return t
+	case []interface{}:
+		for i, val := range t {
+			t[i] = jsonValue(val)
+		}
+		return t
+	case []byte:
+		return string(t)
+	default:
+		return v
+	}
+}
+
+// jsonNumber converts a JSON number to an integer if it is one, or to a
+// float otherwise.
+func jsonNumber(n json.Number) (interface{}, error) {
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	return n.Float64()
+}
+
+// msgpackCodec is the MessagePack representation.  Like YAML, the values
+// go through JSON, so MessagePack maps have the same keys as JSON objects,
+// and prices are "$x.yy" strings.
+type msgpackCodec struct {
+	contentType string
+}
+
+// ContentType returns the MessagePack content type.
+func (mc msgpackCodec) ContentType() string {
+	return mc.contentType
+}
+
+// Marshal encodes the value as MessagePack, with the map keys sorted.
+func (mc msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var gen interface{}
+	if err := dec.Decode(&gen); err != nil {
+		return nil, err
+	}
+	gen, err = msgpackValue(gen)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).SortMapKeys(true).Encode(gen); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the MessagePack into the value.
+func (mc msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	var gen interface{}
+	if err := msgpack.Unmarshal(data, &gen); err != nil {
+		return err
+	}
+	b, err := json.Marshal(jsonValue(gen))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// msgpackValue converts the JSON numbers in a generic value decoded from
+// JSON to integers or floats, so they are encoded as MessagePack numbers.
+func msgpackValue(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			conv, err := msgpackValue(val)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = conv
+		}
+		return t, nil
+	case []interface{}:
+		for i, val := range t {
+			conv, err := msgpackValue(val)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = conv
+		}
+		return t, nil
+	case json.Number:
+		return jsonNumber(t)
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,308 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+func TestCodecs(t *testing.T) {
+	item := dfltProduce
+	item.Category = "Vegetables"
+	item.Tags = []string{"leafy"}
+	item.Attributes = map[string]interface{}{"organic": true, "origin": "Salinas"}
+	item.Names = map[string]string{"fr": "Laitue"}
+	items := []types.Produce{item, secondProduce}
+
+	for i, v := range []struct {
+		mediaType string
+		expType   string
+		expBody   string
+	}{
+		{
+			mediaType: "application/json",
+			expType:   "application/json; charset=UTF-8",
+		},
+		{
+			mediaType: "application/xml",
+			expType:   "application/xml; charset=UTF-8",
+			expBody: `<?xml version="1.0" encoding="UTF-8"?>
+<list>
+  <produce>
+    <code>A12T-4GH7-QPL9-3N4M</code>
+    <name>Lettuce</name>
+    <unit_price>$3.46</unit_price>
+    <category>Vegetables</category>
+    <tags>
+      <tag>leafy</tag>
+    </tags>
+    <attributes>
+      <attribute name="organic" type="bool">true</attribute>
+      <attribute name="origin" type="string">Salinas</attribute>
+    </attributes>
+    <names>
+      <name lang="fr">Laitue</name>
+    </names>
+  </produce>
+  <produce>
+    <code>YRT6-72AS-K736-L4AR</code>
+    <name>Green Pepper</name>
+    <unit_price>$0.79</unit_price>
+  </produce>
+</list>
+`,
+		},
+		{
+			mediaType: "text/yaml",
+			expType:   "application/yaml; charset=UTF-8",
+			expBody: `- code: A12T-4GH7-QPL9-3N4M
+  name: Lettuce
+  unit_price: $3.46
+  category: Vegetables
+  tags:
+  - leafy
+  attributes:
+    organic: true
+    origin: Salinas
+  names:
+    fr: Laitue
+- code: YRT6-72AS-K736-L4AR
+  name: Green Pepper
+  unit_price: $0.79
+`,
+		},
+		{
+			mediaType: "application/x-msgpack",
+			expType:   "application/msgpack",
+		},
+	} {
+		codec, ok := codecFor(v.mediaType)
+		if !ok {
+			t.Fatalf("(%d) no codec for '%s'", i, v.mediaType)
+		}
+		if ct := codec.ContentType(); ct != v.expType {
+			t.Fatalf("(%d) unexpected content type: '%s'", i, ct)
+		}
+		b, err := codec.Marshal(items)
+		if err != nil {
+			t.Fatalf("(%d) marshal failed: %v", i, err)
+		}
+		if v.expBody != "" && string(b) != v.expBody {
+			t.Fatalf("(%d) unexpected body: '%s'", i, b)
+		}
+
+		// Prices keep their string form in every representation.
+		if !bytes.Contains(b, []byte("$3.46")) {
+			t.Fatalf("(%d) price not found in body: '%s'", i, b)
+		}
+
+		var res []types.Produce
+		if err := codec.Unmarshal(b, &res); err != nil {
+			t.Fatalf("(%d) unmarshal failed: %v", i, err)
+		}
+		if !reflect.DeepEqual(res, items) {
+			t.Fatalf("(%d) unexpected items: %+v", i, res)
+		}
+	}
+}
+
+func TestXMLCodecSingleItem(t *testing.T) {
+	codec, _ := codecFor("application/xml")
+	b := []byte(`<produce><code>A12T-4GH7-QPL9-3N4M</code>` +
+		`<name>Lettuce</name><unit_price>3.46</unit_price></produce>`)
+
+	// A single item isn't a list, so an add can fall back to decoding it
+	// on its own.
+	var items []types.Produce
+	err := codec.Unmarshal(b, &items)
+	if err == nil || !strings.Contains(err.Error(), "<list>") {
+		t.Fatalf("expected list error, got: %v", err)
+	}
+	var item types.Produce
+	if err := codec.Unmarshal(b, &item); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(item, dfltProduce) {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+
+	b, err = codec.Marshal(types.StatusResponse{Status: "bad"})
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	exp := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		"<status>\n  <status>bad</status>\n</status>\n"
+	if string(b) != exp {
+		t.Fatalf("unexpected body: '%s'", b)
+	}
+}
+
+func TestContentNegotiationEndpoint(t *testing.T) {
+	for i, v := range []struct {
+		method      string
+		url         string
+		contentType string
+		accept      string
+		body        string
+		existing    []types.Produce
+		expStatus   int
+		expType     string
+		expBody     string
+		expDetail   string
+	}{
+		{
+			method:      http.MethodPost,
+			url:         produceURL,
+			contentType: "application/xml",
+			body: `<produce><code>A12T-4GH7-QPL9-3N4M</code>` +
+				`<name>Lettuce</name><unit_price>$3.46</unit_price></produce>`,
+			expStatus: http.StatusCreated,
+		},
+		{
+			method:      http.MethodPost,
+			url:         produceURL,
+			contentType: "application/x-yaml",
+			body: "- code: A12T-4GH7-QPL9-3N4M\n  name: Lettuce\n" +
+				"  unit_price: $3.46\n- name: Green Pepper\n  unit_price: $0.79\n",
+			accept:    "application/xml",
+			expStatus: http.StatusCreated,
+			expType:   "application/xml; charset=UTF-8",
+			expBody: `<?xml version="1.0" encoding="UTF-8"?>
+<list>
+  <result>
+    <code>A12T-4GH7-QPL9-3N4M</code>
+    <status_code>201</status_code>
+  </result>
+  <result>
+    <code>GEN0-0000-0000-0001</code>
+    <status_code>201</status_code>
+  </result>
+</list>
+`,
+		},
+		{
+			method:      http.MethodPost,
+			url:         produceURL,
+			contentType: "application/xml",
+			body: `<produce><code>A12T-4GH7-QPL9-3N4M</code>` +
+				`<name>Lettuce!</name><unit_price>$3.46</unit_price></produce>`,
+			accept:    "text/yaml",
+			expStatus: http.StatusBadRequest,
+			expType:   types.ProblemContentType,
+			expDetail: "invalid item format: invalid name: 'Lettuce!'",
+		},
+		{
+			method:      http.MethodPost,
+			url:         produceURL,
+			contentType: "text/plain",
+			body:        "Lettuce",
+			expStatus:   http.StatusUnsupportedMediaType,
+			expType:     types.ProblemContentType,
+			expDetail:   "the media type 'text/plain' isn't supported here",
+		},
+		{
+			method:      http.MethodPost,
+			url:         produceURL,
+			contentType: "application/json",
+			body:        `{"name": "Lettuce", "unit_price": "$3.46"}`,
+			accept:      "image/png",
+			expStatus:   http.StatusNotAcceptable,
+			expType:     types.ProblemContentType,
+			expDetail:   "none of the representations in 'image/png' can be written",
+		},
+		{
+			method:    http.MethodGet,
+			url:       produceURL,
+			accept:    "application/yaml",
+			existing:  []types.Produce{dfltProduce},
+			expStatus: http.StatusOK,
+			expType:   "application/yaml; charset=UTF-8",
+			expBody: "- code: A12T-4GH7-QPL9-3N4M\n  name: Lettuce\n" +
+				"  unit_price: $3.46\n",
+		},
+		{
+			method:    http.MethodGet,
+			url:       produceURL,
+			accept:    "application/xml",
+			existing:  []types.Produce{},
+			expStatus: http.StatusOK,
+			expType:   "application/xml; charset=UTF-8",
+			expBody:   `<?xml version="1.0" encoding="UTF-8"?>` + "\n<list></list>\n",
+		},
+		{
+			method:    http.MethodGet,
+			url:       produceURL,
+			accept:    "image/png",
+			expStatus: http.StatusNotAcceptable,
+			expType:   types.ProblemContentType,
+			expDetail: "none of the representations in 'image/png' can be written",
+		},
+		{
+			// Errors are always reported as problem+json.
+			method:    http.MethodGet,
+			url:       produceURL + "/x/y",
+			accept:    "image/png",
+			expStatus: http.StatusNotFound,
+			expType:   types.ProblemContentType,
+			expDetail: "there is no endpoint for /v1/produce/x/y",
+		},
+	} {
+		api := apiImpl{service: DummyService{existing: v.existing},
+			log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(v.method, v.url, strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", v.contentType)
+		req.Header.Set("Accept", v.accept)
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != v.expType {
+			t.Fatalf("(%d) unexpected content type: '%s'", i, ct)
+		}
+		if v.expDetail != "" {
+			if decodeProblem(t, rr).Detail != v.expDetail {
+				t.Fatalf("(%d) unexpected body: '%s'", i, rr.Body.String())
+			}
+		} else if rr.Body.String() != v.expBody {
+			t.Fatalf("(%d) unexpected body: '%s'", i, rr.Body.String())
+		}
+	}
+}
+
+func TestStatusEndpointMsgpack(t *testing.T) {
+	api := apiImpl{log: newLogger(t)}
+	req, err := http.NewRequest(http.MethodGet, statusURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/msgpack")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.getStatus).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %d", rr.Code)
+	}
+
+	codec, _ := codecFor("application/msgpack")
+	var sr types.StatusResponse
+	if err := codec.Unmarshal(rr.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if sr.Status != "produce service is up and running" {
+		t.Fatalf("unexpected status: '%s'", sr.Status)
+	}
+
+	// The map is keyed by the JSON name, not the Go field name.
+	if bytes.Contains(rr.Body.Bytes(), []byte("Status")) {
+		t.Fatalf("Go field name found in body: %q", rr.Body.Bytes())
+	}
+}
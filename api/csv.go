@@ -0,0 +1,307 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// The CSV columns for the produce fields.  Attributes and localized names
+// have a column each, named with the prefixes followed by the attribute
+// name or language tag, e.g. "attr:organic" or "name:fr".  Tags are kept
+// in a single column, separated by tagSeparator.
+const (
+	csvCode       = "code"
+	csvName       = "name"
+	csvUnitPrice  = "unit_price"
+	csvCategory   = "category"
+	csvTags       = "tags"
+	csvAttrPrefix = "attr:"
+	csvNamePrefix = "name:"
+
+	// csvIgnore is the column mapping target for columns to skip.
+	csvIgnore = "-"
+
+	tagSeparator = ";"
+)
+
+// csvOptions are the query parameter options for CSV import and export.
+type csvOptions struct {
+	// The field delimiter, set with "delimiter", which is a single
+	// character or "tab".  It defaults to a comma.
+	delimiter rune
+
+	// The mapping of the file's column headers to the produce columns,
+	// set with any number of "map" parameters of the form "header:column",
+	// such as "map=Description:name".
+	mapping map[string]string
+
+	// Whether to add none of the items if any row is invalid, set with
+	// "on_error=abort".  The default, "on_error=skip", adds the valid rows.
+	abort bool
+}
+
+// parseCSVOptions gets the CSV options from the query parameters.
+func parseCSVOptions(query url.Values) (csvOptions, error) {
+	opts := csvOptions{delimiter: ',', mapping: make(map[string]string)}
+	switch d := query.Get("delimiter"); {
+	case d == "":
+	case d == "tab":
+		opts.delimiter = '\t'
+	case utf8.RuneCountInString(d) == 1:
+		opts.delimiter, _ = utf8.DecodeRuneInString(d)
+		if opts.delimiter == '"' || opts.delimiter == '\r' ||
+			opts.delimiter == '\n' || opts.delimiter == utf8.RuneError {
+			return opts, fmt.Errorf("invalid delimiter: '%s'", d)
+		}
+	default:
+		return opts, fmt.Errorf("invalid delimiter: '%s'", d)
+	}
+
+	for _, v := range query["map"] {
+		ndx := strings.Index(v, ":")
+		if ndx <= 0 || ndx == len(v)-1 {
+			return opts, fmt.Errorf("invalid column mapping: '%s'", v)
+		}
+		opts.mapping[strings.ToLower(strings.TrimSpace(v[:ndx]))] =
+			strings.TrimSpace(v[ndx+1:])
+	}
+
+	switch query.Get("on_error") {
+	case "", "skip":
+	case "abort":
+		opts.abort = true
+	default:
+		return opts, fmt.Errorf("invalid on_error option: '%s'",
+			query.Get("on_error"))
+	}
+	return opts, nil
+}
+
+// writeCSV writes the produce items as CSV with a header row.  There is
+// a column for each attribute and localized name that any item carries,
+// so the output can be imported as is.
+func writeCSV(w io.Writer, items []types.Produce, delimiter rune) error {
+	attrSet := make(map[string]bool)
+	nameSet := make(map[string]bool)
+	for _, v := range items {
+		for k := range v.Attributes {
+			attrSet[k] = true
+		}
+		for k := range v.Names {
+			nameSet[k] = true
+		}
+	}
+	attrs := sortedKeys(attrSet)
+	names := sortedKeys(nameSet)
+
+	header := []string{csvCode, csvName, csvUnitPrice, csvCategory, csvTags}
+	for _, v := range attrs {
+		header = append(header, csvAttrPrefix+v)
+	}
+	for _, v := range names {
+		header = append(header, csvNamePrefix+v)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Comma = delimiter
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, v := range items {
+		rec := []string{v.Code, v.Name, v.UnitPrice.String(), v.Category,
+			strings.Join(v.Tags, tagSeparator)}
+		for _, k := range attrs {
+			val, ok := v.Attributes[k]
+			if !ok {
+				rec = append(rec, "")
+				continue
+			}
+			rec = append(rec, fmt.Sprint(val))
+		}
+		for _, k := range names {
+			rec = append(rec, v.Names[k])
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readCSV reads produce items from CSV with a header row.  It returns an
+// item for each row, along with the problem converting each row, if any,
+// which is types.FieldErrors for a row whose fields could be read.
+// Attribute values are converted according to the schema, so the items
+// can be validated the same way as JSON ones.  An error is returned if
+// the header is invalid or the CSV is malformed.
+func readCSV(r io.Reader, opts csvOptions,
+	schema types.AttributeSchema) ([]types.Produce, []error, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = opts.delimiter
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("missing CSV header row")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns, err := csvColumns(header, opts.mapping)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var items []types.Produce
+	var problems []error
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if pe, ok := err.(*csv.ParseError); ok && pe.Err == csv.ErrFieldCount {
+			items = append(items, types.Produce{})
+			problems = append(problems, fmt.Errorf(
+				"row has %d fields, expected %d", len(rec), len(columns)))
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		item, errs := csvItem(rec, columns, schema)
+		items = append(items, item)
+		if errs != nil {
+			problems = append(problems, errs)
+		} else {
+			problems = append(problems, nil)
+		}
+	}
+	return items, problems, nil
+}
+
+// csvColumns maps each header to the produce column it holds, applying
+// the mapping first.  Columns are matched case insensitively, and those
+// mapped to "-" are ignored.
+func csvColumns(header []string, mapping map[string]string) ([]string,
+	error) {
+	columns := make([]string, len(header))
+	seen := make(map[string]bool)
+	for i, v := range header {
+		col := strings.TrimSpace(v)
+		if m, ok := mapping[strings.ToLower(col)]; ok {
+			col = m
+		}
+		if col == csvIgnore {
+			continue
+		}
+
+		// Keep the case of the language tag or attribute name, as they
+		// are canonicalized when the item is validated.
+		lower := strings.ToLower(col)
+		switch {
+		case lower == csvCode, lower == csvName, lower == csvUnitPrice,
+			lower == csvCategory, lower == csvTags:
+			col = lower
+		case strings.HasPrefix(lower, csvAttrPrefix) && len(col) > len(csvAttrPrefix):
+			col = csvAttrPrefix + col[len(csvAttrPrefix):]
+		case strings.HasPrefix(lower, csvNamePrefix) && len(col) > len(csvNamePrefix):
+			col = csvNamePrefix + col[len(csvNamePrefix):]
+		default:
+			return nil, fmt.Errorf("unknown CSV column: '%s'", v)
+		}
+		if seen[strings.ToLower(col)] {
+			return nil, fmt.Errorf("duplicate CSV column: '%s'", v)
+		}
+		seen[strings.ToLower(col)] = true
+		columns[i] = col
+	}
+
+	for _, v := range []string{csvName, csvUnitPrice} {
+		if !seen[v] {
+			return nil, fmt.Errorf("missing CSV column: '%s'", v)
+		}
+	}
+	return columns, nil
+}
+
+// csvItem converts a CSV row to a produce item.  Empty cells leave the
+// field unset.  A problem is only returned for a unit price that can't be
+// parsed, as the rest of the fields are checked when the item is validated.
+func csvItem(rec []string, columns []string,
+	schema types.AttributeSchema) (types.Produce, types.FieldErrors) {
+	var item types.Produce
+	var errs types.FieldErrors
+	for i, col := range columns {
+		val := rec[i]
+		if col == "" || val == "" {
+			continue
+		}
+		switch {
+		case col == csvCode:
+			item.Code = val
+		case col == csvName:
+			item.Name = val
+		case col == csvUnitPrice:
+			var perr *types.FieldError
+			if item.UnitPrice, perr = types.ParseUnitPrice(val); perr != nil {
+				errs = append(errs, *perr)
+			}
+		case col == csvCategory:
+			item.Category = val
+		case col == csvTags:
+			item.Tags = strings.Split(val, tagSeparator)
+		case strings.HasPrefix(col, csvAttrPrefix):
+			if item.Attributes == nil {
+				item.Attributes = make(map[string]interface{})
+			}
+			name := col[len(csvAttrPrefix):]
+			item.Attributes[name] = attributeFromText(schema, name, val)
+		case strings.HasPrefix(col, csvNamePrefix):
+			if item.Names == nil {
+				item.Names = make(map[string]string)
+			}
+			item.Names[col[len(csvNamePrefix):]] = val
+		}
+	}
+	return item, errs
+}
+
+// attributeFromText converts the text of an attribute value, from CSV or
+// GraphQL, to the type that the schema defines for it.  If the attribute
+// is unknown, or the text can't be converted, the text is returned as is,
+// so that validation reports the problem the same way as for JSON.
+func attributeFromText(schema types.AttributeSchema, name,
+	val string) interface{} {
+	canon, _ := types.ValidateAndConvertAttributeName(name)
+	switch schema[canon].Type {
+	case types.AttributeInt:
+		if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return n
+		}
+	case types.AttributeBool:
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+	return val
+}
+
+// sortedKeys returns the keys of the set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
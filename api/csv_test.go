@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+func TestCSVOptions(t *testing.T) {
+	for i, v := range []struct {
+		query  string
+		expOK  bool
+		expOpt csvOptions
+	}{
+		{
+			query:  "",
+			expOK:  true,
+			expOpt: csvOptions{delimiter: ',', mapping: map[string]string{}},
+		},
+		{
+			query: "delimiter=tab&map=Description:name&map=Origin: attr:country" +
+				"&on_error=abort",
+			expOK: true,
+			expOpt: csvOptions{delimiter: '\t', mapping: map[string]string{
+				"description": "name", "origin": "attr:country"}, abort: true},
+		},
+		{
+			query:  "delimiter=%7C&on_error=skip",
+			expOK:  true,
+			expOpt: csvOptions{delimiter: '|', mapping: map[string]string{}},
+		},
+		{query: "delimiter=%22"},
+		{query: "delimiter=ab"},
+		{query: "map=name"},
+		{query: "map=:name"},
+		{query: "on_error=ignore"},
+	} {
+		query, err := url.ParseQuery(v.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := parseCSVOptions(query)
+		if (err == nil) != v.expOK {
+			t.Fatalf("(%d) unexpected error result: %v", i, err)
+		}
+		if err == nil && !reflect.DeepEqual(opts, v.expOpt) {
+			t.Fatalf("(%d) unexpected options: %+v", i, opts)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	schema := types.NewAttributeSchema([]types.AttributeDef{
+		{Name: "plu", Type: types.AttributeInt},
+		{Name: "organic", Type: types.AttributeBool},
+		{Name: "origin", Type: types.AttributeString},
+	})
+	opts := csvOptions{delimiter: ',', mapping: map[string]string{}}
+
+	csv := "Code,NAME,unit_price,category,tags,attr:PLU,attr:organic," +
+		"attr:origin,name:fr\n" +
+		"A12T-4GH7-QPL9-3N4M,Lettuce,$3.46,Vegetables,Leafy;Local,4061," +
+		"true,1234,Laitue\n" +
+		",Green Pepper,0.79,,,green,,,\n" +
+		"YRT6-72AS-K736-L4AR,Peas,free,,,,,,\n"
+	items, problems, err := readCSV(strings.NewReader(csv), opts, schema)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expItems := []types.Produce{
+		{
+			Code:      "A12T-4GH7-QPL9-3N4M",
+			Name:      "Lettuce",
+			UnitPrice: types.USD(346),
+			Category:  "Vegetables",
+			Tags:      []string{"Leafy", "Local"},
+			Attributes: map[string]interface{}{"PLU": int64(4061),
+				"organic": true, "origin": "1234"},
+			Names: map[string]string{"fr": "Laitue"},
+		},
+		{
+			Name:       "Green Pepper",
+			UnitPrice:  types.USD(79),
+			Attributes: map[string]interface{}{"PLU": "green"},
+		},
+		{
+			Code: "YRT6-72AS-K736-L4AR",
+			Name: "Peas",
+		},
+	}
+	if !reflect.DeepEqual(items, expItems) {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+	if problems[0] != nil || problems[1] != nil || problems[2] == nil ||
+		problems[2].Error() != "invalid unit price: 'free'" {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	for i, v := range []struct {
+		csv    string
+		expErr string
+	}{
+		{"", "missing CSV header row"},
+		{"code,name\n", "missing CSV column: 'unit_price'"},
+		{"name,unit_price,price\n", "unknown CSV column: 'price'"},
+		{"name,unit_price,Name\n", "duplicate CSV column: 'Name'"},
+		{"name,unit_price\n\"Peas,$1\n", ""},
+	} {
+		_, _, err := readCSV(strings.NewReader(v.csv), opts, schema)
+		if err == nil || (v.expErr != "" && err.Error() != v.expErr) {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	items := []types.Produce{
+		{
+			Code:       "A12T-4GH7-QPL9-3N4M",
+			Name:       "Lettuce, Iceberg",
+			UnitPrice:  types.USD(346),
+			Tags:       []string{"Leafy"},
+			Attributes: map[string]interface{}{"plu": int64(4061)},
+			Names:      map[string]string{"fr": "Laitue \"Iceberg\""},
+		},
+		{
+			Code:      "YRT6-72AS-K736-L4AR",
+			Name:      "Green Pepper",
+			UnitPrice: types.USD(79),
+			Category:  "Vegetables",
+		},
+	}
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, items, ';'); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	schema := types.NewAttributeSchema([]types.AttributeDef{
+		{Name: "plu", Type: types.AttributeInt},
+	})
+	res, problems, err := readCSV(&buf,
+		csvOptions{delimiter: ';', mapping: map[string]string{}}, schema)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res, items) {
+		t.Fatalf("items differ after round trip: %+v", res)
+	}
+	for i, v := range problems {
+		if v != nil {
+			t.Fatalf("(%d) unexpected problem: %v", i, v)
+		}
+	}
+}
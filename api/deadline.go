@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// statusClientClosedRequest is the status of a request whose work was
+// abandoned because the client went away.  There is no standard status for
+// this, so it's the one nginx uses.  The client never sees it, but it shows
+// up in the logs.
+const statusClientClosedRequest = 499
+
+// Deadlines are how long the requests to each endpoint may run before their
+// work is abandoned.  Endpoints maps an endpoint, given as its method and
+// path pattern, such as "POST /v1/produce" or "DELETE /v1/produce/{code}",
+// to its deadline, and Default is the deadline of the rest.  A deadline of
+// zero means there is none.  HEAD requests have the deadline of GET.
+type Deadlines struct {
+	Default   time.Duration
+	Endpoints map[string]time.Duration
+}
+
+var (
+	// The deadlines of the requests, which are read as each request
+	// starts, so they may be changed while the service is running.
+	deadlineLock sync.RWMutex
+	deadlines    Deadlines
+)
+
+// SetDeadlines sets the deadlines of the requests to each endpoint.  There
+// are none by default, so a request runs until it is done, the client goes
+// away, or the server shuts down.
+func SetDeadlines(d Deadlines) {
+	deadlineLock.Lock()
+	defer deadlineLock.Unlock()
+	deadlines = d
+}
+
+// ParseDeadlines parses a comma-separated list of deadlines, each of which
+// is an endpoint, or "default", then "=" and a duration, such as
+// "default=10s,POST /v1/produce/import=5m".
+func ParseDeadlines(s string) (Deadlines, error) {
+	var d Deadlines
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		ndx := strings.LastIndex(v, "=")
+		if ndx == -1 {
+			return Deadlines{}, fmt.Errorf("deadline '%s' has no duration", v)
+		}
+		endpoint := strings.TrimSpace(v[:ndx])
+		dur, err := time.ParseDuration(strings.TrimSpace(v[ndx+1:]))
+		if err != nil || dur < 0 {
+			return Deadlines{}, fmt.Errorf("invalid duration in deadline '%s'",
+				v)
+		}
+		if endpoint == "default" {
+			d.Default = dur
+			continue
+		}
+		fields := strings.Fields(endpoint)
+		if len(fields) != 2 || fields[0] != strings.ToUpper(fields[0]) ||
+			!strings.HasPrefix(fields[1], "/") {
+			return Deadlines{}, fmt.Errorf("invalid endpoint in deadline '%s': "+
+				"expected a method and path, such as 'POST /v1/produce'", v)
+		}
+		if d.Endpoints == nil {
+			d.Endpoints = make(map[string]time.Duration)
+		}
+		d.Endpoints[fields[0]+" "+strings.TrimSuffix(fields[1], "/")] = dur
+	}
+	return d, nil
+}
+
+// deadlineFor returns the deadline of the requests to an endpoint, or zero
+// if they have none.
+func deadlineFor(endpoint string) time.Duration {
+	deadlineLock.RLock()
+	defer deadlineLock.RUnlock()
+	if d, ok := deadlines.Endpoints[endpoint]; ok {
+		return d
+	}
+	return deadlines.Default
+}
+
+// withDeadline wraps the handler of an endpoint, so the context of each of
+// its requests times out after the endpoint's deadline, if it has one.
+func withDeadline(method, pattern string,
+	hf http.HandlerFunc) http.HandlerFunc {
+	endpoint := method + " " + strings.TrimSuffix(pattern, "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := deadlineFor(endpoint)
+		if d <= 0 {
+			hf(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		hf(w, r.WithContext(ctx))
+	}
+}
+
+// serverContextKey is the context key for the server's root context.
+type serverContextKey struct{}
+
+// mergeCancel returns a copy of the request's context that is also
+// cancelled when the server's context is done, so the work of a request
+// stops either when its client goes away or the server shuts down.  The
+// server's context is kept in it, for shuttingDown.  The cancel function
+// must be called once the request is done.
+func mergeCancel(rctx, server context.Context) (context.Context,
+	context.CancelFunc) {
+	ctx, cancel := context.WithCancel(
+		context.WithValue(rctx, serverContextKey{}, server))
+	if server.Done() == nil {
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-server.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// shuttingDown returns whether the server handling the request is shutting
+// down.
+func shuttingDown(ctx context.Context) bool {
+	server, ok := ctx.Value(serverContextKey{}).(context.Context)
+	return ok && server.Err() != nil
+}
+
+// writeAbandoned writes the problem for work that was abandoned because the
+// request was cancelled or ran past its deadline, and returns whether the
+// error was one of those.  A request cancelled by the server shutting down
+// gets HTTP 503 (Service Unavailable), as its client is likely still there.
+func (a apiImpl) writeAbandoned(w http.ResponseWriter, r *http.Request,
+	err error) bool {
+	var sc int
+	var code, detail string
+	switch {
+	case err == context.DeadlineExceeded:
+		sc, code = http.StatusServiceUnavailable, types.ProblemDeadlineExceeded
+		detail = "the request ran past its deadline, and was abandoned"
+	case err == context.Canceled && shuttingDown(r.Context()):
+		sc, code = http.StatusServiceUnavailable, types.ProblemShuttingDown
+		detail = "the server is shutting down"
+	case err == context.Canceled:
+		sc, code = statusClientClosedRequest, types.ProblemRequestCancelled
+		detail = "the request was cancelled by the client"
+	default:
+		return false
+	}
+	a.log.Infow("request abandoned", "path", r.URL.Path, "error", err)
+	writeProblem(w, r, sc, code, "", detail)
+	return true
+}
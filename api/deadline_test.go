@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+func TestParseDeadlines(t *testing.T) {
+	for i, v := range []struct {
+		input  string
+		expDl  Deadlines
+		expErr bool
+	}{
+		{input: ""},
+		{input: "default=10s", expDl: Deadlines{Default: 10 * time.Second}},
+		{
+			input: "default=10s, POST /v1/produce/import/=5m,GET /v1/produce=0s",
+			expDl: Deadlines{Default: 10 * time.Second,
+				Endpoints: map[string]time.Duration{
+					"POST /v1/produce/import": 5 * time.Minute,
+					"GET /v1/produce":         0,
+				}},
+		},
+		{input: "default", expErr: true},
+		{input: "default=soon", expErr: true},
+		{input: "default=-1s", expErr: true},
+		{input: "/v1/produce=1s", expErr: true},
+		{input: "post /v1/produce=1s", expErr: true},
+		{input: "POST v1/produce=1s", expErr: true},
+	} {
+		dl, err := ParseDeadlines(v.input)
+		if (err != nil) != v.expErr {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(dl, v.expDl) {
+			t.Fatalf("(%d) unexpected deadlines: %+v", i, dl)
+		}
+	}
+}
+
+func TestAbandonedRequests(t *testing.T) {
+	for i, v := range []struct {
+		method    string
+		url       string
+		err       error
+		expStatus int
+		expCode   string
+	}{
+		{http.MethodGet, produceURL, context.Canceled,
+			statusClientClosedRequest, types.ProblemRequestCancelled},
+		{http.MethodGet, produceURL, context.DeadlineExceeded,
+			http.StatusServiceUnavailable, types.ProblemDeadlineExceeded},
+		{http.MethodGet, categoriesURL, context.DeadlineExceeded,
+			http.StatusServiceUnavailable, types.ProblemDeadlineExceeded},
+		{http.MethodGet, categoryCountsURL, context.Canceled,
+			statusClientClosedRequest, types.ProblemRequestCancelled},
+		{http.MethodGet, attributesURL, context.DeadlineExceeded,
+			http.StatusServiceUnavailable, types.ProblemDeadlineExceeded},
+		{http.MethodPost, importURL, context.DeadlineExceeded,
+			http.StatusServiceUnavailable, types.ProblemDeadlineExceeded},
+	} {
+		api := apiImpl{service: DummyService{err: v.err}, log: newLogger(t)}
+		req, err := http.NewRequest(v.method, v.url,
+			strings.NewReader("code,name,unit_price\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/csv")
+		rr := httptest.NewRecorder()
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code,
+				v.expStatus)
+		}
+		if p := decodeProblem(t, rr); p.Code != v.expCode ||
+			p.Title != statusText(v.expStatus) {
+			t.Fatalf("(%d) unexpected problem: %+v", i, p)
+		}
+	}
+
+	// Work cancelled by the server shutting down is unavailable, rather
+	// than cancelled by the client.
+	server, cancel := context.WithCancel(context.Background())
+	cancel()
+	api := apiImpl{log: newLogger(t)}
+	handler := wrapContext(server, func(w http.ResponseWriter,
+		r *http.Request) {
+		<-r.Context().Done()
+		api.writeError(w, r, r.Context().Err())
+	})
+	req, err := http.NewRequest(http.MethodGet, produceURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if p := decodeProblem(t, rr); rr.Code != http.StatusServiceUnavailable ||
+		p.Code != types.ProblemShuttingDown {
+		t.Fatalf("unexpected problem: %d, %+v", rr.Code, p)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	defer SetDeadlines(Deadlines{})
+	SetDeadlines(Deadlines{Default: time.Hour,
+		Endpoints: map[string]time.Duration{
+			"GET " + produceItemURL: 10 * time.Millisecond,
+			"DELETE " + produceURL:  0,
+		}})
+
+	// Each handler waits for its deadline, if it has one.
+	hf := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		<-r.Context().Done()
+		writeProblem(w, r, http.StatusServiceUnavailable,
+			types.ProblemDeadlineExceeded, "", r.Context().Err().Error())
+	}
+	rt := newRouter()
+	rt.handle(http.MethodGet, produceItemURL,
+		withDeadline(http.MethodGet, produceItemURL, hf))
+	rt.handle(http.MethodDelete, produceURL,
+		withDeadline(http.MethodDelete, produceURL, hf))
+
+	for i, v := range []struct {
+		method    string
+		url       string
+		expStatus int
+	}{
+		{http.MethodGet, produceURL + "/A12T-4GH7-QPL9-3N4M",
+			http.StatusServiceUnavailable},
+		{http.MethodHead, produceURL + "/A12T-4GH7-QPL9-3N4M",
+			http.StatusServiceUnavailable},
+		{http.MethodDelete, produceURL, http.StatusOK},
+	} {
+		req, err := http.NewRequest(v.method, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		rt.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code,
+				v.expStatus)
+		}
+	}
+}
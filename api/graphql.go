@@ -0,0 +1,565 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// graphQLRequest is the JSON body of a GraphQL request.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLError is an error from the service as reported in a GraphQL
+// response.  The extensions carry the HTTP status the REST API would
+// return for the same error, along with a code derived from it, such as
+// "NOT_FOUND".
+type graphQLError struct {
+	err        error
+	statusCode int
+	problem    string
+	field      string
+}
+
+// Error satisfies the error interface.
+func (ge graphQLError) Error() string {
+	return ge.err.Error()
+}
+
+// Extensions satisfies the gqlerrors.ExtendedError interface, so the
+// extensions are included in the response.  The problem is the code the
+// REST API would report the error with, and the field is the one at fault,
+// if it is known.
+func (ge graphQLError) Extensions() map[string]interface{} {
+	code := strings.ToUpper(strings.Replace(http.StatusText(ge.statusCode),
+		" ", "_", -1))
+	ext := map[string]interface{}{"code": code, "status": ge.statusCode,
+		"problem": ge.problem}
+	if ge.field != "" {
+		ext["field"] = ge.field
+	}
+	return ext
+}
+
+// usdScalar is the GraphQL scalar for prices, which have the same string
+// form as in the REST API, e.g. "$3.46", and are parsed the same way.
+var usdScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "USD",
+	Description: `US dollars, as a string such as "$3.46" or "0.79".`,
+	Serialize: func(value interface{}) interface{} {
+		if d, ok := value.(types.USD); ok {
+			return d.String()
+		}
+		return nil
+	},
+	ParseValue: func(value interface{}) interface{} {
+		if s, ok := value.(string); ok {
+			return parseUSD(s)
+		}
+		return nil
+	},
+	ParseLiteral: func(valueAST ast.Value) interface{} {
+		if v, ok := valueAST.(*ast.StringValue); ok {
+			return parseUSD(v.Value)
+		}
+		return nil
+	},
+})
+
+// parseUSD parses a price for the USD scalar, returning nil if it is
+// invalid, which GraphQL reports as an invalid value.
+func parseUSD(s string) interface{} {
+	var d types.USD
+	if err := d.UnmarshalText([]byte(s)); err != nil {
+		return nil
+	}
+	return d
+}
+
+// newGraphQLSchema builds the GraphQL schema, with resolvers that dispatch
+// to the service.
+//
+// The queries list all of the items, look up a single item by its code,
+// or filter the items by category and tags, as the list endpoint does.
+// The mutations add and delete items, and report errors with the same
+// semantics as the REST API.  As with a REST add, each item added succeeds
+// or fails on its own, so the result of each is returned with its own HTTP
+// status code.
+func (a apiImpl) newGraphQLSchema() (graphql.Schema, error) {
+	localizedNameType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "LocalizedName",
+		Fields: graphql.Fields{
+			"lang": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	attributeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Attribute",
+		Fields: graphql.Fields{
+			"name":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"value": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	produceType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Produce",
+		Fields: graphql.Fields{
+			"code": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.String),
+				Description: "The name best matching the Accept-Language header.",
+				Resolve:     resolveName,
+			},
+			"unitPrice": &graphql.Field{Type: graphql.NewNonNull(usdScalar)},
+			"category": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if cat := p.Source.(types.Produce).Category; cat != "" {
+						return cat, nil
+					}
+					return nil, nil
+				},
+			},
+			"tags": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(graphql.String))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if tags := p.Source.(types.Produce).Tags; tags != nil {
+						return tags, nil
+					}
+					return []string{}, nil
+				},
+			},
+			"attributes": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(attributeType))),
+				Resolve: resolveAttributes,
+			},
+			"names": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(localizedNameType))),
+				Description: "The translations of the default name.",
+				Resolve:     resolveNames,
+			},
+		},
+	})
+	fieldErrorType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "FieldError",
+		Description: "A problem with a single field of an item.",
+		Fields: graphql.Fields{
+			"field":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"value":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"rule":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"message": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	addResultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "AddResult",
+		Fields: graphql.Fields{
+			"code":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"generated": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"statusCode": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return errorToStatusCode(p.Source.(service.AddResult).Err,
+						http.StatusCreated), nil
+				},
+			},
+			"error": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := p.Source.(service.AddResult).Err; err != nil {
+						return err.Error(), nil
+					}
+					return nil, nil
+				},
+			},
+			"fieldErrors": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(fieldErrorType))),
+				Description: "The problems with the fields of an invalid item.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if errs := fieldErrors(p.Source.(service.AddResult).Err); errs != nil {
+						return errs, nil
+					}
+					return types.FieldErrors{}, nil
+				},
+			},
+		},
+	})
+	localizedNameInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "LocalizedNameInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"lang": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String)},
+			"name": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	attributeInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "AttributeInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String)},
+			"value": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	produceInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "ProduceInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"code": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"name": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String)},
+			"unitPrice": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(usdScalar)},
+			"category": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"tags": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"attributes": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewList(graphql.NewNonNull(attributeInput)),
+				Description: "The values in their string form, as they are " +
+					"listed, which are converted to the types of the attributes."},
+			"names": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewList(graphql.NewNonNull(localizedNameInput))},
+		},
+	})
+
+	produceList := graphql.NewNonNull(graphql.NewList(
+		graphql.NewNonNull(produceType)))
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"allProduce": &graphql.Field{
+				Type:        produceList,
+				Description: "Lists all of the produce items.",
+				Resolve:     a.resolveAllProduce,
+			},
+			"produce": &graphql.Field{
+				Type:        produceType,
+				Description: "Looks up a produce item by its code.",
+				Args: graphql.FieldConfigArgument{
+					"code": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: a.resolveProduce,
+			},
+			"filterProduce": &graphql.Field{
+				Type: produceList,
+				Description: "Lists the produce items in the subtree of a " +
+					"category that carry all of the tags.",
+				Args: graphql.FieldConfigArgument{
+					"category": &graphql.ArgumentConfig{Type: graphql.String},
+					"tags": &graphql.ArgumentConfig{
+						Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+				},
+				Resolve: a.resolveFilterProduce,
+			},
+		},
+	})
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"addProduce": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(addResultType))),
+				Description: "Adds produce items, returning the result of each.",
+				Args: graphql.FieldConfigArgument{
+					"items": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.NewList(
+							graphql.NewNonNull(produceInput)))},
+				},
+				Resolve: a.resolveAddProduce,
+			},
+			"deleteProduce": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Deletes the produce item with the code.",
+				Args: graphql.FieldConfigArgument{
+					"code": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: a.resolveDeleteProduce,
+			},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	})
+}
+
+// maxGraphQLPeek limits how much of a GraphQL request graphQLMutation
+// reads.  A request that is any longer is taken to be a mutation.
+const maxGraphQLPeek = 1 << 20
+
+// graphQLMutation returns whether the request is to the GraphQL endpoint,
+// and would run a mutation, which is the operation it names, or without a
+// name, any of them, as otherwise it would fail.  The body is read to tell,
+// and then replaced, so the handler reads it as it was.  A body that isn't
+// a GraphQL request doesn't run anything, so it isn't a mutation.
+func graphQLMutation(r *http.Request) bool {
+	if r.Method != http.MethodPost ||
+		strings.TrimSuffix(r.URL.Path, "/") != graphqlURL || r.Body == nil {
+		return false
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxGraphQLPeek+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+	if err != nil || len(b) > maxGraphQLPeek {
+		return true
+	}
+
+	var req graphQLRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return false
+	}
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		return false
+	}
+	for _, v := range doc.Definitions {
+		op, ok := v.(*ast.OperationDefinition)
+		if !ok || op.Operation != ast.OperationTypeMutation {
+			continue
+		}
+		if req.OperationName == "" ||
+			(op.Name != nil && op.Name.Value == req.OperationName) {
+			return true
+		}
+	}
+	return false
+}
+
+// The GraphQL handler executes a query or mutation sent as JSON in a POST
+// body, and writes the result as JSON.  Errors from the service are
+// reported in the "errors" list of the result with HTTP 200, as GraphQL
+// does, but with the REST status in their extensions.  A body that isn't
+// a GraphQL request yields HTTP 400.
+func (a apiImpl) graphQLHandler(schema graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			defer r.Body.Close()
+		}
+		a.log.Debugw("handling GraphQL request", "url", r.URL.String())
+
+		if negotiate(r.Header.Get("Accept"), []string{mediaTypeJSON}) == "" {
+			writeNotAcceptable(w, r)
+			return
+		}
+		codec, _ := codecFor(mediaTypeJSON)
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			a.notifyInternalServerError(w, r, "error reading request body", err)
+			return
+		}
+		var req graphQLRequest
+		if err := json.Unmarshal(b, &req); err != nil || req.Query == "" {
+			if err == nil {
+				err = errors.New("no query in request")
+			}
+			a.writeEncoded(w, r, codec, http.StatusBadRequest,
+				&graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+			return
+		}
+
+		res := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			OperationName:  req.OperationName,
+			VariableValues: req.Variables,
+			Context:        r.Context(),
+			RootObject: map[string]interface{}{
+				"languages": parseAcceptLanguage(r.Header.Get("Accept-Language")),
+			},
+		})
+		w.Header().Set("Vary", "Accept, Accept-Language")
+		a.writeEncoded(w, r, codec, http.StatusOK, res)
+	}
+}
+
+// resolveAllProduce lists all of the produce items.
+func (a apiImpl) resolveAllProduce(p graphql.ResolveParams) (interface{},
+	error) {
+	items, err := a.service.ListAll(p.Context)
+	if err != nil {
+		return nil, a.graphQLError(err)
+	}
+	return items, nil
+}
+
+// resolveProduce looks up the produce item with the code, resolving to
+// null if there is none.
+func (a apiImpl) resolveProduce(p graphql.ResolveParams) (interface{},
+	error) {
+	item, err := a.service.Get(p.Context, p.Args["code"].(string))
+	if _, ok := err.(store.NotFoundError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, a.graphQLError(err)
+	}
+	return item, nil
+}
+
+// resolveFilterProduce lists the produce items matching the category and
+// tags.
+func (a apiImpl) resolveFilterProduce(p graphql.ResolveParams) (interface{},
+	error) {
+	var filter types.ProduceFilter
+	if cat, ok := p.Args["category"].(string); ok {
+		filter.Category = cat
+	}
+	filter.Tags = stringList(p.Args["tags"])
+	items, err := a.service.List(p.Context, filter)
+	if err != nil {
+		return nil, a.graphQLError(err)
+	}
+	return items, nil
+}
+
+// resolveAddProduce adds the produce items, returning the result of each.
+func (a apiImpl) resolveAddProduce(p graphql.ResolveParams) (interface{},
+	error) {
+	inputs, _ := p.Args["items"].([]interface{})
+	if len(inputs) == 0 {
+		return nil, a.graphQLError(service.FormatError{
+			Message: "at least one item must be specified to add"})
+	}
+	// The schema is needed to convert the attribute values from text.
+	defs, err := a.service.ListAttributes(p.Context)
+	if err != nil {
+		return nil, a.graphQLError(err)
+	}
+	schema := types.NewAttributeSchema(defs)
+	items := make([]types.Produce, len(inputs))
+	for i, v := range inputs {
+		items[i] = produceFromInput(v.(map[string]interface{}), schema)
+	}
+	addRes, err := a.service.Add(p.Context, items)
+	if err != nil {
+		return nil, a.graphQLError(err)
+	}
+	return addRes, nil
+}
+
+// resolveDeleteProduce deletes the produce item with the code.
+func (a apiImpl) resolveDeleteProduce(p graphql.ResolveParams) (interface{},
+	error) {
+	if err := a.service.Delete(p.Context, p.Args["code"].(string)); err != nil {
+		return nil, a.graphQLError(err)
+	}
+	return true, nil
+}
+
+// resolveName resolves the name of an item to the translation that best
+// matches the Accept-Language header, as the list endpoint does.
+func resolveName(p graphql.ResolveParams) (interface{}, error) {
+	var prefs []string
+	if root, ok := p.Info.RootValue.(map[string]interface{}); ok {
+		prefs, _ = root["languages"].([]string)
+	}
+	return matchName(p.Source.(types.Produce), prefs), nil
+}
+
+// resolveNames resolves the translations of an item's name, ordered by
+// language tag.
+func resolveNames(p graphql.ResolveParams) (interface{}, error) {
+	names := p.Source.(types.Produce).Names
+	res := make([]map[string]interface{}, 0, len(names))
+	for lang, name := range names {
+		res = append(res, map[string]interface{}{"lang": lang, "name": name})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i]["lang"].(string) < res[j]["lang"].(string)
+	})
+	return res, nil
+}
+
+// resolveAttributes resolves the attributes of an item, ordered by name,
+// with the values in their string form.
+func resolveAttributes(p graphql.ResolveParams) (interface{}, error) {
+	attrs := p.Source.(types.Produce).Attributes
+	res := make([]map[string]interface{}, 0, len(attrs))
+	for name, value := range attrs {
+		res = append(res, map[string]interface{}{"name": name,
+			"value": fmt.Sprint(value)})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i]["name"].(string) < res[j]["name"].(string)
+	})
+	return res, nil
+}
+
+// produceFromInput converts a ProduceInput argument to a produce item.
+// The values have already been checked against the GraphQL schema, and
+// the attribute values are converted according to the attribute schema.
+func produceFromInput(in map[string]interface{},
+	schema types.AttributeSchema) types.Produce {
+	var item types.Produce
+	item.Code, _ = in["code"].(string)
+	item.Name, _ = in["name"].(string)
+	item.UnitPrice, _ = in["unitPrice"].(types.USD)
+	item.Category, _ = in["category"].(string)
+	item.Tags = stringList(in["tags"])
+	if attrs, ok := in["attributes"].([]interface{}); ok {
+		item.Attributes = make(map[string]interface{}, len(attrs))
+		for _, v := range attrs {
+			attr := v.(map[string]interface{})
+			name := attr["name"].(string)
+			item.Attributes[name] = attributeFromText(schema, name,
+				attr["value"].(string))
+		}
+	}
+	if names, ok := in["names"].([]interface{}); ok {
+		item.Names = make(map[string]string, len(names))
+		for _, v := range names {
+			n := v.(map[string]interface{})
+			item.Names[n["lang"].(string)] = n["name"].(string)
+		}
+	}
+	return item
+}
+
+// stringList converts a list of strings argument, which may be absent.
+func stringList(arg interface{}) []string {
+	list, ok := arg.([]interface{})
+	if !ok {
+		return nil
+	}
+	res := make([]string, len(list))
+	for i, v := range list {
+		res[i] = v.(string)
+	}
+	return res
+}
+
+// graphQLError wraps an error from the service for a GraphQL response,
+// with the HTTP status it maps to.  As with the REST API, the details of
+// internal errors are logged rather than returned.
+func (a apiImpl) graphQLError(err error) error {
+	sc, problem, field := problemFor(err)
+	if sc == http.StatusInternalServerError {
+		a.log.Errorw("error resolving GraphQL field", "error", err)
+		err = errors.New("an unexpected error occurred")
+	}
+	return graphQLError{err: err, statusCode: sc, problem: problem,
+		field: field}
+}
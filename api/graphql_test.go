@@ -0,0 +1,269 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+func TestGraphQLEndpoint(t *testing.T) {
+	item := dfltProduce
+	item.Category = "Vegetables"
+	item.Tags = []string{"Leafy"}
+	item.Attributes = map[string]interface{}{"organic": true,
+		"deposit": types.USD(5)}
+	item.Names = map[string]string{"fr": "Laitue"}
+	existing := []types.Produce{item, secondProduce}
+
+	for i, v := range []struct {
+		body      string
+		lang      string
+		err       error
+		expStatus int
+		expBody   string
+	}{
+		{
+			body:      `{"query": "{ allProduce { code unitPrice } }"}`,
+			expStatus: http.StatusOK,
+			expBody: `{"data": {"allProduce": [` +
+				`{"code": "A12T-4GH7-QPL9-3N4M", "unitPrice": "$3.46"},` +
+				`{"code": "YRT6-72AS-K736-L4AR", "unitPrice": "$0.79"}]}}`,
+		},
+		{
+			body: `{"query": "{ produce(code: \"a12t-4gh7-qpl9-3n4m\") ` +
+				`{ name category tags attributes { name value } ` +
+				`names { lang name } } }"}`,
+			lang:      "fr-CA",
+			expStatus: http.StatusOK,
+			expBody: `{"data": {"produce": {"name": "Laitue", ` +
+				`"category": "Vegetables", "tags": ["Leafy"], "attributes": [` +
+				`{"name": "deposit", "value": "$0.05"}, ` +
+				`{"name": "organic", "value": "true"}], ` +
+				`"names": [{"lang": "fr", "name": "Laitue"}]}}}`,
+		},
+		{
+			body: `{"query": "query($code: String!) { produce(code: $code) ` +
+				`{ name category tags } }", ` +
+				`"variables": {"code": "YRT6-72AS-K736-L4AR"}}`,
+			expStatus: http.StatusOK,
+			expBody: `{"data": {"produce": {"name": "Green Pepper", ` +
+				`"category": null, "tags": []}}}`,
+		},
+		{
+			body:      `{"query": "{ produce(code: \"DRT6-72AS-K736-L4AR\") { name } }"}`,
+			expStatus: http.StatusOK,
+			expBody:   `{"data": {"produce": null}}`,
+		},
+		{
+			// List, lookup and filter in a single round trip.
+			body: `{"query": "{ produce(code: \"A12T-4GH7\") { name } ` +
+				`filterProduce(tags: [\"Leafy\"]) { code } }"}`,
+			expStatus: http.StatusOK,
+			expBody: `{"data": {"produce": null, "filterProduce": ` +
+				`[{"code": "A12T-4GH7-QPL9-3N4M"}]}, "errors": [{"message": ` +
+				`"invalid item format: invalid code: 'A12T-4GH7' (quartet: ` +
+				`expected four hyphen-separated groups of four letters or digits)", ` +
+				`"locations": [{"line": 1, "column": 3}], "path": ["produce"], ` +
+				`"extensions": {"code": "BAD_REQUEST", "status": 400, ` +
+				`"problem": "produce.invalid_code", "field": "code"}}]}`,
+		},
+		{
+			body: `{"query": "mutation { addProduce(items: [` +
+				`{code: \"A12T-4GH7-QPL9-3N4M\", name: \"Lettuce\", unitPrice: \"3.46\"}, ` +
+				`{name: \"Leek\", unitPrice: \"$1.25\", tags: [\"local\"], ` +
+				`names: [{lang: \"fr\", name: \"Poireau\"}]}]) ` +
+				`{ code generated statusCode error } }"}`,
+			expStatus: http.StatusOK,
+			expBody: `{"data": {"addProduce": [` +
+				`{"code": "A12T-4GH7-QPL9-3N4M", "generated": false, ` +
+				`"statusCode": 409, "error": "produce code 'Dup' already exists"}, ` +
+				`{"code": "GEN0-0000-0000-0001", "generated": true, ` +
+				`"statusCode": 201, "error": null}]}}`,
+		},
+		{
+			body: `{"query": "mutation { addProduce(items: [` +
+				`{name: \"Green-Pepper\", unitPrice: \"$0.79\"}]) ` +
+				`{ statusCode fieldErrors { field value rule message } } }"}`,
+			expStatus: http.StatusOK,
+			expBody: `{"data": {"addProduce": [{"statusCode": 400, "fieldErrors": ` +
+				`[{"field": "name", "value": "Green-Pepper", "rule": "name_pattern", ` +
+				`"message": "invalid name: 'Green-Pepper'"}]}]}}`,
+		},
+		{
+			body: `{"query": "mutation { addProduce(items: [{name: \"Leek\", ` +
+				`unitPrice: \"lots\"}]) { code } }"}`,
+			expStatus: http.StatusOK,
+			expBody: `{"data": null, "errors": [{"message": "Argument \"items\" ` +
+				`has invalid value [{name: \"Leek\", unitPrice: \"lots\"}].\n` +
+				`In element #1: In field \"unitPrice\": Expected type \"USD\", ` +
+				`found \"lots\".", "locations": [{"line": 1, "column": 30}]}]}`,
+		},
+		{
+			body:      `{"query": "mutation { deleteProduce(code: \"A12T-4GH7-QPL9-3N4M\") }"}`,
+			expStatus: http.StatusOK,
+			expBody:   `{"data": {"deleteProduce": true}}`,
+		},
+		{
+			body:      `{"query": "mutation { deleteProduce(code: \"A12T-4GH7-QPL9-3N4M\") }"}`,
+			err:       store.NotFoundError{Code: "A12T-4GH7-QPL9-3N4M"},
+			expStatus: http.StatusOK,
+			expBody: `{"data": null, "errors": [{"message": ` +
+				`"produce code 'A12T-4GH7-QPL9-3N4M' was not found", ` +
+				`"locations": [{"line": 1, "column": 12}], "path": ["deleteProduce"], ` +
+				`"extensions": {"code": "NOT_FOUND", "status": 404, ` +
+				`"problem": "produce.not_found"}}]}`,
+		},
+		{
+			// The details of internal errors aren't returned.
+			body:      `{"query": "{ allProduce { code } }"}`,
+			err:       service.InternalError{Message: "channel closed"},
+			expStatus: http.StatusOK,
+			expBody: `{"data": null, "errors": [{"message": ` +
+				`"an unexpected error occurred", ` +
+				`"locations": [{"line": 1, "column": 3}], "path": ["allProduce"], ` +
+				`"extensions": {"code": "INTERNAL_SERVER_ERROR", "status": 500, ` +
+				`"problem": "server.internal_error"}}]}`,
+		},
+		{
+			body:      `{"query": ""}`,
+			expStatus: http.StatusBadRequest,
+			expBody: `{"data": null, "errors": [{"message": "no query in request", ` +
+				`"locations": []}]}`,
+		},
+	} {
+		api := apiImpl{service: DummyService{existing: existing, err: v.err},
+			log: newLogger(t)}
+		schema, err := api.newGraphQLSchema()
+		if err != nil {
+			t.Fatalf("(%d) cannot create schema: %v", i, err)
+		}
+		req, err := http.NewRequest(http.MethodPost, graphqlURL,
+			strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Language", v.lang)
+		rr := httptest.NewRecorder()
+		api.graphQLHandler(schema).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+
+		// Compare the decoded bodies, so the formatting doesn't matter.
+		var res, exp interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatalf("(%d) cannot unmarshal response: %v", i, err)
+		}
+		if err := json.Unmarshal([]byte(v.expBody), &exp); err != nil {
+			t.Fatalf("(%d) cannot unmarshal expected body: %v", i, err)
+		}
+		if !reflect.DeepEqual(res, exp) {
+			t.Fatalf("(%d) unexpected body: %s", i, rr.Body.String())
+		}
+	}
+}
+
+func TestGraphQLAddAttributes(t *testing.T) {
+	// The attribute values are given as text, and converted to the types
+	// of the attributes before they are validated.
+	svc := service.New(store.New(), newLogger(t))
+	for _, v := range []types.AttributeDef{
+		{Name: "plu", Type: types.AttributeInt},
+		{Name: "organic", Type: types.AttributeBool},
+	} {
+		if err := svc.AddAttribute(context.Background(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := apiImpl{service: svc, log: newLogger(t)}
+	schema, err := api.newGraphQLSchema()
+	if err != nil {
+		t.Fatalf("cannot create schema: %v", err)
+	}
+
+	for i, v := range []struct {
+		body    string
+		expBody string
+	}{
+		{
+			body: `{"query": "mutation { addProduce(items: [` +
+				`{code: \"A12T-4GH7-QPL9-3N4M\", name: \"Lettuce\", ` +
+				`unitPrice: \"3.46\", attributes: [{name: \"PLU\", ` +
+				`value: \"4061\"}, {name: \"organic\", value: \"true\"}]}, ` +
+				`{name: \"Leek\", unitPrice: \"1.25\", ` +
+				`attributes: [{name: \"plu\", value: \"leek\"}]}]) ` +
+				`{ statusCode fieldErrors { field rule } } }"}`,
+			expBody: `{"data": {"addProduce": [` +
+				`{"statusCode": 201, "fieldErrors": []}, ` +
+				`{"statusCode": 400, "fieldErrors": ` +
+				`[{"field": "attributes.plu", "rule": "type"}]}]}}`,
+		},
+		{
+			body: `{"query": "{ produce(code: \"A12T-4GH7-QPL9-3N4M\") ` +
+				`{ attributes { name value } } }"}`,
+			expBody: `{"data": {"produce": {"attributes": [` +
+				`{"name": "organic", "value": "true"}, ` +
+				`{"name": "plu", "value": "4061"}]}}}`,
+		},
+	} {
+		req, err := http.NewRequest(http.MethodPost, graphqlURL,
+			strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		api.graphQLHandler(schema).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("(%d) handler returned wrong status code: %d", i, rr.Code)
+		}
+		var res, exp interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatalf("(%d) cannot unmarshal response: %v", i, err)
+		}
+		if err := json.Unmarshal([]byte(v.expBody), &exp); err != nil {
+			t.Fatalf("(%d) cannot unmarshal expected body: %v", i, err)
+		}
+		if !reflect.DeepEqual(res, exp) {
+			t.Fatalf("(%d) unexpected body: %s", i, rr.Body.String())
+		}
+	}
+}
+
+func TestGraphQLMethodAndAccept(t *testing.T) {
+	api := apiImpl{service: DummyService{}, log: newLogger(t)}
+	handler := newTestRouter(t, api)
+	for i, v := range []struct {
+		method    string
+		accept    string
+		expStatus int
+	}{
+		{method: http.MethodGet, expStatus: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, accept: "application/xml",
+			expStatus: http.StatusNotAcceptable},
+		{method: http.MethodPost, accept: "application/*",
+			expStatus: http.StatusOK},
+	} {
+		req, err := http.NewRequest(v.method, graphqlURL,
+			strings.NewReader(`{"query": "{ allProduce { code } }"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", v.accept)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+	}
+}
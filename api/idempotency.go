@@ -0,0 +1,274 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+)
+
+// IdempotencyKeyHeader is the request header with the key that makes an add
+// safe to retry, and IdempotentReplayedHeader is set on the responses that
+// are replayed for a retry.
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeyLen is the longest idempotency key accepted, which is
+// long enough for a UUID or a terminal's own transaction number.
+const maxIdempotencyKeyLen = 255
+
+// maxIdempotentBody is the largest add body accepted with an idempotency
+// key, as the whole body is read to hash it, and maxIdempotentResponse the
+// largest response kept for a key.
+const (
+	maxIdempotentBody     = 8 << 20
+	maxIdempotentResponse = 16 << 20
+)
+
+// perRequestHeaders are the response headers that belong to the request
+// that was answered, rather than to the response, so they aren't kept to be
+// replayed.
+var perRequestHeaders = []string{RequestIDHeader}
+
+// idempotencySweepInterval is how often the expired responses are removed.
+const idempotencySweepInterval = time.Minute
+
+// idempotentEntry is the state of an idempotency key: the hash of the
+// payload it was first used with, and once that request is done, its
+// response and when that expires.
+type idempotentEntry struct {
+	hash    string
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// IdempotencyStore keeps the responses to the adds made with idempotency
+// keys, for the TTL, so a retry with the same key gets the same response
+// rather than adding the items again.  The keys of each client are kept
+// apart, so clients can't see each other's responses.  It is safe for
+// concurrent use.
+type IdempotencyStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*idempotentEntry
+	lastSweep time.Time
+}
+
+// NewIdempotencyStore creates a store that keeps each response for the TTL.
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{ttl: ttl, now: time.Now,
+		entries: make(map[string]*idempotentEntry)}
+}
+
+// begin starts a request with the key and payload hash.  If the key was
+// used before with the same payload, its entry is returned, and if that
+// request is done, its response should be replayed.  Otherwise a new entry
+// is returned, for the caller to finish or abandon.  An error is returned
+// if the key was used with a different payload.
+func (is *IdempotencyStore) begin(key, hash string) (*idempotentEntry, bool,
+	error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	now := is.now()
+	if now.Sub(is.lastSweep) >= idempotencySweepInterval {
+		is.lastSweep = now
+		for k, v := range is.entries {
+			if v.done && !now.Before(v.expires) {
+				delete(is.entries, k)
+			}
+		}
+	}
+	if e := is.entries[key]; e != nil && (!e.done || now.Before(e.expires)) {
+		if e.hash != hash {
+			return nil, false, errors.New("the idempotency key was already " +
+				"used with a different payload")
+		}
+		return e, true, nil
+	}
+	e := &idempotentEntry{hash: hash}
+	is.entries[key] = e
+	return e, false, nil
+}
+
+// finish stores the response of the entry's request.
+func (is *IdempotencyStore) finish(e *idempotentEntry, status int,
+	header http.Header, body []byte) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	e.done, e.status, e.header, e.body = true, status, header, body
+	e.expires = is.now().Add(is.ttl)
+}
+
+// abandon forgets the entry, so the key may be used again.
+func (is *IdempotencyStore) abandon(key string, e *idempotentEntry) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.entries[key] == e {
+		delete(is.entries, key)
+	}
+}
+
+// validIdempotencyKey returns whether the key is short enough and made of
+// printable ASCII characters.
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	for _, c := range key {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// recordingWriter writes the response through, keeping a copy of its
+// status and body, unless the body grows past maxIdempotentResponse, when
+// it only notes that it overflowed.
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rw *recordingWriter) WriteHeader(sc int) {
+	if rw.status == 0 {
+		rw.status = sc
+	}
+	rw.ResponseWriter.WriteHeader(sc)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if !rw.overflow && rw.body.Len()+len(b) > maxIdempotentResponse {
+		rw.overflow = true
+		rw.body = bytes.Buffer{}
+	}
+	if !rw.overflow {
+		rw.body.Write(b)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Idempotent wraps the handler, so an add of produce items (a POST to
+// /v1/produce) with an Idempotency-Key header is only carried out once.
+// Its response, status, headers and body, is kept in the store, and
+// replayed, with the Idempotent-Replayed header, for a retry with the same
+// key and payload, which is matched by its SHA-256 hash.  A retry with a
+// different payload is rejected with HTTP 422 (Unprocessable Entity), and
+// one while the first is still in progress with HTTP 409 (Conflict).  A
+// body over maxIdempotentBody is rejected with HTTP 413 (Request Entity
+// Too Large).  Server errors, adds abandoned by their clients and
+// responses over maxIdempotentResponse aren't kept, so the add can be
+// retried.  It goes inside RequireAuth, so the keys are kept apart by the
+// credentials of the clients.
+func Idempotent(is *IdempotencyStore, next http.Handler,
+	log *zap.SugaredLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method != http.MethodPost ||
+			strings.TrimSuffix(r.URL.Path, "/") != produceURL {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeProblem(w, r, http.StatusBadRequest,
+				types.ProblemInvalidRequest, IdempotencyKeyHeader,
+				"the idempotency key must be 1 to 255 printable ASCII "+
+					"characters")
+			return
+		}
+		var b []byte
+		if r.Body != nil {
+			var err error
+			body := http.MaxBytesReader(w, r.Body, maxIdempotentBody)
+			b, err = ioutil.ReadAll(body)
+			if err != nil && len(b) >= maxIdempotentBody {
+				writeProblem(w, r, http.StatusRequestEntityTooLarge,
+					types.ProblemInvalidRequest, "",
+					"the body of an add with an idempotency key must be "+
+						"at most 8 MiB")
+				return
+			}
+			if err != nil {
+				log.Errorw("error reading request body", "error", err)
+				writeProblem(w, r, http.StatusInternalServerError,
+					types.ProblemInternal, "", "")
+				return
+			}
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		}
+		sum := sha256.Sum256(b)
+		hash := hex.EncodeToString(sum[:])
+
+		client := clientName(r)
+		scoped := client + "\x00" + key
+		e, found, err := is.begin(scoped, hash)
+		switch {
+		case err != nil:
+			log.Infow("idempotency key reused with a different payload",
+				"client", client, "key", key)
+			writeProblem(w, r, http.StatusUnprocessableEntity,
+				types.ProblemIdempotencyKeyReused, IdempotencyKeyHeader,
+				err.Error())
+			return
+		case found && !e.done:
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, r, http.StatusConflict,
+				types.ProblemIdempotencyBusy, IdempotencyKeyHeader,
+				"a request with the idempotency key is in progress")
+			return
+		case found:
+			log.Debugw("replaying response", "client", client, "key", key)
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set(RequestIDHeader, newRequestInfo(r).ID)
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		defer func() {
+			if rw.status == 0 || rw.status == statusClientClosedRequest ||
+				rw.status >= http.StatusInternalServerError {
+				is.abandon(scoped, e)
+				return
+			}
+			if rw.overflow {
+				log.Warnw("response too large to keep for idempotency key",
+					"client", client, "key", key)
+				is.abandon(scoped, e)
+				return
+			}
+			header := w.Header().Clone()
+			for _, v := range perRequestHeaders {
+				header.Del(v)
+			}
+			is.finish(e, rw.status, header, rw.body.Bytes())
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
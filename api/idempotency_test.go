@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+)
+
+func TestIdempotent(t *testing.T) {
+	is := NewIdempotencyStore(time.Hour)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	is.now = func() time.Time { return now }
+
+	calls := 0
+	var inFlight func()
+	handler := Idempotent(is, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		calls++
+		if inFlight != nil {
+			inFlight()
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		switch buf.String() {
+		case "fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case "conflict":
+			w.WriteHeader(http.StatusConflict)
+			return
+		case "large":
+			w.WriteHeader(http.StatusCreated)
+			w.Write(make([]byte, maxIdempotentResponse+1))
+			return
+		}
+		w.Header().Set(RequestIDHeader, r.Header.Get(RequestIDHeader))
+		w.Header().Set("Location", produceURL+"/A12T-4GH7-QPL9-3N4M")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created " + buf.String()))
+	}), newLogger(t))
+
+	for i, v := range []struct {
+		method    string
+		path      string
+		key       string
+		subject   string
+		body      string
+		advance   time.Duration
+		expStatus int
+		expBody   string
+		expReplay bool
+		expCalls  int
+	}{
+		// The first add is carried out, and replayed for a retry.
+		{key: "k1", body: "a", expStatus: http.StatusCreated,
+			expBody: "created a", expCalls: 1},
+		{key: "k1", body: "a", expStatus: http.StatusCreated,
+			expBody: "created a", expReplay: true},
+
+		// The key can't be used with another payload.
+		{key: "k1", body: "b", expStatus: http.StatusUnprocessableEntity},
+
+		// Other clients have their own keys.
+		{key: "k1", subject: "pos", body: "b", expStatus: http.StatusCreated,
+			expBody: "created b", expCalls: 1},
+
+		// Without a key, or for other requests, nothing is kept.
+		{body: "a", expStatus: http.StatusCreated, expCalls: 1},
+		{path: bulkURL, key: "k1", body: "a", expStatus: http.StatusCreated,
+			expCalls: 1},
+		{method: http.MethodDelete, key: "k1", body: "a",
+			expStatus: http.StatusCreated, expCalls: 1},
+
+		// Client errors are kept, but server errors aren't.
+		{key: "k2", body: "conflict", expStatus: http.StatusConflict,
+			expCalls: 1},
+		{key: "k2", body: "conflict", expStatus: http.StatusConflict,
+			expReplay: true},
+		{key: "k3", body: "fail", expStatus: http.StatusServiceUnavailable,
+			expCalls: 1},
+		{key: "k3", body: "b", expStatus: http.StatusCreated,
+			expBody: "created b", expCalls: 1},
+
+		// Bodies that are too large are rejected, and responses that are
+		// too large aren't kept.
+		{key: "k5", body: strings.Repeat("a", maxIdempotentBody+1),
+			expStatus: http.StatusRequestEntityTooLarge},
+		{key: "k6", body: "large", expStatus: http.StatusCreated,
+			expCalls: 1},
+		{key: "k6", body: "large", expStatus: http.StatusCreated,
+			expCalls: 1},
+
+		// Once the response expires, the key may be used again.
+		{key: "k1", body: "b", advance: time.Hour,
+			expStatus: http.StatusCreated, expBody: "created b", expCalls: 1},
+
+		{key: strings.Repeat("k", 256), body: "a",
+			expStatus: http.StatusBadRequest},
+		{key: "k\x01", body: "a", expStatus: http.StatusBadRequest},
+	} {
+		now = now.Add(v.advance)
+		method, path := http.MethodPost, produceURL
+		if v.method != "" {
+			method = v.method
+		}
+		if v.path != "" {
+			path = v.path
+		}
+		req, err := http.NewRequest(method, path, strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.7:5123"
+		reqID := fmt.Sprintf("req-%d", i)
+		req.Header.Set(RequestIDHeader, reqID)
+		if v.key != "" {
+			req.Header.Set(IdempotencyKeyHeader, v.key)
+		}
+		if v.subject != "" {
+			req = req.WithContext(reqctx.WithPrincipal(req.Context(),
+				reqctx.Principal{Subject: v.subject}))
+		}
+		before := calls
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if v.expBody != "" && rr.Body.String() != v.expBody {
+			t.Fatalf("(%d) unexpected body: %s", i, rr.Body.String())
+		}
+		if calls-before != v.expCalls {
+			t.Fatalf("(%d) unexpected calls: %d", i, calls-before)
+		}
+		if replayed := rr.Header().Get(IdempotentReplayedHeader) == "true"; replayed != v.expReplay {
+			t.Fatalf("(%d) unexpected replay: %t", i, replayed)
+		}
+		if v.expReplay && v.expStatus == http.StatusCreated &&
+			rr.Header().Get("Location") == "" {
+			t.Fatalf("(%d) the headers weren't replayed", i)
+		}
+		if v.expReplay && rr.Header().Get(RequestIDHeader) != reqID {
+			t.Fatalf("(%d) unexpected request ID: %s", i,
+				rr.Header().Get(RequestIDHeader))
+		}
+	}
+
+	// A retry while the first is in progress is rejected.
+	inFlight = func() {
+		inFlight = nil
+		req := httptest.NewRequest(http.MethodPost, produceURL,
+			strings.NewReader("c"))
+		req.Header.Set(IdempotencyKeyHeader, "k4")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusConflict || rr.Header().Get("Retry-After") != "1" {
+			t.Fatalf("unexpected response while in progress: %d", rr.Code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, produceURL,
+		strings.NewReader("c"))
+	req.Header.Set(IdempotencyKeyHeader, "k4")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %d", rr.Code)
+	}
+}
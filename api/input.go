@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+var (
+	// Whether the fields of the items to add that aren't known are
+	// reported as problems, rather than ignored.
+	inputLock     sync.RWMutex
+	rejectUnknown bool
+)
+
+// SetRejectUnknownFields sets whether the fields of the items to add that
+// aren't known, such as a misspelled "categroy", are reported as problems
+// with the items, rather than ignored, which is the default.
+func SetRejectUnknownFields(reject bool) {
+	inputLock.Lock()
+	defer inputLock.Unlock()
+	rejectUnknown = reject
+}
+
+// rejectUnknownFields returns whether unknown fields are rejected.
+func rejectUnknownFields() bool {
+	inputLock.RLock()
+	defer inputLock.RUnlock()
+	return rejectUnknown
+}
+
+// decodeInputs returns the items decoded for an add, along with the
+// problems found decoding each one, such as a price that can't be parsed.
+func decodeInputs(inputs []types.ProduceInput) ([]types.Produce,
+	[]types.FieldErrors) {
+	reject := rejectUnknownFields()
+	items := make([]types.Produce, len(inputs))
+	problems := make([]types.FieldErrors, len(inputs))
+	for i, v := range inputs {
+		items[i], problems[i] = v.Decode(reject)
+	}
+	return items, problems
+}
+
+// addItems adds the items, apart from those with problems found when they
+// were decoded, which are validated instead, so that all of their problems
+// are reported together.  The results are in the order of the items.
+func (a apiImpl) addItems(ctx context.Context, items []types.Produce,
+	problems []types.FieldErrors) ([]service.AddResult, error) {
+	var valid, invalid []types.Produce
+	var validIdx, invalidIdx []int
+	for i, v := range items {
+		if problems[i] == nil {
+			valid = append(valid, v)
+			validIdx = append(validIdx, i)
+		} else {
+			invalid = append(invalid, v)
+			invalidIdx = append(invalidIdx, i)
+		}
+	}
+
+	res := make([]service.AddResult, len(items))
+	if len(invalid) != 0 {
+		var invalidProblems []types.FieldErrors
+		for _, i := range invalidIdx {
+			invalidProblems = append(invalidProblems, problems[i])
+		}
+		verrs, err := a.validateItems(ctx, invalid, invalidProblems)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range invalidIdx {
+			res[i] = service.AddResult{Code: items[i].Code, Err: verrs[j]}
+		}
+	}
+	if len(valid) != 0 {
+		addRes, err := a.service.Add(ctx, valid)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range validIdx {
+			res[i] = addRes[j]
+		}
+	}
+	return res, nil
+}
+
+// validateItems validates the items without adding them, and returns the
+// error for each, which includes the problems found decoding it, if any.
+func (a apiImpl) validateItems(ctx context.Context, items []types.Produce,
+	problems []types.FieldErrors) ([]error, error) {
+	verrs, err := a.service.Validate(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	for i := range verrs {
+		verrs[i] = mergeProblems(verrs[i], problems[i])
+	}
+	return verrs, nil
+}
+
+// hasError returns whether any of the errors isn't nil.
+func hasError(errs []error) bool {
+	for _, v := range errs {
+		if v != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeProblems adds the problems found decoding an item to the error from
+// validating it.  If the item is otherwise valid, or its error isn't about
+// its fields, such as an unknown category, the problems take its place, as
+// the service would report the format of an item first.
+func mergeProblems(err error, problems types.FieldErrors) error {
+	if problems == nil {
+		return err
+	}
+	if errs := fieldErrors(err); errs != nil {
+		return service.NewFormatError(append(append(types.FieldErrors(nil),
+			errs...), problems...))
+	}
+	return service.NewFormatError(problems)
+}
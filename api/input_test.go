@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+func TestAddFieldErrors(t *testing.T) {
+	defer SetRejectUnknownFields(false)
+	for i, v := range []struct {
+		body          string
+		rejectUnknown bool
+		expStatus     int
+		expErrs       types.FieldErrors
+	}{
+		{
+			body:      `{"code": "A12T-4GH7-QPL9-3N4M", "name": "Lettuce", "unit_price": "$3.46", "colour": "green"}`,
+			expStatus: http.StatusCreated,
+		},
+		{
+			// Every problem with the item is reported, including the price.
+			body:      `{"code": "DRT6-72AS-K736-L4AR", "name": "Green-Pepper", "unit_price": "cheap", "tags": ["!"]}`,
+			expStatus: http.StatusBadRequest,
+			expErrs: types.FieldErrors{
+				badNameErrors[0],
+				{Field: "tags[0]", Value: "!", Rule: types.RuleNamePattern,
+					Message: "invalid tag: '!'"},
+				{Field: "unit_price", Value: "cheap", Rule: types.RulePriceFormat,
+					Message: "invalid unit price: 'cheap'"},
+			},
+		},
+		{
+			body:          `{"code": "A12T-4GH7-QPL9-3N4M", "name": "Lettuce", "unit_price": "$3.46", "colour": "green"}`,
+			rejectUnknown: true,
+			expStatus:     http.StatusBadRequest,
+			expErrs: types.FieldErrors{{Field: "colour",
+				Rule: types.RuleUnknownField, Message: "unknown field: 'colour'"}},
+		},
+	} {
+		SetRejectUnknownFields(v.rejectUnknown)
+		api := apiImpl{service: DummyService{}, log: newLogger(t)}
+		req, err := http.NewRequest(http.MethodPost, produceURL,
+			strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		newTestRouter(t, api).ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code,
+				v.expStatus)
+		}
+		if v.expErrs == nil {
+			continue
+		}
+		p := decodeProblem(t, rr)
+		if !reflect.DeepEqual(p.Errors, v.expErrs) {
+			t.Fatalf("(%d) unexpected field errors: %+v", i, p.Errors)
+		}
+		if p.Detail != "invalid item format: "+v.expErrs.Error() {
+			t.Fatalf("(%d) unexpected detail: '%s'", i, p.Detail)
+		}
+	}
+}
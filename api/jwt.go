@@ -0,0 +1,405 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+)
+
+// The signing algorithms accepted for bearer tokens.
+const (
+	algHS256 = "HS256"
+	algRS256 = "RS256"
+)
+
+// defaultRolesClaim is the claim holding the roles of the subject, if the
+// configuration doesn't name another.
+const defaultRolesClaim = "roles"
+
+// TokenConfig configures the validation of JWT bearer tokens.  At least
+// one key must be given, through the secret, the PEM file or the JWKS file.
+type TokenConfig struct {
+	// Secret is the shared secret for HS256 tokens.
+	Secret string
+
+	// PublicKeyFile holds one or more RSA public keys for RS256 tokens, in
+	// PEM form.
+	PublicKeyFile string
+
+	// JWKSFile holds a JSON Web Key Set, with "RSA" keys for RS256 tokens
+	// and "oct" keys for HS256 tokens.  The "kid" of a token picks the key
+	// with the same ID, if there is one.
+	JWKSFile string
+
+	// Issuer and Audience, if set, must match the "iss" claim and one of
+	// the "aud" claims.
+	Issuer   string
+	Audience string
+
+	// RolesClaim is the claim listing the roles, as an array or a
+	// space-separated string, "roles" if empty.
+	RolesClaim string
+
+	// Leeway allows for clock skew when checking the expiry and
+	// not-before times.
+	Leeway time.Duration
+}
+
+// tokenKey is a key that may have signed a token.
+type tokenKey struct {
+	id     string
+	alg    string
+	secret []byte
+	rsa    *rsa.PublicKey
+}
+
+// TokenVerifier validates JWT bearer tokens signed with HS256 or RS256,
+// checking the signature, expiry, issuer and audience, and returns the
+// subject and roles they carry.  It is safe for concurrent use.
+type TokenVerifier struct {
+	cfg TokenConfig
+
+	mu   sync.RWMutex
+	keys []tokenKey
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the registered claims that are checked.  The times are
+// numbers of seconds, which may have a fraction.
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// jsonWebKey is a key of a JWKS file.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+// NewTokenVerifier creates a verifier with the keys in the configuration.
+func NewTokenVerifier(cfg TokenConfig) (*TokenVerifier, error) {
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = defaultRolesClaim
+	}
+	tv := &TokenVerifier{cfg: cfg}
+	if err := tv.Reload(); err != nil {
+		return nil, err
+	}
+	return tv, nil
+}
+
+// Reload reads the key files again, so the keys may be rotated without a
+// restart.  If the keys can't be read, the current ones are kept.
+func (tv *TokenVerifier) Reload() error {
+	var keys []tokenKey
+	if tv.cfg.Secret != "" {
+		keys = append(keys, tokenKey{alg: algHS256,
+			secret: []byte(tv.cfg.Secret)})
+	}
+	if tv.cfg.PublicKeyFile != "" {
+		b, err := ioutil.ReadFile(tv.cfg.PublicKeyFile)
+		if err != nil {
+			return err
+		}
+		pks, err := parsePublicKeys(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", tv.cfg.PublicKeyFile, err)
+		}
+		keys = append(keys, pks...)
+	}
+	if tv.cfg.JWKSFile != "" {
+		b, err := ioutil.ReadFile(tv.cfg.JWKSFile)
+		if err != nil {
+			return err
+		}
+		jks, err := parseJWKS(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", tv.cfg.JWKSFile, err)
+		}
+		keys = append(keys, jks...)
+	}
+	if len(keys) == 0 {
+		return errors.New("no keys for verifying tokens")
+	}
+
+	tv.mu.Lock()
+	tv.keys = keys
+	tv.mu.Unlock()
+	return nil
+}
+
+// Verify validates the token and returns the principal it identifies.  The
+// error describes why a token isn't valid.
+func (tv *TokenVerifier) Verify(token string) (reqctx.Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return reqctx.Principal{}, errors.New("malformed token")
+	}
+	var hdr jwtHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return reqctx.Principal{}, fmt.Errorf("malformed token header: %v", err)
+	}
+	if hdr.Alg != algHS256 && hdr.Alg != algRS256 {
+		return reqctx.Principal{}, fmt.Errorf("unsupported algorithm '%s'",
+			hdr.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return reqctx.Principal{}, errors.New("malformed token signature")
+	}
+	if !tv.checkSignature(hdr, parts[0]+"."+parts[1], sig) {
+		return reqctx.Principal{}, errors.New("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return reqctx.Principal{}, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := tv.checkClaims(claims); err != nil {
+		return reqctx.Principal{}, err
+	}
+	var all map[string]json.RawMessage
+	if err := decodeSegment(parts[1], &all); err != nil {
+		return reqctx.Principal{}, fmt.Errorf("malformed token claims: %v", err)
+	}
+	roles, err := parseRoles(all[tv.cfg.RolesClaim])
+	if err != nil {
+		return reqctx.Principal{}, fmt.Errorf("invalid '%s' claim",
+			tv.cfg.RolesClaim)
+	}
+	return reqctx.Principal{Subject: claims.Subject, Roles: roles,
+		Scheme: reqctx.SchemeBearer}, nil
+}
+
+// checkSignature returns whether the signature of the signed part is
+// valid for one of the keys of the algorithm.  If the token names a key
+// that is known, only that key is tried.
+func (tv *TokenVerifier) checkSignature(hdr jwtHeader, signed string,
+	sig []byte) bool {
+	tv.mu.RLock()
+	defer tv.mu.RUnlock()
+
+	named := false
+	for _, k := range tv.keys {
+		named = named || (hdr.Kid != "" && k.id == hdr.Kid)
+	}
+	digest := sha256.Sum256([]byte(signed))
+	for _, k := range tv.keys {
+		if k.alg != hdr.Alg || (named && k.id != hdr.Kid) {
+			continue
+		}
+		switch k.alg {
+		case algHS256:
+			mac := hmac.New(sha256.New, k.secret)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return true
+			}
+		case algRS256:
+			if rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, digest[:], sig) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkClaims checks the subject, times, issuer and audience of a token.
+func (tv *TokenVerifier) checkClaims(claims jwtClaims) error {
+	if claims.Subject == "" {
+		return errors.New("token has no subject")
+	}
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.After(unixTime(*claims.ExpiresAt).Add(tv.cfg.Leeway)) {
+		return errors.New("token has expired")
+	}
+	if claims.NotBefore != nil &&
+		now.Add(tv.cfg.Leeway).Before(unixTime(*claims.NotBefore)) {
+		return errors.New("token is not valid yet")
+	}
+	if tv.cfg.Issuer != "" && claims.Issuer != tv.cfg.Issuer {
+		return fmt.Errorf("token issuer '%s' is not accepted", claims.Issuer)
+	}
+	if tv.cfg.Audience != "" {
+		aud, err := parseStrings(claims.Audience)
+		if err != nil {
+			return errors.New("invalid 'aud' claim")
+		}
+		found := false
+		for _, v := range aud {
+			found = found || v == tv.cfg.Audience
+		}
+		if !found {
+			return errors.New("token is not for this audience")
+		}
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a token.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// unixTime converts a JWT time, in seconds, to a time.
+func unixTime(secs float64) time.Time {
+	return time.Unix(0, int64(secs*float64(time.Second)))
+}
+
+// parseStrings parses a claim that is either a string or an array of them.
+func parseStrings(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []string{s}, nil
+	}
+	var ss []string
+	if err := json.Unmarshal(raw, &ss); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// parseRoles parses the roles claim, which is an array of roles or a
+// space-separated string of them.  Only a string is split, so each element
+// of an array is taken as one role, whatever it holds.  Roles the service
+// doesn't know are dropped.
+func parseRoles(raw json.RawMessage) ([]reqctx.Role, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var ss []string
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		ss = strings.Fields(s)
+	} else if err := json.Unmarshal(raw, &ss); err != nil {
+		return nil, err
+	}
+	var roles []reqctx.Role
+	for _, v := range ss {
+		if r := reqctx.Role(strings.ToLower(v)); r.Known() {
+			roles = append(roles, r)
+		}
+	}
+	return roles, nil
+}
+
+// parsePublicKeys parses the RSA public keys in PEM form, either as
+// "PUBLIC KEY" or "RSA PUBLIC KEY" blocks.
+func parsePublicKeys(b []byte) ([]tokenKey, error) {
+	var keys []tokenKey
+	for {
+		var blk *pem.Block
+		blk, b = pem.Decode(b)
+		if blk == nil {
+			break
+		}
+		var pub interface{}
+		var err error
+		switch blk.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(blk.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(blk.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rk, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+		keys = append(keys, tokenKey{alg: algRS256, rsa: rk})
+	}
+	if len(bytes.TrimSpace(b)) != 0 || len(keys) == 0 {
+		return nil, errors.New("no valid PEM public keys")
+	}
+	return keys, nil
+}
+
+// parseJWKS parses the RSA and symmetric keys of a JSON Web Key Set.  Keys
+// of other types, and those not for signatures, are skipped.
+func parseJWKS(b []byte) ([]tokenKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	var keys []tokenKey
+	for i, v := range set.Keys {
+		if v.Use != "" && v.Use != "sig" {
+			continue
+		}
+		switch v.Kty {
+		case "RSA":
+			if v.Alg != "" && v.Alg != algRS256 {
+				continue
+			}
+			n, err := base64.RawURLEncoding.DecodeString(v.N)
+			if err != nil || len(n) == 0 {
+				return nil, fmt.Errorf("key %d: invalid modulus", i)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(v.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("key %d: invalid exponent", i)
+			}
+			keys = append(keys, tokenKey{id: v.Kid, alg: algRS256,
+				rsa: &rsa.PublicKey{N: new(big.Int).SetBytes(n),
+					E: int(new(big.Int).SetBytes(e).Int64())}})
+		case "oct":
+			if v.Alg != "" && v.Alg != algHS256 {
+				continue
+			}
+			k, err := base64.RawURLEncoding.DecodeString(v.K)
+			if err != nil || len(k) == 0 {
+				return nil, fmt.Errorf("key %d: invalid secret", i)
+			}
+			keys = append(keys, tokenKey{id: v.Kid, alg: algHS256, secret: k})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,394 @@
+package api
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+)
+
+// signToken makes a token with the header and claims, signed with the
+// HMAC secret or the RSA key, whichever is given.
+func signToken(t *testing.T, hdr, claims map[string]interface{},
+	secret []byte, key *rsa.PrivateKey) string {
+	enc := base64.RawURLEncoding
+	h, err := json.Marshal(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	var sig []byte
+	if key != nil {
+		digest := sha256.Sum256([]byte(signed))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256,
+			digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// claimsWith returns valid claims for the subject, with the changes.
+func claimsWith(changes map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":   "alice",
+		"iss":   "https://sso.example.com",
+		"aud":   "produce",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": []string{"editor"},
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestTokenVerifier(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{
+		Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The JWKS has another RSA key and an HMAC key, picked by their IDs.
+	jwksKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": "%s", "e": "%s"},
+		{"kty": "oct", "kid": "oct1", "alg": "HS256", "k": "%s"},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": "", "y": ""}]}`,
+		enc.EncodeToString(jwksKey.N.Bytes()),
+		enc.EncodeToString(big.NewInt(int64(jwksKey.E)).Bytes()),
+		enc.EncodeToString([]byte("jwks-s3cret")))
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tv, err := NewTokenVerifier(TokenConfig{
+		Secret:        "s3cret",
+		PublicKeyFile: pemFile,
+		JWKSFile:      jwksFile,
+		Issuer:        "https://sso.example.com",
+		Audience:      "produce",
+		Leeway:        time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("cannot create verifier: %v", err)
+	}
+
+	hs := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rs := map[string]interface{}{"alg": "RS256", "typ": "JWT"}
+	secret := []byte("s3cret")
+	past := time.Now().Add(-time.Hour).Unix()
+	future := time.Now().Add(time.Hour).Unix()
+	for i, v := range []struct {
+		token    string
+		expRoles []reqctx.Role
+		expErr   string
+	}{
+		{
+			token:    signToken(t, hs, claimsWith(nil), secret, nil),
+			expRoles: []reqctx.Role{reqctx.RoleEditor},
+		},
+		{
+			token: signToken(t, rs, claimsWith(map[string]interface{}{
+				"roles": "viewer Admin auditor"}), nil, rsaKey),
+			expRoles: []reqctx.Role{reqctx.RoleViewer, reqctx.RoleAdmin},
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"roles": []string{"Viewer", "admin"}}), secret, nil),
+			expRoles: []reqctx.Role{reqctx.RoleViewer, reqctx.RoleAdmin},
+		},
+		{
+			// The elements of an array aren't split.
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"roles": []string{"admin editor"}}), secret, nil),
+		},
+		{
+			token: signToken(t, map[string]interface{}{"alg": "RS256",
+				"kid": "rsa1"}, claimsWith(map[string]interface{}{
+				"aud": []string{"billing", "produce"}}), nil, jwksKey),
+			expRoles: []reqctx.Role{reqctx.RoleEditor},
+		},
+		{
+			token: signToken(t, map[string]interface{}{"alg": "HS256",
+				"kid": "oct1"}, claimsWith(map[string]interface{}{
+				"roles": nil}), []byte("jwks-s3cret"), nil),
+		},
+		{
+			token: signToken(t, map[string]interface{}{"alg": "HS256",
+				"kid": "oct1"}, claimsWith(nil), secret, nil),
+			expErr: "invalid token signature",
+		},
+		{
+			token:  signToken(t, hs, claimsWith(nil), []byte("guess"), nil),
+			expErr: "invalid token signature",
+		},
+		{
+			// An RSA public key is never used as an HMAC secret.
+			token:  signToken(t, hs, claimsWith(nil), der, nil),
+			expErr: "invalid token signature",
+		},
+		{
+			token: strings.TrimSuffix(signToken(t, map[string]interface{}{
+				"alg": "none"}, claimsWith(nil), secret, nil), "x"),
+			expErr: "unsupported algorithm 'none'",
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"exp": past}), secret, nil),
+			expErr: "token has expired",
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"exp": time.Now().Add(-30 * time.Second).Unix()}), secret, nil),
+			expRoles: []reqctx.Role{reqctx.RoleEditor},
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"exp": nil}), secret, nil),
+			expErr: "token has no expiry",
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"nbf": future}), secret, nil),
+			expErr: "token is not valid yet",
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"iss": "https://evil.example.com"}), secret, nil),
+			expErr: "token issuer 'https://evil.example.com' is not accepted",
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"aud": []string{"billing"}}), secret, nil),
+			expErr: "token is not for this audience",
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"sub": ""}), secret, nil),
+			expErr: "token has no subject",
+		},
+		{
+			token: signToken(t, hs, claimsWith(map[string]interface{}{
+				"roles": 7}), secret, nil),
+			expErr: "invalid 'roles' claim",
+		},
+		{token: "a.b", expErr: "malformed token"},
+		{token: "!!.e30.", expErr: "malformed token header"},
+	} {
+		p, err := tv.Verify(v.token)
+		if v.expErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), v.expErr) {
+				t.Fatalf("(%d) expected error '%s', got %v", i, v.expErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+		exp := reqctx.Principal{Subject: "alice", Roles: v.expRoles,
+			Scheme: reqctx.SchemeBearer}
+		if !reflect.DeepEqual(p, exp) {
+			t.Fatalf("(%d) unexpected principal: %+v", i, p)
+		}
+	}
+
+	for i, v := range []TokenConfig{
+		{},
+		{PublicKeyFile: filepath.Join(dir, "missing.pem")},
+		{PublicKeyFile: jwksFile},
+		{JWKSFile: pemFile},
+		{JWKSFile: writeFile(t, dir, `{"keys": [{"kty": "EC"}]}`)},
+	} {
+		if _, err := NewTokenVerifier(v); err == nil {
+			t.Fatalf("(%d) expected error", i)
+		}
+	}
+}
+
+func TestRequireAuthWithTokens(t *testing.T) {
+	ks, err := NewKeyStore("", "ops:0p3r4t0r")
+	if err != nil {
+		t.Fatalf("cannot load keys: %v", err)
+	}
+	tv, err := NewTokenVerifier(TokenConfig{Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("cannot create verifier: %v", err)
+	}
+	var subject, body string
+	handler := RequireAuth(Authenticator{Keys: ks, Tokens: tv},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := reqctx.PrincipalFromContext(r.Context())
+			subject = p.Subject
+			b, _ := ioutil.ReadAll(r.Body)
+			body = string(b)
+			w.WriteHeader(http.StatusTeapot)
+		}), newLogger(t))
+
+	hs := map[string]interface{}{"alg": "HS256"}
+	secret := []byte("s3cret")
+	token := func(roles ...string) string {
+		return signToken(t, hs, claimsWith(map[string]interface{}{
+			"roles": roles}), secret, nil)
+	}
+	query := `{"query": "{ allProduce { code } }"}`
+	mutation := `{"query": "mutation { ` +
+		`deleteProduce(code: \"A12T-4GH7-QPL9-3N4M\") }"}`
+	named := `{"query": "query q { allProduce { code } } ` +
+		`mutation m { deleteProduce(code: \"A12T-4GH7-QPL9-3N4M\") }", ` +
+		`"operationName": "%s"}`
+	for i, v := range []struct {
+		method     string
+		url        string
+		body       string
+		token      string
+		key        string
+		expStatus  int
+		expSubject string
+		expDetail  string
+	}{
+		{method: http.MethodGet, url: statusURL, expStatus: http.StatusTeapot},
+		{method: http.MethodGet, url: openAPIURL, expStatus: http.StatusTeapot},
+		{
+			method: http.MethodGet, url: produceURL,
+			expStatus: http.StatusUnauthorized,
+			expDetail: "an API key or bearer token is required",
+		},
+		{method: http.MethodGet, url: produceURL, token: token("viewer"),
+			expStatus: http.StatusTeapot, expSubject: "alice"},
+		{method: http.MethodGet, url: produceURL, token: token(),
+			expStatus: http.StatusForbidden},
+		{
+			method: http.MethodPost, url: produceURL, token: token("viewer"),
+			expStatus: http.StatusForbidden,
+			expDetail: "the 'editor' role is required",
+		},
+		{method: http.MethodPost, url: produceURL, token: token("editor"),
+			expStatus: http.StatusTeapot, expSubject: "alice"},
+		{method: http.MethodDelete, url: produceURL + "/A12T-4GH7-QPL9-3N4M",
+			token: token("admin"), expStatus: http.StatusTeapot,
+			expSubject: "alice"},
+		{method: http.MethodGet, url: resetURL, token: token("editor"),
+			expStatus: http.StatusForbidden},
+		{method: http.MethodGet, url: resetURL, token: token("admin"),
+			expStatus: http.StatusTeapot, expSubject: "alice"},
+		{method: http.MethodGet, url: resetURL, key: "0p3r4t0r",
+			expStatus: http.StatusTeapot, expSubject: "ops"},
+		{method: http.MethodGet, url: statusURL, token: "junk",
+			expStatus: http.StatusUnauthorized},
+		// A GraphQL query needs a viewer, and a mutation an editor.
+		{method: http.MethodPost, url: graphqlURL, body: query,
+			token: token("viewer"), expStatus: http.StatusTeapot,
+			expSubject: "alice"},
+		{method: http.MethodPost, url: graphqlURL, body: query,
+			expStatus: http.StatusUnauthorized},
+		{
+			method: http.MethodPost, url: graphqlURL, body: mutation,
+			token: token("viewer"), expStatus: http.StatusForbidden,
+			expDetail: "the 'editor' role is required",
+		},
+		{method: http.MethodPost, url: graphqlURL, body: mutation,
+			token: token("editor"), expStatus: http.StatusTeapot,
+			expSubject: "alice"},
+		{method: http.MethodPost, url: graphqlURL,
+			body: fmt.Sprintf(named, "q"), token: token("viewer"),
+			expStatus: http.StatusTeapot, expSubject: "alice"},
+		{method: http.MethodPost, url: graphqlURL,
+			body: fmt.Sprintf(named, "m"), token: token("viewer"),
+			expStatus: http.StatusForbidden},
+		{method: http.MethodPost, url: graphqlURL,
+			body: fmt.Sprintf(named, ""), token: token("viewer"),
+			expStatus: http.StatusForbidden},
+		{method: http.MethodPost, url: graphqlURL, body: "junk",
+			token: token("viewer"), expStatus: http.StatusTeapot,
+			expSubject: "alice"},
+	} {
+		req, err := http.NewRequest(v.method, v.url,
+			strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.token != "" {
+			req.Header.Set("Authorization", "Bearer "+v.token)
+		}
+		req.Header.Set(APIKeyHeader, v.key)
+		subject = ""
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if subject != v.expSubject {
+			t.Fatalf("(%d) unexpected subject: '%s'", i, subject)
+		}
+		if v.expStatus == http.StatusTeapot && body != v.body {
+			t.Fatalf("(%d) unexpected body: '%s'", i, body)
+		}
+		if v.expDetail != "" && decodeProblem(t, rr).Detail != v.expDetail {
+			t.Fatalf("(%d) unexpected body: %s", i, rr.Body.String())
+		}
+		if v.expStatus == http.StatusUnauthorized &&
+			len(rr.Header()["Www-Authenticate"]) != 2 {
+			t.Fatalf("(%d) unexpected challenges: %v", i,
+				rr.Header()["Www-Authenticate"])
+		}
+	}
+}
+
+// writeFile writes the contents to a new file in the directory.
+func writeFile(t *testing.T, dir, contents string) string {
+	f, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// langPref is a single language range from an Accept-Language header,
+// along with its quality value.
+type langPref struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage parses an Accept-Language header (RFC 7231) into
+// the list of acceptable language ranges, ordered by decreasing quality.
+// Ranges with quality zero, or that are malformed, are dropped.  Ranges
+// of equal quality keep the order they were listed in.
+func parseAcceptLanguage(header string) []string {
+	var prefs []langPref
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				v, err := strconv.ParseFloat(f[2:], 64)
+				if err != nil || v < 0 || v > 1 {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if q == 0 {
+			continue
+		}
+		if tag != "*" {
+			var ok bool
+			if tag, ok = types.ValidateAndConvertLanguageTag(tag); !ok {
+				continue
+			}
+		}
+		prefs = append(prefs, langPref{tag: tag, q: q})
+	}
+	sort.SliceStable(prefs, func(i, j int) bool {
+		return prefs[i].q > prefs[j].q
+	})
+
+	res := make([]string, len(prefs))
+	for i, v := range prefs {
+		res[i] = v.tag
+	}
+	return res
+}
+
+// matchName picks the localized name that best matches the language
+// preferences.  For each preference in turn, an exact match is tried
+// first, then the preference is progressively truncated as per the
+// RFC 4647 lookup scheme (so "fr-CA" matches "fr"), and finally a more
+// specific name is accepted (so "fr" matches "fr-CA").  A "*" preference,
+// or no match at all, selects the default name.
+func matchName(item types.Produce, prefs []string) string {
+	if len(item.Names) == 0 {
+		return item.Name
+	}
+	for _, pref := range prefs {
+		if pref == "*" {
+			return item.Name
+		}
+		for tag := pref; tag != ""; {
+			if name, ok := item.Names[tag]; ok {
+				return name
+			}
+			ndx := strings.LastIndex(tag, "-")
+			if ndx == -1 {
+				break
+			}
+			tag = tag[:ndx]
+		}
+
+		// Use the lowest sorted of the more specific tags, so the choice
+		// doesn't depend on map ordering.
+		var best string
+		for tag := range item.Names {
+			if strings.HasPrefix(tag, pref+"-") && (best == "" || tag < best) {
+				best = tag
+			}
+		}
+		if best != "" {
+			return item.Names[best]
+		}
+	}
+	return item.Name
+}
+
+// localizeNames replaces the name of each item with the one that best
+// matches the language preferences, and removes the translations from
+// the result.  When all names are requested, the items are left as they
+// are, so the client gets both the default name and all translations.
+func localizeNames(items []types.Produce, prefs []string, allNames bool) {
+	if allNames {
+		return
+	}
+	for i := range items {
+		items[i].Name = matchName(items[i], prefs)
+		items[i].Names = nil
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	for i, v := range []struct {
+		header   string
+		expected []string
+	}{
+		{
+			header:   "",
+			expected: []string{},
+		},
+		{
+			header:   "fr-ca, en;q=0.8",
+			expected: []string{"fr-CA", "en"},
+		},
+		{
+			header:   "en;q=0.5, fr;q=0.9, de, *;q=0.1",
+			expected: []string{"de", "fr", "en", "*"},
+		},
+		{
+			header:   "en;q=0, fr;q=bad, zh-hant-tw, !!",
+			expected: []string{"zh-Hant-TW"},
+		},
+	} {
+		prefs := parseAcceptLanguage(v.header)
+		if !reflect.DeepEqual(prefs, v.expected) {
+			t.Fatalf("(%d) unexpected preferences: %v", i, prefs)
+		}
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	item := types.Produce{
+		Name: "Gala Apple",
+		Names: map[string]string{
+			"fr":    "Pomme Gala",
+			"fr-CA": "Pomme Gala Du Québec",
+			"es-MX": "Manzana Gala",
+		},
+	}
+	for i, v := range []struct {
+		prefs    []string
+		expected string
+	}{
+		{
+			prefs:    nil,
+			expected: "Gala Apple",
+		},
+		{
+			prefs:    []string{"fr-CA"},
+			expected: "Pomme Gala Du Québec",
+		},
+		{
+			prefs:    []string{"fr-BE"},
+			expected: "Pomme Gala",
+		},
+		{
+			prefs:    []string{"es"},
+			expected: "Manzana Gala",
+		},
+		{
+			prefs:    []string{"de", "*", "fr"},
+			expected: "Gala Apple",
+		},
+		{
+			prefs:    []string{"de", "es-MX"},
+			expected: "Manzana Gala",
+		},
+	} {
+		if name := matchName(item, v.prefs); name != v.expected {
+			t.Fatalf("(%d) unexpected name: %s", i, name)
+		}
+	}
+}
+
+func TestLocalizedListEndpoint(t *testing.T) {
+	gala := types.Produce{Code: "TQ4C-VV6T-75ZX-1RMR", Name: "Gala Apple",
+		UnitPrice: 359, Names: map[string]string{"fr": "Pomme Gala"}}
+	for i, v := range []struct {
+		url      string
+		language string
+		expName  string
+		expNames map[string]string
+	}{
+		{
+			url:     produceURL,
+			expName: "Gala Apple",
+		},
+		{
+			url:      produceURL,
+			language: "fr-CA,en;q=0.5",
+			expName:  "Pomme Gala",
+		},
+		{
+			url:      produceURL + "?all_names=true",
+			language: "fr-CA,en;q=0.5",
+			expName:  "Gala Apple",
+			expNames: map[string]string{"fr": "Pomme Gala"},
+		},
+	} {
+		d := DummyService{existing: []types.Produce{gala}}
+		api := apiImpl{service: d, log: newLogger(t)}
+		rr := httptest.NewRecorder()
+		handler := newTestRouter(t, api)
+
+		req, err := http.NewRequest(http.MethodGet, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.language != "" {
+			req.Header.Set("Accept-Language", v.language)
+		}
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, http.StatusOK)
+		}
+		var ap types.ProduceListResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &ap); err != nil {
+			t.Fatal(err)
+		}
+		if len(ap) != 1 || ap[0].Name != v.expName ||
+			!reflect.DeepEqual(ap[0].Names, v.expNames) {
+			t.Fatalf("(%d) unexpected list contents: %+v", i, ap)
+		}
+	}
+}
@@ -0,0 +1,650 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// The OpenAPI 3 document is built from these types, which cover only the
+// parts of the specification the service uses.
+
+// openAPIDoc is the root of an OpenAPI document.
+type openAPIDoc struct {
+	OpenAPI    string                     `json:"openapi"`
+	Info       openAPIInfo                `json:"info"`
+	Paths      map[string]openAPIPathItem `json:"paths"`
+	Components openAPIComponents          `json:"components"`
+}
+
+// openAPIInfo describes the API as a whole.
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// openAPIPathItem holds the operations on a path, keyed by the method in
+// lower case, e.g. "get".
+type openAPIPathItem map[string]*openAPIOperation
+
+// openAPIOperation describes a single method on a path.  The responses
+// are keyed by the HTTP status code.
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description,omitempty"`
+	OperationID string                     `json:"operationId"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+	Role        reqctx.Role                `json:"x-required-role,omitempty"`
+}
+
+// openAPIParameter describes a path, query or header parameter.
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+// openAPIRequestBody describes the body of a request, keyed by media type.
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+// openAPIResponse describes a response, whose body, if any, is keyed by
+// media type.
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+// openAPIMediaType gives the schema of a body, along with an example.
+type openAPIMediaType struct {
+	Schema  *openAPISchema `json:"schema"`
+	Example interface{}    `json:"example,omitempty"`
+}
+
+// openAPIComponents holds the named schemas and security schemes that are
+// referred to.
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// openAPISecurityScheme describes how requests are authenticated.
+type openAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Description  string `json:"description,omitempty"`
+	Name         string `json:"name,omitempty"`
+	In           string `json:"in,omitempty"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+// openAPISchema is a JSON schema, as used in OpenAPI.
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties interface{}               `json:"additionalProperties,omitempty"`
+	OneOf                []*openAPISchema          `json:"oneOf,omitempty"`
+	Example              interface{}               `json:"example,omitempty"`
+}
+
+// The OpenAPI endpoint returns the description of the API as JSON.  It is
+// built on each request, so the code pattern reflects the configured code
+// formats.
+func (a apiImpl) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	b, err := json.MarshalIndent(newOpenAPIDoc(), "", "  ")
+	if err != nil {
+		a.notifyInternalServerError(w, r, "marshal error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// newOpenAPIDoc builds the description of every endpoint.  The patterns
+// for codes, names and prices are the ones the service validates with.
+func newOpenAPIDoc() openAPIDoc {
+	// The representations every structured response may be written in.
+	codecTypes := codecMediaTypes()
+	content := func(s *openAPISchema) map[string]openAPIMediaType {
+		res := make(map[string]openAPIMediaType, len(codecTypes))
+		for _, v := range codecTypes {
+			res[v] = openAPIMediaType{Schema: s}
+		}
+		return res
+	}
+	ref := func(name string) *openAPISchema {
+		return &openAPISchema{Ref: "#/components/schemas/" + name}
+	}
+	list := func(name string) *openAPISchema {
+		return &openAPISchema{Type: "array", Items: ref(name)}
+	}
+	resp := func(desc string, s *openAPISchema) openAPIResponse {
+		return openAPIResponse{Description: desc, Content: content(s)}
+	}
+	empty := func(desc string) openAPIResponse {
+		return openAPIResponse{Description: desc}
+	}
+	problem := func(desc string) openAPIResponse {
+		return openAPIResponse{Description: desc,
+			Content: map[string]openAPIMediaType{
+				types.ProblemContentType: {Schema: ref("Problem")}}}
+	}
+	body := func(s *openAPISchema, example interface{}) *openAPIRequestBody {
+		c := content(s)
+		c[mediaTypeJSON] = openAPIMediaType{Schema: s, Example: example}
+		return &openAPIRequestBody{Required: true, Content: c}
+	}
+	str := &openAPISchema{Type: "string"}
+	nameParam := func(desc string) openAPIParameter {
+		return openAPIParameter{Name: "name", In: "path", Required: true,
+			Description: desc, Schema: str}
+	}
+	badRequest := problem("The request is invalid.")
+	notAcceptable := problem("None of the representations in the Accept " +
+		"header can be written.")
+	unsupported := problem("The request body's media type isn't supported.")
+	csvOptions := []openAPIParameter{
+		{Name: "delimiter", In: "query", Schema: str,
+			Description: `The field delimiter, a single character or "tab".`},
+		{Name: "map", In: "query",
+			Schema: &openAPISchema{Type: "array", Items: str},
+			Description: `Maps a column heading to a field, as in ` +
+				`"Item Name:name".`},
+		{Name: "on_error", In: "query",
+			Schema:      &openAPISchema{Type: "string", Enum: []string{"skip", "abort"}},
+			Description: "Whether to add the valid rows when any fail, or none."},
+	}
+
+	produceExample := types.Produce{Code: "A12T-4GH7-QPL9-3N4M",
+		Name: "Lettuce", UnitPrice: types.USD(346)}
+	addResults := resp("The result of each add, when any failed, or when "+
+		"any codes were generated.", ref("ProduceAddResponse"))
+	// An aborted import reports the result of each row, and any other bad
+	// request is a problem.
+	importAborted := resp("The request is invalid, or the import was "+
+		"aborted.", ref("ProduceAddResponse"))
+	importAborted.Content[types.ProblemContentType] = openAPIMediaType{
+		Schema: ref("Problem")}
+	paths := map[string]openAPIPathItem{
+		statusURL: {
+			"get": {
+				Summary:     "Check that the service is running.",
+				OperationID: "getStatus",
+				Responses: map[string]openAPIResponse{
+					"200": resp("The service is running.", ref("StatusResponse")),
+					"406": notAcceptable,
+				},
+			},
+		},
+		produceURL: {
+			"get": {
+				Summary:     "List the produce items.",
+				OperationID: "listProduce",
+				Description: "The items are written in the representation " +
+					"that best matches the Accept header, including CSV and NDJSON.",
+				Parameters: []openAPIParameter{
+					{Name: "category", In: "query", Schema: str,
+						Description: "Only list the items in the category's subtree."},
+					{Name: "tag", In: "query",
+						Schema:      &openAPISchema{Type: "array", Items: str},
+						Description: "Only list the items carrying all of the tags."},
+					{Name: "all_names", In: "query",
+						Schema: &openAPISchema{Type: "boolean"},
+						Description: "Return all of the translations, rather " +
+							"than the name best matching Accept-Language."},
+					{Name: "stream", In: "query",
+						Schema:      &openAPISchema{Type: "boolean"},
+						Description: "Stream the JSON array as it is read."},
+					{Name: "Accept-Language", In: "header", Schema: str},
+				},
+				Responses: map[string]openAPIResponse{
+					"200": {
+						Description: "The matching items.",
+						Content: func() map[string]openAPIMediaType {
+							c := content(list("Produce"))
+							c[mediaTypeCSV] = openAPIMediaType{Schema: str}
+							c[mediaTypeNDJSON] = openAPIMediaType{Schema: str}
+							return c
+						}(),
+					},
+					"400": badRequest,
+					"404": problem("The category doesn't exist."),
+					"406": notAcceptable,
+				},
+			},
+			"post": {
+				Summary:     "Add one or more produce items.",
+				OperationID: "addProduce",
+				Description: "Each item is added on its own, so some may fail.  " +
+					"A code is generated for any item without one.",
+				Parameters: []openAPIParameter{
+					{Name: IdempotencyKeyHeader, In: "header", Schema: str,
+						Description: "Makes the add safe to retry: a retry " +
+							"with the same key and body gets the first " +
+							"response again, with the " +
+							IdempotentReplayedHeader + " header."},
+				},
+				RequestBody: body(&openAPISchema{OneOf: []*openAPISchema{
+					ref("Produce"), list("Produce")}}, produceExample),
+				Responses: map[string]openAPIResponse{
+					"200": addResults,
+					"201": addResults,
+					"400": badRequest,
+					"406": notAcceptable,
+					"409": problem("The item already exists, or an add with " +
+						"the idempotency key is in progress."),
+					"415": unsupported,
+					"422": problem("The idempotency key was used with a " +
+						"different body."),
+				},
+			},
+		},
+		produceURL + "/{code}": {
+			"get": {
+				Summary:     "Get a produce item.",
+				OperationID: "getProduce",
+				Parameters: []openAPIParameter{
+					{Name: "code", In: "path", Required: true,
+						Schema: &openAPISchema{Type: "string",
+							Pattern: types.CodePattern()}},
+					{Name: "all_names", In: "query",
+						Schema: &openAPISchema{Type: "boolean"},
+						Description: "Return all of the translations, rather " +
+							"than the name best matching Accept-Language."},
+					{Name: "Accept-Language", In: "header", Schema: str},
+				},
+				Responses: map[string]openAPIResponse{
+					"200": resp("The item.", ref("Produce")),
+					"400": badRequest,
+					"404": problem("The item doesn't exist."),
+					"406": notAcceptable,
+				},
+			},
+			"delete": {
+				Summary:     "Delete a produce item.",
+				OperationID: "deleteProduce",
+				Parameters: []openAPIParameter{
+					{Name: "code", In: "path", Required: true,
+						Schema: &openAPISchema{Type: "string",
+							Pattern: types.CodePattern()}},
+				},
+				Responses: map[string]openAPIResponse{
+					"204": empty("The item was deleted."),
+					"400": badRequest,
+					"404": problem("The item doesn't exist."),
+				},
+			},
+		},
+		importURL: {
+			"post": {
+				Summary:     "Import produce items from CSV.",
+				OperationID: "importProduce",
+				Parameters:  csvOptions,
+				RequestBody: &openAPIRequestBody{Required: true,
+					Content: map[string]openAPIMediaType{mediaTypeCSV: {
+						Schema:  str,
+						Example: "code,name,unit_price\nA12T-4GH7-QPL9-3N4M,Lettuce,$3.46\n",
+					}}},
+				Responses: map[string]openAPIResponse{
+					"200": addResults,
+					"201": addResults,
+					"400": importAborted,
+					"406": notAcceptable,
+					"415": unsupported,
+				},
+			},
+		},
+		bulkURL: {
+			"post": {
+				Summary:     "Add produce items from NDJSON, one per line.",
+				OperationID: "bulkAddProduce",
+				RequestBody: &openAPIRequestBody{Required: true,
+					Content: map[string]openAPIMediaType{mediaTypeNDJSON: {
+						Schema: str,
+						Example: `{"code": "A12T-4GH7-QPL9-3N4M", "name": ` +
+							`"Lettuce", "unit_price": "$3.46"}` + "\n",
+					}}},
+				Responses: map[string]openAPIResponse{
+					"200": {
+						Description: "The result of each add as NDJSON, " +
+							"in the order they complete.",
+						Content: map[string]openAPIMediaType{mediaTypeNDJSON: {
+							Schema: ref("ProduceAddItemResponse")}},
+					},
+					"400": badRequest,
+					"415": unsupported,
+				},
+			},
+		},
+		resetURL: {
+			"get": {
+				Summary:     "Delete all of the produce items.",
+				OperationID: "reset",
+				Description: "POST does the same, and HEAD deletes nothing.",
+				Responses: map[string]openAPIResponse{
+					"200": empty("The items were deleted."),
+				},
+			},
+			"post": {
+				Summary:     "Delete all of the produce items.",
+				OperationID: "resetWithPost",
+				Description: "The same as GET.",
+				Responses: map[string]openAPIResponse{
+					"200": empty("The items were deleted."),
+				},
+			},
+		},
+		categoriesURL: {
+			"get": {
+				Summary:     "List the categories.",
+				OperationID: "listCategories",
+				Responses: map[string]openAPIResponse{
+					"200": resp("The categories.", list("Category")),
+					"406": notAcceptable,
+				},
+			},
+			"post": {
+				Summary:     "Add a category.",
+				OperationID: "addCategory",
+				RequestBody: body(ref("Category"),
+					types.Category{Name: "Apples", Parent: "Fruit"}),
+				Responses: map[string]openAPIResponse{
+					"201": empty("The category was added."),
+					"400": badRequest,
+					"404": problem("The parent doesn't exist."),
+					"409": problem("The category already exists."),
+					"415": unsupported,
+				},
+			},
+		},
+		categoriesURL + "/{name}": {
+			"delete": {
+				Summary:     "Delete an unused category.",
+				OperationID: "deleteCategory",
+				Parameters:  []openAPIParameter{nameParam("The category name.")},
+				Responses: map[string]openAPIResponse{
+					"204": empty("The category was deleted."),
+					"400": badRequest,
+					"404": problem("The category doesn't exist."),
+					"409": problem("The category has children or items."),
+				},
+			},
+		},
+		categoryCountsURL: {
+			"get": {
+				Summary:     "Count the produce items in each category.",
+				OperationID: "countCategories",
+				Responses: map[string]openAPIResponse{
+					"200": resp("The counts.", list("CategoryCount")),
+					"406": notAcceptable,
+				},
+			},
+		},
+		attributesURL: {
+			"get": {
+				Summary:     "List the attribute definitions.",
+				OperationID: "listAttributes",
+				Responses: map[string]openAPIResponse{
+					"200": resp("The definitions.", list("AttributeDef")),
+					"406": notAcceptable,
+				},
+			},
+			"post": {
+				Summary:     "Define an attribute.",
+				OperationID: "addAttribute",
+				RequestBody: body(ref("AttributeDef"), types.AttributeDef{
+					Name: "origin", Type: types.AttributeString}),
+				Responses: map[string]openAPIResponse{
+					"201": empty("The attribute was defined."),
+					"400": badRequest,
+					"409": problem("The attribute is already defined."),
+					"415": unsupported,
+				},
+			},
+		},
+		attributesURL + "/{name}": {
+			"delete": {
+				Summary:     "Delete an unused attribute definition.",
+				OperationID: "deleteAttribute",
+				Parameters:  []openAPIParameter{nameParam("The attribute name.")},
+				Responses: map[string]openAPIResponse{
+					"204": empty("The attribute was deleted."),
+					"400": badRequest,
+					"404": problem("The attribute isn't defined."),
+					"409": problem("Produce items carry the attribute."),
+				},
+			},
+		},
+		graphqlURL: {
+			"post": {
+				Summary: "Run a GraphQL query or mutation.",
+				Description: "Queries need the viewer role, and mutations " +
+					"the editor role.",
+				OperationID: "graphql",
+				RequestBody: &openAPIRequestBody{Required: true,
+					Content: map[string]openAPIMediaType{mediaTypeJSON: {
+						Schema: &openAPISchema{Type: "object",
+							Properties: map[string]*openAPISchema{
+								"query":         str,
+								"operationName": str,
+								"variables":     {Type: "object"},
+							},
+							Required: []string{"query"}},
+						Example: map[string]string{
+							"query": "{ allProduce { code name } }"},
+					}}},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The result, with any errors.",
+						Content: map[string]openAPIMediaType{mediaTypeJSON: {
+							Schema: &openAPISchema{Type: "object"}}}},
+					"400": empty("The body isn't a GraphQL request."),
+					"406": notAcceptable,
+				},
+			},
+		},
+		openAPIURL: {
+			"get": {
+				Summary:     "Get this description of the API.",
+				OperationID: "getOpenAPI",
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The OpenAPI document.",
+						Content: map[string]openAPIMediaType{mediaTypeJSON: {
+							Schema: &openAPISchema{Type: "object"}}}},
+				},
+			},
+		},
+	}
+
+	name := &openAPISchema{Type: "string", Pattern: types.NamePattern()}
+	price := &openAPISchema{Type: "string", Pattern: types.USDPattern(),
+		Example: "$3.46"}
+	schemas := map[string]*openAPISchema{
+		"Produce": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"code": {Type: "string", Pattern: types.CodePattern(),
+					Description: "The produce code in one of the formats: " +
+						strings.Join(types.CodeFormats(), ", ") + ".  It is " +
+						"generated if it is missing from an add."},
+				"name":       name,
+				"unit_price": price,
+				"category":   name,
+				"tags":       {Type: "array", Items: name},
+				"attributes": {Type: "object", AdditionalProperties: true,
+					Description: "Values for the defined attributes."},
+				"names": {Type: "object", AdditionalProperties: name,
+					Description: "Translations of the name, keyed by " +
+						"BCP 47 language tag."},
+			},
+			Required: []string{"name", "unit_price"},
+			Example:  produceExample,
+		},
+		"ProduceAddItemResponse": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"row":         {Type: "integer"},
+				"code":        {Type: "string"},
+				"status_code": {Type: "integer"},
+				"error_code":  {Type: "string"},
+				"error":       {Type: "string"},
+				"errors":      list("FieldError"),
+			},
+			Required: []string{"code", "status_code"},
+		},
+		"ProduceAddResponse": list("ProduceAddItemResponse"),
+		"StatusResponse": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"status": {Type: "string"},
+			},
+			Required: []string{"status"},
+		},
+		"Problem": {
+			Type: "object",
+			Description: "An error, as in RFC 7807.  The code identifies " +
+				"the problem, and the detail is meant for people.",
+			Properties: map[string]*openAPISchema{
+				"type":     {Type: "string", Example: "about:blank"},
+				"title":    {Type: "string"},
+				"status":   {Type: "integer"},
+				"detail":   {Type: "string"},
+				"instance": {Type: "string"},
+				"code": {Type: "string",
+					Example: types.ProblemInvalidCode},
+				"field":      {Type: "string"},
+				"request_id": {Type: "string"},
+				"errors":     list("FieldError"),
+			},
+			Required: []string{"type", "title", "status", "code"},
+		},
+		"FieldError": {
+			Type: "object",
+			Description: "A problem with a single field of an item, given " +
+				"by its path, such as \"tags[1]\" or \"names.fr\".",
+			Properties: map[string]*openAPISchema{
+				"field": {Type: "string", Example: "unit_price"},
+				"value": {Type: "string"},
+				"rule": {Type: "string", Enum: []string{
+					types.RuleCodeFormat, types.RuleNamePattern,
+					types.RulePriceFormat, types.RuleLanguageTag,
+					types.RuleDuplicate, types.RuleUnknownField,
+					types.RuleUnknownAttribute, types.RuleRequired,
+					types.RuleType, types.RuleMaxLength, types.RulePattern,
+					types.RuleMin, types.RuleMax, types.RuleEnum}},
+				"message": {Type: "string"},
+			},
+			Required: []string{"field", "value", "rule", "message"},
+		},
+		"Category": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"name":   name,
+				"parent": name,
+			},
+			Required: []string{"name"},
+		},
+		"CategoryCount": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"name":        {Type: "string"},
+				"parent":      {Type: "string"},
+				"count":       {Type: "integer"},
+				"total_count": {Type: "integer"},
+			},
+			Required: []string{"name", "count", "total_count"},
+		},
+		"AttributeDef": {
+			Type: "object",
+			Properties: map[string]*openAPISchema{
+				"name": {Type: "string"},
+				"type": {Type: "string", Enum: []string{
+					string(types.AttributeString), string(types.AttributeInt),
+					string(types.AttributeBool), string(types.AttributeEnum),
+					string(types.AttributeMoney)}},
+				"required":   {Type: "boolean"},
+				"max_length": {Type: "integer"},
+				"pattern":    {Type: "string"},
+				"min":        {Type: "integer", Format: "int64"},
+				"max":        {Type: "integer", Format: "int64"},
+				"min_price":  price,
+				"max_price":  price,
+				"values":     {Type: "array", Items: str},
+			},
+			Required: []string{"name", "type"},
+		},
+	}
+
+	// Every operation may fail with a server error, or run past its
+	// deadline.  The operations that make changes need an API key or a
+	// bearer token with the role, if the service is configured with either,
+	// and for the others they are optional, which is given as the
+	// alternative of no security at all.  Reads need a token with the viewer
+	// role if the service accepts tokens.
+	for path, item := range paths {
+		for method, op := range item {
+			op.Role = requiredRole(strings.ToUpper(method), path)
+			op.Responses["403"] = problem("The API key is not valid, or the " +
+				"bearer token doesn't have the role.")
+			op.Responses["500"] = problem("An unexpected error occurred.")
+			op.Responses["503"] = problem("The request ran past the " +
+				"deadline of its endpoint, the server is shutting down, or " +
+				"it is too busy to add the items.")
+			op.Security = []map[string][]string{{"apiKey": {}},
+				{"bearerAuth": {}}}
+			if op.Role != reqctx.RoleEditor && op.Role != reqctx.RoleAdmin {
+				op.Security = append([]map[string][]string{{}}, op.Security...)
+			}
+			if op.Role != "" {
+				op.Responses["401"] = problem("No credentials were given, " +
+					"or the bearer token is not valid.")
+			}
+		}
+	}
+	securitySchemes := map[string]openAPISecurityScheme{
+		"apiKey": {Type: "apiKey", In: "header", Name: APIKeyHeader,
+			Description: "Required for changes when the service is " +
+				"configured with API keys.  It is optional for the other " +
+				"requests, but must be valid if given.  A key has every role."},
+		"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT",
+			Description: "An HS256 or RS256 token, with the roles in its " +
+				"roles claim: viewer may read, editor may also add and " +
+				"delete, and admin may also reset."},
+	}
+
+	return openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title: "Produce Service",
+			Description: "REST service for supermarket produce inventory.  " +
+				"Request bodies may be in any of the listed representations, " +
+				"given by the Content-Type header, and JSON is assumed if " +
+				"it is missing.",
+			Version: "1.0",
+		},
+		Paths: paths,
+		Components: openAPIComponents{Schemas: schemas,
+			SecuritySchemes: securitySchemes},
+	}
+}
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// getOpenAPIDoc fetches and decodes the OpenAPI document from the endpoint.
+func getOpenAPIDoc(t *testing.T, handler http.Handler) openAPIDoc {
+	req, err := http.NewRequest(http.MethodGet, openAPIURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %d", rr.Code)
+	}
+	var doc openAPIDoc
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("cannot unmarshal document: %v", err)
+	}
+	return doc
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	api := apiImpl{log: newLogger(t)}
+	doc := getOpenAPIDoc(t, http.HandlerFunc(api.getOpenAPI))
+	if doc.OpenAPI != "3.0.3" || len(doc.Paths) == 0 {
+		t.Fatalf("unexpected document: %+v", doc)
+	}
+
+	// Every reference must be to a defined schema.
+	var check func(where string, s *openAPISchema)
+	check = func(where string, s *openAPISchema) {
+		if s == nil {
+			return
+		}
+		if s.Ref != "" {
+			name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+			if _, ok := doc.Components.Schemas[name]; !ok {
+				t.Fatalf("%s: unknown schema reference '%s'", where, s.Ref)
+			}
+		}
+		check(where, s.Items)
+		for _, v := range s.Properties {
+			check(where, v)
+		}
+		for _, v := range s.OneOf {
+			check(where, v)
+		}
+	}
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			where := method + " " + path
+			if op.OperationID == "" || len(op.Responses) == 0 {
+				t.Fatalf("%s: incomplete operation: %+v", where, op)
+			}
+			for _, v := range op.Parameters {
+				check(where, v.Schema)
+			}
+			if op.RequestBody != nil {
+				for _, v := range op.RequestBody.Content {
+					check(where, v.Schema)
+				}
+			}
+			for sc, r := range op.Responses {
+				for _, v := range r.Content {
+					check(where, v.Schema)
+				}
+
+				// Errors are problems, apart from those GraphQL reports
+				// its own way.
+				if sc >= "400" && path != graphqlURL {
+					if _, ok := r.Content[types.ProblemContentType]; !ok {
+						t.Fatalf("%s: %s is not a problem", where, sc)
+					}
+				}
+			}
+		}
+	}
+	for name, v := range doc.Components.Schemas {
+		check(name, v)
+	}
+
+	produce := doc.Components.Schemas["Produce"]
+	for i, v := range []struct {
+		field string
+		exp   string
+	}{
+		{"code", `^([A-Za-z0-9]{4}-){3}([A-Za-z0-9]){4}$`},
+		{"name", `^[\p{L}\p{N}][\p{L}\p{N}\s]*$`},
+		{"unit_price", `^\$?\d*.(\.\d{1,2})?$|^\$?(\.\d{1,2})?$`},
+	} {
+		if p := produce.Properties[v.field].Pattern; p != v.exp {
+			t.Fatalf("(%d) unexpected pattern for %s: %s", i, v.field, p)
+		}
+	}
+}
+
+// The handlers are run against a real service and store, so the requests
+// behave as they would in the running service.  The paths are visited in
+// sorted order, so the items the examples add are deleted afterwards.
+func TestOpenAPIMatchesHandlers(t *testing.T) {
+	log := newLogger(t)
+	svc := service.New(store.New(), log)
+	err := svc.AddCategory(context.Background(), types.Category{Name: "Fruit"})
+	if err != nil {
+		t.Fatalf("cannot add category: %v", err)
+	}
+	mux := http.NewServeMux()
+	if err := Init(context.Background(), mux, svc, log); err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	doc := getOpenAPIDoc(t, mux)
+	resources := map[string]string{
+		produceURL + "/{code}":    dfltProduce.Code,
+		categoriesURL + "/{name}": "Apples",
+		attributesURL + "/{name}": "origin",
+	}
+
+	// Every endpoint must be described.
+	for _, v := range []string{statusURL, produceURL, produceURL + "/{code}",
+		importURL, bulkURL, resetURL, categoriesURL, categoriesURL + "/{name}",
+		categoryCountsURL, attributesURL, attributesURL + "/{name}",
+		graphqlURL, openAPIURL} {
+		if _, ok := doc.Paths[v]; !ok {
+			t.Fatalf("path '%s' is not described", v)
+		}
+	}
+
+	methods := []string{http.MethodGet, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete}
+	paths := make([]string, 0, len(doc.Paths))
+	for k := range doc.Paths {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		url := path
+		if name, ok := resources[path]; ok {
+			url = path[:strings.LastIndex(path, "/")+1] + name
+		}
+		// The methods that are allowed are those described, along with
+		// HEAD for GET, and OPTIONS.
+		allowed := []string{http.MethodOptions}
+		for k := range doc.Paths[path] {
+			allowed = append(allowed, strings.ToUpper(k))
+			if k == "get" {
+				allowed = append(allowed, http.MethodHead)
+			}
+		}
+		sort.Strings(allowed)
+		rr := serve(t, mux, http.MethodOptions, url, "", "")
+		if rr.Code != http.StatusNoContent ||
+			rr.Header().Get("Allow") != strings.Join(allowed, ", ") {
+			t.Fatalf("OPTIONS %s: unexpected response %d, Allow '%s'", path,
+				rr.Code, rr.Header().Get("Allow"))
+		}
+
+		for _, method := range methods {
+			op, ok := doc.Paths[path][strings.ToLower(method)]
+			if !ok {
+				// The methods that aren't described must be rejected.
+				rr := serve(t, mux, method, url, "", "")
+				if rr.Code != http.StatusMethodNotAllowed {
+					t.Fatalf("%s %s: undescribed method returned %d",
+						method, path, rr.Code)
+				}
+				continue
+			}
+
+			// Send the example body, if there is one, which must succeed,
+			// and the response must be one that is described.
+			var body, contentType string
+			if op.RequestBody != nil {
+				for _, mt := range []string{mediaTypeJSON, mediaTypeCSV,
+					mediaTypeNDJSON} {
+					if c, ok := op.RequestBody.Content[mt]; ok {
+						contentType = mt
+						if s, ok := c.Example.(string); ok {
+							body = s
+						} else {
+							b, _ := json.Marshal(c.Example)
+							body = string(b)
+						}
+						break
+					}
+				}
+				if body == "" {
+					t.Fatalf("%s %s: no example request body", method, path)
+				}
+			}
+			rr := serve(t, mux, method, url, contentType, body)
+			if _, ok := op.Responses[strconv.Itoa(rr.Code)]; !ok ||
+				rr.Code >= http.StatusBadRequest {
+				t.Fatalf("%s %s: unexpected status %d: %s", method, path,
+					rr.Code, rr.Body.String())
+			}
+
+			// A request that can't be accepted must be described too.
+			if op.RequestBody != nil {
+				rr := serve(t, mux, method, url, "image/png", body)
+				if _, ok := op.Responses[strconv.Itoa(rr.Code)]; !ok {
+					t.Fatalf("%s %s: undescribed status %d for bad media type",
+						method, path, rr.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenAPIPatterns(t *testing.T) {
+	defer types.SetCodeFormats([]string{types.CodeFormatQuartet})
+	err := types.SetCodeFormats([]string{types.CodeFormatQuartet,
+		types.CodeFormatPLU, types.CodeFormatUPCA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := newOpenAPIDoc().Components.Schemas["Produce"]
+	codeExp := regexp.MustCompile(schema.Properties["code"].Pattern)
+	nameExp := regexp.MustCompile(schema.Properties["name"].Pattern)
+	priceExp := regexp.MustCompile(schema.Properties["unit_price"].Pattern)
+
+	// The patterns must accept whatever the service does, and reject what
+	// it rejects, apart from the checks a pattern can't make, such as the
+	// check digit.
+	for i, v := range []struct {
+		value string
+		exp   bool
+	}{
+		{"a12t-4gh7-qpl9-3n4m", true},
+		{"4011", true},
+		{"9 4011", true},
+		{"036000-291452", true},
+		{"A12T-4GH7-QPL9", false},
+		{"40x1", false},
+		{"", false},
+	} {
+		_, msg := types.ValidateAndConvertProduceCode(v.value)
+		if (msg == "") != v.exp || codeExp.MatchString(v.value) != v.exp {
+			t.Fatalf("(%d) code '%s' mismatch: %s", i, v.value, msg)
+		}
+	}
+	for i, v := range []struct {
+		value string
+		exp   bool
+	}{
+		{"Green Pepper", true},
+		{"Äpfel 2", true},
+		{" Lettuce", false},
+		{"Green-Pepper", false},
+	} {
+		_, ok := types.ValidateAndConvertName(v.value)
+		if ok != v.exp || nameExp.MatchString(v.value) != v.exp {
+			t.Fatalf("(%d) name '%s' mismatch", i, v.value)
+		}
+	}
+	for i, v := range []struct {
+		value string
+		exp   bool
+	}{
+		{"$3.46", true},
+		{"3.4", true},
+		{"$0.79", true},
+		{"12", true},
+		{"$3.456", false},
+		{"lots", false},
+	} {
+		var d types.USD
+		err := d.UnmarshalText([]byte(v.value))
+		if (err == nil) != v.exp || priceExp.MatchString(v.value) != v.exp {
+			t.Fatalf("(%d) price '%s' mismatch: %v", i, v.value, err)
+		}
+	}
+}
+
+// serve sends a request to the handler and returns the recorded response.
+func serve(t *testing.T, handler http.Handler, method, url, contentType,
+	body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// problemFor maps an error of the service or the store to the HTTP status
+// and the code of its problem, along with the field at fault, if there is
+// one.  This is the one place these errors are mapped, for the error
+// responses, the results of the items of an add, and the GraphQL errors.
+// Work abandoned because the request was cancelled or ran past its
+// deadline maps to HTTP 499 (Client Closed Request) or 503.
+func problemFor(err error) (int, string, string) {
+	switch err {
+	case context.Canceled:
+		return statusClientClosedRequest, types.ProblemRequestCancelled, ""
+	case context.DeadlineExceeded:
+		return http.StatusServiceUnavailable, types.ProblemDeadlineExceeded, ""
+	}
+	switch e := err.(type) {
+	case service.OverloadedError:
+		return http.StatusServiceUnavailable, types.ProblemOverloaded, ""
+	case service.FormatError:
+		switch e.Field {
+		case "code":
+			return http.StatusBadRequest, types.ProblemInvalidCode, e.Field
+		case "category":
+			return http.StatusBadRequest, types.ProblemInvalidCategory, e.Field
+		case "tags":
+			return http.StatusBadRequest, types.ProblemInvalidTags, e.Field
+		}
+		return http.StatusBadRequest, types.ProblemInvalidRequest, e.Field
+	case store.NotFoundError:
+		return http.StatusNotFound, types.ProblemProduceNotFound, ""
+	case store.AlreadyExistsError:
+		return http.StatusConflict, types.ProblemProduceExists, "code"
+	case store.CategoryNotFoundError:
+		return http.StatusNotFound, types.ProblemCategoryNotFound, ""
+	case store.CategoryExistsError:
+		return http.StatusConflict, types.ProblemCategoryExists, "name"
+	case store.CategoryInUseError:
+		return http.StatusConflict, types.ProblemCategoryInUse, ""
+	case store.AttributeNotFoundError:
+		return http.StatusNotFound, types.ProblemAttributeNotFound, ""
+	case store.AttributeExistsError:
+		return http.StatusConflict, types.ProblemAttributeExists, "name"
+	case store.AttributeInUseError:
+		return http.StatusConflict, types.ProblemAttributeInUse, ""
+	default:
+		return http.StatusInternalServerError, types.ProblemInternal, ""
+	}
+}
+
+// errorToStatusCode maps a Go error to an HTTP status, or to the status
+// given for success if there is no error.
+func errorToStatusCode(err error, nilCode int) int {
+	if err == nil {
+		return nilCode
+	}
+	sc, _, _ := problemFor(err)
+	return sc
+}
+
+// fieldErrors returns the problems with the fields of an item, if the
+// error is about one.
+func fieldErrors(err error) types.FieldErrors {
+	if fe, ok := err.(service.FormatError); ok {
+		return fe.Errors
+	}
+	return nil
+}
+
+// writeProblem writes a problem+json error response with the status, code,
+// field and detail, along with the path and the ID of the request.  Errors
+// are always written as JSON, whatever the Accept header, so the cause is
+// never lost.
+func writeProblem(w http.ResponseWriter, r *http.Request, sc int, code,
+	field, detail string) {
+	writeFieldProblem(w, r, sc, code, field, detail, nil)
+}
+
+// writeFieldProblem writes a problem as writeProblem does, along with the
+// problems with the fields of an item, if there are any.
+func writeFieldProblem(w http.ResponseWriter, r *http.Request, sc int, code,
+	field, detail string, errs types.FieldErrors) {
+	p := types.Problem{
+		Type:      "about:blank",
+		Title:     statusText(sc),
+		Status:    sc,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		Field:     field,
+		RequestID: problemRequestID(w, r),
+		Errors:    errs,
+	}
+	b, _ := json.MarshalIndent(p, "", "  ")
+	w.Header().Set("Content-Type", types.ProblemContentType)
+	w.WriteHeader(sc)
+	w.Write(b)
+}
+
+// statusText returns the text of the HTTP status, for the title of a
+// problem, including the one that isn't standard.
+func statusText(sc int) string {
+	if sc == statusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(sc)
+}
+
+// problemRequestID returns the ID of the request for a problem.  The
+// middleware that runs before the handlers have no request info yet, so
+// for them, the ID is taken from the request, or generated, and returned
+// in the X-Request-ID header, as the handlers do.
+func problemRequestID(w http.ResponseWriter, r *http.Request) string {
+	if info, ok := reqctx.RequestInfoFromContext(r.Context()); ok {
+		return info.ID
+	}
+	if id := w.Header().Get(RequestIDHeader); id != "" {
+		return id
+	}
+	id := newRequestInfo(r).ID
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// writeError writes the problem for an error of the service or the store.
+// The details of internal errors are logged rather than returned.
+func (a apiImpl) writeError(w http.ResponseWriter, r *http.Request,
+	err error) {
+	if a.writeAbandoned(w, r, err) {
+		return
+	}
+	sc, code, field := problemFor(err)
+	if sc == http.StatusInternalServerError {
+		a.notifyInternalServerError(w, r, "an unexpected problem occurred", err)
+		return
+	}
+	setRetryAfter(w, err)
+	writeFieldProblem(w, r, sc, code, field, err.Error(), fieldErrors(err))
+}
+
+// notifyInternalServerError logs the error and writes HTTP 500, without
+// the details.  Errors that aren't internal, such as work that was
+// abandoned, or an overloaded service, get their own problems.
+func (a apiImpl) notifyInternalServerError(w http.ResponseWriter,
+	r *http.Request, msg string, err error) {
+	if sc, _, _ := problemFor(err); sc != http.StatusInternalServerError {
+		a.writeError(w, r, err)
+		return
+	}
+	a.log.Errorw(msg, "error", err)
+	writeProblem(w, r, http.StatusInternalServerError, types.ProblemInternal,
+		"", "")
+}
+
+// setRetryAfter sets the Retry-After header of the response to an error
+// that says how long to wait before trying again.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if oe, ok := err.(service.OverloadedError); ok {
+		w.Header().Set("Retry-After", reqctx.RetryAfterSeconds(oe.RetryAfter))
+	}
+}
+
+// For HTTP bad request repsonses, write a problem with the cause.  The
+// errors of the service are mapped to their codes, and any others are
+// taken to be about the request as a whole.
+func writeBadRequestResponse(w http.ResponseWriter, r *http.Request,
+	err error) {
+	if fe, ok := err.(service.FormatError); ok {
+		_, code, field := problemFor(fe)
+		writeFieldProblem(w, r, http.StatusBadRequest, code, field, err.Error(),
+			fe.Errors)
+		return
+	}
+	writeProblem(w, r, http.StatusBadRequest, types.ProblemInvalidRequest, "",
+		err.Error())
+}
+
+// writeMalformedBody writes HTTP 400 for a request body that can't be
+// decoded.
+func writeMalformedBody(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, http.StatusBadRequest, types.ProblemMalformedBody, "",
+		err.Error())
+}
+
+// writeNotAcceptable writes HTTP 406 (Not Acceptable), for a request whose
+// response can't be written in any representation the Accept header
+// allows.
+func writeNotAcceptable(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotAcceptable, types.ProblemNotAcceptable,
+		"Accept", fmt.Sprintf("none of the representations in '%s' can be "+
+			"written", r.Header.Get("Accept")))
+}
+
+// writeUnsupportedMediaType writes HTTP 415 (Unsupported Media Type), for
+// a request body whose media type isn't supported.
+func writeUnsupportedMediaType(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusUnsupportedMediaType,
+		types.ProblemUnsupportedMediaType, "Content-Type",
+		fmt.Sprintf("the media type '%s' isn't supported here",
+			r.Header.Get("Content-Type")))
+}
+
+// writeMethodNotAllowed writes HTTP 405 (Method Not Allowed) for a method
+// that the endpoint for the path doesn't handle.  The caller sets the Allow
+// header.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+	writeProblem(w, r, http.StatusMethodNotAllowed,
+		types.ProblemMethodNotAllowed, "", fmt.Sprintf(
+			"%s is not allowed for %s", r.Method, r.URL.Path))
+}
+
+// writeNoRoute writes HTTP 404 for a path that no endpoint handles.
+func writeNoRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+	writeProblem(w, r, http.StatusNotFound, types.ProblemNoRoute, "",
+		fmt.Sprintf("there is no endpoint for %s", r.URL.Path))
+}
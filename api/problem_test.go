@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// decodeProblem decodes the problem in the body of a response, failing
+// the test if it isn't one.
+func decodeProblem(t *testing.T, rr *httptest.ResponseRecorder) types.Problem {
+	t.Helper()
+	if ct := rr.Header().Get("Content-Type"); ct != types.ProblemContentType {
+		t.Fatalf("unexpected content type for a problem: '%s'", ct)
+	}
+	var p types.Problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatalf("cannot decode problem: %v: %s", err, rr.Body.String())
+	}
+	return p
+}
+
+func TestProblemFor(t *testing.T) {
+	for i, v := range []struct {
+		err       error
+		expStatus int
+		expCode   string
+		expField  string
+	}{
+		{service.FormatError{Message: "bad", Field: "code"},
+			http.StatusBadRequest, types.ProblemInvalidCode, "code"},
+		{service.FormatError{Message: "bad", Field: "category"},
+			http.StatusBadRequest, types.ProblemInvalidCategory, "category"},
+		{service.FormatError{Message: "bad", Field: "tags"},
+			http.StatusBadRequest, types.ProblemInvalidTags, "tags"},
+		{service.FormatError{Message: "bad"},
+			http.StatusBadRequest, types.ProblemInvalidRequest, ""},
+		{store.NotFoundError{Code: "A12T-4GH7-QPL9-3N4M"},
+			http.StatusNotFound, types.ProblemProduceNotFound, ""},
+		{store.AlreadyExistsError{Code: "A12T-4GH7-QPL9-3N4M"},
+			http.StatusConflict, types.ProblemProduceExists, "code"},
+		{store.CategoryInUseError{Name: "Herbs"},
+			http.StatusConflict, types.ProblemCategoryInUse, ""},
+		{store.AttributeExistsError{Name: "organic"},
+			http.StatusConflict, types.ProblemAttributeExists, "name"},
+		{service.OverloadedError{RetryAfter: time.Second},
+			http.StatusServiceUnavailable, types.ProblemOverloaded, ""},
+		{context.Canceled,
+			statusClientClosedRequest, types.ProblemRequestCancelled, ""},
+		{context.DeadlineExceeded,
+			http.StatusServiceUnavailable, types.ProblemDeadlineExceeded, ""},
+		{errors.New("disk on fire"),
+			http.StatusInternalServerError, types.ProblemInternal, ""},
+	} {
+		sc, code, field := problemFor(v.err)
+		if sc != v.expStatus || code != v.expCode || field != v.expField {
+			t.Fatalf("(%d) unexpected problem: %d, '%s', '%s'", i, sc, code,
+				field)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	api := apiImpl{log: newLogger(t)}
+	for i, v := range []struct {
+		err       error
+		reqID     string
+		expStatus int
+		expDetail string
+	}{
+		{store.NotFoundError{Code: "A12T-4GH7-QPL9-3N4M"}, "r-1",
+			http.StatusNotFound, "produce code 'A12T-4GH7-QPL9-3N4M' was not found"},
+		{errors.New("disk on fire"), "", http.StatusInternalServerError, ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, produceURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.reqID != "" {
+			req.Header.Set(RequestIDHeader, v.reqID)
+		}
+		rr := httptest.NewRecorder()
+		api.writeError(rr, req, v.err)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code,
+				v.expStatus)
+		}
+		p := decodeProblem(t, rr)
+		_, code, _ := problemFor(v.err)
+		if p.Type != "about:blank" || p.Status != v.expStatus ||
+			p.Title != http.StatusText(v.expStatus) || p.Code != code ||
+			p.Detail != v.expDetail || p.Instance != produceURL {
+			t.Fatalf("(%d) unexpected problem: %+v", i, p)
+		}
+		if p.RequestID == "" || p.RequestID != rr.Header().Get(RequestIDHeader) {
+			t.Fatalf("(%d) unexpected request ID: '%s'", i, p.RequestID)
+		}
+		if v.reqID != "" && p.RequestID != v.reqID {
+			t.Fatalf("(%d) the request ID wasn't kept: '%s'", i, p.RequestID)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+)
+
+// idleClientAge is how long a client's state is kept once its buckets are
+// full and it has nothing in flight.  Forgetting it then loses nothing, as
+// it would start out the same way.
+const idleClientAge = 5 * time.Minute
+
+// defaultAuthFailures are the limits of the failed authentication attempts
+// from each address, if the file doesn't give them: a burst of ten, and
+// then one every ten seconds.
+var defaultAuthFailures = BucketLimits{Rate: 0.1, Burst: 10}
+
+// BucketLimits are the limits of a token bucket: requests are allowed at
+// Rate per second, with bursts of up to Burst requests.  A zero rate means
+// no limit.
+type BucketLimits struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// ClientLimits are the limits for a client.  Reads are GET, HEAD and OPTIONS
+// requests, and writes are all the others.  MaxConcurrent limits the
+// requests in flight at once, or there is no limit if it is zero.  In the
+// limits for a particular client, those left out are taken from the
+// defaults.
+type ClientLimits struct {
+	Read          *BucketLimits `json:"read,omitempty"`
+	Write         *BucketLimits `json:"write,omitempty"`
+	MaxConcurrent *int          `json:"max_concurrent,omitempty"`
+}
+
+// RateLimitConfig is the configuration for rate limiting, as read from the
+// file: the default limits for each client, and those for particular
+// clients.  A client is named by its API key's name or its token's
+// subject, if it has one, and otherwise by its IP address.  AuthFailures
+// limits the failed authentication attempts from each IP address, whatever
+// credentials they carry, or defaultAuthFailures if it is left out.
+type RateLimitConfig struct {
+	Default      ClientLimits            `json:"default"`
+	Clients      map[string]ClientLimits `json:"clients,omitempty"`
+	AuthFailures *BucketLimits           `json:"auth_failures,omitempty"`
+}
+
+// RateLimitError is returned when a request exceeds the limits of its
+// client.  It maps to HTTP 429, with the time to wait before retrying.
+type RateLimitError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (re RateLimitError) Error() string {
+	return re.Message
+}
+
+// bucket is a token bucket, which holds up to its burst of tokens, and is
+// refilled at its rate.  A request takes a token.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// capacity returns the number of tokens the bucket holds when full, which
+// is at least one, so a request can get through.
+func (lim BucketLimits) capacity() float64 {
+	return math.Max(float64(lim.Burst), 1)
+}
+
+// take takes a token from the bucket, refilling it for the time since it
+// was last used, and returns how long to wait for one if there is none.
+func (b *bucket) take(lim BucketLimits, now time.Time) time.Duration {
+	wait := b.wait(lim, now)
+	if wait == 0 && lim.Rate > 0 {
+		b.tokens--
+	}
+	return wait
+}
+
+// wait refills the bucket for the time since it was last used, and
+// returns how long to wait for a token if there is none, without taking
+// one.
+func (b *bucket) wait(lim BucketLimits, now time.Time) time.Duration {
+	if lim.Rate <= 0 {
+		return 0
+	}
+	b.tokens = math.Min(lim.capacity(),
+		b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / lim.Rate * float64(time.Second))
+}
+
+// full returns whether the bucket would have refilled by now.
+func (b *bucket) full(lim BucketLimits, now time.Time) bool {
+	return lim.Rate <= 0 ||
+		b.tokens+now.Sub(b.last).Seconds()*lim.Rate >= lim.capacity()
+}
+
+// clientState is the state of the limits for a client.
+type clientState struct {
+	limits   effectiveLimits
+	read     bucket
+	write    bucket
+	inFlight int
+}
+
+// effectiveLimits are the limits for a client, with the defaults filled in.
+type effectiveLimits struct {
+	read, write   BucketLimits
+	maxConcurrent int
+}
+
+// RateLimiter limits the rate of reads and writes, and the number of
+// requests in flight, of each client, with the limits from a file.  The
+// limits can be changed without a restart by editing the file and calling
+// Reload.  The failed authentication attempts from each address are
+// limited too.  It is safe for concurrent use.
+type RateLimiter struct {
+	file string
+	now  func() time.Time
+
+	mu        sync.Mutex
+	cfg       RateLimitConfig
+	clients   map[string]*clientState
+	failures  map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a limiter with the limits from the file.
+func NewRateLimiter(file string) (*RateLimiter, error) {
+	rl := &RateLimiter{file: file, now: time.Now,
+		clients:  make(map[string]*clientState),
+		failures: make(map[string]*bucket)}
+	if err := rl.Reload(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// Reload reads the limits from the file again.  The state of the clients
+// starts over with the new limits.  If the file can't be read, the current
+// limits are kept.
+func (rl *RateLimiter) Reload() error {
+	b, err := ioutil.ReadFile(rl.file)
+	if err != nil {
+		return err
+	}
+	var cfg RateLimitConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("%s: %v", rl.file, err)
+	}
+	if err := checkLimits("default", cfg.Default); err != nil {
+		return fmt.Errorf("%s: %v", rl.file, err)
+	}
+	for k, v := range cfg.Clients {
+		if err := checkLimits(k, v); err != nil {
+			return fmt.Errorf("%s: %v", rl.file, err)
+		}
+	}
+	if err := checkLimits("auth_failures",
+		ClientLimits{Read: cfg.AuthFailures}); err != nil {
+		return fmt.Errorf("%s: %v", rl.file, err)
+	}
+	if cfg.AuthFailures == nil {
+		lim := defaultAuthFailures
+		cfg.AuthFailures = &lim
+	}
+
+	rl.mu.Lock()
+	rl.cfg = cfg
+	rl.clients = make(map[string]*clientState)
+	rl.failures = make(map[string]*bucket)
+	rl.mu.Unlock()
+	return nil
+}
+
+// checkLimits checks that none of the limits are negative.
+func checkLimits(name string, cl ClientLimits) error {
+	for _, v := range []*BucketLimits{cl.Read, cl.Write} {
+		if v != nil && (v.Rate < 0 || v.Burst < 0) {
+			return fmt.Errorf("negative rate limit for '%s'", name)
+		}
+	}
+	if cl.MaxConcurrent != nil && *cl.MaxConcurrent < 0 {
+		return fmt.Errorf("negative concurrency limit for '%s'", name)
+	}
+	return nil
+}
+
+// limitsFor returns the limits of the client, with the defaults filled in.
+func (rl *RateLimiter) limitsFor(client string) effectiveLimits {
+	var el effectiveLimits
+	for _, v := range []ClientLimits{rl.cfg.Default, rl.cfg.Clients[client]} {
+		if v.Read != nil {
+			el.read = *v.Read
+		}
+		if v.Write != nil {
+			el.write = *v.Write
+		}
+		if v.MaxConcurrent != nil {
+			el.maxConcurrent = *v.MaxConcurrent
+		}
+	}
+	return el
+}
+
+// Acquire admits a read or write by the client, if its limits allow, and
+// returns the function to call once the request is done.  Otherwise it
+// returns a RateLimitError.
+func (rl *RateLimiter) Acquire(client string, write bool) (func(), error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+	cs := rl.clients[client]
+	if cs == nil {
+		el := rl.limitsFor(client)
+		cs = &clientState{limits: el,
+			read:  bucket{tokens: el.read.capacity(), last: now},
+			write: bucket{tokens: el.write.capacity(), last: now}}
+		rl.clients[client] = cs
+	}
+
+	if cs.limits.maxConcurrent > 0 && cs.inFlight >= cs.limits.maxConcurrent {
+		return nil, RateLimitError{Message: "too many concurrent requests",
+			RetryAfter: time.Second}
+	}
+	kind, b, lim := "reads", &cs.read, cs.limits.read
+	if write {
+		kind, b, lim = "writes", &cs.write, cs.limits.write
+	}
+	if wait := b.take(lim, now); wait > 0 {
+		return nil, RateLimitError{
+			Message:    "the rate limit for " + kind + " was exceeded",
+			RetryAfter: wait}
+	}
+
+	cs.inFlight++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rl.mu.Lock()
+			cs.inFlight--
+			rl.mu.Unlock()
+		})
+	}, nil
+}
+
+// CheckAuthFailures returns a RateLimitError if the address has used up
+// its failed authentication attempts, so its requests should be rejected
+// before their credentials are checked.
+func (rl *RateLimiter) CheckAuthFailures(addr string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b := rl.failures[addr]
+	if b == nil {
+		return nil
+	}
+	if wait := b.wait(*rl.cfg.AuthFailures, rl.now()); wait > 0 {
+		return RateLimitError{
+			Message:    "too many failed authentication attempts",
+			RetryAfter: wait}
+	}
+	return nil
+}
+
+// AuthFailed counts a failed authentication attempt from the address.
+func (rl *RateLimiter) AuthFailed(addr string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+	b := rl.failures[addr]
+	if b == nil {
+		b = &bucket{tokens: rl.cfg.AuthFailures.capacity(), last: now}
+		rl.failures[addr] = b
+	}
+	b.take(*rl.cfg.AuthFailures, now)
+}
+
+// sweep forgets the clients and addresses that have been idle long enough,
+// at most once per idle period.  It is called with the lock held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < idleClientAge {
+		return
+	}
+	rl.lastSweep = now
+	for k, v := range rl.clients {
+		if v.inFlight == 0 && now.Sub(v.read.last) > idleClientAge &&
+			now.Sub(v.write.last) > idleClientAge &&
+			v.read.full(v.limits.read, now) && v.write.full(v.limits.write, now) {
+			delete(rl.clients, k)
+		}
+	}
+	for k, v := range rl.failures {
+		if now.Sub(v.last) > idleClientAge && v.full(*rl.cfg.AuthFailures, now) {
+			delete(rl.failures, k)
+		}
+	}
+}
+
+// clientName returns the name the rate limits and idempotency keys of the
+// request's client are kept under: the principal it was authenticated as,
+// if any, or else its IP address.
+func clientName(r *http.Request) string {
+	p, ok := reqctx.PrincipalFromContext(r.Context())
+	if ok && p.Subject != "" {
+		return p.Subject
+	}
+	return remoteHost(r)
+}
+
+// remoteHost returns the IP address of the request's client.
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// statusWriter writes the response through, noting its status.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(sc int) {
+	if sw.status == 0 {
+		sw.status = sc
+	}
+	sw.ResponseWriter.WriteHeader(sc)
+}
+
+// Flush flushes the response, if the underlying writer can, so the
+// streamed responses still reach the client as they are written.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// LimitAuthFailures wraps the handler, so the requests from an address that
+// keeps failing to authenticate are rejected with HTTP 429 (Too Many
+// Requests), with a Retry-After header and a problem+json body, once it
+// has used up its attempts.  Each HTTP 401 (Unauthorized) or 403
+// (Forbidden) response counts as a failed attempt, as a key that isn't
+// valid is forbidden.  It goes outside RequireAuth, so the requests it
+// turns away, which have no valid credentials to be known by, are limited
+// by their address, as RateLimit can't see them.
+func LimitAuthFailures(rl *RateLimiter, next http.Handler,
+	log *zap.SugaredLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := remoteHost(r)
+		if err := rl.CheckAuthFailures(addr); err != nil {
+			re := err.(RateLimitError)
+			log.Infow("request was rate limited", "client", addr,
+				"method", r.Method, "url", r.URL.String(), "error", err)
+			w.Header().Set("Retry-After",
+				reqctx.RetryAfterSeconds(re.RetryAfter))
+			writeProblem(w, r, http.StatusTooManyRequests,
+				types.ProblemRateLimited, "", err.Error())
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == http.StatusUnauthorized ||
+			sw.status == http.StatusForbidden {
+			rl.AuthFailed(addr)
+		}
+	})
+}
+
+// isWrite reports whether a request with the method and path counts as a
+// write.  Reset clears the store whether it is a GET or a POST, so it is
+// always a write, as it always needs an admin in requiredRole.
+func isWrite(method, path string) bool {
+	if strings.TrimSuffix(path, "/") == resetURL {
+		return true
+	}
+	return method != http.MethodGet && method != http.MethodHead &&
+		method != http.MethodOptions
+}
+
+// RateLimit wraps the handler, so the requests of each client are limited
+// by the limiter.  The requests over the limits are rejected with HTTP 429
+// (Too Many Requests), with a Retry-After header and a problem+json body,
+// before they reach the handler, so a rejected add never gets as far as
+// the service.  It goes inside RequireAuth, so the clients with
+// credentials are limited by them, rather than by their address.
+func RateLimit(rl *RateLimiter, next http.Handler,
+	log *zap.SugaredLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientName(r)
+		release, err := rl.Acquire(client, isWrite(r.Method, r.URL.Path))
+		if err != nil {
+			re := err.(RateLimitError)
+			log.Infow("request was rate limited", "client", client,
+				"method", r.Method, "url", r.URL.String(), "error", err)
+			w.Header().Set("Retry-After",
+				reqctx.RetryAfterSeconds(re.RetryAfter))
+			writeProblem(w, r, http.StatusTooManyRequests,
+				types.ProblemRateLimited, "", err.Error())
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,279 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+)
+
+const testLimits = `{
+	"default": {
+		"read": {"rate": 10, "burst": 2},
+		"write": {"rate": 0.5, "burst": 1},
+		"max_concurrent": 2
+	},
+	"clients": {
+		"pos": {"write": {"rate": 0.1}},
+		"10.0.0.9": {"read": {"rate": 0}}
+	}
+}`
+
+func TestLimitAuthFailures(t *testing.T) {
+	rl, _, advance := newTestLimiter(t, `{
+		"default": {},
+		"auth_failures": {"rate": 0.5, "burst": 3}
+	}`)
+	ks, err := NewKeyStore("", "ops:0p3r4t0r")
+	if err != nil {
+		t.Fatalf("cannot load keys: %v", err)
+	}
+	calls := 0
+	handler := LimitAuthFailures(rl, RequireAuth(Authenticator{Keys: ks},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusTeapot)
+		}), newLogger(t)), newLogger(t))
+
+	for i, v := range []struct {
+		key       string
+		remote    string
+		advance   time.Duration
+		expStatus int
+		expRetry  string
+	}{
+		// A flood of guessed keys is cut off once the burst is used up,
+		// and so are the address's other requests, but not those of
+		// other addresses.
+		{key: "guess1", remote: "10.0.0.7:5123",
+			expStatus: http.StatusForbidden},
+		{remote: "10.0.0.7:5124", expStatus: http.StatusUnauthorized},
+		{key: "guess2", remote: "10.0.0.7:5125",
+			expStatus: http.StatusForbidden},
+		{key: "guess3", remote: "10.0.0.7:5126",
+			expStatus: http.StatusTooManyRequests, expRetry: "2"},
+		{key: "0p3r4t0r", remote: "10.0.0.7:5127",
+			expStatus: http.StatusTooManyRequests, expRetry: "2"},
+		{key: "0p3r4t0r", remote: "10.0.0.8:5123",
+			expStatus: http.StatusTeapot},
+
+		// Good requests use up nothing, and the attempts come back at
+		// the rate.
+		{key: "0p3r4t0r", remote: "10.0.0.7:5128", advance: 2 * time.Second,
+			expStatus: http.StatusTeapot},
+		{key: "guess4", remote: "10.0.0.7:5129",
+			expStatus: http.StatusForbidden},
+		{key: "guess5", remote: "10.0.0.7:5130",
+			expStatus: http.StatusTooManyRequests, expRetry: "2"},
+	} {
+		advance(v.advance)
+		req, err := http.NewRequest(http.MethodPost, produceURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = v.remote
+		if v.key != "" {
+			req.Header.Set(APIKeyHeader, v.key)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if rr.Header().Get("Retry-After") != v.expRetry {
+			t.Fatalf("(%d) unexpected Retry-After: '%s'", i,
+				rr.Header().Get("Retry-After"))
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("unexpected calls: %d", calls)
+	}
+}
+
+// newTestLimiter creates a limiter with the limits, whose clock only moves
+// when the returned function is called.
+func newTestLimiter(t *testing.T, limits string) (*RateLimiter, string,
+	func(time.Duration)) {
+	file := filepath.Join(t.TempDir(), "limits.json")
+	if err := ioutil.WriteFile(file, []byte(limits), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rl, err := NewRateLimiter(file)
+	if err != nil {
+		t.Fatalf("cannot create limiter: %v", err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+	return rl, file, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl, file, advance := newTestLimiter(t, testLimits)
+
+	var releases []func()
+	for i, v := range []struct {
+		client   string
+		write    bool
+		advance  time.Duration
+		release  bool
+		expErr   string
+		expRetry time.Duration
+	}{
+		// Reads come in bursts of two, at ten a second.
+		{client: "alice"},
+		{client: "alice", release: true},
+		{client: "alice", expErr: "the rate limit for reads was exceeded",
+			expRetry: 100 * time.Millisecond},
+		{client: "alice", advance: 100 * time.Millisecond, release: true},
+
+		// The writes have their own budget, of one every two seconds.
+		{client: "alice", write: true, release: true},
+		{client: "alice", write: true, advance: time.Second,
+			expErr:   "the rate limit for writes was exceeded",
+			expRetry: time.Second},
+		{client: "alice", write: true, advance: time.Second, release: true},
+
+		// Other clients have their own budgets.
+		{client: "bob", write: true, release: true},
+		{client: "pos", write: true, release: true},
+		{client: "pos", write: true, advance: 2 * time.Second,
+			expErr:   "the rate limit for writes was exceeded",
+			expRetry: 8 * time.Second},
+
+		// Only two requests may be in flight at once, even without a rate.
+		{client: "10.0.0.9"},
+		{client: "10.0.0.9"},
+		{client: "10.0.0.9", expErr: "too many concurrent requests",
+			expRetry: time.Second},
+	} {
+		advance(v.advance)
+		release, err := rl.Acquire(v.client, v.write)
+		if v.expErr != "" {
+			if err != (RateLimitError{Message: v.expErr,
+				RetryAfter: v.expRetry}) {
+				t.Fatalf("(%d) unexpected error: %#v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+		if v.release {
+			release()
+			release()
+		} else {
+			releases = append(releases, release)
+		}
+	}
+
+	// Once a request is done, another may start.
+	releases[len(releases)-1]()
+	if _, err := rl.Acquire("10.0.0.9", false); err != nil {
+		t.Fatalf("unexpected error after release: %v", err)
+	}
+
+	// The limits can be changed, but not to invalid ones.
+	for i, v := range []string{
+		`{"default": {"read": {"rate": -1}}}`,
+		`{"default": {"max_concurrent": -1}}`,
+		`{"clients": {"pos": {"write": {"burst": -1}}}}`,
+		`{"default":`,
+	} {
+		if err := ioutil.WriteFile(file, []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := rl.Reload(); err == nil {
+			t.Fatalf("(%d) expected error", i)
+		}
+	}
+	if err := ioutil.WriteFile(file, []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.Reload(); err != nil {
+		t.Fatalf("cannot reload: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := rl.Acquire("pos", true); err != nil {
+			t.Fatalf("(%d) unexpected error without limits: %v", i, err)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rl, _, _ := newTestLimiter(t, testLimits)
+	calls := 0
+	handler := RateLimit(rl, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusTeapot)
+	}), newLogger(t))
+
+	for i, v := range []struct {
+		method    string
+		url       string
+		remote    string
+		subject   string
+		expStatus int
+		expRetry  string
+		expDetail string
+	}{
+		{method: http.MethodPost, remote: "10.0.0.7:5123",
+			expStatus: http.StatusTeapot},
+		{
+			method: http.MethodPost, remote: "10.0.0.7:6001",
+			expStatus: http.StatusTooManyRequests, expRetry: "2",
+			expDetail: "the rate limit for writes was exceeded",
+		},
+		{method: http.MethodGet, remote: "10.0.0.7:6001",
+			expStatus: http.StatusTeapot},
+		{method: http.MethodPost, remote: "10.0.0.8:5123",
+			expStatus: http.StatusTeapot},
+		{method: http.MethodPost, remote: "10.0.0.7:5123", subject: "pos",
+			expStatus: http.StatusTeapot},
+		{method: http.MethodDelete, remote: "10.0.0.8:5123", subject: "pos",
+			expStatus: http.StatusTooManyRequests, expRetry: "10"},
+		{method: http.MethodGet, url: resetURL, remote: "10.0.0.9:5123",
+			expStatus: http.StatusTeapot},
+		{
+			method: http.MethodGet, url: resetURL, remote: "10.0.0.9:6001",
+			expStatus: http.StatusTooManyRequests, expRetry: "2",
+			expDetail: "the rate limit for writes was exceeded",
+		},
+	} {
+		url := v.url
+		if url == "" {
+			url = produceURL
+		}
+		req, err := http.NewRequest(v.method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = v.remote
+		if v.subject != "" {
+			req = req.WithContext(reqctx.WithPrincipal(req.Context(),
+				reqctx.Principal{Subject: v.subject}))
+		}
+		before := calls
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) handler returned wrong status code: got %d, expected %d",
+				i, rr.Code, v.expStatus)
+		}
+		if rr.Header().Get("Retry-After") != v.expRetry {
+			t.Fatalf("(%d) unexpected Retry-After: '%s'", i,
+				rr.Header().Get("Retry-After"))
+		}
+		if v.expDetail != "" && decodeProblem(t, rr).Detail != v.expDetail {
+			t.Fatalf("(%d) unexpected body: %s", i, rr.Body.String())
+		}
+		if (calls != before) != (v.expStatus == http.StatusTeapot) {
+			t.Fatalf("(%d) a rejected request reached the handler", i)
+		}
+	}
+}
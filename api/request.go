@@ -0,0 +1,28 @@
+package api
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+)
+
+// RequestIDHeader is the header carrying the ID of a request.  A client
+// may give its own ID, and otherwise one is generated.  Either way, it is
+// returned in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// newRequestInfo returns the info for the request, with its own ID if it
+// has a valid one.  The client IP is that of the connection, as forwarding
+// headers can't be trusted without knowing the proxies.
+func newRequestInfo(r *http.Request) reqctx.RequestInfo {
+	info := reqctx.RequestInfo{ID: r.Header.Get(RequestIDHeader)}
+	if !reqctx.ValidRequestID(info.ID) {
+		info.ID = reqctx.NewRequestID()
+	}
+	info.ClientIP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		info.ClientIP = host
+	}
+	return info
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+)
+
+func TestRequestInfo(t *testing.T) {
+	for i, v := range []struct {
+		id     string
+		remote string
+		expID  string
+		expIP  string
+	}{
+		{id: "abc-123", remote: "10.0.0.7:5123", expID: "abc-123",
+			expIP: "10.0.0.7"},
+		{remote: "[::1]:5123", expIP: "::1"},
+		{id: "has space", remote: "10.0.0.7:5123", expIP: "10.0.0.7"},
+		{id: strings.Repeat("x", 129), remote: "pipe",
+			expIP: "pipe"},
+	} {
+		var info reqctx.RequestInfo
+		var principal reqctx.Principal
+		handler := wrapContext(context.Background(),
+			func(w http.ResponseWriter, r *http.Request) {
+				info, _ = reqctx.RequestInfoFromContext(r.Context())
+				principal, _ = reqctx.PrincipalFromContext(r.Context())
+			})
+		req, err := http.NewRequest(http.MethodGet, statusURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(RequestIDHeader, v.id)
+		req.RemoteAddr = v.remote
+		req = req.WithContext(reqctx.WithPrincipal(req.Context(),
+			reqctx.Principal{Subject: "alice"}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if v.expID != "" && info.ID != v.expID {
+			t.Fatalf("(%d) unexpected ID: '%s'", i, info.ID)
+		}
+		if v.expID == "" && (len(info.ID) != 16 || info.ID == v.id) {
+			t.Fatalf("(%d) unexpected generated ID: '%s'", i, info.ID)
+		}
+		if rr.Header().Get(RequestIDHeader) != info.ID {
+			t.Fatalf("(%d) ID wasn't returned: '%s'", i,
+				rr.Header().Get(RequestIDHeader))
+		}
+		if info.ClientIP != v.expIP {
+			t.Fatalf("(%d) unexpected client IP: '%s'", i, info.ClientIP)
+		}
+		if principal.Subject != "alice" {
+			t.Fatalf("(%d) the principal wasn't carried over", i)
+		}
+	}
+}
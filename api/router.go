@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// router dispatches requests to their handlers by method and path.  The
+// path of a route is a pattern, whose segments may be parameters, such as
+// "{code}" in "/v1/produce/{code}", each of which matches any single
+// segment and is passed to the handler in the request context, to be read
+// with pathParam.  A trailing slash on a path is ignored.  When more than
+// one pattern matches a path, the one with a literal segment where the
+// other has a parameter wins, so "/v1/produce/import" is matched before
+// "/v1/produce/{code}".
+//
+// A path that no pattern matches gets HTTP 404, and a method that the
+// route has no handler for gets HTTP 405 (Method Not Allowed), with the
+// methods it has in the Allow header.  HEAD is handled by the GET handler,
+// with the body discarded, and OPTIONS is answered with the Allow header,
+// so neither is registered.
+type router struct {
+	routes []*route
+}
+
+// route is the handler for each method of a single path pattern.
+type route struct {
+	pattern  string
+	segments []string
+	handlers map[string]http.Handler
+}
+
+// newRouter returns a router with no routes.
+func newRouter() *router {
+	return &router{}
+}
+
+// handle registers the handler for the method and path pattern.
+func (rt *router) handle(method, pattern string, h http.Handler) {
+	pattern = strings.TrimSuffix(pattern, "/")
+	for _, v := range rt.routes {
+		if v.pattern == pattern {
+			v.handlers[method] = h
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		pattern:  pattern,
+		segments: strings.Split(pattern, "/"),
+		handlers: map[string]http.Handler{method: h},
+	})
+}
+
+// ServeHTTP dispatches the request to the handler of its route.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rte, params := rt.match(r.URL.EscapedPath())
+	if rte == nil {
+		writeNoRoute(w, r)
+		return
+	}
+	if len(params) != 0 {
+		r = r.WithContext(withPathParams(r.Context(), params))
+	}
+
+	h, ok := rte.handlers[r.Method]
+	switch {
+	case ok:
+	case r.Method == http.MethodHead && rte.handlers[http.MethodGet] != nil:
+		h = rte.handlers[http.MethodGet]
+		w = headWriter{w}
+	case r.Method == http.MethodOptions:
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		w.Header().Set("Allow", rte.allow())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", rte.allow())
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// match returns the most specific route whose pattern matches the escaped
+// path, along with the values of its parameters, or nil if none match.
+func (rt *router) match(path string) (*route, map[string]string) {
+	if path != "/" {
+		path = strings.TrimSuffix(path, "/")
+	}
+	segments := strings.Split(path, "/")
+	var best *route
+	var bestParams map[string]string
+	for _, v := range rt.routes {
+		params, ok := v.match(segments)
+		if ok && (best == nil || v.moreSpecific(best)) {
+			best, bestParams = v, params
+		}
+	}
+	return best, bestParams
+}
+
+// match returns whether the route's pattern matches the escaped segments
+// of a path, and if so, the unescaped values of its parameters.
+func (rte *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rte.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, v := range rte.segments {
+		name, ok := paramName(v)
+		if !ok {
+			if segments[i] != v {
+				return nil, false
+			}
+			continue
+		}
+		val, err := url.PathUnescape(segments[i])
+		if err != nil || val == "" {
+			return nil, false
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = val
+	}
+	return params, true
+}
+
+// moreSpecific returns whether the route's pattern has a literal segment
+// where the other's has a parameter, before any segment where the reverse
+// is true.  Both patterns are taken to match the same path.
+func (rte *route) moreSpecific(other *route) bool {
+	for i, v := range rte.segments {
+		_, param := paramName(v)
+		_, otherParam := paramName(other.segments[i])
+		if param != otherParam {
+			return otherParam
+		}
+	}
+	return false
+}
+
+// allow returns the value of the Allow header for the route, which lists
+// its methods, including HEAD if it has GET, and OPTIONS.
+func (rte *route) allow() string {
+	methods := []string{http.MethodOptions}
+	for k := range rte.handlers {
+		methods = append(methods, k)
+	}
+	if _, ok := rte.handlers[http.MethodGet]; ok {
+		if _, ok := rte.handlers[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// paramName returns the name of the parameter a pattern segment holds,
+// such as "code" for "{code}", and whether it holds one.
+func paramName(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") &&
+		strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+// pathParamsKey is the context key for the path parameters.
+type pathParamsKey struct{}
+
+// withPathParams returns a copy of the context carrying the values of the
+// path parameters of a request.
+func withPathParams(ctx context.Context,
+	params map[string]string) context.Context {
+	return context.WithValue(ctx, pathParamsKey{}, params)
+}
+
+// pathParamsFromContext returns the values of the path parameters of the
+// request being handled, if it has any.
+func pathParamsFromContext(ctx context.Context) (map[string]string, bool) {
+	params, ok := ctx.Value(pathParamsKey{}).(map[string]string)
+	return params, ok
+}
+
+// pathParam returns the unescaped value of the named path parameter of
+// the request, such as the code of "/v1/produce/{code}".
+func pathParam(r *http.Request, name string) string {
+	params, _ := pathParamsFromContext(r.Context())
+	return params[name]
+}
+
+// headWriter discards the body of the response to a HEAD request, so the
+// GET handler can write the response as usual.
+type headWriter struct {
+	http.ResponseWriter
+}
+
+// Write discards the body.
+func (hw headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Flush flushes the headers, if the underlying writer can.
+func (hw headWriter) Flush() {
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+func TestRouter(t *testing.T) {
+	// Each handler writes its name and the path parameter.
+	named := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(name + ":" + pathParam(r, "code")))
+		}
+	}
+	rt := newRouter()
+	rt.handle(http.MethodGet, produceURL, named("list"))
+	rt.handle(http.MethodPost, produceURL, named("add"))
+	rt.handle(http.MethodGet, produceItemURL, named("get"))
+	rt.handle(http.MethodDelete, produceItemURL, named("delete"))
+	rt.handle(http.MethodPost, importURL, named("import"))
+
+	for i, v := range []struct {
+		method    string
+		url       string
+		expStatus int
+		expBody   string
+		expAllow  string
+	}{
+		{method: http.MethodGet, url: produceURL, expStatus: http.StatusOK,
+			expBody: "list:"},
+		{method: http.MethodGet, url: produceURL + "/", expStatus: http.StatusOK,
+			expBody: "list:"},
+		{method: http.MethodPost, url: produceURL, expStatus: http.StatusOK,
+			expBody: "add:"},
+		{method: http.MethodGet, url: produceURL + "/A12T-4GH7-QPL9-3N4M/",
+			expStatus: http.StatusOK, expBody: "get:A12T-4GH7-QPL9-3N4M"},
+		{method: http.MethodDelete, url: produceURL + "/Stone%20Fruit%2F1",
+			expStatus: http.StatusOK, expBody: "delete:Stone Fruit/1"},
+
+		// A literal segment is matched before a parameter.
+		{method: http.MethodPost, url: importURL, expStatus: http.StatusOK,
+			expBody: "import:"},
+		{method: http.MethodGet, url: importURL,
+			expStatus: http.StatusMethodNotAllowed, expAllow: "OPTIONS, POST"},
+
+		// HEAD is handled by GET without the body, and OPTIONS lists the
+		// methods.
+		{method: http.MethodHead, url: produceURL, expStatus: http.StatusOK},
+		{method: http.MethodOptions, url: produceURL + "/A12T-4GH7-QPL9-3N4M",
+			expStatus: http.StatusNoContent,
+			expAllow:  "DELETE, GET, HEAD, OPTIONS"},
+		{method: http.MethodPut, url: produceURL,
+			expStatus: http.StatusMethodNotAllowed,
+			expAllow:  "GET, HEAD, OPTIONS, POST"},
+
+		{method: http.MethodGet, url: produceURL + "/x/y",
+			expStatus: http.StatusNotFound},
+		{method: http.MethodGet, url: produceURL + "//",
+			expStatus: http.StatusNotFound},
+		{method: http.MethodGet, url: "/v1", expStatus: http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(v.method, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		rt.ServeHTTP(rr, req)
+		if rr.Code != v.expStatus {
+			t.Fatalf("(%d) wrong status code: got %d, expected %d", i, rr.Code,
+				v.expStatus)
+		}
+		if rr.Code < http.StatusBadRequest && rr.Body.String() != v.expBody {
+			t.Fatalf("(%d) unexpected body: '%s'", i, rr.Body.String())
+		}
+		if allow := rr.Header().Get("Allow"); allow != v.expAllow {
+			t.Fatalf("(%d) unexpected Allow header: '%s'", i, allow)
+		}
+		if rr.Code >= http.StatusBadRequest {
+			p := decodeProblem(t, rr)
+			if (rr.Code == http.StatusNotFound) !=
+				(p.Code == types.ProblemNoRoute) {
+				t.Fatalf("(%d) unexpected problem: %+v", i, p)
+			}
+		}
+	}
+}
+
+// errResetCalled is returned by the dummy service if reset is called.
+var errResetCalled = errors.New("reset was called")
+
+func TestHeadRequests(t *testing.T) {
+	// A HEAD of a list has the headers of a GET, and no body.
+	d := DummyService{existing: []types.Produce{dfltProduce}}
+	handler := newTestRouter(t, apiImpl{service: d, log: newLogger(t)})
+	req, err := http.NewRequest(http.MethodHead, produceURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 ||
+		rr.Header().Get("Content-Type") != "application/json; charset=UTF-8" {
+		t.Fatalf("unexpected HEAD response: %d, '%s'", rr.Code,
+			rr.Body.String())
+	}
+
+	// A HEAD of reset deletes nothing.
+	d.err = errResetCalled
+	handler = newTestRouter(t, apiImpl{service: d, log: newLogger(t)})
+	req, err = http.NewRequest(http.MethodHead, resetURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected HEAD response for reset: %d", rr.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// streamFlushItems is the number of items written between flushes when
+// streaming a list, so the client gets the items steadily without a flush
+// for every one.
+const streamFlushItems = 64
+
+// streamList writes the items matching the filter one at a time, as they
+// are read from the store, so the whole list is never held in memory.
+// The items are written as NDJSON, or otherwise as a JSON array formatted
+// the same as the regular list response.
+//
+// Errors are only reported with an HTTP status if they occur before the
+// first item is written.  After that, the response is cut short, which the
+// client will see as truncated JSON.
+func (a apiImpl) streamList(w http.ResponseWriter, r *http.Request,
+	filter types.ProduceFilter, ndjson bool) {
+	prefs := parseAcceptLanguage(r.Header.Get("Accept-Language"))
+	allNames, _ := strconv.ParseBool(r.URL.Query().Get("all_names"))
+	flusher, _ := w.(http.Flusher)
+
+	count := 0
+	start := func() {
+		if ndjson {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		} else {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	err := a.service.Iterate(r.Context(), filter, func(item types.Produce) error {
+		items := []types.Produce{item}
+		localizeNames(items, prefs, allNames)
+
+		// Indent the items as MarshalIndent would as array elements.
+		var b []byte
+		var err error
+		if ndjson {
+			b, err = json.Marshal(items[0])
+			b = append(b, '\n')
+		} else {
+			b, err = json.MarshalIndent(items[0], "  ", "  ")
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case count == 0:
+			start()
+			if !ndjson {
+				w.Write([]byte("[\n  "))
+			}
+		case !ndjson:
+			w.Write([]byte(",\n  "))
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		count++
+		if flusher != nil && count%streamFlushItems == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if count == 0 {
+			a.writeError(w, r, err)
+		} else {
+			a.log.Warnw("error streaming list", "error", err, "items", count)
+		}
+		return
+	}
+
+	switch {
+	case count == 0:
+		start()
+		if !ndjson {
+			w.Write([]byte("[]"))
+		}
+	case !ndjson:
+		w.Write([]byte("\n]"))
+	}
+}
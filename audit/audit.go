@@ -0,0 +1,280 @@
+// Package audit keeps a tamper-evident record of every change to the
+// produce catalog: who made it, from where, in which request, and the
+// produce items before and after.  The records are appended to a local
+// file, one JSON object per line, and each is hash-chained to the one
+// before it, so editing or removing a record breaks the chain, which
+// Verify detects.
+//
+// Each line has the form {"hash": "<hex>", "record": {...}}, where the hash
+// is the HMAC-SHA256 of the bytes of the record exactly as written, keyed
+// with the log's secret key, and the record carries the hash of the
+// previous line in "prev_hash".  The first record has an empty
+// "prev_hash".  Without the key, the hashes can't be recomputed for an
+// edited record, so even someone who can rewrite the whole file can't
+// forge a chain that checks out.  A log may be kept without a key, in
+// which case the hash is the plain SHA-256 digest, which anyone can
+// recompute, so the chain only shows tampering if its head is noted
+// somewhere the file's editor can't reach, and passed to Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// The actions that are recorded, which are the kinds of change made to the
+// store.
+const (
+	ActionAdd             = store.ChangeAdd
+	ActionDelete          = store.ChangeDelete
+	ActionReset           = store.ChangeReset
+	ActionAddCategory     = store.ChangeAddCategory
+	ActionDeleteCategory  = store.ChangeDeleteCategory
+	ActionAddAttribute    = store.ChangeAddAttribute
+	ActionDeleteAttribute = store.ChangeDeleteAttribute
+)
+
+// Record is a single change to the catalog.  Before is the produce item
+// before the change, and After the item after it, so an add has only
+// After, and a delete only Before.  A reset lists the items it removed,
+// and is followed by a delete for each category and attribute it removed.
+// The changes to categories and attributes name them in Target, and those
+// to attributes have the definition in Attribute.
+type Record struct {
+	Seq       uint64              `json:"seq"`
+	Time      time.Time           `json:"time"`
+	Action    string              `json:"action"`
+	Actor     string              `json:"actor"`
+	ClientIP  string              `json:"client_ip,omitempty"`
+	RequestID string              `json:"request_id,omitempty"`
+	Code      string              `json:"code,omitempty"`
+	Target    string              `json:"target,omitempty"`
+	Before    *types.Produce      `json:"before,omitempty"`
+	After     *types.Produce      `json:"after,omitempty"`
+	Removed   []types.Produce     `json:"removed,omitempty"`
+	Attribute *types.AttributeDef `json:"attribute,omitempty"`
+	PrevHash  string              `json:"prev_hash"`
+}
+
+// line is a line of the file, with the record kept as written, so its
+// hash can be checked.
+type line struct {
+	Hash   string          `json:"hash"`
+	Record json.RawMessage `json:"record"`
+}
+
+// TamperError is returned by Verify for a log that has been changed.  Line
+// is the line number of the first record that doesn't check out.
+type TamperError struct {
+	Line   int
+	Reason string
+}
+
+func (te TamperError) Error() string {
+	return fmt.Sprintf("audit log was tampered with at line %d: %s", te.Line,
+		te.Reason)
+}
+
+// Summary describes a log that checks out: the number of records and the
+// hash of the last one, which may be noted, and passed to a later Verify,
+// to detect the removal of records from the end, which the chain alone
+// can't.
+type Summary struct {
+	Records int
+	Head    string
+}
+
+// logFile is the file a log is written to, which is an *os.File.
+type logFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// Log is an append-only audit log.  It is safe for concurrent use.  The
+// size is the length of the file up to the end of the last record that was
+// written in full, and damaged is set if an append that failed couldn't be
+// undone, so nothing more is written after a partial record.
+type Log struct {
+	mu      sync.Mutex
+	f       logFile
+	key     []byte
+	seq     uint64
+	head    string
+	size    int64
+	damaged error
+}
+
+// ReadKeyFile reads the secret key of a log from the file, ignoring the
+// white space around it.
+func ReadKeyFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, errors.New(path + ": the audit key is empty")
+	}
+	return key, nil
+}
+
+// Open opens the audit log in the file, creating it if needed, with the
+// secret key the records are hashed with, or none.  An existing log is
+// verified first, with the same key, so records are never chained to one
+// that has been tampered with.
+func Open(path string, key []byte) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := Verify(f, "", key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Log{f: f, key: key, seq: uint64(sum.Records), head: sum.Head,
+		size: size}, nil
+}
+
+// Append chains the records to the log and writes them, setting the
+// sequence number, the previous hash and, if it is zero, the time of each.
+// The records are written together, and synced to disk before Append
+// returns.  If they can't be, the file is truncated back to the end of the
+// last record, so a partial record never breaks the chain, and if even
+// that fails, the log refuses any more records.
+func (l *Log) Append(recs ...Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.damaged != nil {
+		return fmt.Errorf("the log was left damaged by an earlier failure: %v",
+			l.damaged)
+	}
+	seq, head := l.seq, l.head
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		seq++
+		rec.Seq = seq
+		rec.PrevHash = head
+		if rec.Time.IsZero() {
+			rec.Time = time.Now()
+		}
+		rec.Time = rec.Time.UTC()
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		head = hashOf(l.key, b)
+
+		buf.WriteString(`{"hash":"` + head + `","record":`)
+		buf.Write(b)
+		buf.WriteString("}\n")
+	}
+	_, err := l.f.Write(buf.Bytes())
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		if terr := l.f.Truncate(l.size); terr != nil {
+			l.damaged = terr
+			return fmt.Errorf("%v, and the partial record can't be removed: %v",
+				err, terr)
+		}
+		return err
+	}
+	l.seq, l.head = seq, head
+	l.size += int64(buf.Len())
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Verify reads the log and checks that each record has the hash given for
+// it, with the key the log was written with, follows on from the one
+// before it, and is numbered in sequence.  It returns a TamperError for
+// the first record that doesn't.  The anchor, if it isn't empty, is the
+// head of the log when it was checked before, and the record with that
+// hash must still be there.
+func Verify(r io.Reader, anchor string, key []byte) (Summary, error) {
+	var sum Summary
+	anchored := anchor == ""
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			if !anchored {
+				return sum, TamperError{Line: n, Reason: fmt.Sprintf(
+					"the record with hash %s is missing", anchor)}
+			}
+			return sum, nil
+		}
+		if err != nil && err != io.EOF {
+			return sum, err
+		}
+		if err == io.EOF {
+			return sum, TamperError{Line: n, Reason: "the line is incomplete"}
+		}
+
+		var ln line
+		if err := json.Unmarshal(b, &ln); err != nil || len(ln.Record) == 0 {
+			return sum, TamperError{Line: n, Reason: "the line is malformed"}
+		}
+		if hashOf(key, ln.Record) != ln.Hash {
+			return sum, TamperError{Line: n,
+				Reason: "the record doesn't match its hash"}
+		}
+		var rec Record
+		if err := json.Unmarshal(ln.Record, &rec); err != nil {
+			return sum, TamperError{Line: n, Reason: "the record is malformed"}
+		}
+		if rec.PrevHash != sum.Head {
+			return sum, TamperError{Line: n,
+				Reason: "the record doesn't follow the one before it"}
+		}
+		if rec.Seq != uint64(sum.Records)+1 {
+			return sum, TamperError{Line: n, Reason: fmt.Sprintf(
+				"record %d is out of sequence", rec.Seq)}
+		}
+		sum.Records++
+		sum.Head = ln.Hash
+		anchored = anchored || ln.Hash == anchor
+	}
+}
+
+// hashOf returns the HMAC-SHA256 of the bytes with the key, or without a
+// key, their SHA-256 digest, in hex.
+func hashOf(key, b []byte) string {
+	if len(key) == 0 {
+		h := sha256.Sum256(b)
+		return hex.EncodeToString(h[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,380 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+)
+
+var (
+	dfltProduce = types.Produce{
+		Code:      "A12T-4GH7-QPL9-3N4M",
+		Name:      "Lettuce",
+		UnitPrice: types.USD(346),
+	}
+
+	secondProduce = types.Produce{
+		Code:      "YRT6-72AS-K736-L4AR",
+		Name:      "Green Pepper",
+		UnitPrice: types.USD(79),
+	}
+)
+
+// readRecords reads the records of the log, in order.
+func readRecords(t *testing.T, path string) []Record {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []Record
+	for _, v := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		var ln struct {
+			Record Record `json:"record"`
+		}
+		if err := json.Unmarshal(v, &ln); err != nil {
+			t.Fatalf("cannot read record: %v", err)
+		}
+		recs = append(recs, ln.Record)
+	}
+	return recs
+}
+
+func TestStore(t *testing.T) {
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	al, err := Open(path, nil)
+	if err != nil {
+		t.Fatalf("cannot open log: %v", err)
+	}
+	defer al.Close()
+	svc := service.New(NewStore(al), lg.Sugar())
+
+	ctx := reqctx.WithRequestInfo(reqctx.WithPrincipal(context.Background(),
+		reqctx.Principal{Subject: "alice"}),
+		reqctx.RequestInfo{ID: "req-1", ClientIP: "10.0.0.7"})
+	if err := svc.AddCategory(ctx, types.Category{Name: "vegetables"}); err != nil {
+		t.Fatalf("cannot add category: %v", err)
+	}
+	if err := svc.AddCategory(ctx, types.Category{Name: "peppers",
+		Parent: "vegetables"}); err != nil {
+		t.Fatalf("cannot add category: %v", err)
+	}
+	organic := types.AttributeDef{Name: "organic", Type: types.AttributeBool}
+	if err := svc.AddAttribute(ctx, organic); err != nil {
+		t.Fatalf("cannot add attribute: %v", err)
+	}
+	lower := dfltProduce
+	lower.Code, lower.Category = strings.ToLower(lower.Code), "vegetables"
+	res, err := svc.Add(ctx, []types.Produce{lower,
+		{Name: "Green Pepper", UnitPrice: types.USD(79)}, lower})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := svc.Delete(ctx, dfltProduce.Code); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := svc.Delete(ctx, dfltProduce.Code); err == nil {
+		t.Fatal("expected second delete to fail")
+	}
+	if err := svc.Clear(context.Background()); err != nil {
+		t.Fatalf("clear failed: %v", err)
+	}
+
+	// The failed add and delete aren't recorded, and the items are
+	// recorded as stored.
+	stored := dfltProduce
+	stored.Category = "Vegetables"
+	generated := types.Produce{Code: res[1].Code, Name: "Green Pepper",
+		UnitPrice: types.USD(79)}
+	recs := readRecords(t, path)
+	var adds []Record
+	for i, v := range recs {
+		if v.Seq != uint64(i+1) || v.Time.IsZero() {
+			t.Fatalf("(%d) unexpected record: %+v", i, v)
+		}
+		if v.Action == ActionAdd {
+			adds = append(adds, v)
+		}
+	}
+	if len(recs) != 10 || len(adds) != 2 {
+		t.Fatalf("unexpected records: %+v", recs)
+	}
+	// The adds run concurrently, so may be recorded in either order.
+	if adds[0].Code != stored.Code {
+		adds[0], adds[1] = adds[1], adds[0]
+	}
+	for i, v := range []struct {
+		rec Record
+		exp Record
+	}{
+		{recs[0], Record{Action: ActionAddCategory, Target: "Vegetables"}},
+		{recs[1], Record{Action: ActionAddCategory, Target: "Peppers"}},
+		{recs[2], Record{Action: ActionAddAttribute, Target: "organic",
+			Attribute: &organic}},
+		{adds[0], Record{Action: ActionAdd, Code: stored.Code, After: &stored}},
+		{adds[1], Record{Action: ActionAdd, Code: generated.Code,
+			After: &generated}},
+		{recs[5], Record{Action: ActionDelete, Code: stored.Code,
+			Before: &stored}},
+
+		// The reset records the categories, children first, and the
+		// attributes it removes, as well as the items.
+		{recs[6], Record{Action: ActionReset,
+			Removed: []types.Produce{generated}}},
+		{recs[7], Record{Action: ActionDeleteCategory, Target: "Peppers"}},
+		{recs[8], Record{Action: ActionDeleteCategory, Target: "Vegetables"}},
+		{recs[9], Record{Action: ActionDeleteAttribute, Target: "organic",
+			Attribute: &organic}},
+	} {
+		v.exp.Actor, v.exp.ClientIP, v.exp.RequestID = "alice", "10.0.0.7",
+			"req-1"
+		if v.rec.Seq > 6 {
+			v.exp.Actor, v.exp.ClientIP, v.exp.RequestID = anonymous, "", ""
+		}
+		v.exp.Seq, v.exp.Time, v.exp.PrevHash = v.rec.Seq, v.rec.Time,
+			v.rec.PrevHash
+		if !reflect.DeepEqual(v.rec, v.exp) {
+			t.Fatalf("(%d) unexpected record: %+v", i, v.rec)
+		}
+	}
+}
+
+// shortFile writes only part of what it is given, as when the disk fills
+// up part way through a write.
+type shortFile struct {
+	logFile
+}
+
+func (sf shortFile) Write(b []byte) (int, error) {
+	n, _ := sf.logFile.Write(b[:len(b)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestAppendFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	al, err := Open(path, nil)
+	if err != nil {
+		t.Fatalf("cannot open log: %v", err)
+	}
+	defer al.Close()
+	if err := al.Append(Record{Action: ActionAdd, Code: "a"}); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+
+	// The partial record of a failed append is removed, so the log goes on
+	// from the last record, and can still be verified and opened.
+	f := al.f
+	al.f = shortFile{logFile: f}
+	if err := al.Append(Record{Action: ActionAdd, Code: "b"}); err == nil {
+		t.Fatal("expected append to fail")
+	}
+	al.f = f
+	if err := al.Append(Record{Action: ActionAdd, Code: "c"}); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	recs := readRecords(t, path)
+	if len(recs) != 2 || recs[0].Code != "a" || recs[1].Code != "c" ||
+		recs[1].Seq != 2 {
+		t.Fatalf("unexpected records: %+v", recs)
+	}
+	reopened, err := Open(path, nil)
+	if err != nil {
+		t.Fatalf("cannot reopen log: %v", err)
+	}
+	reopened.Close()
+}
+
+func TestStoreUnrecorded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	al, err := Open(path, nil)
+	if err != nil {
+		t.Fatalf("cannot open log: %v", err)
+	}
+	st := NewStore(al)
+	if err := st.Add(context.Background(), dfltProduce); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	// With the log closed, the changes can't be recorded, so they fail,
+	// and aren't made.
+	al.Close()
+	if err := st.Add(context.Background(), secondProduce); err == nil {
+		t.Fatal("expected add to fail")
+	}
+	if err := st.Delete(context.Background(), dfltProduce.Code); err == nil {
+		t.Fatal("expected delete to fail")
+	}
+	if err := st.Clear(context.Background()); err == nil {
+		t.Fatal("expected clear to fail")
+	}
+	items, err := st.ListAll(context.Background())
+	if err != nil || !reflect.DeepEqual(items, []types.Produce{dfltProduce}) {
+		t.Fatalf("unexpected items: %+v, %v", items, err)
+	}
+	if recs := readRecords(t, path); len(recs) != 1 {
+		t.Fatalf("unexpected records: %+v", recs)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	al, err := Open(path, nil)
+	if err != nil {
+		t.Fatalf("cannot open log: %v", err)
+	}
+	for _, v := range []Record{
+		{Action: ActionAdd, Actor: "alice", Code: dfltProduce.Code,
+			After: &dfltProduce},
+		{Action: ActionAdd, Actor: "bob", Code: secondProduce.Code,
+			After: &secondProduce},
+	} {
+		if err := al.Append(v); err != nil {
+			t.Fatalf("cannot append: %v", err)
+		}
+	}
+	al.Close()
+
+	// Reopening the log continues the chain.
+	al, err = Open(path, nil)
+	if err != nil {
+		t.Fatalf("cannot reopen log: %v", err)
+	}
+	if err := al.Append(Record{Action: ActionDelete, Actor: "alice",
+		Code: dfltProduce.Code, Before: &dfltProduce}); err != nil {
+		t.Fatalf("cannot append: %v", err)
+	}
+	al.Close()
+
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := Verify(bytes.NewReader(orig), "", nil)
+	if err != nil || sum.Records != 3 {
+		t.Fatalf("unexpected result: %+v, %v", sum, err)
+	}
+	lines := strings.SplitAfter(string(orig), "\n")[:3]
+	_, err = Verify(bytes.NewReader(orig), hashOfLine(t, lines[1]), nil)
+	if err != nil {
+		t.Fatalf("the anchor wasn't found: %v", err)
+	}
+
+	// An edited record whose hash is recomputed no longer matches the
+	// previous hash in the next record.
+	edited := strings.Replace(lines[1], `"$0.79"`, `"$0.07"`, 1)
+	rehashed := rehash(t, edited)
+
+	for i, v := range []struct {
+		log     string
+		anchor  string
+		expLine int
+		expMsg  string
+	}{
+		{log: lines[0] + edited + lines[2], expLine: 2,
+			expMsg: "the record doesn't match its hash"},
+		{log: lines[0] + rehashed + lines[2], expLine: 3,
+			expMsg: "the record doesn't follow the one before it"},
+		{log: lines[0] + lines[2], expLine: 2,
+			expMsg: "the record doesn't follow the one before it"},
+		{log: lines[1] + lines[0] + lines[2], expLine: 1,
+			expMsg: "the record doesn't follow the one before it"},
+		{log: lines[0] + lines[1], anchor: sum.Head, expLine: 3,
+			expMsg: "the record with hash " + sum.Head + " is missing"},
+		{log: lines[0] + strings.TrimSuffix(lines[1], "\n"), expLine: 2,
+			expMsg: "the line is incomplete"},
+		{log: lines[0] + "{}\n", expLine: 2, expMsg: "the line is malformed"},
+	} {
+		_, err := Verify(strings.NewReader(v.log), v.anchor, nil)
+		if err != (TamperError{Line: v.expLine, Reason: v.expMsg}) {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+	}
+
+	// A log that has been tampered with can't be opened for appending.
+	if err := ioutil.WriteFile(path, []byte(lines[0]+edited), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, nil); err == nil {
+		t.Fatal("expected error opening a tampered log")
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key := []byte("s3cret")
+	al, err := Open(path, key)
+	if err != nil {
+		t.Fatalf("cannot open log: %v", err)
+	}
+	if err := al.Append(Record{Action: ActionAdd, Actor: "alice",
+		Code: dfltProduce.Code, After: &dfltProduce}, Record{
+		Action: ActionAdd, Actor: "bob", Code: secondProduce.Code,
+		After: &secondProduce}); err != nil {
+		t.Fatalf("cannot append: %v", err)
+	}
+	al.Close()
+
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := Verify(bytes.NewReader(orig), "", key); err != nil ||
+		sum.Records != 2 {
+		t.Fatalf("unexpected result: %+v, %v", sum, err)
+	}
+
+	// Without the key, an edited record can't be given a hash that checks
+	// out, and the log only checks out with the key it was written with.
+	lines := strings.SplitAfter(string(orig), "\n")[:2]
+	edited := rehash(t, strings.Replace(lines[0], `"$3.46"`, `"$0.46"`, 1))
+	for i, v := range []struct {
+		log string
+		key []byte
+	}{
+		{log: edited + lines[1], key: key},
+		{log: string(orig), key: []byte("guess")},
+		{log: string(orig)},
+	} {
+		_, err := Verify(strings.NewReader(v.log), "", v.key)
+		if err != (TamperError{Line: 1,
+			Reason: "the record doesn't match its hash"}) {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+	}
+	if _, err := Open(path, []byte("guess")); err == nil {
+		t.Fatal("expected error opening the log with the wrong key")
+	}
+}
+
+// hashOfLine returns the hash given in the line.
+func hashOfLine(t *testing.T, ln string) string {
+	var l line
+	if err := json.Unmarshal([]byte(ln), &l); err != nil {
+		t.Fatal(err)
+	}
+	return l.Hash
+}
+
+// rehash replaces the hash of the line with that of its record.
+func rehash(t *testing.T, ln string) string {
+	var l line
+	if err := json.Unmarshal([]byte(ln), &l); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(ln, l.Hash, hashOf(nil, l.Record), 1)
+}
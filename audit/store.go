@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"github.com/gdotgordon/produce-demo/store"
+)
+
+// anonymous is the actor recorded for a change made without credentials,
+// when the service doesn't require them.
+const anonymous = "anonymous"
+
+// NewStore creates a store that records each change made to it in the
+// audit log.  The changes are recorded by the store, rather than the
+// service, so the items are recorded as stored, after they are validated
+// and converted, and the REST, GraphQL and gRPC requests are all covered.
+// Each change is recorded with the store locked, before it is made, so the
+// items are recorded exactly as they were changed, and a change that can't
+// be recorded isn't made, but fails instead.  The actor, client IP and
+// request ID are taken from the context.
+func NewStore(audit *Log) store.ProduceStore {
+	return store.NewJournaled(func(ctx context.Context,
+		changes []store.Change) error {
+		if err := audit.Append(records(ctx, changes)...); err != nil {
+			return fmt.Errorf("cannot write audit record: %v", err)
+		}
+		return nil
+	})
+}
+
+// records returns the records of the changes, filling in who made them,
+// and where from.
+func records(ctx context.Context, changes []store.Change) []Record {
+	actor := anonymous
+	if p, ok := reqctx.PrincipalFromContext(ctx); ok && p.Subject != "" {
+		actor = p.Subject
+	}
+	var clientIP, requestID string
+	if info, ok := reqctx.RequestInfoFromContext(ctx); ok {
+		clientIP, requestID = info.ClientIP, info.ID
+	}
+	recs := make([]Record, len(changes))
+	for i, v := range changes {
+		recs[i] = Record{Action: v.Kind, Actor: actor, ClientIP: clientIP,
+			RequestID: requestID, Code: v.Code, Target: v.Target,
+			Before: v.Before, After: v.After, Removed: v.Removed,
+			Attribute: v.Attribute}
+	}
+	return recs
+}
@@ -0,0 +1,357 @@
+// Package client is a Go client for the REST API of the produce service.
+// Each endpoint has a typed method, which takes a context, so calls can be
+// cancelled, and returns the same errors the service itself uses, such as
+// store.NotFoundError or service.FormatError, so callers can switch on the
+// error type rather than on HTTP status codes.
+//
+// Idempotent calls, which are the lists, the deletes and reset, are retried
+// with exponential backoff when the service can't be reached or reports
+// that it is temporarily unavailable.  Adds are only retried when they have
+// an idempotency key, as otherwise a retry could add an item twice, or
+// report a conflict for an item that the first attempt added.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// Definitions for the URLs of the service.
+const (
+	statusURL         = "/v1/status"
+	produceURL        = "/v1/produce"
+	importURL         = "/v1/produce/import"
+	bulkURL           = "/v1/produce/bulk"
+	resetURL          = "/v1/reset"
+	categoriesURL     = "/v1/categories"
+	categoryCountsURL = "/v1/categories/counts"
+	attributesURL     = "/v1/attributes"
+	graphqlURL        = "/v1/graphql"
+	openAPIURL        = "/v1/openapi.json"
+)
+
+// The defaults for the options left unset.
+const (
+	DefaultTimeout    = 10 * time.Second
+	DefaultRetries    = 3
+	DefaultBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// apiKeyHeader is the request header that carries the API key.
+const apiKeyHeader = "X-API-Key"
+
+// idempotencyKeyHeader is the request header that makes an add safe to
+// retry.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// formatPrefix starts the message of a service.FormatError.
+const formatPrefix = "invalid item format: "
+
+// Options configures a Client.  The zero value of each field selects its
+// default.
+type Options struct {
+	// HTTPClient is used to send the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// Timeout limits each attempt of a call, including reading the
+	// response.  The context passed to the call limits all the attempts
+	// together.  A negative value means no limit.
+	Timeout time.Duration
+
+	// Retries is the number of times an idempotent call is retried after
+	// the first attempt fails.  A negative value disables the retries.
+	Retries int
+
+	// Backoff is the delay before the first retry, which doubles for each
+	// retry after that, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// APIKey is sent in the X-API-Key header of every request, if set.
+	// The service requires one for the calls that make changes, if it
+	// has been configured with keys.
+	APIKey string
+
+	// BearerToken is sent in the Authorization header of every request,
+	// if set, for a service that accepts JWT bearer tokens.
+	BearerToken string
+}
+
+// Client calls the endpoints of a produce service.  It is safe for
+// concurrent use.
+type Client struct {
+	baseURL string
+	opts    Options
+}
+
+// StatusError is returned when the service responds with an HTTP status
+// that doesn't correspond to one of the errors of the service, such as
+// 500 (Internal Server Error).  The message and the code, such as
+// types.ProblemRateLimited, are taken from the problem in the body of the
+// response, if it has one.
+type StatusError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+// Error satisfies the error interface.
+func (se StatusError) Error() string {
+	if se.Message == "" {
+		return fmt.Sprintf("unexpected HTTP status %d (%s)", se.StatusCode,
+			http.StatusText(se.StatusCode))
+	}
+	return fmt.Sprintf("unexpected HTTP status %d (%s): %s", se.StatusCode,
+		http.StatusText(se.StatusCode), se.Message)
+}
+
+// New creates a client for the service at the base URL, such as
+// "http://localhost:8080".  If the URL has no scheme, HTTP is assumed.
+func New(baseURL string, opts Options) (*Client, error) {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid service URL: '%s'", baseURL)
+	}
+
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	return &Client{baseURL: strings.TrimSuffix(u.String(), "/"), opts: opts}, nil
+}
+
+// request describes a call to the service.  The body is held in memory, so
+// it can be sent again if the call is retried.
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	header      http.Header
+	contentType string
+	body        []byte
+	idempotent  bool
+}
+
+// response is the status, header and body of the service's response.
+type response struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// do sends the request, retrying it if it is idempotent and the attempt
+// failed in a way that may be temporary.  The response is returned
+// whatever its status, so the caller can interpret it.
+func (c *Client) do(ctx context.Context, rq request) (response, error) {
+	u := c.baseURL + rq.path
+	if len(rq.query) != 0 {
+		u += "?" + rq.query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, u, rq)
+		if ctx.Err() != nil {
+			return response{}, ctx.Err()
+		}
+		if !rq.idempotent || attempt >= c.opts.Retries || !retryable(resp, err) {
+			return resp, err
+		}
+
+		// Wait before trying again, as long as the server asks, if it does.
+		wait := c.opts.Backoff << uint(attempt)
+		if wait > c.opts.MaxBackoff || wait <= 0 {
+			wait = c.opts.MaxBackoff
+		}
+		if err == nil {
+			if secs, perr := strconv.Atoi(resp.header.Get("Retry-After")); perr == nil &&
+				secs >= 0 {
+				wait = time.Duration(secs) * time.Second
+			}
+		}
+		tmr := time.NewTimer(wait)
+		select {
+		case <-tmr.C:
+		case <-ctx.Done():
+			tmr.Stop()
+			return response{}, ctx.Err()
+		}
+	}
+}
+
+// attempt makes a single attempt to send the request and read the
+// response, within the per-attempt timeout.
+func (c *Client) attempt(ctx context.Context, u string,
+	rq request) (response, error) {
+	if c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+
+	var body io.Reader
+	if rq.body != nil {
+		body = bytes.NewReader(rq.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, rq.method, u, body)
+	if err != nil {
+		return response{}, err
+	}
+	for k, v := range rq.header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	if rq.contentType != "" {
+		req.Header.Set("Content-Type", rq.contentType)
+	}
+	if c.opts.APIKey != "" {
+		req.Header.Set(apiKeyHeader, c.opts.APIKey)
+	}
+	if c.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.BearerToken)
+	}
+
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return response{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return response{}, err
+	}
+	return response{statusCode: resp.StatusCode, header: resp.Header,
+		body: b}, nil
+}
+
+// retryable returns whether an attempt that got the response or error may
+// succeed if it is tried again.
+func retryable(resp response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		// An add whose idempotency key is in use by an attempt still in
+		// progress is asked to try again later.
+		return resp.header.Get("Retry-After") != ""
+	}
+	return false
+}
+
+// getJSON gets the resource at the path and decodes it into the value.
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values,
+	v interface{}) error {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: path,
+		query: query, idempotent: true})
+	if err != nil {
+		return err
+	}
+	if resp.statusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return json.Unmarshal(resp.body, v)
+}
+
+// postJSON marshals the value and posts it to the path.
+func (c *Client) postJSON(ctx context.Context, path string,
+	v interface{}) (response, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return response{}, err
+	}
+	return c.do(ctx, request{method: http.MethodPost, path: path,
+		contentType: "application/json", body: b})
+}
+
+// deleteResource deletes the named resource in the collection at the path,
+// and returns the response to be interpreted by the caller.
+func (c *Client) deleteResource(ctx context.Context, path,
+	name string) (response, error) {
+	if name == "" {
+		return response{}, errors.New("no name given for delete")
+	}
+	return c.do(ctx, request{method: http.MethodDelete,
+		path: path + "/" + url.PathEscape(name), idempotent: true})
+}
+
+// problemOf decodes the problem in the body of an error response, and
+// returns whether there is one.
+func problemOf(resp response) (types.Problem, bool) {
+	var p types.Problem
+	if json.Unmarshal(resp.body, &p) != nil || p.Code == "" {
+		return p, false
+	}
+	return p, true
+}
+
+// badRequestError converts the body of an HTTP 400 response, which carries
+// a problem with the cause, to the error the service reported.
+func badRequestError(resp response) error {
+	p, ok := problemOf(resp)
+	if !ok || p.Detail == "" {
+		return statusError(resp)
+	}
+	if err, ok := messageError(http.StatusBadRequest,
+		p.Detail).(service.FormatError); ok {
+		err.Field = p.Field
+		err.Errors = p.Errors
+		return err
+	}
+	return statusError(resp)
+}
+
+// messageError converts a status and error message, as reported for a
+// bad request or for an item of an add, to the error the service reported,
+// if the status doesn't identify it by itself.
+func messageError(statusCode int, msg string) error {
+	if statusCode == http.StatusBadRequest && strings.HasPrefix(msg, formatPrefix) {
+		return service.FormatError{Message: strings.TrimPrefix(msg, formatPrefix)}
+	}
+	return StatusError{StatusCode: statusCode, Message: msg}
+}
+
+// statusError returns the error for a response with an unexpected status,
+// with the code and detail of the problem in the body, if any.
+func statusError(resp response) error {
+	se := StatusError{StatusCode: resp.statusCode}
+	if p, ok := problemOf(resp); ok {
+		se.Code, se.Message = p.Code, p.Detail
+	}
+	return se
+}
@@ -0,0 +1,563 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/api"
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+)
+
+var (
+	lettuce = types.Produce{
+		Code:      "A12T-4GH7-QPL9-3N4M",
+		Name:      "Lettuce",
+		UnitPrice: 346,
+		Category:  "Vegetables",
+	}
+	pepper = types.Produce{
+		Code:      "YRT6-72AS-K736-L4AR",
+		Name:      "Green Pepper",
+		UnitPrice: 79,
+	}
+)
+
+// newServer starts a produce service with a real service and store.
+func newServer(t *testing.T) *httptest.Server {
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	mux := http.NewServeMux()
+	err = api.Init(context.Background(), mux, service.New(store.New(),
+		lg.Sugar()), lg.Sugar())
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	return httptest.NewServer(mux)
+}
+
+func newClient(t *testing.T, url string, opts Options) *Client {
+	c, err := New(url, opts)
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	return c
+}
+
+func TestNew(t *testing.T) {
+	for i, v := range []struct {
+		url string
+		exp string
+	}{
+		{url: "localhost:8080", exp: "http://localhost:8080"},
+		{url: "https://produce.example.com/", exp: "https://produce.example.com"},
+		{url: "ftp://produce.example.com"},
+		{url: "http://"},
+	} {
+		c, err := New(v.url, Options{})
+		if v.exp == "" {
+			if err == nil {
+				t.Fatalf("(%d) expected error for '%s'", i, v.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+		if c.baseURL != v.exp || c.opts.Retries != DefaultRetries ||
+			c.opts.Timeout != DefaultTimeout {
+			t.Fatalf("(%d) unexpected client: %+v", i, c)
+		}
+	}
+}
+
+func TestProduce(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	c := newClient(t, srv.URL, Options{})
+	ctx := context.Background()
+
+	status, err := c.Status(ctx)
+	if err != nil || status != "produce service is up and running" {
+		t.Fatalf("unexpected status: '%s', %v", status, err)
+	}
+	if err := c.AddCategory(ctx, types.Category{Name: "Vegetables"}); err != nil {
+		t.Fatalf("cannot add category: %v", err)
+	}
+
+	// A batch where every item is added has no individual results.
+	res, err := c.Add(ctx, []types.Produce{lettuce, pepper})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	exp := []service.AddResult{{Code: lettuce.Code}, {Code: pepper.Code}}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("unexpected add results: %+v", res)
+	}
+
+	// The errors of the items are those of the service.
+	bad := pepper
+	bad.Code = "4GH7-QPL9-3N4M-A12T"
+	bad.Name = "@@@"
+	orphan := pepper
+	orphan.Code = "QPL9-3N4M-A12T-4GH7"
+	orphan.Category = "Fruit"
+	leek := types.Produce{Name: "Leek", UnitPrice: 125}
+	res, err = c.Add(ctx, []types.Produce{lettuce, bad, orphan, leek})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if len(res) != 4 {
+		t.Fatalf("unexpected add results: %+v", res)
+	}
+	if res[0].Err != (store.AlreadyExistsError{Code: lettuce.Code}) {
+		t.Fatalf("unexpected error for existing item: %v", res[0].Err)
+	}
+	if fe, ok := res[1].Err.(service.FormatError); !ok ||
+		len(fe.Errors) != 1 || fe.Errors[0].Field != "name" {
+		t.Fatalf("unexpected error for bad item: %#v", res[1].Err)
+	}
+	if res[2].Err != (store.CategoryNotFoundError{Name: "Fruit"}) {
+		t.Fatalf("unexpected error for orphan item: %v", res[2].Err)
+	}
+	if res[3].Err != nil || !res[3].Generated || res[3].Code == "" {
+		t.Fatalf("unexpected result for generated item: %+v", res[3])
+	}
+
+	// A single item is reported by its status.
+	code, err := c.AddOne(ctx, types.Produce{Name: "Onion", UnitPrice: 50})
+	if err != nil || code == "" {
+		t.Fatalf("unexpected result for single item: '%s', %v", code, err)
+	}
+	if _, err = c.AddOne(ctx, pepper); err != (store.AlreadyExistsError{
+		Code: pepper.Code}) {
+		t.Fatalf("unexpected error for existing item: %v", err)
+	}
+	if _, err = c.AddOne(ctx, bad); err == nil ||
+		!strings.HasPrefix(err.Error(), "invalid item format: ") {
+		t.Fatalf("unexpected error for bad item: %v", err)
+	}
+
+	items, err := c.List(ctx, ListOptions{Category: "Vegetables"})
+	if err != nil || len(items) != 1 || items[0].Code != lettuce.Code {
+		t.Fatalf("unexpected list: %+v, %v", items, err)
+	}
+	if _, err = c.List(ctx, ListOptions{Category: "Fruit"}); err !=
+		(store.CategoryNotFoundError{Name: "Fruit"}) {
+		t.Fatalf("unexpected error for unknown category: %v", err)
+	}
+	if items, err = c.ListAll(ctx); err != nil || len(items) != 4 {
+		t.Fatalf("unexpected list: %+v, %v", items, err)
+	}
+
+	item, err := c.Get(ctx, strings.ToLower(pepper.Code), ListOptions{})
+	if err != nil || !reflect.DeepEqual(item, pepper) {
+		t.Fatalf("unexpected item: %+v, %v", item, err)
+	}
+	if _, err = c.Get(ctx, "QPL9-3N4M-A12T-4GH7", ListOptions{}); err !=
+		(store.NotFoundError{Code: "QPL9-3N4M-A12T-4GH7"}) {
+		t.Fatalf("unexpected error for unknown item: %v", err)
+	}
+
+	if err := c.DeleteCategory(ctx, "Vegetables"); err == nil {
+		t.Fatal("expected error deleting category in use")
+	} else if _, ok := err.(store.CategoryInUseError); !ok {
+		t.Fatalf("unexpected error deleting category: %v", err)
+	}
+	if err := c.Delete(ctx, lettuce.Code); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := c.Delete(ctx, lettuce.Code); err !=
+		(store.NotFoundError{Code: lettuce.Code}) {
+		t.Fatalf("unexpected error deleting again: %v", err)
+	}
+	if _, ok := c.Delete(ctx, "A12T").(service.FormatError); !ok {
+		t.Fatal("expected format error for bad code")
+	}
+
+	if err := c.Reset(ctx); err != nil {
+		t.Fatalf("reset failed: %v", err)
+	}
+	if items, err = c.ListAll(ctx); err != nil || len(items) != 0 {
+		t.Fatalf("unexpected list after reset: %+v, %v", items, err)
+	}
+}
+
+func TestBulkAndImport(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	c := newClient(t, srv.URL, Options{})
+	ctx := context.Background()
+
+	bad := pepper
+	bad.Name = "@@@"
+	res, err := c.AddBulk(ctx, []types.Produce{lettuce, {Name: "Leek",
+		UnitPrice: 125}, pepper, bad})
+	if err != nil {
+		t.Fatalf("bulk add failed: %v", err)
+	}
+	if len(res) != 4 {
+		t.Fatalf("unexpected bulk results: %+v", res)
+	}
+	for i, v := range res {
+		if v.Seq != i+1 {
+			t.Fatalf("(%d) unexpected row: %d", i, v.Seq)
+		}
+	}
+	if res[0].Err != (store.CategoryNotFoundError{Name: "Vegetables"}) ||
+		!res[1].Generated || res[1].Err != nil || res[2].Err != nil {
+		t.Fatalf("unexpected bulk results: %+v", res)
+	}
+	if _, ok := res[3].Err.(service.FormatError); !ok {
+		t.Fatalf("unexpected error for bad item: %v", res[3].Err)
+	}
+
+	csv := "code;name;price\n" +
+		"A12T-4GH7-QPL9-3N4M;Lettuce;3.46\n" +
+		"YRT6;Green Pepper;0.79\n"
+	opts := ImportOptions{Delimiter: ';', Map: map[string]string{
+		"price": "unit_price"}, Abort: true}
+	res, err = c.Import(ctx, strings.NewReader(csv), opts)
+	if err != ErrImportAborted || len(res) != 2 {
+		t.Fatalf("unexpected import result: %+v, %v", res, err)
+	}
+	if res[0].Seq != 1 || res[0].Err != (StatusError{
+		StatusCode: http.StatusFailedDependency,
+		Code:       types.ProblemImportAborted,
+		Message:    "not added, as the import was aborted"}) {
+		t.Fatalf("unexpected result for valid row: %+v", res[0])
+	}
+	if _, ok := res[1].Err.(service.FormatError); !ok || res[1].Seq != 2 {
+		t.Fatalf("unexpected result for bad row: %+v", res[1])
+	}
+
+	opts.Abort = false
+	res, err = c.Import(ctx, strings.NewReader(csv), opts)
+	if err != nil || len(res) != 2 || res[0].Err != nil || res[1].Err == nil {
+		t.Fatalf("unexpected import result: %+v, %v", res, err)
+	}
+	b, err := c.ExportCSV(ctx, ListOptions{}, ';')
+	if err != nil || !strings.HasPrefix(string(b), "code;name;unit_price") {
+		t.Fatalf("unexpected export: %s, %v", b, err)
+	}
+}
+
+func TestGraphQLAndOpenAPI(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	c := newClient(t, srv.URL, Options{})
+	ctx := context.Background()
+
+	if _, err := c.AddOne(ctx, pepper); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	var data struct {
+		Produce *struct {
+			Name string `json:"name"`
+		} `json:"produce"`
+	}
+	err := c.GraphQL(ctx, `query($code: String!) { produce(code: $code) { name } }`,
+		map[string]interface{}{"code": pepper.Code}, &data)
+	if err != nil || data.Produce == nil || data.Produce.Name != pepper.Name {
+		t.Fatalf("unexpected GraphQL result: %+v, %v", data, err)
+	}
+	err = c.GraphQL(ctx, `mutation { deleteProduce(code: "A12T-4GH7-QPL9-3N4M") }`,
+		nil, nil)
+	if gerr, ok := err.(GraphQLErrors); !ok || len(gerr) != 1 ||
+		gerr[0].Extensions["status"] != float64(http.StatusNotFound) {
+		t.Fatalf("unexpected GraphQL error: %v", err)
+	}
+
+	b, err := c.OpenAPI(ctx)
+	if err != nil {
+		t.Fatalf("cannot get OpenAPI document: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil || doc["openapi"] != "3.0.3" {
+		t.Fatalf("unexpected OpenAPI document: %.40s, %v", b, err)
+	}
+}
+
+func TestCategoriesAndAttributes(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	c := newClient(t, srv.URL, Options{})
+	ctx := context.Background()
+
+	for i, v := range []struct {
+		cat types.Category
+		err error
+	}{
+		{cat: types.Category{Name: "Produce"}},
+		{cat: types.Category{Name: "Fruit", Parent: "Produce"}},
+		{cat: types.Category{Name: "Fruit"},
+			err: store.CategoryExistsError{Name: "Fruit"}},
+		{cat: types.Category{Name: "Apples", Parent: "Orchard"},
+			err: store.CategoryNotFoundError{Name: "Orchard"}},
+	} {
+		if err := c.AddCategory(ctx, v.cat); err != v.err {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+	}
+	cats, err := c.ListCategories(ctx)
+	if err != nil || len(cats) != 2 {
+		t.Fatalf("unexpected categories: %+v, %v", cats, err)
+	}
+	counts, err := c.CategoryCounts(ctx)
+	if err != nil || len(counts) != 2 {
+		t.Fatalf("unexpected counts: %+v, %v", counts, err)
+	}
+	if err := c.DeleteCategory(ctx, "Produce"); err == nil {
+		t.Fatal("expected error deleting category with children")
+	}
+	if err := c.DeleteCategory(ctx, "Fruit"); err != nil {
+		t.Fatalf("cannot delete category: %v", err)
+	}
+	if err := c.DeleteCategory(ctx, "Fruit"); err !=
+		(store.CategoryNotFoundError{Name: "Fruit"}) {
+		t.Fatalf("unexpected error deleting again: %v", err)
+	}
+
+	def := types.AttributeDef{Name: "organic", Type: types.AttributeBool}
+	if err := c.AddAttribute(ctx, def); err != nil {
+		t.Fatalf("cannot add attribute: %v", err)
+	}
+	if err := c.AddAttribute(ctx, def); err !=
+		(store.AttributeExistsError{Name: "organic"}) {
+		t.Fatalf("unexpected error adding again: %v", err)
+	}
+	defs, err := c.ListAttributes(ctx)
+	if err != nil || len(defs) != 1 || defs[0].Name != "organic" {
+		t.Fatalf("unexpected attributes: %+v, %v", defs, err)
+	}
+	item := pepper
+	item.Attributes = map[string]interface{}{"organic": true}
+	if _, err := c.AddOne(ctx, item); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := c.DeleteAttribute(ctx, "organic"); err !=
+		(store.AttributeInUseError{Name: "organic"}) {
+		t.Fatalf("unexpected error deleting attribute in use: %v", err)
+	}
+	if err := c.DeleteAttribute(ctx, "origin"); err !=
+		(store.AttributeNotFoundError{Name: "origin"}) {
+		t.Fatalf("unexpected error deleting unknown attribute: %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	for i, v := range []struct {
+		retries  int
+		call     func(c *Client) error
+		expCalls int32
+		expErr   error
+	}{
+		{
+			call: func(c *Client) error {
+				_, err := c.ListAll(ctx)
+				return err
+			},
+			expCalls: 3,
+		},
+		{
+			retries: 1,
+			call: func(c *Client) error {
+				_, err := c.ListAll(ctx)
+				return err
+			},
+			expCalls: 2,
+			expErr:   StatusError{StatusCode: http.StatusServiceUnavailable},
+		},
+		{
+			// Adds are not idempotent, so they aren't retried.
+			call: func(c *Client) error {
+				_, err := c.Add(ctx, []types.Produce{lettuce, pepper})
+				return err
+			},
+			expCalls: 1,
+			expErr:   StatusError{StatusCode: http.StatusServiceUnavailable},
+		},
+	} {
+		atomic.StoreInt32(&calls, 0)
+		c := newClient(t, srv.URL, Options{Retries: v.retries,
+			Backoff: time.Millisecond})
+		if err := v.call(c); err != v.expErr {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+		if n := atomic.LoadInt32(&calls); n != v.expCalls {
+			t.Fatalf("(%d) expected %d calls, got %d", i, v.expCalls, n)
+		}
+	}
+}
+
+func TestAddIdempotent(t *testing.T) {
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	mux := http.NewServeMux()
+	err = api.Init(context.Background(), mux, service.New(store.New(),
+		lg.Sugar()), lg.Sugar())
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	handler := api.Idempotent(api.NewIdempotencyStore(time.Hour), mux,
+		lg.Sugar())
+
+	// The response to the first add is lost, after the item was added.
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	c := newClient(t, srv.URL, Options{Backoff: time.Millisecond})
+	ctx := context.Background()
+
+	res, err := c.AddIdempotent(ctx, "txn-1", []types.Produce{pepper})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if len(res) != 1 || res[0].Err != nil || res[0].Code != pepper.Code {
+		t.Fatalf("unexpected results: %+v", res)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 calls, got %d", n)
+	}
+
+	other := pepper
+	other.Code = "A12T-4GH7-QPL9-3N4M"
+	_, err = c.AddIdempotent(ctx, "txn-1", []types.Produce{other})
+	if se, ok := err.(StatusError); !ok ||
+		se.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.AddIdempotent(ctx, "", nil); err == nil {
+		t.Fatal("expected error without a key")
+	}
+}
+
+func TestTimeoutAndCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	// Each attempt times out, and once the retries are exhausted the
+	// timeout is reported.
+	c := newClient(t, srv.URL, Options{Timeout: 20 * time.Millisecond,
+		Retries: 1, Backoff: time.Millisecond})
+	start := time.Now()
+	_, err := c.ListAll(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatal("the call wasn't retried")
+	}
+
+	// Cancelling the context stops the call, without any retries.
+	c = newClient(t, srv.URL, Options{Timeout: -1})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err = c.ListAll(ctx); err != context.Canceled {
+		t.Fatalf("expected cancellation, got: %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	mux := http.NewServeMux()
+	err = api.Init(context.Background(), mux, service.New(store.New(),
+		lg.Sugar()), lg.Sugar())
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	ks, err := api.NewKeyStore("", "ops:0p3r4t0r")
+	if err != nil {
+		t.Fatalf("cannot load keys: %v", err)
+	}
+	tv, err := api.NewTokenVerifier(api.TokenConfig{Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("cannot create verifier: %v", err)
+	}
+	srv := httptest.NewServer(api.RequireAuth(api.Authenticator{Keys: ks,
+		Tokens: tv}, mux, lg.Sugar()))
+	defer srv.Close()
+
+	// An unsigned part followed by an HS256 signature with the secret.
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256"}`)) + "." +
+		enc.EncodeToString([]byte(fmt.Sprintf(
+			`{"sub":"alice","exp":%d,"roles":["viewer"]}`,
+			time.Now().Add(time.Hour).Unix())))
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(signed))
+	viewer := signed + "." + enc.EncodeToString(mac.Sum(nil))
+
+	ctx := context.Background()
+	for i, v := range []struct {
+		opts   Options
+		expErr error
+	}{
+		{expErr: StatusError{StatusCode: http.StatusUnauthorized,
+			Code:    types.ProblemUnauthenticated,
+			Message: "an API key or bearer token is required"}},
+		{opts: Options{APIKey: "guess"}, expErr: StatusError{
+			StatusCode: http.StatusForbidden, Code: types.ProblemForbidden,
+			Message: "the API key is not valid"}},
+		{opts: Options{APIKey: "0p3r4t0r"}},
+		{opts: Options{BearerToken: viewer}, expErr: StatusError{
+			StatusCode: http.StatusForbidden, Code: types.ProblemForbidden,
+			Message: "the 'admin' role is required"}},
+	} {
+		c := newClient(t, srv.URL, v.opts)
+		if err := c.Reset(ctx); err != v.expErr {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+	}
+
+	// A viewer may read.
+	_, err = newClient(t, srv.URL, Options{BearerToken: viewer}).ListAll(ctx)
+	if err != nil {
+		t.Fatalf("cannot list as a viewer: %v", err)
+	}
+}
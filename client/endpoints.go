@@ -0,0 +1,646 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// ErrImportAborted is returned by Import with the results of the rows when
+// the import was aborted, because some of them are invalid.
+var ErrImportAborted = errors.New("import aborted, as some rows are invalid")
+
+// ListOptions selects and localizes the produce items that are listed.
+type ListOptions struct {
+	// Category and Tags filter the items as for types.ProduceFilter.
+	Category string
+	Tags     []string
+
+	// Language is sent as the Accept-Language header, so each name is
+	// localized to best match it.  With AllNames, the default name and
+	// all of the translations are returned instead.
+	Language string
+	AllNames bool
+}
+
+// ImportOptions configures how the rows of a CSV import are read.
+type ImportOptions struct {
+	// Delimiter separates the fields, a comma if zero.
+	Delimiter rune
+
+	// Map maps column names in the file to the names of the fields.
+	Map map[string]string
+
+	// Abort requests that no rows be added if any are invalid.
+	Abort bool
+}
+
+// GraphQLError is a single error in the response to a GraphQL request.
+// The extensions of an error caused by the service carry its HTTP status.
+type GraphQLError struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// GraphQLErrors is the error returned for a GraphQL response with errors.
+type GraphQLErrors []GraphQLError
+
+// Error satisfies the error interface.
+func (ge GraphQLErrors) Error() string {
+	msgs := make([]string, len(ge))
+	for i, v := range ge {
+		msgs[i] = v.Message
+	}
+	return "graphql: " + strings.Join(msgs, "; ")
+}
+
+// Status returns the status message of the service.
+func (c *Client) Status(ctx context.Context) (string, error) {
+	var sr types.StatusResponse
+	if err := c.getJSON(ctx, statusURL, nil, &sr); err != nil {
+		return "", err
+	}
+	return sr.Status, nil
+}
+
+// Add adds the produce items and returns the result of each, in the same
+// order, with the code it was added under, which is generated for items
+// without one.  The error of an item that wasn't added is one of those of
+// the service, such as store.AlreadyExistsError.  An error is returned
+// only if the request as a whole failed.
+func (c *Client) Add(ctx context.Context,
+	items []types.Produce) ([]service.AddResult, error) {
+	return c.add(ctx, items, "")
+}
+
+// AddIdempotent adds the produce items as Add does, with the idempotency
+// key, which makes the add safe to retry, so it is retried as the other
+// idempotent calls are.  A retry gets the response to the first attempt
+// that reached the service, so the results are those of the add that
+// actually happened.  The key should be unique to the add, such as a UUID
+// or the transaction number of a terminal, and reusing it for different
+// items fails with a client.StatusError with HTTP 422.
+func (c *Client) AddIdempotent(ctx context.Context, key string,
+	items []types.Produce) ([]service.AddResult, error) {
+	if key == "" {
+		return nil, errors.New("no idempotency key given for add")
+	}
+	return c.add(ctx, items, key)
+}
+
+// add adds the produce items, with the idempotency key, if there is one.
+func (c *Client) add(ctx context.Context, items []types.Produce,
+	key string) ([]service.AddResult, error) {
+	b, err := json.Marshal(types.ProduceAddRequest(items))
+	if err != nil {
+		return nil, err
+	}
+	rq := request{method: http.MethodPost, path: produceURL,
+		contentType: "application/json", body: b}
+	if key != "" {
+		rq.header = http.Header{idempotencyKeyHeader: {key}}
+		rq.idempotent = true
+	}
+	resp, err := c.do(ctx, rq)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single item is reported by the status of the response alone.
+	if len(items) == 1 {
+		item := items[0]
+		res := service.AddResult{Code: item.Code}
+		switch resp.statusCode {
+		case http.StatusCreated:
+			res.Generated = item.Code == ""
+			if loc := resp.header.Get("Location"); loc != "" {
+				if code, err := url.PathUnescape(path.Base(loc)); err == nil {
+					res.Code = code
+				}
+			}
+		case http.StatusBadRequest:
+			res.Err = badRequestError(resp)
+		case http.StatusConflict, http.StatusNotFound:
+			p, _ := problemOf(resp)
+			res.Err = itemError(resp.statusCode, p.Code, p.Detail, item.Code,
+				item.Category)
+		default:
+			return nil, statusError(resp)
+		}
+		return []service.AddResult{res}, nil
+	}
+
+	// If all of the items were added and none had a code generated, there
+	// are no individual results.
+	switch {
+	case resp.statusCode == http.StatusCreated && len(resp.body) == 0:
+		res := make([]service.AddResult, len(items))
+		for i, v := range items {
+			res[i].Code = v.Code
+		}
+		return res, nil
+	case resp.statusCode == http.StatusBadRequest:
+		return nil, badRequestError(resp)
+	case resp.statusCode != http.StatusCreated && resp.statusCode != http.StatusOK:
+		return nil, statusError(resp)
+	}
+
+	var restResp types.ProduceAddResponse
+	if err := json.Unmarshal(resp.body, &restResp); err != nil {
+		return nil, err
+	}
+	if len(restResp) != len(items) {
+		return nil, fmt.Errorf("expected %d add results, got %d", len(items),
+			len(restResp))
+	}
+	res := make([]service.AddResult, len(items))
+	for i, v := range restResp {
+		res[i] = addResult(v, items[i])
+	}
+	return res, nil
+}
+
+// AddOne adds a single produce item, and returns the code it was added
+// under, which is generated if it has none.
+func (c *Client) AddOne(ctx context.Context, item types.Produce) (string,
+	error) {
+	res, err := c.Add(ctx, []types.Produce{item})
+	if err != nil {
+		return "", err
+	}
+	return res[0].Code, res[0].Err
+}
+
+// AddBulk adds the produce items with a single bulk request, which sends
+// them as NDJSON, and is meant for feeds too large for a batch add.  The
+// results are returned in the order of the items, each with its row, which
+// is its position in the feed, counting from one.
+func (c *Client) AddBulk(ctx context.Context,
+	items []types.Produce) ([]service.BulkResult, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, v := range items {
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: bulkURL,
+		contentType: "application/x-ndjson", body: buf.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	switch resp.statusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest:
+		return nil, badRequestError(resp)
+	default:
+		return nil, statusError(resp)
+	}
+
+	var res []service.BulkResult
+	sc := bufio.NewScanner(bytes.NewReader(resp.body))
+	sc.Buffer(make([]byte, 0, 64*1024), len(resp.body)+1)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var v types.ProduceAddItemResponse
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+			return nil, err
+		}
+		if v.Row < 1 || v.Row > len(items) {
+			return nil, fmt.Errorf("bulk result for unknown row %d", v.Row)
+		}
+		res = append(res, service.BulkResult{Seq: v.Row,
+			AddResult: addResult(v, items[v.Row-1])})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Seq < res[j].Seq })
+	return res, nil
+}
+
+// Import adds the produce items in the CSV file and returns the result of
+// each row, in order, with the row number, counting from one.  If every
+// row was added and no codes were generated, the service doesn't report
+// the individual rows, so no results are returned.  If the import was
+// aborted, the results are returned along with ErrImportAborted.
+func (c *Client) Import(ctx context.Context, csv io.Reader,
+	opts ImportOptions) ([]service.BulkResult, error) {
+	b, err := ioutil.ReadAll(csv)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if opts.Delimiter != 0 {
+		query.Set("delimiter", string(opts.Delimiter))
+	}
+	for k, v := range opts.Map {
+		query.Add("map", k+":"+v)
+	}
+	if opts.Abort {
+		query.Set("on_error", "abort")
+	}
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: importURL,
+		query: query, contentType: "text/csv", body: b})
+	if err != nil {
+		return nil, err
+	}
+
+	var restResp types.ProduceAddResponse
+	switch resp.statusCode {
+	case http.StatusOK, http.StatusCreated:
+		if len(resp.body) == 0 {
+			return nil, nil
+		}
+		if err := json.Unmarshal(resp.body, &restResp); err != nil {
+			return nil, err
+		}
+	case http.StatusBadRequest:
+		// The results of an aborted import are an array, whereas a bad
+		// request has a status message.
+		if json.Unmarshal(resp.body, &restResp) != nil {
+			return nil, badRequestError(resp)
+		}
+	default:
+		return nil, statusError(resp)
+	}
+
+	res := make([]service.BulkResult, len(restResp))
+	for i, v := range restResp {
+		res[i] = service.BulkResult{Seq: v.Row,
+			AddResult: addResult(v, types.Produce{Code: v.Code})}
+	}
+	if resp.statusCode == http.StatusBadRequest {
+		return res, ErrImportAborted
+	}
+	return res, nil
+}
+
+// Delete deletes the produce item with the code, or returns
+// store.NotFoundError if there is none.  If a delete is retried after the
+// first attempt deleted the item, but its response was lost, the retry
+// reports that the item wasn't found.
+func (c *Client) Delete(ctx context.Context, code string) error {
+	resp, err := c.deleteResource(ctx, produceURL, code)
+	if err != nil {
+		return err
+	}
+	switch resp.statusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return store.NotFoundError{Code: code}
+	case http.StatusBadRequest:
+		return badRequestError(resp)
+	default:
+		return statusError(resp)
+	}
+}
+
+// Get gets the produce item with the code, or returns store.NotFoundError
+// if there is none.  Only the Language and AllNames options apply.
+func (c *Client) Get(ctx context.Context, code string,
+	opts ListOptions) (types.Produce, error) {
+	if code == "" {
+		return types.Produce{}, errors.New("no code given for get")
+	}
+	query := url.Values{}
+	if opts.AllNames {
+		query.Set("all_names", "true")
+	}
+	header := http.Header{}
+	if opts.Language != "" {
+		header.Set("Accept-Language", opts.Language)
+	}
+	resp, err := c.do(ctx, request{method: http.MethodGet,
+		path: produceURL + "/" + url.PathEscape(code), query: query,
+		header: header, idempotent: true})
+	if err != nil {
+		return types.Produce{}, err
+	}
+	var item types.Produce
+	switch resp.statusCode {
+	case http.StatusOK:
+		err = json.Unmarshal(resp.body, &item)
+	case http.StatusNotFound:
+		err = store.NotFoundError{Code: code}
+	case http.StatusBadRequest:
+		err = badRequestError(resp)
+	default:
+		err = statusError(resp)
+	}
+	return item, err
+}
+
+// ListAll lists all of the produce items.
+func (c *Client) ListAll(ctx context.Context) ([]types.Produce, error) {
+	return c.List(ctx, ListOptions{})
+}
+
+// List lists the produce items selected by the options.  An unknown
+// category yields store.CategoryNotFoundError.
+func (c *Client) List(ctx context.Context,
+	opts ListOptions) ([]types.Produce, error) {
+	resp, err := c.list(ctx, opts, "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	var items types.ProduceListResponse
+	if err := json.Unmarshal(resp.body, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// ExportCSV lists the produce items selected by the options as CSV, in the
+// form accepted by Import.  The delimiter separates the fields, a comma if
+// zero.
+func (c *Client) ExportCSV(ctx context.Context, opts ListOptions,
+	delimiter rune) ([]byte, error) {
+	query := url.Values{}
+	if delimiter != 0 {
+		query.Set("delimiter", string(delimiter))
+	}
+	resp, err := c.list(ctx, opts, "text/csv", query)
+	if err != nil {
+		return nil, err
+	}
+	return resp.body, nil
+}
+
+// list lists the produce items in the accepted representation.
+func (c *Client) list(ctx context.Context, opts ListOptions, accept string,
+	query url.Values) (response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if opts.Category != "" {
+		query.Set("category", opts.Category)
+	}
+	for _, v := range opts.Tags {
+		query.Add("tag", v)
+	}
+	if opts.AllNames {
+		query.Set("all_names", "true")
+	}
+	header := http.Header{"Accept": {accept}}
+	if opts.Language != "" {
+		header.Set("Accept-Language", opts.Language)
+	}
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: produceURL,
+		query: query, header: header, idempotent: true})
+	if err != nil {
+		return response{}, err
+	}
+	switch resp.statusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		return response{}, store.CategoryNotFoundError{Name: opts.Category}
+	case http.StatusBadRequest:
+		return response{}, badRequestError(resp)
+	default:
+		return response{}, statusError(resp)
+	}
+}
+
+// Reset deletes all of the produce items, categories and attributes.
+func (c *Client) Reset(ctx context.Context) error {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: resetURL,
+		idempotent: true})
+	if err != nil {
+		return err
+	}
+	if resp.statusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// AddCategory adds a category.  It returns store.CategoryNotFoundError if
+// the parent is unknown, and store.CategoryExistsError if the category
+// already exists.
+func (c *Client) AddCategory(ctx context.Context, cat types.Category) error {
+	resp, err := c.postJSON(ctx, categoriesURL, cat)
+	if err != nil {
+		return err
+	}
+	switch resp.statusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusNotFound:
+		return store.CategoryNotFoundError{Name: cat.Parent}
+	case http.StatusConflict:
+		return store.CategoryExistsError{Name: cat.Name}
+	case http.StatusBadRequest:
+		return badRequestError(resp)
+	default:
+		return statusError(resp)
+	}
+}
+
+// ListCategories lists all of the categories.
+func (c *Client) ListCategories(ctx context.Context) ([]types.Category,
+	error) {
+	var cats types.CategoryListResponse
+	if err := c.getJSON(ctx, categoriesURL, nil, &cats); err != nil {
+		return nil, err
+	}
+	return cats, nil
+}
+
+// CategoryCounts returns the direct and subtree item counts for every
+// category.
+func (c *Client) CategoryCounts(ctx context.Context) ([]types.CategoryCount,
+	error) {
+	var counts types.CategoryCountResponse
+	if err := c.getJSON(ctx, categoryCountsURL, nil, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// DeleteCategory deletes the named category.  It returns
+// store.CategoryNotFoundError if there is none, and
+// store.CategoryInUseError if it still has children or produce items.
+func (c *Client) DeleteCategory(ctx context.Context, name string) error {
+	resp, err := c.deleteResource(ctx, categoriesURL, name)
+	if err != nil {
+		return err
+	}
+	switch resp.statusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return store.CategoryNotFoundError{Name: name}
+	case http.StatusConflict:
+		return store.CategoryInUseError{Name: name,
+			Reason: "it has child categories or produce items"}
+	case http.StatusBadRequest:
+		return badRequestError(resp)
+	default:
+		return statusError(resp)
+	}
+}
+
+// AddAttribute adds an attribute definition to the schema.  It returns
+// store.AttributeExistsError if the attribute is already defined.
+func (c *Client) AddAttribute(ctx context.Context,
+	def types.AttributeDef) error {
+	resp, err := c.postJSON(ctx, attributesURL, def)
+	if err != nil {
+		return err
+	}
+	switch resp.statusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return store.AttributeExistsError{Name: def.Name}
+	case http.StatusBadRequest:
+		return badRequestError(resp)
+	default:
+		return statusError(resp)
+	}
+}
+
+// ListAttributes lists all of the attribute definitions.
+func (c *Client) ListAttributes(ctx context.Context) ([]types.AttributeDef,
+	error) {
+	var defs types.AttributeListResponse
+	if err := c.getJSON(ctx, attributesURL, nil, &defs); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// DeleteAttribute deletes the named attribute definition.  It returns
+// store.AttributeNotFoundError if there is none, and
+// store.AttributeInUseError if produce items still carry it.
+func (c *Client) DeleteAttribute(ctx context.Context, name string) error {
+	resp, err := c.deleteResource(ctx, attributesURL, name)
+	if err != nil {
+		return err
+	}
+	switch resp.statusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return store.AttributeNotFoundError{Name: name}
+	case http.StatusConflict:
+		return store.AttributeInUseError{Name: name}
+	case http.StatusBadRequest:
+		return badRequestError(resp)
+	default:
+		return statusError(resp)
+	}
+}
+
+// GraphQL runs a GraphQL query or mutation, and decodes the data of the
+// response into the value, if it isn't nil.  If the response has errors,
+// they are returned as GraphQLErrors, after any partial data is decoded.
+// As a mutation may not be idempotent, the request is never retried.
+func (c *Client) GraphQL(ctx context.Context, query string,
+	variables map[string]interface{}, data interface{}) error {
+	resp, err := c.postJSON(ctx, graphqlURL, map[string]interface{}{
+		"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	if resp.statusCode != http.StatusOK &&
+		resp.statusCode != http.StatusBadRequest {
+		return statusError(resp)
+	}
+
+	var gr struct {
+		Data   json.RawMessage `json:"data"`
+		Errors GraphQLErrors   `json:"errors"`
+	}
+	if err := json.Unmarshal(resp.body, &gr); err != nil {
+		return err
+	}
+	if data != nil && len(gr.Data) != 0 && string(gr.Data) != "null" {
+		if err := json.Unmarshal(gr.Data, data); err != nil {
+			return err
+		}
+	}
+	if len(gr.Errors) != 0 {
+		return gr.Errors
+	}
+	return nil
+}
+
+// OpenAPI returns the OpenAPI 3 description of the service as JSON.
+func (c *Client) OpenAPI(ctx context.Context) ([]byte, error) {
+	var doc json.RawMessage
+	if err := c.getJSON(ctx, openAPIURL, nil, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// addResult converts the REST result of adding an item to the service's
+// form, given the item.
+func addResult(v types.ProduceAddItemResponse,
+	item types.Produce) service.AddResult {
+	res := service.AddResult{Code: v.Code}
+	if v.StatusCode == http.StatusCreated {
+		res.Generated = item.Code == ""
+		return res
+	}
+	res.Err = itemError(v.StatusCode, v.ErrorCode, v.Error, v.Code,
+		item.Category)
+	if fe, ok := res.Err.(service.FormatError); ok {
+		fe.Errors = v.Errors
+		res.Err = fe
+	}
+	return res
+}
+
+// itemError converts the status, problem code and error message reported
+// for an item to the error of the service.  The code and category of the
+// item are used when there is no message to take them from.
+func itemError(statusCode int, problem, msg, code, category string) error {
+	switch {
+	case problem == types.ProblemProduceExists ||
+		(problem == "" && statusCode == http.StatusConflict):
+		return store.AlreadyExistsError{Code: code}
+	case problem == types.ProblemCategoryNotFound ||
+		(problem == "" && statusCode == http.StatusNotFound):
+		if name, ok := quoted(msg); ok {
+			category = name
+		}
+		return store.CategoryNotFoundError{Name: category}
+	case statusCode == http.StatusBadRequest:
+		return messageError(statusCode, msg)
+	default:
+		return StatusError{StatusCode: statusCode, Code: problem, Message: msg}
+	}
+}
+
+// quoted returns the name quoted in an error message, such as that of
+// store.CategoryNotFoundError.
+func quoted(msg string) (string, bool) {
+	start := strings.Index(msg, "'")
+	end := strings.LastIndex(msg, "'")
+	if start < 0 || end <= start {
+		return "", false
+	}
+	return msg[start+1 : end], true
+}
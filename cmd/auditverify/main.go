@@ -0,0 +1,87 @@
+// Package main is auditverify, which checks that an audit log written by
+// the produce service hasn't been tampered with.  It follows the hash chain
+// from the first record to the last, and reports the first record that was
+// edited, removed or reordered.  On success, it prints the number of
+// records and the hash of the last one, which can be noted and passed with
+// -head on a later run, to detect records removed from the end.  A log
+// written with a secret key is checked with the same key, from -key-file.
+// Without a key, anyone who can edit the log can recompute its hashes, so
+// the chain only shows tampering if -head is given, with a head noted
+// somewhere the log's editor can't reach.  The exit code is:
+//
+//	0  the log checks out
+//	1  the log was tampered with
+//	2  the command line is invalid, or the log can't be read
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gdotgordon/produce-demo/audit"
+)
+
+// The exit codes.
+const (
+	exitOK       = 0
+	exitTampered = 1
+	exitUsage    = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command line and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("auditverify", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	head := fs.String("head", "",
+		"head hash from an earlier run, which must still be in the log")
+	keyFile := fs.String("key-file", "",
+		"file of the secret key the log was written with")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr,
+			"Usage: auditverify [-head hash] [-key-file file] <audit log>\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		var err error
+		if key, err = audit.ReadKeyFile(*keyFile); err != nil {
+			fmt.Fprintf(stderr, "auditverify: %v\n", err)
+			return exitUsage
+		}
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "auditverify: %v\n", err)
+		return exitUsage
+	}
+	defer f.Close()
+	sum, err := audit.Verify(f, *head, key)
+	switch err.(type) {
+	case nil:
+	case audit.TamperError:
+		fmt.Fprintf(stderr, "auditverify: %v\n", err)
+		return exitTampered
+	default:
+		fmt.Fprintf(stderr, "auditverify: %v\n", err)
+		return exitUsage
+	}
+	fmt.Fprintf(stdout, "ok: %d records, head %s\n", sum.Records, sum.Head)
+	return exitOK
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/audit"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	al, err := audit.Open(path, nil)
+	if err != nil {
+		t.Fatalf("cannot open log: %v", err)
+	}
+	item := types.Produce{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce",
+		UnitPrice: types.USD(346)}
+	for _, v := range []audit.Record{
+		{Action: audit.ActionAdd, Actor: "alice", Code: item.Code, After: &item},
+		{Action: audit.ActionDelete, Actor: "bob", Code: item.Code, Before: &item},
+	} {
+		if err := al.Append(v); err != nil {
+			t.Fatalf("cannot append: %v", err)
+		}
+	}
+	al.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := filepath.Join(dir, "edited.log")
+	err = ioutil.WriteFile(edited, bytes.Replace(b, []byte(`"$3.46"`),
+		[]byte(`"$0.46"`), 1), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if code := run([]string{path}, &out, ioutil.Discard); code != exitOK {
+		t.Fatalf("verify failed with %d", code)
+	}
+	head := strings.Fields(out.String())[4]
+
+	for i, v := range []struct {
+		args    string
+		expCode int
+		expOut  string
+		expErr  string
+	}{
+		{args: path, expOut: "ok: 2 records, head " + head + "\n"},
+		{args: "-head " + head + " " + path, expOut: "ok: 2 records"},
+		{args: "-head 00 " + path, expCode: exitTampered,
+			expErr: "line 3: the record with hash 00 is missing"},
+		{args: edited, expCode: exitTampered,
+			expErr: "line 1: the record doesn't match its hash"},
+		{args: filepath.Join(dir, "missing.log"), expCode: exitUsage},
+		{args: "", expCode: exitUsage, expErr: "Usage:"},
+	} {
+		var stdout, stderr bytes.Buffer
+		code := run(strings.Fields(v.args), &stdout, &stderr)
+		if code != v.expCode {
+			t.Fatalf("(%d) '%s' exited with %d, expected %d: %s", i, v.args,
+				code, v.expCode, stderr.String())
+		}
+		if !strings.HasPrefix(stdout.String(), v.expOut) ||
+			(v.expOut == "" && stdout.Len() != 0) {
+			t.Fatalf("(%d) unexpected output: %s", i, stdout.String())
+		}
+		if !strings.Contains(stderr.String(), v.expErr) {
+			t.Fatalf("(%d) unexpected error output: %s", i, stderr.String())
+		}
+	}
+
+	// A keyed log checks out with its key, and only with its key.
+	keyed := filepath.Join(dir, "keyed.log")
+	keyFile := filepath.Join(dir, "audit.key")
+	if err := ioutil.WriteFile(keyFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	al, err = audit.Open(keyed, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("cannot open log: %v", err)
+	}
+	if err := al.Append(audit.Record{Action: audit.ActionAdd, Actor: "alice",
+		Code: item.Code, After: &item}); err != nil {
+		t.Fatalf("cannot append: %v", err)
+	}
+	al.Close()
+	if code := run([]string{"-key-file", keyFile, keyed}, ioutil.Discard,
+		ioutil.Discard); code != exitOK {
+		t.Fatalf("keyed verify failed with %d", code)
+	}
+	if code := run([]string{keyed}, ioutil.Discard,
+		ioutil.Discard); code != exitTampered {
+		t.Fatalf("unkeyed verify exited with %d", code)
+	}
+}
@@ -0,0 +1,618 @@
+// Package main is producectl, a command-line tool for administering the
+// produce catalog.  It calls the REST API with the client package, so the
+// outcome of each command can be reported by its exit code:
+//
+//	0  success
+//	1  the command failed for any other reason, such as a server error
+//	2  the command line is invalid
+//	3  the service rejected the request as invalid (HTTP 400)
+//	4  the item, category or attribute wasn't found (HTTP 404)
+//	5  the item, category or attribute already exists or is in use (HTTP 409)
+//	6  the credentials are missing, not valid or lack the role (HTTP 401
+//	   or 403)
+//
+// Run "producectl -h" for the commands.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gdotgordon/produce-demo/client"
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// The exit codes.
+const (
+	exitOK         = 0
+	exitError      = 1
+	exitUsage      = 2
+	exitBadRequest = 3
+	exitNotFound   = 4
+	exitConflict   = 5
+	exitAuth       = 6
+)
+
+// The output formats for items.
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+// defaultServer is used when neither the -server flag nor the
+// PRODUCE_SERVER environment variable is set.
+const defaultServer = "http://localhost:8080"
+
+// errUsage is returned for an invalid command line, once the problem has
+// been reported.
+var errUsage = errors.New("invalid usage")
+
+// command is a subcommand, which parses its own flags from the arguments.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, env *env, args []string) error
+}
+
+// env is what the commands run with.
+type env struct {
+	client *client.Client
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var commands = []command{
+	{"status", "show the status of the service", runStatus},
+	{"list", "list the produce items", runList},
+	{"get", "show a single produce item", runGet},
+	{"add", "add produce items from flags, a file or stdin", runAdd},
+	{"delete", "delete produce items", runDelete},
+	{"import", "import produce items from a CSV file", runImport},
+	{"export", "export the produce items as CSV", runExport},
+	{"reset", "delete every item, category and attribute", runReset},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("producectl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", os.Getenv("PRODUCE_SERVER"),
+		"produce service URL (default $PRODUCE_SERVER or "+defaultServer+")")
+	timeout := fs.Duration("timeout", client.DefaultTimeout,
+		"timeout for each request")
+	retries := fs.Int("retries", client.DefaultRetries,
+		"retries for requests that are safe to repeat, 0 for none")
+	apiKey := fs.String("api-key", os.Getenv("PRODUCE_API_KEY"),
+		"API key for commands that make changes (default $PRODUCE_API_KEY)")
+	token := fs.String("token", os.Getenv("PRODUCE_TOKEN"),
+		"JWT bearer token (default $PRODUCE_TOKEN)")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: producectl [flags] <command> [command flags]\n\n")
+		fmt.Fprintf(stderr, "Commands:\n")
+		for _, v := range commands {
+			fmt.Fprintf(stderr, "  %-8s %s\n", v.name, v.summary)
+		}
+		fmt.Fprintf(stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == fs.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "producectl: unknown command '%s'\n", fs.Arg(0))
+		fs.Usage()
+		return exitUsage
+	}
+
+	if *server == "" {
+		*server = defaultServer
+	}
+	if *retries == 0 {
+		*retries = -1
+	}
+	c, err := client.New(*server, client.Options{Timeout: *timeout,
+		Retries: *retries, APIKey: *apiKey, BearerToken: *token})
+	if err != nil {
+		fmt.Fprintf(stderr, "producectl: %v\n", err)
+		return exitUsage
+	}
+
+	e := &env{client: c, stdin: stdin, stdout: stdout, stderr: stderr}
+	err = cmd.run(context.Background(), e, fs.Args()[1:])
+	if se, ok := err.(silentError); ok {
+		return exitCode(se.error)
+	}
+	switch err {
+	case nil, flag.ErrHelp:
+		return exitOK
+	case errUsage:
+		return exitUsage
+	}
+	fmt.Fprintf(stderr, "producectl: %v\n", err)
+	return exitCode(err)
+}
+
+// exitCode returns the exit code for the error of a command.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return exitOK
+	case service.FormatError:
+		return exitBadRequest
+	case store.NotFoundError, store.CategoryNotFoundError,
+		store.AttributeNotFoundError:
+		return exitNotFound
+	case store.AlreadyExistsError, store.CategoryExistsError,
+		store.CategoryInUseError, store.AttributeExistsError,
+		store.AttributeInUseError:
+		return exitConflict
+	case client.StatusError:
+		switch e.StatusCode {
+		case http.StatusBadRequest:
+			return exitBadRequest
+		case http.StatusNotFound:
+			return exitNotFound
+		case http.StatusConflict:
+			return exitConflict
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return exitAuth
+		}
+	}
+	return exitError
+}
+
+// newFlagSet creates the flag set for a command.
+func newFlagSet(e *env, name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(e.stderr, "Usage: producectl %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags of a command, and checks the number of
+// arguments that follow them is in range.  The flag set reports any
+// problem with the flags.
+func parse(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// listFlag is a flag that may be repeated, collecting each value.
+type listFlag []string
+
+// String satisfies the flag.Value interface.
+func (lf *listFlag) String() string {
+	return strings.Join(*lf, ",")
+}
+
+// Set satisfies the flag.Value interface.
+func (lf *listFlag) Set(v string) error {
+	*lf = append(*lf, v)
+	return nil
+}
+
+// delimiterFlag adds the flag for the CSV delimiter to the flag set.
+func delimiterFlag(fs *flag.FlagSet) *string {
+	return fs.String("delimiter", "",
+		"CSV field delimiter, a single character or 'tab' (default ',')")
+}
+
+// parseDelimiter converts the delimiter flag to a rune, zero for the
+// default.
+func parseDelimiter(d string) (rune, error) {
+	switch {
+	case d == "":
+		return 0, nil
+	case d == "tab":
+		return '\t', nil
+	case len([]rune(d)) == 1:
+		return []rune(d)[0], nil
+	}
+	return 0, fmt.Errorf("invalid delimiter: '%s'", d)
+}
+
+func runStatus(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet(e, "status", "")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	status, err := e.client.Status(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(e.stdout, status)
+	return nil
+}
+
+func runList(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet(e, "list", "")
+	format := fs.String("o", formatTable, "output format: 'table', 'json', 'csv'")
+	var opts client.ListOptions
+	fs.StringVar(&opts.Category, "category", "",
+		"only list the items in the category's subtree")
+	fs.Var((*listFlag)(&opts.Tags), "tag",
+		"only list the items with the tag (may be repeated)")
+	fs.StringVar(&opts.Language, "lang", "", "language for the names, e.g. 'fr'")
+	fs.BoolVar(&opts.AllNames, "all-names", false, "show all of the names")
+	delimiter := delimiterFlag(fs)
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	switch *format {
+	case formatCSV:
+		d, err := parseDelimiter(*delimiter)
+		if err != nil {
+			return err
+		}
+		b, err := e.client.ExportCSV(ctx, opts, d)
+		if err != nil {
+			return err
+		}
+		_, err = e.stdout.Write(b)
+		return err
+	case formatTable, formatJSON:
+		items, err := e.client.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		return writeItems(e.stdout, *format, items)
+	}
+	return fmt.Errorf("invalid output format: '%s'", *format)
+}
+
+func runGet(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet(e, "get", "<code>")
+	format := fs.String("o", formatTable, "output format: 'table', 'json'")
+	var opts client.ListOptions
+	fs.StringVar(&opts.Language, "lang", "", "language for the name, e.g. 'fr'")
+	fs.BoolVar(&opts.AllNames, "all-names", false, "show all of the names")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	if *format != formatTable && *format != formatJSON {
+		return fmt.Errorf("invalid output format: '%s'", *format)
+	}
+
+	item, err := e.client.Get(ctx, fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	if *format == formatJSON {
+		return writeJSON(e.stdout, item)
+	}
+	return writeItems(e.stdout, formatTable, []types.Produce{item})
+}
+
+func runAdd(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet(e, "add", "")
+	file := fs.String("file", "",
+		"JSON file with an item or an array of items, '-' for stdin")
+	var item types.Produce
+	fs.StringVar(&item.Code, "code", "", "produce code (generated if not set)")
+	fs.StringVar(&item.Name, "name", "", "name")
+	price := fs.String("price", "", "unit price, e.g. '$3.46'")
+	fs.StringVar(&item.Category, "category", "", "category")
+	fs.Var((*listFlag)(&item.Tags), "tag", "tag (may be repeated)")
+	var attrs, names listFlag
+	fs.Var(&attrs, "attr", "attribute as name=value, where the value is "+
+		"JSON or else a string (may be repeated)")
+	fs.Var(&names, "localized", "localized name as lang=name (may be repeated)")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	var items []types.Produce
+	if *file != "" {
+		if item.Name != "" || *price != "" {
+			return errors.New("items are added from either a file or flags")
+		}
+		var err error
+		if items, err = readItems(e, *file); err != nil {
+			return err
+		}
+	} else {
+		if item.Name == "" || *price == "" {
+			fs.Usage()
+			return errUsage
+		}
+		if err := item.UnitPrice.UnmarshalText([]byte(*price)); err != nil {
+			return err
+		}
+		for _, v := range attrs {
+			ndx := strings.Index(v, "=")
+			if ndx <= 0 {
+				return fmt.Errorf("invalid attribute: '%s'", v)
+			}
+			if item.Attributes == nil {
+				item.Attributes = make(map[string]interface{})
+			}
+			var val interface{}
+			if json.Unmarshal([]byte(v[ndx+1:]), &val) != nil {
+				val = v[ndx+1:]
+			}
+			item.Attributes[v[:ndx]] = val
+		}
+		for _, v := range names {
+			ndx := strings.Index(v, "=")
+			if ndx <= 0 {
+				return fmt.Errorf("invalid localized name: '%s'", v)
+			}
+			if item.Names == nil {
+				item.Names = make(map[string]string)
+			}
+			item.Names[v[:ndx]] = v[ndx+1:]
+		}
+		items = []types.Produce{item}
+	}
+
+	res, err := e.client.Add(ctx, items)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, v := range res {
+		if v.Err != nil {
+			fmt.Fprintf(e.stderr, "%s: %v\n", v.Code, v.Err)
+			if first == nil {
+				first = v.Err
+			}
+			continue
+		}
+		fmt.Fprintln(e.stdout, v.Code)
+	}
+	return failed(first)
+}
+
+// readItems reads a single item or an array of items as JSON from the
+// file, or from stdin for "-".
+func readItems(e *env, file string) ([]types.Produce, error) {
+	b, err := readFile(e, file)
+	if err != nil {
+		return nil, err
+	}
+	var items []types.Produce
+	if err := json.Unmarshal(b, &items); err != nil {
+		var item types.Produce
+		if serr := json.Unmarshal(b, &item); serr != nil {
+			return nil, fmt.Errorf("cannot read items from %s: %v", file, err)
+		}
+		items = []types.Produce{item}
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no items in %s", file)
+	}
+	return items, nil
+}
+
+// readFile reads the file, or stdin for "-".
+func readFile(e *env, file string) ([]byte, error) {
+	if file == "-" {
+		return ioutil.ReadAll(e.stdin)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// silentError is an error that has already been reported, so it is only
+// used for the exit code.  A command on several items reports the failure
+// of each, and exits with the code for the first.
+type silentError struct {
+	error
+}
+
+// failed returns the silent error for the first failure, if any.
+func failed(first error) error {
+	if first == nil {
+		return nil
+	}
+	return silentError{first}
+}
+
+func runDelete(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet(e, "delete", "<code>...")
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+	var first error
+	for _, code := range fs.Args() {
+		if err := e.client.Delete(ctx, code); err != nil {
+			fmt.Fprintf(e.stderr, "%s: %v\n", code, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return failed(first)
+}
+
+func runImport(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet(e, "import", "<file>|-")
+	delimiter := delimiterFlag(fs)
+	var mapping listFlag
+	fs.Var(&mapping, "map", "map a column to a field as column:field "+
+		"(may be repeated)")
+	abort := fs.Bool("abort", false, "add no rows if any are invalid")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	opts := client.ImportOptions{Abort: *abort, Map: make(map[string]string)}
+	var err error
+	if opts.Delimiter, err = parseDelimiter(*delimiter); err != nil {
+		return err
+	}
+	for _, v := range mapping {
+		ndx := strings.Index(v, ":")
+		if ndx <= 0 {
+			return fmt.Errorf("invalid column mapping: '%s'", v)
+		}
+		opts.Map[v[:ndx]] = v[ndx+1:]
+	}
+	b, err := readFile(e, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Import(ctx, strings.NewReader(string(b)), opts)
+	if err != nil && err != client.ErrImportAborted {
+		return err
+	}
+	var first error
+	for _, v := range res {
+		if v.Err != nil {
+			fmt.Fprintf(e.stderr, "row %d: %s: %v\n", v.Seq, v.Code, v.Err)
+			if first == nil {
+				first = v.Err
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(e.stderr, "producectl: %v\n", err)
+		return silentError{client.StatusError{StatusCode: http.StatusBadRequest,
+			Message: err.Error()}}
+	}
+	if res == nil {
+		fmt.Fprintln(e.stdout, "all rows were added")
+	} else {
+		fmt.Fprintf(e.stdout, "%d of %d rows were added\n",
+			added(res), len(res))
+	}
+	return failed(first)
+}
+
+// added counts the rows that were added.
+func added(res []service.BulkResult) int {
+	n := 0
+	for _, v := range res {
+		if v.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func runExport(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet(e, "export", "")
+	out := fs.String("out", "", "file to write (default stdout)")
+	var opts client.ListOptions
+	fs.StringVar(&opts.Category, "category", "",
+		"only export the items in the category's subtree")
+	fs.Var((*listFlag)(&opts.Tags), "tag",
+		"only export the items with the tag (may be repeated)")
+	delimiter := delimiterFlag(fs)
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	d, err := parseDelimiter(*delimiter)
+	if err != nil {
+		return err
+	}
+
+	opts.AllNames = true
+	b, err := e.client.ExportCSV(ctx, opts, d)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = e.stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(*out, b, 0644)
+}
+
+func runReset(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet(e, "reset", "")
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if !*yes {
+		fmt.Fprint(e.stderr, "This deletes every produce item, category "+
+			"and attribute.  Continue? [y/N] ")
+		answer, _ := bufio.NewReader(e.stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return errors.New("reset cancelled")
+		}
+	}
+	return e.client.Reset(ctx)
+}
+
+// writeItems writes the items as a table or as JSON.
+func writeItems(w io.Writer, format string, items []types.Produce) error {
+	if format == formatJSON {
+		if items == nil {
+			items = []types.Produce{}
+		}
+		return writeJSON(w, items)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CODE\tNAME\tPRICE\tCATEGORY\tTAGS\tATTRIBUTES")
+	for _, v := range items {
+		attrs := make([]string, 0, len(v.Attributes))
+		for k, a := range v.Attributes {
+			attrs = append(attrs, fmt.Sprintf("%s=%v", k, a))
+		}
+		sort.Strings(attrs)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Code, v.Name,
+			v.UnitPrice, v.Category, strings.Join(v.Tags, ","),
+			strings.Join(attrs, ","))
+	}
+	return tw.Flush()
+}
+
+// writeJSON writes the value as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
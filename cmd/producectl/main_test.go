@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/api"
+	"github.com/gdotgordon/produce-demo/client"
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+)
+
+func TestCommands(t *testing.T) {
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	svc := service.New(store.New(), lg.Sugar())
+	if err := svc.AddCategory(context.Background(),
+		types.Category{Name: "Vegetables"}); err != nil {
+		t.Fatalf("cannot add category: %v", err)
+	}
+	mux := http.NewServeMux()
+	if err := api.Init(context.Background(), mux, svc, lg.Sugar()); err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// The commands run in order against the same service.
+	for i, v := range []struct {
+		args    string
+		stdin   string
+		expCode int
+		expOut  string
+		expErr  string
+	}{
+		{args: "", expCode: exitUsage, expErr: "Commands:"},
+		{args: "bogus", expCode: exitUsage, expErr: "unknown command 'bogus'"},
+		{args: "status", expOut: "produce service is up and running\n"},
+		{
+			args: "add -code a12t-4gh7-qpl9-3n4m -name Lettuce -price 3.46 " +
+				"-category Vegetables -tag Leafy -localized fr=Laitue",
+			expOut: "A12T-4GH7-QPL9-3N4M\n",
+		},
+		{
+			args:    "add -code A12T-4GH7-QPL9-3N4M -name Lettuce -price 3.46",
+			expCode: exitConflict,
+			expErr:  "produce code 'A12T-4GH7-QPL9-3N4M' already exists",
+		},
+		{args: "add -name Lettuce", expCode: exitUsage},
+		{
+			args: "add -file -",
+			stdin: `[{"code": "YRT6-72AS-K736-L4AR", "name": "Green Pepper", ` +
+				`"unit_price": "$0.79"}, {"code": "TQ4C-VV6T-75ZX-1RMR", ` +
+				`"name": "@@@", "unit_price": "$1.00"}]`,
+			expCode: exitBadRequest,
+			expOut:  "YRT6-72AS-K736-L4AR\n",
+			expErr:  "TQ4C-VV6T-75ZX-1RMR: invalid item format",
+		},
+		{
+			args: "list -tag Leafy",
+			expOut: "CODE                 NAME     PRICE  CATEGORY    TAGS   ATTRIBUTES\n" +
+				"A12T-4GH7-QPL9-3N4M  Lettuce  $3.46  Vegetables  Leafy  \n",
+		},
+		{args: "list -category Fruit", expCode: exitNotFound,
+			expErr: "category 'Fruit' was not found"},
+		{args: "list -o xml", expCode: exitError, expErr: "invalid output format"},
+		{
+			args: "get -o json -lang fr a12t-4gh7-qpl9-3n4m",
+			expOut: `{
+  "code": "A12T-4GH7-QPL9-3N4M",
+  "name": "Laitue",
+  "unit_price": "$3.46",
+  "category": "Vegetables",
+  "tags": [
+    "Leafy"
+  ]
+}
+`,
+		},
+		{args: "get TQ4C-VV6T-75ZX-1RMR", expCode: exitNotFound},
+		{args: "get A12T", expCode: exitBadRequest},
+		{args: "get", expCode: exitUsage},
+		{
+			args:    "delete YRT6-72AS-K736-L4AR TQ4C-VV6T-75ZX-1RMR",
+			expCode: exitNotFound,
+			expErr:  "TQ4C-VV6T-75ZX-1RMR: produce code 'TQ4C-VV6T-75ZX-1RMR' was not found",
+		},
+		{
+			args:   "import -delimiter ; -map price:unit_price -",
+			stdin:  "code;name;price\nYRT6-72AS-K736-L4AR;Green Pepper;0.79\n",
+			expOut: "all rows were added\n",
+		},
+		{
+			args: "import -abort -",
+			stdin: "code,name,unit_price\nTQ4C-VV6T-75ZX-1RMR,Leek,1.25\n" +
+				"YRT6,Bad,0.79\n",
+			expCode: exitBadRequest,
+			expErr:  "row 2: YRT6: invalid item format",
+		},
+		{
+			args: "export -category Vegetables",
+			expOut: "code,name,unit_price,category,tags,name:fr\n" +
+				"A12T-4GH7-QPL9-3N4M,Lettuce,$3.46,Vegetables,Leafy,Laitue\n",
+		},
+		{args: "reset", stdin: "n\n", expCode: exitError, expErr: "reset cancelled"},
+		{args: "list -o json", expOut: "[\n  {\n    \"code\""},
+		{args: "reset", stdin: "yes\n"},
+		{args: "list -o json", expOut: "[]\n"},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-server", srv.URL}, strings.Fields(v.args)...)
+		code := run(args, strings.NewReader(v.stdin), &stdout, &stderr)
+		if code != v.expCode {
+			t.Fatalf("(%d) '%s' exited with %d, expected %d: %s", i, v.args,
+				code, v.expCode, stderr.String())
+		}
+		if !strings.HasPrefix(stdout.String(), v.expOut) ||
+			(v.expOut == "" && stdout.Len() != 0) {
+			t.Fatalf("(%d) unexpected output: %s", i, stdout.String())
+		}
+		if !strings.Contains(stderr.String(), v.expErr) {
+			t.Fatalf("(%d) unexpected error output: %s", i, stderr.String())
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for i, v := range []struct {
+		err error
+		exp int
+	}{
+		{nil, exitOK},
+		{service.FormatError{Message: "bad"}, exitBadRequest},
+		{store.NotFoundError{Code: "A12T-4GH7-QPL9-3N4M"}, exitNotFound},
+		{store.AttributeInUseError{Name: "organic"}, exitConflict},
+		{service.InternalError{Message: "oops"}, exitError},
+		{client.StatusError{StatusCode: http.StatusUnauthorized}, exitAuth},
+	} {
+		if code := exitCode(v.err); code != v.exp {
+			t.Fatalf("(%d) expected %d, got %d", i, v.exp, code)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package grpcapi
+
+import (
+	"context"
+
+	"github.com/gdotgordon/produce-demo/api"
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The metadata keys that carry the credentials, the gRPC forms of the REST
+// headers.
+const (
+	apiKeyMetadata = "x-api-key"
+	authMetadata   = "authorization"
+)
+
+// methodRoles are the roles the RPCs need, as for the matching REST
+// requests.  Any other method needs an admin.
+var methodRoles = map[string]reqctx.Role{
+	"/produce.v1.ProduceService/ListAll": reqctx.RoleViewer,
+	"/produce.v1.ProduceService/Add":     reqctx.RoleEditor,
+	"/produce.v1.ProduceService/Delete":  reqctx.RoleEditor,
+	"/produce.v1.ProduceService/Clear":   reqctx.RoleAdmin,
+}
+
+// UnaryAuthInterceptor and StreamAuthInterceptor apply the same rules to
+// the RPCs as api.RequireAuth does to the REST requests, with the API key
+// in the "x-api-key" metadata or a bearer token in the "authorization"
+// metadata.  The RPCs that aren't authorized fail with
+// codes.Unauthenticated or codes.PermissionDenied, and the principal of
+// those that are is added to their context.
+func UnaryAuthInterceptor(auth api.Authenticator,
+	log *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{},
+		error) {
+		ctx, err := authorize(ctx, auth, info.FullMethod, log)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamAuthInterceptor is the streaming counterpart of
+// UnaryAuthInterceptor.
+func StreamAuthInterceptor(auth api.Authenticator,
+	log *zap.SugaredLogger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), auth, info.FullMethod, log)
+		if err != nil {
+			return err
+		}
+		return handler(srv, authStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authStream is a server stream with the principal in its context.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (as authStream) Context() context.Context {
+	return as.ctx
+}
+
+// authorize checks the credentials in the metadata of a call to the method,
+// and returns the context with the principal.
+func authorize(ctx context.Context, auth api.Authenticator, method string,
+	log *zap.SugaredLogger) (context.Context, error) {
+	var token, key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(apiKeyMetadata); len(v) != 0 {
+			key = v[0]
+		}
+		if v := md.Get(authMetadata); len(v) != 0 {
+			token = api.BearerToken(v[0])
+		}
+	}
+	role, ok := methodRoles[method]
+	if !ok {
+		role = reqctx.RoleAdmin
+	}
+	p, err := auth.Authorize(role, token, key)
+	switch err.(type) {
+	case nil:
+	case api.UnauthenticatedError:
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	default:
+		log.Warnw("forbidden call", "method", method, "subject", p.Subject,
+			"error", err)
+		return ctx, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if p.Subject != "" {
+		log.Debugw("authenticated call", "subject", p.Subject,
+			"scheme", p.Scheme, "method", method)
+		ctx = reqctx.WithPrincipal(ctx, p)
+	}
+	return ctx, nil
+}
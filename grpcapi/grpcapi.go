@@ -0,0 +1,285 @@
+// Package grpcapi is the gRPC endpoint implementation for the produce
+// service.  It is the gRPC counterpart of the api package: it converts
+// the protobuf messages to and from the Go types, dispatches to the same
+// service as the REST endpoints, and maps the service and store errors
+// to gRPC status codes.
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+
+	"github.com/gdotgordon/produce-demo/producepb"
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDMetadata is the metadata key that carries the request ID, the
+// gRPC form of the REST header.
+const requestIDMetadata = "x-request-id"
+
+// grpcImpl implements the produce gRPC service.  Embedding the
+// unimplemented server means methods added to the service definition
+// return codes.Unimplemented until they are implemented here.
+type grpcImpl struct {
+	producepb.UnimplementedProduceServiceServer
+	service service.Service
+	log     *zap.SugaredLogger
+}
+
+// Register registers the produce service with the gRPC server, sharing the
+// service instance used by the REST endpoints.
+func Register(srv grpc.ServiceRegistrar, service service.Service,
+	log *zap.SugaredLogger) {
+	producepb.RegisterProduceServiceServer(srv,
+		&grpcImpl{service: service, log: log})
+}
+
+// Add adds the produce items.  As with the REST batch add, each item
+// succeeds or fails on its own, so the result of each is returned with its
+// own status code, and the RPC only fails if none could be attempted.
+func (g *grpcImpl) Add(ctx context.Context,
+	req *producepb.AddRequest) (*producepb.AddResponse, error) {
+	if len(req.GetItems()) == 0 {
+		return nil, status.Error(codes.InvalidArgument,
+			"at least one item must be specified to add")
+	}
+
+	items := make([]types.Produce, len(req.GetItems()))
+	for i, v := range req.GetItems() {
+		item, err := fromProto(v)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument,
+				fmt.Sprintf("item %d: %v", i, err))
+		}
+		items[i] = item
+	}
+	addRes, err := g.service.Add(requestContext(ctx), items)
+	if err != nil {
+		if oe, ok := err.(service.OverloadedError); ok {
+			grpc.SetTrailer(ctx, metadata.Pairs(retryAfterMetadata,
+				reqctx.RetryAfterSeconds(oe.RetryAfter)))
+		}
+		g.log.Errorw("server error from Add", "error", err)
+		return nil, statusError(err)
+	}
+
+	resp := &producepb.AddResponse{
+		Results: make([]*producepb.AddResult, len(addRes)),
+	}
+	for i, v := range addRes {
+		res := &producepb.AddResult{
+			Code:       v.Code,
+			Generated:  v.Generated,
+			StatusCode: int32(errorToCode(v.Err)),
+		}
+		if v.Err != nil {
+			res.Error = v.Err.Error()
+		}
+		resp.Results[i] = res
+	}
+	return resp, nil
+}
+
+// Delete deletes the produce item with the code.
+func (g *grpcImpl) Delete(ctx context.Context,
+	req *producepb.DeleteRequest) (*producepb.DeleteResponse, error) {
+	if err := g.service.Delete(requestContext(ctx),
+		req.GetCode()); err != nil {
+		return nil, statusError(err)
+	}
+	return &producepb.DeleteResponse{}, nil
+}
+
+// ListAll streams the produce items as they are read from the store, so
+// the whole list is never held in memory.
+func (g *grpcImpl) ListAll(req *producepb.ListAllRequest,
+	stream producepb.ProduceService_ListAllServer) error {
+	err := g.service.Iterate(stream.Context(), types.ProduceFilter{},
+		func(item types.Produce) error {
+			return stream.Send(toProto(item))
+		})
+	if err != nil {
+		return statusError(err)
+	}
+	return nil
+}
+
+// Clear deletes all of the produce items.
+func (g *grpcImpl) Clear(ctx context.Context,
+	req *producepb.ClearRequest) (*producepb.ClearResponse, error) {
+	if err := g.service.Clear(requestContext(ctx)); err != nil {
+		return nil, statusError(err)
+	}
+	return &producepb.ClearResponse{}, nil
+}
+
+// requestContext adds the info of the call to its context, as the REST
+// handlers do, with the ID from the "x-request-id" metadata if it is
+// valid, or else a new one, which is returned in the header.
+func requestContext(ctx context.Context) context.Context {
+	var info reqctx.RequestInfo
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestIDMetadata); len(v) != 0 &&
+			reqctx.ValidRequestID(v[0]) {
+			info.ID = v[0]
+		}
+	}
+	if info.ID == "" {
+		info.ID = reqctx.NewRequestID()
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		info.ClientIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(info.ClientIP); err == nil {
+			info.ClientIP = host
+		}
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, info.ID))
+	return reqctx.WithRequestInfo(ctx, info)
+}
+
+// statusError converts an error from the service to a gRPC status error.
+// Errors that are already gRPC status errors, such as those from sending
+// on a stream, are returned as is.
+func statusError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(errorToCode(err), err.Error())
+}
+
+// Map a Go error to a gRPC status code, in the same way as the REST API
+// maps them to HTTP status codes.  The conflicts that HTTP reports as 409
+// are split between AlreadyExists, for duplicates, and FailedPrecondition,
+// for categories and attributes that are still in use.
+func errorToCode(err error) codes.Code {
+	switch err {
+	case context.Canceled:
+		return codes.Canceled
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	}
+	switch err.(type) {
+	case service.InternalError:
+		return codes.Internal
+	case service.OverloadedError:
+		return codes.Unavailable
+	case service.FormatError:
+		return codes.InvalidArgument
+	case store.AlreadyExistsError:
+		return codes.AlreadyExists
+	case store.NotFoundError:
+		return codes.NotFound
+	case store.CategoryExistsError:
+		return codes.AlreadyExists
+	case store.CategoryInUseError:
+		return codes.FailedPrecondition
+	case store.CategoryNotFoundError:
+		return codes.NotFound
+	case store.AttributeExistsError:
+		return codes.AlreadyExists
+	case store.AttributeInUseError:
+		return codes.FailedPrecondition
+	case store.AttributeNotFoundError:
+		return codes.NotFound
+	case nil:
+		return codes.OK
+	default:
+		return codes.Internal
+	}
+}
+
+// toProto converts a produce item to its protobuf form.
+func toProto(item types.Produce) *producepb.Produce {
+	pb := &producepb.Produce{
+		Code:           item.Code,
+		Name:           item.Name,
+		UnitPriceCents: int64(item.UnitPrice),
+		Category:       item.Category,
+		Tags:           item.Tags,
+		Names:          item.Names,
+	}
+	if len(item.Attributes) != 0 {
+		pb.Attributes = make(map[string]*producepb.AttributeValue,
+			len(item.Attributes))
+	}
+	for k, v := range item.Attributes {
+		av := &producepb.AttributeValue{}
+		switch t := v.(type) {
+		case string:
+			av.Value = &producepb.AttributeValue_StringValue{StringValue: t}
+		case int64:
+			av.Value = &producepb.AttributeValue_IntValue{IntValue: t}
+		case bool:
+			av.Value = &producepb.AttributeValue_BoolValue{BoolValue: t}
+		case types.USD:
+			av.Value = &producepb.AttributeValue_MoneyCents{MoneyCents: int64(t)}
+		default:
+			av.Value = &producepb.AttributeValue_StringValue{
+				StringValue: fmt.Sprint(t)}
+		}
+		pb.Attributes[k] = av
+	}
+	return pb
+}
+
+// fromProto converts a produce item from its protobuf form.  The attribute
+// values keep their types, which validation checks against the schema,
+// and a value that isn't set is nil, which validation rejects.  A price
+// in cents that a USD can't hold is an error, rather than wrapping around.
+func fromProto(pb *producepb.Produce) (types.Produce, error) {
+	price, err := usdFromCents(pb.GetUnitPriceCents(), "unit_price_cents")
+	if err != nil {
+		return types.Produce{}, err
+	}
+	item := types.Produce{
+		Code:      pb.GetCode(),
+		Name:      pb.GetName(),
+		UnitPrice: price,
+		Category:  pb.GetCategory(),
+		Tags:      pb.GetTags(),
+		Names:     pb.GetNames(),
+	}
+	if len(pb.GetAttributes()) != 0 {
+		item.Attributes = make(map[string]interface{},
+			len(pb.GetAttributes()))
+	}
+	for k, v := range pb.GetAttributes() {
+		var val interface{}
+		switch t := v.GetValue().(type) {
+		case *producepb.AttributeValue_StringValue:
+			val = t.StringValue
+		case *producepb.AttributeValue_IntValue:
+			val = t.IntValue
+		case *producepb.AttributeValue_BoolValue:
+			val = t.BoolValue
+		case *producepb.AttributeValue_MoneyCents:
+			usd, err := usdFromCents(t.MoneyCents, "attributes."+k)
+			if err != nil {
+				return types.Produce{}, err
+			}
+			val = usd
+		}
+		item.Attributes[k] = val
+	}
+	return item, nil
+}
+
+// usdFromCents converts an amount in cents to a USD, or returns an error
+// naming the field if it is negative or too large.
+func usdFromCents(cents int64, field string) (types.USD, error) {
+	if cents < 0 || cents > math.MaxUint32 {
+		return 0, fmt.Errorf("%s: %d cents is out of range", field, cents)
+	}
+	return types.USD(cents), nil
+}
@@ -0,0 +1,461 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/api"
+	"github.com/gdotgordon/produce-demo/producepb"
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// These tests run the gRPC service in-process over a bufconn listener, in
+// front of a real service and store, so the whole stack is exercised
+// without opening a port.
+
+var (
+	dfltProduce = &producepb.Produce{
+		Code:           "A12T-4GH7-QPL9-3N4M",
+		Name:           "Lettuce",
+		UnitPriceCents: 346,
+	}
+
+	secondProduce = &producepb.Produce{
+		Code:           "YRT6-72AS-K736-L4AR",
+		Name:           "Green Pepper",
+		UnitPriceCents: 79,
+	}
+)
+
+func TestAdd(t *testing.T) {
+	client := newClient(t)
+	ctx := context.Background()
+
+	_, err := client.Add(ctx, &producepb.AddRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unexpected error for empty add: %v", err)
+	}
+
+	badName := &producepb.Produce{Code: "DRT6-72AS-K736-L4AR",
+		Name: "Green-Pepper", UnitPriceCents: 79}
+	noCode := &producepb.Produce{Name: "Leek", UnitPriceCents: 125}
+	resp, err := client.Add(ctx, &producepb.AddRequest{
+		Items: []*producepb.Produce{dfltProduce, dfltProduce, badName, noCode},
+	})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	res := resp.GetResults()
+	if len(res) != 4 {
+		t.Fatalf("unexpected results: %v", res)
+	}
+
+	// The duplicates run concurrently, so either one may win.
+	exp := []codes.Code{codes.OK, codes.AlreadyExists}
+	got := []codes.Code{codes.Code(res[0].StatusCode),
+		codes.Code(res[1].StatusCode)}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected duplicate results: %v", res[:2])
+	}
+	if codes.Code(res[2].StatusCode) != codes.InvalidArgument ||
+		res[2].Error == "" {
+		t.Fatalf("unexpected result for bad name: %v", res[2])
+	}
+	if codes.Code(res[3].StatusCode) != codes.OK || !res[3].Generated ||
+		res[3].Code == "" {
+		t.Fatalf("unexpected result for generated code: %v", res[3])
+	}
+}
+
+func TestDelete(t *testing.T) {
+	client := newClient(t)
+	ctx := context.Background()
+	_, err := client.Add(ctx, &producepb.AddRequest{
+		Items: []*producepb.Produce{dfltProduce}})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	for i, v := range []struct {
+		code    string
+		expCode codes.Code
+	}{
+		{code: "A12T-4GH7-QP", expCode: codes.InvalidArgument},
+		{code: secondProduce.Code, expCode: codes.NotFound},
+		{code: dfltProduce.Code, expCode: codes.OK},
+		{code: dfltProduce.Code, expCode: codes.NotFound},
+	} {
+		_, err := client.Delete(ctx, &producepb.DeleteRequest{Code: v.code})
+		if status.Code(err) != v.expCode {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestListAllAndClear(t *testing.T) {
+	client := newClient(t)
+	ctx := context.Background()
+	item := &producepb.Produce{
+		Code:           dfltProduce.Code,
+		Name:           dfltProduce.Name,
+		UnitPriceCents: dfltProduce.UnitPriceCents,
+		Tags:           []string{"Leafy"},
+		Names:          map[string]string{"fr": "Laitue"},
+	}
+	_, err := client.Add(ctx, &producepb.AddRequest{
+		Items: []*producepb.Produce{item, secondProduce}})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	items := listAll(t, client)
+	if len(items) != 2 {
+		t.Fatalf("unexpected item count: %d", len(items))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Code < items[j].Code })
+	for i, v := range []*producepb.Produce{item, secondProduce} {
+		if items[i].Code != v.Code || items[i].Name != v.Name ||
+			items[i].UnitPriceCents != v.UnitPriceCents ||
+			!reflect.DeepEqual(items[i].Tags, v.Tags) ||
+			!reflect.DeepEqual(items[i].Names, v.Names) {
+			t.Fatalf("(%d) unexpected item: %v", i, items[i])
+		}
+	}
+
+	if _, err := client.Clear(ctx, &producepb.ClearRequest{}); err != nil {
+		t.Fatalf("clear failed: %v", err)
+	}
+	if items := listAll(t, client); len(items) != 0 {
+		t.Fatalf("unexpected items after clear: %v", items)
+	}
+}
+
+func TestAuthInterceptors(t *testing.T) {
+	ks, err := api.NewKeyStore("", "ops:0p3r4t0r")
+	if err != nil {
+		t.Fatalf("cannot load keys: %v", err)
+	}
+	tv, err := api.NewTokenVerifier(api.TokenConfig{Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("cannot create verifier: %v", err)
+	}
+	auth := api.Authenticator{Keys: ks, Tokens: tv}
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	client := newClient(t,
+		grpc.UnaryInterceptor(UnaryAuthInterceptor(auth, lg.Sugar())),
+		grpc.StreamInterceptor(StreamAuthInterceptor(auth, lg.Sugar())))
+
+	exp := time.Now().Add(time.Hour).Unix()
+	viewer := hs256Token(t, "s3cret", map[string]interface{}{
+		"sub": "alice", "exp": exp, "roles": []string{"viewer"}})
+	admin := hs256Token(t, "s3cret", map[string]interface{}{
+		"sub": "bob", "exp": exp, "roles": "editor admin"})
+	forged := hs256Token(t, "guess", map[string]interface{}{
+		"sub": "mallory", "exp": exp, "roles": []string{"admin"}})
+	for i, v := range []struct {
+		key     string
+		token   string
+		stream  bool
+		expCode codes.Code
+	}{
+		{expCode: codes.Unauthenticated},
+		{key: "guess", expCode: codes.PermissionDenied},
+		{key: "0p3r4t0r", expCode: codes.OK},
+		{token: viewer, expCode: codes.PermissionDenied},
+		{token: admin, expCode: codes.OK},
+		{token: forged, expCode: codes.Unauthenticated},
+		{stream: true, expCode: codes.Unauthenticated},
+		{stream: true, key: "guess", expCode: codes.PermissionDenied},
+		{stream: true, key: "0p3r4t0r", expCode: codes.OK},
+		{stream: true, token: viewer, expCode: codes.OK},
+	} {
+		ctx := context.Background()
+		if v.key != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", v.key)
+		}
+		if v.token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization",
+				"Bearer "+v.token)
+		}
+		if v.stream {
+			var stream producepb.ProduceService_ListAllClient
+			stream, err = client.ListAll(ctx, &producepb.ListAllRequest{})
+			if err == nil {
+				_, err = stream.Recv()
+				if err == io.EOF {
+					err = nil
+				}
+			}
+		} else {
+			_, err = client.Clear(ctx, &producepb.ClearRequest{})
+		}
+		if code := status.Code(err); code != v.expCode {
+			t.Fatalf("(%d) expected %v, got %v", i, v.expCode, err)
+		}
+	}
+}
+
+func TestRateLimitInterceptors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.json")
+	err := ioutil.WriteFile(file, []byte(`{"default": `+
+		`{"write": {"rate": 0.001, "burst": 1}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := api.NewRateLimiter(file)
+	if err != nil {
+		t.Fatalf("cannot create limiter: %v", err)
+	}
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	client := newClient(t,
+		grpc.UnaryInterceptor(UnaryRateLimitInterceptor(rl, lg.Sugar())),
+		grpc.StreamInterceptor(StreamRateLimitInterceptor(rl, lg.Sugar())))
+
+	ctx := context.Background()
+	if _, err := client.Clear(ctx, &producepb.ClearRequest{}); err != nil {
+		t.Fatalf("clear failed: %v", err)
+	}
+	var trailer metadata.MD
+	_, err = client.Clear(ctx, &producepb.ClearRequest{}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the clear to be limited, got %v", err)
+	}
+	if v := trailer.Get("retry-after"); len(v) != 1 || v[0] != "1000" {
+		t.Fatalf("unexpected retry-after: %v", v)
+	}
+
+	// Reads have their own budget.
+	if items := listAll(t, client); len(items) != 0 {
+		t.Fatalf("unexpected items: %v", items)
+	}
+}
+
+func TestAuthFailureInterceptors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits.json")
+	err := ioutil.WriteFile(file, []byte(`{"default": {}, `+
+		`"auth_failures": {"rate": 0.001, "burst": 2}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := api.NewRateLimiter(file)
+	if err != nil {
+		t.Fatalf("cannot create limiter: %v", err)
+	}
+	ks, err := api.NewKeyStore("", "ops:0p3r4t0r")
+	if err != nil {
+		t.Fatalf("cannot load keys: %v", err)
+	}
+	auth := api.Authenticator{Keys: ks}
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	client := newClient(t,
+		grpc.ChainUnaryInterceptor(
+			UnaryAuthFailureInterceptor(rl, lg.Sugar()),
+			UnaryAuthInterceptor(auth, lg.Sugar())),
+		grpc.ChainStreamInterceptor(
+			StreamAuthFailureInterceptor(rl, lg.Sugar()),
+			StreamAuthInterceptor(auth, lg.Sugar())))
+
+	// Guessed and missing keys are cut off once the attempts are used up,
+	// and so are the other calls from the same address.
+	for i, v := range []struct {
+		key     string
+		stream  bool
+		expCode codes.Code
+	}{
+		{key: "0p3r4t0r", expCode: codes.OK},
+		{key: "guess1", expCode: codes.PermissionDenied},
+		{stream: true, expCode: codes.OK},
+		{expCode: codes.Unauthenticated},
+		{key: "guess2", expCode: codes.ResourceExhausted},
+		{stream: true, expCode: codes.ResourceExhausted},
+	} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(),
+			"x-api-key", v.key)
+		if v.stream {
+			var stream producepb.ProduceService_ListAllClient
+			stream, err = client.ListAll(ctx, &producepb.ListAllRequest{})
+			if err == nil {
+				_, err = stream.Recv()
+				if err == io.EOF {
+					err = nil
+				}
+			}
+		} else {
+			_, err = client.Clear(ctx, &producepb.ClearRequest{})
+		}
+		if code := status.Code(err); code != v.expCode {
+			t.Fatalf("(%d) expected %v, got %v", i, v.expCode, err)
+		}
+	}
+}
+
+// hs256Token signs the claims with the secret.
+func hs256Token(t *testing.T, secret string,
+	claims map[string]interface{}) string {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("cannot marshal claims: %v", err)
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) +
+		"." + enc.EncodeToString(b)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestErrorToCode(t *testing.T) {
+	for i, v := range []struct {
+		err error
+		exp codes.Code
+	}{
+		{nil, codes.OK},
+		{service.InternalError{}, codes.Internal},
+		{service.OverloadedError{}, codes.Unavailable},
+		{service.FormatError{}, codes.InvalidArgument},
+		{store.AlreadyExistsError{}, codes.AlreadyExists},
+		{store.NotFoundError{}, codes.NotFound},
+		{store.CategoryExistsError{}, codes.AlreadyExists},
+		{store.CategoryInUseError{}, codes.FailedPrecondition},
+		{store.CategoryNotFoundError{}, codes.NotFound},
+		{store.AttributeExistsError{}, codes.AlreadyExists},
+		{store.AttributeInUseError{}, codes.FailedPrecondition},
+		{store.AttributeNotFoundError{}, codes.NotFound},
+		{context.Canceled, codes.Canceled},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{errors.New("hiya"), codes.Internal},
+	} {
+		if code := errorToCode(v.err); code != v.exp {
+			t.Fatalf("(%d) unexpected code: %v", i, code)
+		}
+	}
+}
+
+func TestProtoConversion(t *testing.T) {
+	item := types.Produce{
+		Code:      "A12T-4GH7-QPL9-3N4M",
+		Name:      "Lettuce",
+		UnitPrice: types.USD(346),
+		Category:  "Vegetables",
+		Tags:      []string{"leafy"},
+		Attributes: map[string]interface{}{
+			"origin":  "Salinas",
+			"plu":     int64(4061),
+			"organic": true,
+			"deposit": types.USD(5),
+		},
+		Names: map[string]string{"fr": "Laitue"},
+	}
+	pb := toProto(item)
+	if pb.UnitPriceCents != 346 ||
+		pb.Attributes["deposit"].GetMoneyCents() != 5 ||
+		pb.Attributes["plu"].GetIntValue() != 4061 {
+		t.Fatalf("unexpected protobuf: %v", pb)
+	}
+	if res, err := fromProto(pb); err != nil || !reflect.DeepEqual(res, item) {
+		t.Fatalf("unexpected item: %+v, %v", res, err)
+	}
+}
+
+func TestAddPriceOutOfRange(t *testing.T) {
+	client := newClient(t)
+	for i, v := range []*producepb.Produce{
+		{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", UnitPriceCents: -1},
+		{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce",
+			UnitPriceCents: math.MaxUint32 + 1},
+		{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", UnitPriceCents: 346,
+			Attributes: map[string]*producepb.AttributeValue{
+				"deposit": {Value: &producepb.AttributeValue_MoneyCents{
+					MoneyCents: -5}}}},
+	} {
+		_, err := client.Add(context.Background(),
+			&producepb.AddRequest{Items: []*producepb.Produce{v}})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+	}
+
+	// Nothing was added.
+	if items := listAll(t, client); len(items) != 0 {
+		t.Fatalf("unexpected items: %v", items)
+	}
+}
+
+// newClient starts the gRPC service on an in-process listener and returns
+// a client connected to it.  Both are stopped when the test completes.
+func newClient(t *testing.T,
+	opts ...grpc.ServerOption) producepb.ProduceServiceClient {
+	lg, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("cannot create logger: %v", err)
+	}
+	log := lg.Sugar()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(opts...)
+	Register(srv, service.New(store.New(), log), log)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return producepb.NewProduceServiceClient(conn)
+}
+
+// listAll receives all of the items streamed by ListAll.
+func listAll(t *testing.T,
+	client producepb.ProduceServiceClient) []*producepb.Produce {
+	stream, err := client.ListAll(context.Background(),
+		&producepb.ListAllRequest{})
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var items []*producepb.Produce
+	for {
+		item, err := stream.Recv()
+		if err == io.EOF {
+			return items
+		}
+		if err != nil {
+			t.Fatalf("receive failed: %v", err)
+		}
+		items = append(items, item)
+	}
+}
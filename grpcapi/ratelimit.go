@@ -0,0 +1,137 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+
+	"github.com/gdotgordon/produce-demo/api"
+	"github.com/gdotgordon/produce-demo/reqctx"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// retryAfterMetadata is the trailer key with the seconds to wait before
+// retrying a call that was rate limited, the gRPC form of the REST header.
+const retryAfterMetadata = "retry-after"
+
+// UnaryRateLimitInterceptor and StreamRateLimitInterceptor limit the calls
+// of each client with the limiter, as api.RateLimit does the REST
+// requests, with ListAll as a read, and the other RPCs as writes.  The calls
+// over the limits fail with codes.ResourceExhausted, with the seconds to
+// wait in the "retry-after" trailer.  They go after the auth interceptors,
+// so the clients with credentials are limited by them.
+func UnaryRateLimitInterceptor(rl *api.RateLimiter,
+	log *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{},
+		error) {
+		release, err := acquire(ctx, rl, info.FullMethod, log)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+// StreamRateLimitInterceptor is the streaming counterpart of
+// UnaryRateLimitInterceptor.
+func StreamRateLimitInterceptor(rl *api.RateLimiter,
+	log *zap.SugaredLogger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, err := acquire(ss.Context(), rl, info.FullMethod, log)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return handler(srv, ss)
+	}
+}
+
+// acquire admits a call to the method, if the limits of its client allow.
+func acquire(ctx context.Context, rl *api.RateLimiter, method string,
+	log *zap.SugaredLogger) (func(), error) {
+	client := peerHost(ctx)
+	if p, ok := reqctx.PrincipalFromContext(ctx); ok && p.Subject != "" {
+		client = p.Subject
+	}
+	release, err := rl.Acquire(client, methodRoles[method] != reqctx.RoleViewer)
+	if err != nil {
+		return nil, limited(ctx, client, method, err, log)
+	}
+	return release, nil
+}
+
+// UnaryAuthFailureInterceptor and StreamAuthFailureInterceptor limit the
+// failed authentication attempts from each address with the limiter, as
+// api.LimitAuthFailures does for the REST requests, counting the calls
+// that fail with codes.Unauthenticated or codes.PermissionDenied.  They go
+// before the auth interceptors, so they see the calls those turn away.
+func UnaryAuthFailureInterceptor(rl *api.RateLimiter,
+	log *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{},
+		error) {
+		addr := peerHost(ctx)
+		if err := rl.CheckAuthFailures(addr); err != nil {
+			return nil, limited(ctx, addr, info.FullMethod, err, log)
+		}
+		resp, err := handler(ctx, req)
+		countAuthFailure(rl, addr, err)
+		return resp, err
+	}
+}
+
+// StreamAuthFailureInterceptor is the streaming counterpart of
+// UnaryAuthFailureInterceptor.
+func StreamAuthFailureInterceptor(rl *api.RateLimiter,
+	log *zap.SugaredLogger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		addr := peerHost(ss.Context())
+		if err := rl.CheckAuthFailures(addr); err != nil {
+			return limited(ss.Context(), addr, info.FullMethod, err, log)
+		}
+		err := handler(srv, ss)
+		countAuthFailure(rl, addr, err)
+		return err
+	}
+}
+
+// countAuthFailure counts the call's error against the address, if the
+// call wasn't authorized.
+func countAuthFailure(rl *api.RateLimiter, addr string, err error) {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		rl.AuthFailed(addr)
+	}
+}
+
+// limited returns the error for a call that was rate limited, with the
+// seconds to wait in its trailer.
+func limited(ctx context.Context, client, method string, err error,
+	log *zap.SugaredLogger) error {
+	log.Infow("call was rate limited", "client", client, "method", method,
+		"error", err)
+	grpc.SetTrailer(ctx, metadata.Pairs(retryAfterMetadata,
+		reqctx.RetryAfterSeconds(err.(api.RateLimitError).RetryAfter)))
+	return status.Error(codes.ResourceExhausted, err.Error())
+}
+
+// peerHost returns the IP address of the call's client.
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -8,6 +8,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -17,10 +18,14 @@ import (
 	"time"
 
 	"github.com/gdotgordon/produce-demo/api"
+	"github.com/gdotgordon/produce-demo/audit"
+	"github.com/gdotgordon/produce-demo/grpcapi"
+	"github.com/gdotgordon/produce-demo/reqctx"
 	"github.com/gdotgordon/produce-demo/service"
 	"github.com/gdotgordon/produce-demo/store"
 	"github.com/gdotgordon/produce-demo/types"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -28,16 +33,92 @@ const (
 )
 
 var (
-	portNum  int    // listen port
-	logLevel string // zap log level
-	timeout  int    // server timeout in seconds
+	portNum        int    // listen port
+	grpcPortNum    int    // gRPC listen port
+	logLevel       string // zap log level
+	timeout        int    // server timeout in seconds
+	nameCase       string // name canonicalization mode
+	nameLocale     string // locale for name casing rules
+	nameExceptions string // comma-separated words that keep their casing
+	nameNFC        bool   // whether to NFC normalize names
+	codeFormats    string // comma-separated accepted produce code formats
+	apiKeysFile    string // file of API keys for requests that make changes
+	apiKeysReload  int    // how often to check the API key file (seconds)
+	jwtKeyFile     string // PEM file of RSA public keys for bearer tokens
+	jwksFile       string // JWKS file of keys for bearer tokens
+	jwtIssuer      string // required issuer of bearer tokens
+	jwtAudience    string // required audience of bearer tokens
+	jwtRolesClaim  string // claim of bearer tokens listing the roles
+	jwtLeeway      int    // allowed clock skew for bearer tokens (seconds)
+	auditLog       string // file of the audit log of changes
+	auditKeyFile   string // file of the secret key of the audit log
+	rateLimits     string // file of the rate limits for each client
+	idempotencyTTL int    // how long to keep responses to idempotent adds (seconds)
+	rejectUnknown  bool   // whether unknown fields of items to add are errors
+	deadlines      string // comma-separated deadlines of the endpoints
+	addWorkers     int    // number of items being added at once
+	addMaxInFlight int    // number of items queued or being added at once
+	addQueueWait   int    // how long each item waits to be queued (seconds)
 )
 
 func init() {
 	flag.IntVar(&portNum, "port", 8080, "HTTP port number")
+	flag.IntVar(&grpcPortNum, "grpc-port", 9090, "gRPC port number")
 	flag.StringVar(&logLevel, "log", "production",
 		"log level: 'production', 'development'")
 	flag.IntVar(&timeout, "timeout", 30, "server timeout (seconds)")
+	flag.StringVar(&nameCase, "name-case", string(types.NameCaseTitle),
+		"name canonicalization: 'title', 'preserve', 'lower'")
+	flag.StringVar(&nameLocale, "name-locale", "",
+		"language tag for locale-specific name casing, e.g. 'tr' or 'nl'")
+	flag.StringVar(&nameExceptions, "name-exceptions", "",
+		"comma-separated words that keep their casing, e.g. 'McIntosh,choy'")
+	flag.BoolVar(&nameNFC, "name-nfc", true,
+		"normalize names to Unicode NFC")
+	flag.StringVar(&codeFormats, "code-formats", types.CodeFormatQuartet,
+		"comma-separated produce code formats: 'quartet', 'plu', 'upc-a', 'ean-13'")
+	flag.StringVar(&apiKeysFile, "api-keys-file", "",
+		"file of API keys required to make changes, one per line")
+	flag.IntVar(&apiKeysReload, "api-keys-reload", 10,
+		"how often to check the API key file for changes (seconds)")
+	flag.StringVar(&jwtKeyFile, "jwt-public-key-file", "",
+		"PEM file of RSA public keys for RS256 bearer tokens")
+	flag.StringVar(&jwksFile, "jwks-file", "",
+		"JWKS file of keys for RS256 and HS256 bearer tokens")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", "",
+		"required issuer ('iss') of bearer tokens")
+	flag.StringVar(&jwtAudience, "jwt-audience", "",
+		"required audience ('aud') of bearer tokens")
+	flag.StringVar(&jwtRolesClaim, "jwt-roles-claim", "roles",
+		"claim of bearer tokens listing the roles")
+	flag.IntVar(&jwtLeeway, "jwt-leeway", 30,
+		"allowed clock skew when checking bearer token times (seconds)")
+	flag.StringVar(&auditLog, "audit-log", "",
+		"append-only file to record the changes to the catalog in")
+	flag.StringVar(&auditKeyFile, "audit-key-file", "",
+		"file of the secret key the audit log records are hashed with")
+	flag.StringVar(&rateLimits, "rate-limits", "",
+		"file of the rate and concurrency limits for each client")
+	flag.IntVar(&idempotencyTTL, "idempotency-ttl", 24*60*60,
+		"how long to keep the responses to adds with idempotency keys "+
+			"(seconds), or 0 to ignore the keys")
+	flag.BoolVar(&rejectUnknown, "reject-unknown-fields", false,
+		"report unknown fields of the items to add as errors, rather than "+
+			"ignoring them")
+	flag.StringVar(&deadlines, "deadlines", "",
+		"comma-separated deadlines of the requests to each endpoint, e.g. "+
+			"'default=10s,POST /v1/produce/import=5m'")
+	flag.IntVar(&addWorkers, "add-workers",
+		service.DefaultPoolConfig.Workers,
+		"number of items added at once, across all of the requests")
+	flag.IntVar(&addMaxInFlight, "add-max-in-flight",
+		service.DefaultPoolConfig.MaxInFlight,
+		"number of items queued or being added at once, across all of the "+
+			"requests")
+	flag.IntVar(&addQueueWait, "add-queue-timeout",
+		int(service.DefaultPoolConfig.QueueTimeout/time.Second),
+		"how long each item of an add waits for room in the queue before "+
+			"it is rejected as overloaded (seconds)")
 }
 
 func main() {
@@ -56,39 +137,146 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Set up the name and code validation before anything is stored.
+	if err := initNamePolicy(); err != nil {
+		log.Errorw("Error setting name policy", "error", err)
+		os.Exit(1)
+	}
+	if err := types.SetCodeFormats(splitList(codeFormats)); err != nil {
+		log.Errorw("Error setting code formats", "error", err)
+		os.Exit(1)
+	}
+	api.SetRejectUnknownFields(rejectUnknown)
+	dl, err := api.ParseDeadlines(deadlines)
+	if err != nil {
+		log.Errorw("Error parsing deadlines", "error", err)
+		os.Exit(1)
+	}
+	api.SetDeadlines(dl)
+
 	// Create the server to handle the produce service.  The API module will
 	// set up the routes, as we don't need to know the details in the
 	// main program.
 	muxer := http.NewServeMux()
-	service := service.New(store.New(), log)
+	prodStore := store.New()
+	if auditLog != "" {
+		var key []byte
+		if auditKeyFile != "" {
+			if key, err = audit.ReadKeyFile(auditKeyFile); err != nil {
+				log.Errorw("Error reading audit key", "error", err)
+				os.Exit(1)
+			}
+		} else {
+			log.Warnw("The audit log has no key, so its head must be " +
+				"noted to detect tampering")
+		}
+		al, err := audit.Open(auditLog, key)
+		if err != nil {
+			log.Errorw("Error opening audit log", "error", err)
+			os.Exit(1)
+		}
+		defer al.Close()
+		prodStore = audit.NewStore(al)
+	}
+	service := service.NewWithPool(prodStore, log,
+		service.NewPool(service.PoolConfig{
+			Workers:      addWorkers,
+			MaxInFlight:  addMaxInFlight,
+			QueueTimeout: time.Duration(addQueueWait) * time.Second,
+		}))
 	if err := api.Init(ctx, muxer, service, log); err != nil {
 		log.Errorf("Error initializing API layer", "error", err)
 		os.Exit(1)
 	}
 
 	// Load the seed items as (required by the spec), from the seed.json file.
-	if err := loadSeedItems(ctx, service, log); err != nil {
+	// They are audited as added by the seed file.
+	seedCtx := reqctx.WithPrincipal(ctx, reqctx.Principal{Subject: seedFile})
+	if err := loadSeedItems(seedCtx, service, log); err != nil {
 		log.Errorw("Error loading seed items", "error", err)
 		os.Exit(1)
 	}
 
+	// Replay the responses to adds retried with the same idempotency key.
+	var handler http.Handler = muxer
+	if idempotencyTTL > 0 {
+		handler = api.Idempotent(api.NewIdempotencyStore(
+			time.Duration(idempotencyTTL)*time.Second), handler, log)
+	}
+
+	// Limit the requests of each client, if limits are configured.  This,
+	// like the idempotency keys, goes inside the auth check, so clients are
+	// known by their credentials where they have them.
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	rl, err := initRateLimits(ctx, log)
+	if err != nil {
+		log.Errorw("Error loading rate limits", "error", err)
+		os.Exit(1)
+	}
+	if rl != nil {
+		handler = api.RateLimit(rl, handler, log)
+		unary = append(unary, grpcapi.UnaryRateLimitInterceptor(rl, log))
+		stream = append(stream, grpcapi.StreamRateLimitInterceptor(rl, log))
+	}
+
+	// Require API keys or bearer tokens, if any are configured.  The
+	// failed attempts are limited by address, outside the auth check, as
+	// they have no credentials to be known by.
+	auth, err := initAuth(ctx, log)
+	if err != nil {
+		log.Errorw("Error loading API keys or token keys", "error", err)
+		os.Exit(1)
+	}
+	if auth.Keys != nil || auth.Tokens != nil {
+		handler = api.RequireAuth(auth, handler, log)
+		unary = append([]grpc.UnaryServerInterceptor{
+			grpcapi.UnaryAuthInterceptor(auth, log)}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{
+			grpcapi.StreamAuthInterceptor(auth, log)}, stream...)
+		if rl != nil {
+			handler = api.LimitAuthFailures(rl, handler, log)
+			unary = append([]grpc.UnaryServerInterceptor{
+				grpcapi.UnaryAuthFailureInterceptor(rl, log)}, unary...)
+			stream = append([]grpc.StreamServerInterceptor{
+				grpcapi.StreamAuthFailureInterceptor(rl, log)}, stream...)
+		}
+	}
+
 	srv := &http.Server{
-		Handler:      muxer,
+		Handler:      handler,
 		Addr:         fmt.Sprintf(":%d", portNum),
 		ReadTimeout:  time.Duration(timeout) * time.Second,
 		WriteTimeout: time.Duration(timeout) * time.Second,
 	}
 
-	// Start Server
+	// The gRPC server shares the service with the REST endpoints, so both
+	// see the same items.
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPortNum))
+	if err != nil {
+		log.Errorw("Error listening for gRPC connections", "error", err)
+		os.Exit(1)
+	}
+	grpcSrv := grpc.NewServer(grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...))
+	grpcapi.Register(grpcSrv, service, log)
+
+	// Start Servers
 	go func() {
 		log.Infow("Listening for connections", "port", portNum)
 		if err := srv.ListenAndServe(); err != nil {
 			log.Infow("Server completed", "err", err)
 		}
 	}()
+	go func() {
+		log.Infow("Listening for gRPC connections", "port", grpcPortNum)
+		if err := grpcSrv.Serve(lis); err != nil {
+			log.Infow("gRPC server completed", "err", err)
+		}
+	}()
 
 	// Block until we shutdown.
-	waitForShutdown(ctx, srv, log)
+	waitForShutdown(ctx, cancel, srv, grpcSrv, log)
 }
 
 func loadSeedItems(ctx context.Context, service service.Service,
@@ -140,9 +328,133 @@ func initLogging() (*zap.SugaredLogger, error) {
 	return lg.Sugar(), nil // ♫ ♩ ♩ ♫ ah honey honey
 }
 
-// Setup for clean shutdown with signal handlers/cancel.
-func waitForShutdown(ctx context.Context, srv *http.Server,
-	log *zap.SugaredLogger) {
+// set up the name canonicalization policy from the command line.
+func initNamePolicy() error {
+	return types.SetNamePolicy(types.NamePolicy{
+		Case:       types.NameCase(nameCase),
+		Locale:     nameLocale,
+		Exceptions: splitList(nameExceptions),
+		Normalize:  nameNFC,
+	})
+}
+
+// set up the API keys and bearer token keys from the command line and the
+// env vars.  Either may be left unset, and if both are, nothing is
+// required.  The API keys are reloaded when the file changes, and all the
+// keys on SIGHUP.
+func initAuth(ctx context.Context,
+	log *zap.SugaredLogger) (api.Authenticator, error) {
+	var auth api.Authenticator
+	entries := os.Getenv("PRODUCE_API_KEYS")
+	if apiKeysFile != "" || strings.TrimSpace(entries) != "" {
+		keys, err := api.NewKeyStore(apiKeysFile, entries)
+		if err != nil {
+			return auth, err
+		}
+		log.Infow("Loaded API keys", "count", keys.Len())
+		go keys.Watch(ctx, time.Duration(apiKeysReload)*time.Second, log)
+		auth.Keys = keys
+	}
+	secret := os.Getenv("PRODUCE_JWT_SECRET")
+	if secret != "" || jwtKeyFile != "" || jwksFile != "" {
+		tokens, err := api.NewTokenVerifier(api.TokenConfig{
+			Secret:        secret,
+			PublicKeyFile: jwtKeyFile,
+			JWKSFile:      jwksFile,
+			Issuer:        jwtIssuer,
+			Audience:      jwtAudience,
+			RolesClaim:    jwtRolesClaim,
+			Leeway:        time.Duration(jwtLeeway) * time.Second,
+		})
+		if err != nil {
+			return auth, err
+		}
+		log.Infow("Accepting bearer tokens", "issuer", jwtIssuer,
+			"audience", jwtAudience)
+		auth.Tokens = tokens
+	}
+	if auth.Keys == nil && auth.Tokens == nil {
+		log.Warn("No API keys or token keys configured, changes are allowed " +
+			"without credentials")
+		return auth, nil
+	}
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hupChan:
+				if auth.Keys != nil {
+					if err := auth.Keys.Reload(); err != nil {
+						log.Errorw("Error reloading API keys", "error", err)
+					} else {
+						log.Infow("Reloaded API keys", "count", auth.Keys.Len())
+					}
+				}
+				if auth.Tokens != nil {
+					if err := auth.Tokens.Reload(); err != nil {
+						log.Errorw("Error reloading token keys", "error", err)
+					} else {
+						log.Infow("Reloaded token keys")
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return auth, nil
+}
+
+// set up the rate limits from the command line, if a file is given, and
+// reload them on SIGHUP.  If it isn't, the limiter is nil, and nothing is
+// limited.
+func initRateLimits(ctx context.Context,
+	log *zap.SugaredLogger) (*api.RateLimiter, error) {
+	if rateLimits == "" {
+		return nil, nil
+	}
+	rl, err := api.NewRateLimiter(rateLimits)
+	if err != nil {
+		return nil, err
+	}
+	log.Infow("Loaded rate limits", "file", rateLimits)
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hupChan:
+				if err := rl.Reload(); err != nil {
+					log.Errorw("Error reloading rate limits", "error", err)
+				} else {
+					log.Infow("Reloaded rate limits", "file", rateLimits)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return rl, nil
+}
+
+// split a comma-separated command line list, dropping empty entries.
+func splitList(list string) []string {
+	var res []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Setup for clean shutdown with signal handlers/cancel.  The requests still
+// in flight once the deadline has passed are cancelled.
+func waitForShutdown(ctx context.Context, cancelAll context.CancelFunc,
+	srv *http.Server, grpcSrv *grpc.Server, log *zap.SugaredLogger) {
 	interruptChan := make(chan os.Signal, 1)
 	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
@@ -153,7 +465,22 @@ func waitForShutdown(ctx context.Context, srv *http.Server,
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
-	srv.Shutdown(ctx)
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Infow("Cancelling the requests in flight", "error", err)
+		cancelAll()
+	}
+
+	// Let the in-flight RPCs finish, up to the same deadline.
+	stopped := make(chan struct{})
+	go func() {
+		grpcSrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcSrv.Stop()
+	}
 
 	log.Infof("Shutting down")
 }
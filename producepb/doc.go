@@ -0,0 +1,5 @@
+// Package producepb holds the protobuf messages and gRPC stubs for the
+// produce service, generated from produce.proto.
+package producepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative produce.proto
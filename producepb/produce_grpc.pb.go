@@ -0,0 +1,251 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.19.1
+// source: produce.proto
+
+package producepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ProduceServiceClient is the client API for ProduceService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProduceServiceClient interface {
+	// Add adds the produce items, reporting the result of each.  An error
+	// is only returned if none of the items could be attempted.
+	Add(ctx context.Context, in *AddRequest, opts ...grpc.CallOption) (*AddResponse, error)
+	// Delete deletes the produce item with the code.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// ListAll streams all of the produce items, in no particular order.
+	ListAll(ctx context.Context, in *ListAllRequest, opts ...grpc.CallOption) (ProduceService_ListAllClient, error)
+	// Clear deletes all of the produce items.
+	Clear(ctx context.Context, in *ClearRequest, opts ...grpc.CallOption) (*ClearResponse, error)
+}
+
+type produceServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProduceServiceClient(cc grpc.ClientConnInterface) ProduceServiceClient {
+	return &produceServiceClient{cc}
+}
+
+func (c *produceServiceClient) Add(ctx context.Context, in *AddRequest, opts ...grpc.CallOption) (*AddResponse, error) {
+	out := new(AddResponse)
+	err := c.cc.Invoke(ctx, "/produce.v1.ProduceService/Add", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *produceServiceClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/produce.v1.ProduceService/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *produceServiceClient) ListAll(ctx context.Context, in *ListAllRequest, opts ...grpc.CallOption) (ProduceService_ListAllClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ProduceService_ServiceDesc.Streams[0], "/produce.v1.ProduceService/ListAll", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &produceServiceListAllClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ProduceService_ListAllClient interface {
+	Recv() (*Produce, error)
+	grpc.ClientStream
+}
+
+type produceServiceListAllClient struct {
+	grpc.ClientStream
+}
+
+func (x *produceServiceListAllClient) Recv() (*Produce, error) {
+	m := new(Produce)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *produceServiceClient) Clear(ctx context.Context, in *ClearRequest, opts ...grpc.CallOption) (*ClearResponse, error) {
+	out := new(ClearResponse)
+	err := c.cc.Invoke(ctx, "/produce.v1.ProduceService/Clear", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ProduceServiceServer is the server API for ProduceService service.
+// All implementations must embed UnimplementedProduceServiceServer
+// for forward compatibility
+type ProduceServiceServer interface {
+	// Add adds the produce items, reporting the result of each.  An error
+	// is only returned if none of the items could be attempted.
+	Add(context.Context, *AddRequest) (*AddResponse, error)
+	// Delete deletes the produce item with the code.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// ListAll streams all of the produce items, in no particular order.
+	ListAll(*ListAllRequest, ProduceService_ListAllServer) error
+	// Clear deletes all of the produce items.
+	Clear(context.Context, *ClearRequest) (*ClearResponse, error)
+	mustEmbedUnimplementedProduceServiceServer()
+}
+
+// UnimplementedProduceServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedProduceServiceServer struct {
+}
+
+func (UnimplementedProduceServiceServer) Add(context.Context, *AddRequest) (*AddResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Add not implemented")
+}
+func (UnimplementedProduceServiceServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedProduceServiceServer) ListAll(*ListAllRequest, ProduceService_ListAllServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListAll not implemented")
+}
+func (UnimplementedProduceServiceServer) Clear(context.Context, *ClearRequest) (*ClearResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Clear not implemented")
+}
+func (UnimplementedProduceServiceServer) mustEmbedUnimplementedProduceServiceServer() {}
+
+// UnsafeProduceServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProduceServiceServer will
+// result in compilation errors.
+type UnsafeProduceServiceServer interface {
+	mustEmbedUnimplementedProduceServiceServer()
+}
+
+func RegisterProduceServiceServer(s grpc.ServiceRegistrar, srv ProduceServiceServer) {
+	s.RegisterService(&ProduceService_ServiceDesc, srv)
+}
+
+func _ProduceService_Add_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProduceServiceServer).Add(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/produce.v1.ProduceService/Add",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProduceServiceServer).Add(ctx, req.(*AddRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProduceService_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProduceServiceServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/produce.v1.ProduceService/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProduceServiceServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProduceService_ListAll_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListAllRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProduceServiceServer).ListAll(m, &produceServiceListAllServer{stream})
+}
+
+type ProduceService_ListAllServer interface {
+	Send(*Produce) error
+	grpc.ServerStream
+}
+
+type produceServiceListAllServer struct {
+	grpc.ServerStream
+}
+
+func (x *produceServiceListAllServer) Send(m *Produce) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ProduceService_Clear_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClearRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProduceServiceServer).Clear(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/produce.v1.ProduceService/Clear",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProduceServiceServer).Clear(ctx, req.(*ClearRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ProduceService_ServiceDesc is the grpc.ServiceDesc for ProduceService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ProduceService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "produce.v1.ProduceService",
+	HandlerType: (*ProduceServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Add",
+			Handler:    _ProduceService_Add_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _ProduceService_Delete_Handler,
+		},
+		{
+			MethodName: "Clear",
+			Handler:    _ProduceService_Clear_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListAll",
+			Handler:       _ProduceService_ListAll_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "produce.proto",
+}
@@ -0,0 +1,80 @@
+// Package reqctx carries who made a request, and which request it is, in
+// its context, so the layers below the APIs, such as the audit log, can
+// tell without depending on the REST or gRPC API packages.  The API
+// packages add the principal and request info as each request comes in.
+package reqctx
+
+import "context"
+
+// Role is what a principal may do.  Each role allows what the roles below
+// it do, too.
+type Role string
+
+// The roles, from least to most privileged.
+const (
+	RoleViewer Role = "viewer" // may list and get items
+	RoleEditor Role = "editor" // may also add and delete them
+	RoleAdmin  Role = "admin"  // may also reset the service
+)
+
+// rank orders the roles, from 1 for a viewer.  A role the service doesn't
+// know has rank 0.
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleEditor:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Known returns whether the role is one the service knows.
+func (r Role) Known() bool {
+	return r.rank() > 0
+}
+
+// The schemes that authenticate a principal.
+const (
+	SchemeAPIKey = "api-key"
+	SchemeBearer = "bearer"
+)
+
+// Principal is the authenticated caller of a request.  The holder of an
+// API key is named after the key, and has every role.
+type Principal struct {
+	Subject string
+	Roles   []Role
+	Scheme  string
+}
+
+// HasRole returns whether the principal has the role, or a more privileged
+// one.  No role is needed for the empty role.
+func (p Principal) HasRole(role Role) bool {
+	if role == "" {
+		return true
+	}
+	for _, v := range p.Roles {
+		if v.rank() >= role.rank() {
+			return true
+		}
+	}
+	return false
+}
+
+// principalKey is the context key for the principal.
+type principalKey struct{}
+
+// WithPrincipal returns a copy of the context carrying the principal.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal the request was authenticated
+// as, if it was.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
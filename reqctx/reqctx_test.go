@@ -0,0 +1,83 @@
+package reqctx
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHasRole(t *testing.T) {
+	for i, v := range []struct {
+		roles []Role
+		role  Role
+		exp   bool
+	}{
+		{role: "", exp: true},
+		{role: RoleViewer},
+		{roles: []Role{RoleViewer}, role: RoleViewer, exp: true},
+		{roles: []Role{RoleViewer}, role: RoleEditor},
+		{roles: []Role{"owner", RoleEditor}, role: RoleViewer, exp: true},
+		{roles: []Role{RoleAdmin}, role: RoleEditor, exp: true},
+		{roles: []Role{"owner"}, role: RoleViewer},
+	} {
+		if (Principal{Roles: v.roles}).HasRole(v.role) != v.exp {
+			t.Fatalf("(%d) unexpected result for %v having '%s'", i, v.roles,
+				v.role)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := PrincipalFromContext(ctx); ok {
+		t.Fatal("unexpected principal")
+	}
+	if _, ok := RequestInfoFromContext(ctx); ok {
+		t.Fatal("unexpected request info")
+	}
+	ctx = WithRequestInfo(WithPrincipal(ctx, Principal{Subject: "alice"}),
+		RequestInfo{ID: "req-1", ClientIP: "10.0.0.7"})
+	if p, ok := PrincipalFromContext(ctx); !ok || p.Subject != "alice" {
+		t.Fatalf("unexpected principal: %+v", p)
+	}
+	info, ok := RequestInfoFromContext(ctx)
+	if !ok || info != (RequestInfo{ID: "req-1", ClientIP: "10.0.0.7"}) {
+		t.Fatalf("unexpected request info: %+v", info)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for i, v := range []struct {
+		id  string
+		exp bool
+	}{
+		{id: "abc-123", exp: true},
+		{id: ""},
+		{id: "has space"},
+		{id: strings.Repeat("x", maxRequestIDLen), exp: true},
+		{id: strings.Repeat("x", maxRequestIDLen+1)},
+	} {
+		if ValidRequestID(v.id) != v.exp {
+			t.Fatalf("(%d) unexpected result for '%s'", i, v.id)
+		}
+	}
+	if id := NewRequestID(); len(id) != 16 || !ValidRequestID(id) {
+		t.Fatalf("unexpected generated ID: '%s'", id)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	for i, v := range []struct {
+		wait time.Duration
+		exp  string
+	}{
+		{0, "0"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+	} {
+		if s := RetryAfterSeconds(v.wait); s != v.exp {
+			t.Fatalf("(%d) unexpected value: '%s'", i, s)
+		}
+	}
+}
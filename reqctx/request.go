@@ -0,0 +1,63 @@
+package reqctx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"time"
+)
+
+// maxRequestIDLen limits the length of an ID given by a client.
+const maxRequestIDLen = 128
+
+// RequestInfo identifies a request and where it came from, for logging and
+// auditing.
+type RequestInfo struct {
+	ID       string
+	ClientIP string
+}
+
+// requestInfoKey is the context key for the request info.
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a copy of the context carrying the request info.
+func WithRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the info of the request being handled, if
+// there is one.
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// NewRequestID generates a random request ID.
+func NewRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// ValidRequestID returns whether an ID given by a client may be used,
+// which is if it isn't too long and is printable ASCII.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RetryAfterSeconds returns how long a client told to back off should
+// wait, as the value of a Retry-After header, or retry-after trailer, in
+// whole seconds, rounded up.
+func RetryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolConfig is the configuration of the pool of workers that add the
+// items of every Add.  Workers is the number of items being added at once,
+// and MaxInFlight the number that may be queued or being added at once,
+// across all of the requests.  An item waits up to QueueTimeout for room in
+// the queue, after which the add is rejected as overloaded.
+type PoolConfig struct {
+	Workers      int
+	MaxInFlight  int
+	QueueTimeout time.Duration
+}
+
+// DefaultPoolConfig is the configuration of the pool of a service made
+// with New.
+var DefaultPoolConfig = PoolConfig{
+	Workers:      32,
+	MaxInFlight:  1024,
+	QueueTimeout: 5 * time.Second,
+}
+
+// OverloadedError is used when the items of an add can't be queued, as
+// the pool is already full and doesn't make room for them in time.
+// RetryAfter is how long to wait before trying again.
+type OverloadedError struct {
+	RetryAfter time.Duration
+}
+
+// Error satisfies the error interface.
+func (oe OverloadedError) Error() string {
+	return "the service is too busy to add the item, try again later"
+}
+
+// Pool is a bounded pool of workers, shared by the adds of all of the
+// requests, so that a large batch doesn't start a goroutine for each of
+// its items, nor can many batches at once.  The workers are started as
+// items are queued, up to the configured number, and stop once the queue
+// is empty, so an idle pool holds no goroutines.  Items are added in the
+// order they are queued.
+type Pool struct {
+	cfg   PoolConfig
+	slots chan struct{}
+
+	// The queued items, and the number of workers running, which are
+	// guarded by the lock.
+	lock    sync.Mutex
+	queue   []func()
+	running int
+}
+
+// NewPool creates a pool with the configuration.  Values of zero or less
+// are taken from DefaultPoolConfig.
+func NewPool(cfg PoolConfig) *Pool {
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultPoolConfig.Workers
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = DefaultPoolConfig.MaxInFlight
+	}
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = DefaultPoolConfig.QueueTimeout
+	}
+	return &Pool{cfg: cfg, slots: make(chan struct{}, cfg.MaxInFlight)}
+}
+
+// retryAfter returns how long an overloaded caller should wait, which is
+// the queue timeout, but at least a second.
+func (p *Pool) retryAfter() time.Duration {
+	if p.cfg.QueueTimeout < time.Second {
+		return time.Second
+	}
+	return p.cfg.QueueTimeout
+}
+
+// acquire waits for room for an item in the pool, up to the queue timeout,
+// or until the context is done.  It returns an OverloadedError if the
+// timeout passes first, or the context's error.  Each item waits its own
+// timeout, so a batch larger than the pool isn't rejected while the pool
+// is still making room for its items.
+func (p *Pool) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(p.cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return OverloadedError{RetryAfter: p.retryAfter()}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives back the room acquired for an item that won't be queued
+// after all.
+func (p *Pool) release() {
+	<-p.slots
+}
+
+// submit queues the job, which must have room acquired for it, and starts
+// a worker for it if there aren't enough running.
+func (p *Pool) submit(job func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.queue = append(p.queue, job)
+	if p.running < p.cfg.Workers {
+		p.running++
+		go p.work()
+	}
+}
+
+// work runs the queued jobs until there are none left, releasing the room
+// of each as it completes.
+func (p *Pool) work() {
+	for {
+		p.lock.Lock()
+		if len(p.queue) == 0 {
+			p.running--
+			p.lock.Unlock()
+			return
+		}
+		job := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.lock.Unlock()
+
+		job()
+		p.release()
+	}
+}
@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+	"go.uber.org/zap"
+)
+
+// countingStore is a store whose adds take a while, which counts the most
+// that are in progress at once.
+type countingStore struct {
+	store.ProduceStore
+	delay time.Duration
+
+	lock    sync.Mutex
+	current int
+	max     int
+}
+
+func (cs *countingStore) Add(ctx context.Context, item types.Produce) error {
+	cs.lock.Lock()
+	cs.current++
+	if cs.current > cs.max {
+		cs.max = cs.current
+	}
+	cs.lock.Unlock()
+
+	time.Sleep(cs.delay)
+	err := cs.ProduceStore.Add(ctx, item)
+
+	cs.lock.Lock()
+	cs.current--
+	cs.lock.Unlock()
+	return err
+}
+
+// numberedItems returns the given number of valid items, each with its own
+// code.
+func numberedItems(count int) []types.Produce {
+	items := make([]types.Produce, count)
+	for i := range items {
+		items[i] = types.Produce{
+			Code:      fmt.Sprintf("A12T-4GH7-QPL9-%04d", i),
+			Name:      "Lettuce",
+			UnitPrice: types.USD(346),
+		}
+	}
+	return items
+}
+
+func TestPoolBounded(t *testing.T) {
+	const workers = 3
+	cs := &countingStore{ProduceStore: store.New(), delay: time.Millisecond}
+	service := NewWithPool(cs, newLogger(t), NewPool(PoolConfig{
+		Workers: workers, MaxInFlight: 10, QueueTimeout: time.Minute}))
+
+	// Several batches at once share the workers, and each gets its results
+	// in order.
+	var wg sync.WaitGroup
+	items := numberedItems(100)
+	for b := 0; b < 4; b++ {
+		batch := items[b*25 : (b+1)*25]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := service.Add(context.Background(), batch)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			for i, v := range res {
+				if v.Code != batch[i].Code || v.Err != nil {
+					t.Errorf("(%d) unexpected result: %+v", i, v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if cs.max > workers {
+		t.Fatalf("too many adds at once: %d", cs.max)
+	}
+	if all, _ := cs.ListAll(context.Background()); len(all) != len(items) {
+		t.Fatalf("unexpected item count: %d", len(all))
+	}
+}
+
+func TestAddOverloaded(t *testing.T) {
+	d := DummyStore{store: store.New(), wait: make(chan struct{})}
+	service := NewWithPool(d, newLogger(t), NewPool(PoolConfig{
+		Workers: 1, MaxInFlight: 2, QueueTimeout: 20 * time.Millisecond}))
+
+	// The first two items fill the pool, while the store is held up, so
+	// the third has no room.
+	items := numberedItems(3)
+	time.AfterFunc(100*time.Millisecond, func() { close(d.wait) })
+	res, err := service.Add(context.Background(), items)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, v := range res[:2] {
+		if v != (AddResult{Code: items[i].Code}) {
+			t.Fatalf("(%d) unexpected result: %+v", i, v)
+		}
+	}
+	if res[2] != (AddResult{Code: items[2].Code,
+		Err: OverloadedError{RetryAfter: time.Second}}) {
+		t.Fatalf("unexpected result: %+v", res[2])
+	}
+
+	// If none of the items can be queued, the add as a whole fails.
+	d = DummyStore{store: store.New(), wait: make(chan struct{})}
+	service = NewWithPool(d, newLogger(t), NewPool(PoolConfig{
+		Workers: 1, MaxInFlight: 1, QueueTimeout: 20 * time.Millisecond}))
+	done := make(chan struct{})
+	go func() {
+		service.Add(context.Background(), items[:1])
+		close(done)
+	}()
+	for len(service.pool.slots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = service.Add(context.Background(), items[1:])
+	if err != (OverloadedError{RetryAfter: time.Second}) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(d.wait)
+	<-done
+}
+
+func TestAddQueueTimeoutPerItem(t *testing.T) {
+	// The batch takes far longer to add than the queue timeout, but each
+	// item gets room within it, so none are rejected.
+	cs := &countingStore{ProduceStore: store.New(),
+		delay: 10 * time.Millisecond}
+	service := NewWithPool(cs, newLogger(t), NewPool(PoolConfig{
+		Workers: 1, MaxInFlight: 1, QueueTimeout: 50 * time.Millisecond}))
+	items := numberedItems(20)
+	res, err := service.Add(context.Background(), items)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, v := range res {
+		if v != (AddResult{Code: items[i].Code}) {
+			t.Fatalf("(%d) unexpected result: %+v", i, v)
+		}
+	}
+}
+
+func TestAddBulkPooled(t *testing.T) {
+	// The bulk adds share the pool's workers with the other adds.
+	cs := &countingStore{ProduceStore: store.New(), delay: time.Millisecond}
+	service := NewWithPool(cs, newLogger(t), NewPool(PoolConfig{
+		Workers: 2, MaxInFlight: 4, QueueTimeout: time.Minute}))
+	res := addBulk(t, service, numberedItems(50))
+	for _, v := range res {
+		if v.Err != nil {
+			t.Fatalf("(%d) unexpected result: %+v", v.Seq, v)
+		}
+	}
+	if cs.max > 2 {
+		t.Fatalf("too many adds at once: %d", cs.max)
+	}
+
+	// An item the pool has no room for is overloaded, but once the pool
+	// has drained, the items after it are added.
+	d := DummyStore{store: store.New(), wait: make(chan struct{})}
+	service = NewWithPool(d, newLogger(t), NewPool(PoolConfig{
+		Workers: 1, MaxInFlight: 1, QueueTimeout: 20 * time.Millisecond}))
+	time.AfterFunc(100*time.Millisecond, func() { close(d.wait) })
+	items := numberedItems(3)
+	ich := make(chan BulkItem, len(items))
+	rch := make(chan BulkResult)
+	go func() {
+		if err := service.AddBulk(context.Background(), ich, rch); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		close(rch)
+	}()
+	ich <- BulkItem{Seq: 0, Item: items[0]}
+	ich <- BulkItem{Seq: 1, Item: items[1]}
+	res = make([]BulkResult, len(items))
+	for i := 0; i < 2; i++ {
+		v := <-rch
+		res[v.Seq] = v
+	}
+	ich <- BulkItem{Seq: 2, Item: items[2]}
+	close(ich)
+	for v := range rch {
+		res[v.Seq] = v
+	}
+	overloaded := OverloadedError{RetryAfter: time.Second}
+	for i, v := range res {
+		if (i == 1) != (v.Err == overloaded) || (i != 1 && v.Err != nil) {
+			t.Fatalf("(%d) unexpected result: %+v", i, v)
+		}
+	}
+}
+
+// addBulk adds the items with AddBulk, and returns the results in the
+// order of the items.
+func addBulk(t *testing.T, service ProduceService,
+	items []types.Produce) []BulkResult {
+	ich := make(chan BulkItem)
+	rch := make(chan BulkResult)
+	go func() {
+		defer close(ich)
+		for i, v := range items {
+			ich <- BulkItem{Seq: i, Item: v}
+		}
+	}()
+	go func() {
+		if err := service.AddBulk(context.Background(), ich, rch); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		close(rch)
+	}()
+	res := make([]BulkResult, len(items))
+	for v := range rch {
+		res[v.Seq] = v
+	}
+	return res
+}
+
+// BenchmarkAdd compares adding a large batch with the pool to adding it
+// with a goroutine for each item, as Add once did, which a pool with as
+// many workers as items amounts to.  Besides the time and allocations of
+// each add, it reports the most goroutines seen running during the adds.
+func BenchmarkAdd(b *testing.B) {
+	const count = 10000
+	items := numberedItems(count)
+	for _, v := range []struct {
+		name string
+		cfg  PoolConfig
+	}{
+		{"pool", DefaultPoolConfig},
+		{"goroutine-per-item", PoolConfig{Workers: count, MaxInFlight: count,
+			QueueTimeout: time.Minute}},
+	} {
+		b.Run(v.name, func(b *testing.B) {
+			pool := NewPool(v.cfg)
+			stop := make(chan struct{})
+			peak := make(chan int)
+			go sampleGoroutines(stop, peak)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				service := NewWithPool(store.New(), zap.NewNop().Sugar(), pool)
+				batch := append([]types.Produce(nil), items...)
+				b.StartTimer()
+				if _, err := service.Add(context.Background(), batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			close(stop)
+			b.ReportMetric(float64(<-peak), "peak-goroutines")
+		})
+	}
+}
+
+// sampleGoroutines samples the number of goroutines until stopped, and then
+// sends the most it saw.
+func sampleGoroutines(stop <-chan struct{}, peak chan<- int) {
+	max := 0
+	ticker := time.NewTicker(100 * time.Microsecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := runtime.NumGoroutine(); n > max {
+				max = n
+			}
+		case <-stop:
+			peak <- max
+			return
+		}
+	}
+}
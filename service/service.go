@@ -11,6 +11,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/gdotgordon/produce-demo/store"
 	"github.com/gdotgordon/produce-demo/types"
@@ -29,10 +30,13 @@ func (ie InternalError) Error() string {
 }
 
 // FormatError is used when an item doesn't conform to the expcted format,
-// particularly the syntax for a field value.
-// while invloking the service
+// particularly the syntax for a field value.  Field names the field at
+// fault, when the error is about a single one, and for an item, Errors
+// holds the problem with each of its fields.
 type FormatError struct {
 	Message string
+	Field   string
+	Errors  types.FieldErrors
 }
 
 // Error satisfies the error interface.
@@ -40,11 +44,34 @@ func (fe FormatError) Error() string {
 	return fmt.Sprintf("invalid item format: %s", fe.Message)
 }
 
+// NewFormatError returns the error for the problems with the fields of
+// an item.
+func NewFormatError(errs types.FieldErrors) FormatError {
+	return FormatError{Message: errs.Error(), Errors: errs}
+}
+
 // AddResult is used to communicate back the results of each of the
 // adds  to the api layer.
 type AddResult struct {
 	Code string
-	Err  error
+
+	// Generated is set when the item was added without a code, so the
+	// code was assigned by the store.
+	Generated bool
+	Err       error
+}
+
+// BulkItem is a single item for AddBulk, along with a sequence number
+// that is passed back in its result, so the caller can match them up.
+type BulkItem struct {
+	Seq  int
+	Item types.Produce
+}
+
+// BulkResult is the result of adding a single BulkItem.
+type BulkResult struct {
+	Seq int
+	AddResult
 }
 
 // Service is the interface for produce item management.  The use
@@ -52,98 +79,416 @@ type AddResult struct {
 type Service interface {
 	// Add adds multiple produce items to the store or returns the status
 	// of each add, or a general error if a system error prevented even
-	// attempting the add.
+	// attempting the add, or an OverloadedError if the service is too busy
+	// to.
 	Add(context.Context, []types.Produce) ([]AddResult, error)
 
+	// AddAll adds all of the produce items, or if any of them is invalid or
+	// can't be added, none of them, and returns the status of each, or a
+	// general error if a system error prevented even attempting the add.
+	AddAll(context.Context, []types.Produce) ([]AddResult, error)
+
+	// AddBulk adds the produce items received on a channel with the same
+	// bounded pool of workers as Add, and sends the result of each on the
+	// results channel as it completes.  It returns once the items channel
+	// is closed and drained, or an error if a system error prevented even
+	// attempting the adds.
+	AddBulk(ctx context.Context, items <-chan BulkItem,
+		results chan<- BulkResult) error
+
+	// Validate validates and converts produce items without adding them,
+	// and returns the problem with each one, or a general error if a
+	// system error prevented the validation.
+	Validate(context.Context, []types.Produce) ([]error, error)
+
 	// Delete deletes single produce item from the store or returns an error
 	// if it fails.
 	Delete(context.Context, string) error
 
+	// Get fetches the produce item with the code, or returns an error if
+	// the code is invalid, or there is no such item.
+	Get(context.Context, string) (types.Produce, error)
+
 	// ListAll fetches all produce items from the store or returns an error
 	// if it fails.
 	ListAll(context.Context) ([]types.Produce, error)
 
+	// List fetches the produce items matching the filter or returns an
+	// error if it fails.
+	List(context.Context, types.ProduceFilter) ([]types.Produce, error)
+
+	// Iterate calls the function for each produce item matching the filter,
+	// so the items can be processed without fetching them all at once.  It
+	// returns the error that stopped it, if any.
+	Iterate(context.Context, types.ProduceFilter,
+		func(types.Produce) error) error
+
 	// Clear is a convenience API to reset the database, useful for testing.
 	Clear(context.Context) error
+
+	// AddCategory adds a category to the hierarchy or returns an error
+	// if it fails.
+	AddCategory(context.Context, types.Category) error
+
+	// DeleteCategory deletes an unused category or returns an error
+	// if it fails.
+	DeleteCategory(context.Context, string) error
+
+	// ListCategories fetches all categories or returns an error
+	// if it fails.
+	ListCategories(context.Context) ([]types.Category, error)
+
+	// CategoryCounts fetches the item counts for each category or returns
+	// an error if it fails.
+	CategoryCounts(context.Context) ([]types.CategoryCount, error)
+
+	// AddAttribute adds an attribute definition to the schema or returns
+	// an error if it fails.
+	AddAttribute(context.Context, types.AttributeDef) error
+
+	// DeleteAttribute deletes an unused attribute definition or returns
+	// an error if it fails.
+	DeleteAttribute(context.Context, string) error
+
+	// ListAttributes fetches all attribute definitions or returns an error
+	// if it fails.
+	ListAttributes(context.Context) ([]types.AttributeDef, error)
 }
 
 // ProduceService is the concrete instance of the service described above.
 type ProduceService struct {
 	store store.ProduceStore
 	log   *zap.SugaredLogger
+	pool  *Pool
 }
 
-// New creates and returns a Produce Service instance
+// New creates and returns a Produce Service instance, which adds items
+// with a pool of the default configuration.
 func New(store store.ProduceStore, log *zap.SugaredLogger) ProduceService {
-	return ProduceService{store: store, log: log}
+	return NewWithPool(store, log, NewPool(DefaultPoolConfig))
+}
+
+// NewWithPool creates and returns a Produce Service instance, which adds
+// items with the pool.
+func NewWithPool(store store.ProduceStore, log *zap.SugaredLogger,
+	pool *Pool) ProduceService {
+	return ProduceService{store: store, log: log, pool: pool}
 }
 
 // Add adds multiple produce items to the store or returns the status
 // of each add, or a general error if a system error prevented even
-// attempting the add.
+// attempting the add.  If the context is done before all of the items have
+// been added, the context's error is returned instead, and the items that
+// haven't been started yet aren't added.
+//
+// The items are added by the service's pool, so only so many are in flight
+// at once, whatever the size of the batch.  If the pool is full, and
+// doesn't make room for the first item within its queue timeout, an
+// OverloadedError is returned, and if it doesn't for a later one, that item
+// and the rest have the OverloadedError as their result, and aren't added.
 func (ps ProduceService) Add(ctx context.Context,
 	items []types.Produce) ([]AddResult, error) {
 	if len(items) == 0 {
 		return []AddResult{}, nil
 	}
 
-	// Each goroutine will pass it's index into the array
+	// Fetch the attribute schema once for the whole batch.
+	defs, err := ps.store.ListAttributes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	schema := types.NewAttributeSchema(defs)
+
+	// Each job will pass it's index into the array
 	// and a possible error back through the channel.
 	type addResp struct {
 		ndx int
 		err error
 	}
-	ch := make(chan addResp)
+	// The channel is buffered, so the workers don't block if the results
+	// are abandoned.
+	ch := make(chan addResp, len(items))
 
-	// Run the delete in a goroutine as requested by the spec.
+	// Run the adds in the pool's goroutines.
 	var wch chan<- addResp = ch
 	res := make([]AddResult, len(items))
 
-	for i := 0; i < len(items); i++ {
-		// Need the proper loop index bound to the goroutine
-		i := i
-		go func() {
+	// Note which items need a code generated, before the goroutines
+	// fill them in.
+	generated := make([]bool, len(items))
+	for i := range items {
+		generated[i] = items[i].Code == ""
+	}
+
+	// Queue the items in order, each waiting for room up to the queue
+	// timeout.
+	queued := 0
+	for ; queued < len(items); queued++ {
+		if err := ps.pool.acquire(ctx); err != nil {
+			if _, ok := err.(OverloadedError); !ok || queued == 0 {
+				return nil, err
+			}
+			ps.log.Infow("add overloaded", "queued", queued,
+				"rejected", len(items)-queued)
+			for i := queued; i < len(items); i++ {
+				res[i] = AddResult{Code: items[i].Code,
+					Generated: generated[i], Err: err}
+			}
+			break
+		}
+
+		// Need the proper loop index bound to the job
+		i := queued
+		ps.pool.submit(func() {
 			// Enforce the semntics and convert the produce items before
 			// sending them to storage
 			resp := addResp{ndx: i}
-			msg := types.ValidateAndConvertProduce(&items[i])
-			if msg != "" {
-				resp.err = FormatError{Message: msg}
-			} else {
-				resp.err = ps.store.Add(ctx, items[i])
+			if resp.err = ctx.Err(); resp.err == nil {
+				resp.err = ps.addItem(ctx, &items[i], schema)
 			}
 			wch <- resp
-		}()
+		})
 	}
 
 	// Process each return from add, and store the error result
 	// in the appropriate slot in the return item
-	for n := 0; n < len(items); n++ {
-		aresp, ok := <-ch
+	for n := 0; n < queued; n++ {
+		var aresp addResp
+		var ok bool
+		select {
+		case aresp, ok = <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		if !ok {
 			// Channel was mysteriously closed!
 			ps.log.Errorw("unexpcted channel close", "err", "channel was closed")
 			return nil, InternalError{Message: "Unexpceted channel close"}
 		}
 		res[aresp.ndx].Code = items[aresp.ndx].Code
+		res[aresp.ndx].Generated = generated[aresp.ndx]
 		res[aresp.ndx].Err = aresp.err
 	}
 	return res, nil
 }
 
+// AddAll adds all of the produce items, or none of them.  The items are
+// validated and converted first, and if any is invalid, none are added.
+// Otherwise they are added by the store together, which fails them all if
+// any can't be added, such as for a code already in the store or given
+// twice, or an unknown category.  The result of each item is returned, and
+// when the add fails, the items without errors of their own are the ones
+// that weren't added on account of the others.
+func (ps ProduceService) AddAll(ctx context.Context,
+	items []types.Produce) ([]AddResult, error) {
+	if len(items) == 0 {
+		return []AddResult{}, nil
+	}
+	defs, err := ps.store.ListAttributes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	schema := types.NewAttributeSchema(defs)
+
+	res := make([]AddResult, len(items))
+	failed := false
+	for i := range items {
+		res[i].Code = items[i].Code
+		res[i].Generated = items[i].Code == ""
+		res[i].Err = validateItem(&items[i], schema)
+		failed = failed || res[i].Err != nil
+	}
+	if failed {
+		return res, nil
+	}
+
+	codes, errs, err := ps.store.AddAll(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i].Code = codes[i]
+		if errs != nil {
+			res[i].Err = errs[i]
+		}
+	}
+	return res, nil
+}
+
+// AddBulk adds the items received on the channel until it is closed, with
+// the service's pool, as Add does, and sends the result of each on the
+// results channel as soon as it completes.  Each result carries the
+// sequence number of its item, as the results may be out of order.  It
+// returns once all of the items have been processed, but doesn't close the
+// results channel.  If the context is cancelled, the remaining items are
+// drained without being added.
+//
+// At most as many items as the pool has workers are in flight for the call
+// at once, so a slow reader of the results holds up the items, rather than
+// the pool's workers.  If the pool doesn't make room for an item within its
+// queue timeout, that item has the OverloadedError as its result, and isn't
+// added, but each of the items after it waits for the pool afresh.
+func (ps ProduceService) AddBulk(ctx context.Context,
+	items <-chan BulkItem, results chan<- BulkResult) error {
+	// Fetch the attribute schema once for all of the items.
+	defs, err := ps.store.ListAttributes(ctx)
+	if err != nil {
+		return err
+	}
+	schema := types.NewAttributeSchema(defs)
+
+	// The workers pass the results back on a channel with room for every
+	// item in flight, so they never wait for the reader, and the results
+	// are forwarded from there.  An item takes its room once the pool has
+	// room for it, and gives it back once its result is forwarded.
+	inFlight := ps.pool.cfg.Workers
+	room := make(chan struct{}, inFlight)
+	done := make(chan BulkResult, inFlight)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for res := range done {
+			select {
+			case results <- res:
+			case <-ctx.Done():
+			}
+			<-room
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for bi := range items {
+		if ctx.Err() != nil {
+			continue
+		}
+		res := BulkResult{Seq: bi.Seq}
+		res.Code, res.Generated = bi.Item.Code, bi.Item.Code == ""
+		overloaded := ps.pool.acquire(ctx)
+		if overloaded != nil {
+			if _, ok := overloaded.(OverloadedError); !ok {
+				continue
+			}
+			ps.log.Infow("bulk add overloaded", "seq", bi.Seq)
+		}
+		select {
+		case room <- struct{}{}:
+		case <-ctx.Done():
+			if overloaded == nil {
+				ps.pool.release()
+			}
+			continue
+		}
+		if overloaded != nil {
+			res.Err = overloaded
+			done <- res
+			continue
+		}
+
+		item := bi.Item
+		wg.Add(1)
+		ps.pool.submit(func() {
+			defer wg.Done()
+			if res.Err = ctx.Err(); res.Err == nil {
+				res.Err = ps.addItem(ctx, &item, schema)
+				res.Code = item.Code
+			}
+			done <- res
+		})
+	}
+	wg.Wait()
+	close(done)
+	<-forwarded
+	return nil
+}
+
+// addItem validates, converts and adds a single item, generating a code
+// for it if it doesn't have one.  The item's code is updated to the one
+// that was assigned.
+func (ps ProduceService) addItem(ctx context.Context, item *types.Produce,
+	schema types.AttributeSchema) error {
+	generate := item.Code == ""
+	if err := validateItem(item, schema); err != nil {
+		return err
+	}
+	if !generate {
+		return ps.store.Add(ctx, *item)
+	}
+	code, err := ps.store.AddWithNewCode(ctx, *item)
+	item.Code = code
+	return err
+}
+
+// Validate validates and converts the produce items as Add does, but
+// without adding them.  It returns the problem with each item, or nil if
+// it is valid, or a general error if the validation could not be done.
+func (ps ProduceService) Validate(ctx context.Context,
+	items []types.Produce) ([]error, error) {
+	defs, err := ps.store.ListAttributes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	schema := types.NewAttributeSchema(defs)
+
+	res := make([]error, len(items))
+	for i := range items {
+		res[i] = validateItem(&items[i], schema)
+	}
+	return res, nil
+}
+
+// validateItem validates and converts a single item, returning a
+// FormatError if it is invalid.  An item without a code is validated with
+// a generated code standing in for the one the store will assign, and is
+// left without a code.
+func validateItem(item *types.Produce, schema types.AttributeSchema) error {
+	if item.Code != "" {
+		if errs := types.ValidateAndConvertProduceWithSchema(item,
+			schema); errs != nil {
+			return NewFormatError(errs)
+		}
+		return nil
+	}
+
+	code, err := types.NewProduceCode()
+	if err != nil {
+		return FormatError{Message: err.Error()}
+	}
+	item.Code = code
+	errs := types.ValidateAndConvertProduceWithSchema(item, schema)
+	item.Code = ""
+	if errs != nil {
+		return NewFormatError(errs)
+	}
+	return nil
+}
+
+// Get fetches the produce item with the code, which is validated and
+// converted first, so it may be given in lower case.  It returns a
+// FormatError if the code is invalid, or the store's NotFoundError if
+// there is no such item.
+func (ps ProduceService) Get(ctx context.Context, code string) (
+	types.Produce, error) {
+	code, msg := types.ValidateAndConvertProduceCode(code)
+	if msg != "" {
+		return types.Produce{}, FormatError{Message: msg, Field: "code"}
+	}
+	return ps.store.Get(ctx, code)
+}
+
 // Delete deletes single produce item (specified by the code) from the store,
-// or returns an error if it fails.
+// or returns an error if it fails.  If the context is done first, the
+// context's error is returned without waiting for the store.
 func (ps ProduceService) Delete(ctx context.Context, code string) error {
-	ch := make(chan error)
+	ch := make(chan error, 1)
 
 	// Run the delete in a goroutine as requested by the spec.
 	var wch chan<- error = ch
 	go func() {
 		// Validate that the code is syntactically correct.
 		var delErr error
-		code, valid := types.ValidateAndConvertProduceCode(code)
-		if !valid {
-			delErr = FormatError{Message: code}
+		code, msg := types.ValidateAndConvertProduceCode(code)
+		if msg != "" {
+			delErr = FormatError{Message: msg, Field: "code"}
 		} else {
 			delErr = ps.store.Delete(ctx, code)
 		}
@@ -151,7 +496,13 @@ func (ps ProduceService) Delete(ctx context.Context, code string) error {
 	}()
 
 	// And wait for the return in the channel, which is just an error.
-	err, ok := <-ch
+	var err error
+	var ok bool
+	select {
+	case err, ok = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	if !ok {
 		// Channel was mysteriously closed!
 		ps.log.Errorw("unexpcted channel close", "err", "channel was closed")
@@ -161,15 +512,16 @@ func (ps ProduceService) Delete(ctx context.Context, code string) error {
 }
 
 // ListAll fetches all produce items from the store or returns an error
-// if it fails.
+// if it fails.  If the context is done first, the context's error is
+// returned without waiting for the store.
 func (ps ProduceService) ListAll(ctx context.Context) ([]types.Produce, error) {
 	type listResp struct {
 		items []types.Produce
 		err   error
 	}
-	ch := make(chan listResp)
+	ch := make(chan listResp, 1)
 
-	// Run the delete in a goroutine as requested by the spec.
+	// Run the list in a goroutine as requested by the spec.
 	var wch chan<- listResp = ch
 	go func() {
 		items, err := ps.store.ListAll(ctx)
@@ -177,7 +529,13 @@ func (ps ProduceService) ListAll(ctx context.Context) ([]types.Produce, error) {
 	}()
 
 	// And wait for the return in the channel.
-	lr, ok := <-ch
+	var lr listResp
+	var ok bool
+	select {
+	case lr, ok = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 	if !ok {
 		// Channel was mysteriously closed!
 		ps.log.Errorw("unexpcted channel close", "err", "channel was closed")
@@ -186,11 +544,120 @@ func (ps ProduceService) ListAll(ctx context.Context) ([]types.Produce, error) {
 	return lr.items, lr.err
 }
 
+// List fetches the produce items matching the filter or returns an
+// error if it fails.  The category and tags in the filter are converted
+// to canonical form, so they match the stored values.
+func (ps ProduceService) List(ctx context.Context,
+	filter types.ProduceFilter) ([]types.Produce, error) {
+	filter, err := convertFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return ps.store.List(ctx, filter)
+}
+
+// Iterate calls the function for each produce item matching the filter,
+// stopping at the first error it returns, or when the context is done.
+// The filter is converted to canonical form as for List.
+func (ps ProduceService) Iterate(ctx context.Context,
+	filter types.ProduceFilter, fn func(types.Produce) error) error {
+	filter, err := convertFilter(filter)
+	if err != nil {
+		return err
+	}
+	return ps.store.Iterate(ctx, filter, fn)
+}
+
+// convertFilter validates and converts the category and tags in the
+// filter to canonical form, so they match the stored values.
+func convertFilter(filter types.ProduceFilter) (types.ProduceFilter, error) {
+	if filter.Category != "" {
+		cat, valid := types.ValidateAndConvertName(filter.Category)
+		if !valid {
+			return filter, FormatError{
+				Message: fmt.Sprintf("invalid category: '%s'", filter.Category),
+				Field:   "category"}
+		}
+		filter.Category = cat
+	}
+	tags, msg := types.ValidateAndConvertTags(filter.Tags)
+	if msg != "" {
+		return filter, FormatError{Message: msg, Field: "tags"}
+	}
+	filter.Tags = tags
+	return filter, nil
+}
+
 // Clear is a convenience API to reset the database, useful for testing.
 func (ps ProduceService) Clear(ctx context.Context) error {
 	return ps.store.Clear(ctx)
 }
 
+// AddCategory validates and canonicalizes the category, and then adds
+// it to the store, or returns an error if it fails.
+func (ps ProduceService) AddCategory(ctx context.Context,
+	cat types.Category) error {
+	if msg := types.ValidateAndConvertCategory(&cat); msg != "" {
+		return FormatError{Message: msg}
+	}
+	return ps.store.AddCategory(ctx, cat)
+}
+
+// DeleteCategory deletes an unused category or returns an error
+// if it fails.
+func (ps ProduceService) DeleteCategory(ctx context.Context,
+	name string) error {
+	name, valid := types.ValidateAndConvertName(name)
+	if !valid {
+		return FormatError{Message: fmt.Sprintf("invalid category: '%s'", name)}
+	}
+	return ps.store.DeleteCategory(ctx, name)
+}
+
+// ListCategories fetches all categories or returns an error if it fails.
+func (ps ProduceService) ListCategories(ctx context.Context) (
+	[]types.Category, error) {
+	return ps.store.ListCategories(ctx)
+}
+
+// CategoryCounts fetches the item counts for each category or returns
+// an error if it fails.
+func (ps ProduceService) CategoryCounts(ctx context.Context) (
+	[]types.CategoryCount, error) {
+	return ps.store.CategoryCounts(ctx)
+}
+
+// AddAttribute validates and canonicalizes the attribute definition, and
+// then adds it to the schema, or returns an error if it fails.  Note that
+// existing items are not revalidated, so a new required attribute only
+// applies to items added afterwards.
+func (ps ProduceService) AddAttribute(ctx context.Context,
+	def types.AttributeDef) error {
+	if msg := types.ValidateAndConvertAttributeDef(&def); msg != "" {
+		return FormatError{Message: msg}
+	}
+	return ps.store.AddAttribute(ctx, def)
+}
+
+// DeleteAttribute deletes an unused attribute definition or returns
+// an error if it fails.
+func (ps ProduceService) DeleteAttribute(ctx context.Context,
+	name string) error {
+	name, valid := types.ValidateAndConvertAttributeName(name)
+	if !valid {
+		return FormatError{Message: fmt.Sprintf("invalid attribute name: '%s'",
+			name)}
+	}
+	return ps.store.DeleteAttribute(ctx, name)
+}
+
+// ListAttributes fetches all attribute definitions or returns an error
+// if it fails.
+func (ps ProduceService) ListAttributes(ctx context.Context) (
+	[]types.AttributeDef, error) {
+	return ps.store.ListAttributes(ctx)
+}
+
 // ResSorter sorts slices of AddResult.  Sort by key, since it is unique.
 type resSorter struct {
 	res []AddResult
@@ -2,14 +2,33 @@ package service
 
 import (
 	"context"
+	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/gdotgordon/produce-demo/store"
 	"github.com/gdotgordon/produce-demo/types"
 	"go.uber.org/zap"
 )
 
+// The reason a code fails the default quartet code format.
+const quartetRule = "(quartet: expected four hyphen-separated groups of " +
+	"four letters or digits)"
+
+// nameError returns the error for an item whose only problem is the name.
+func nameError(name string) FormatError {
+	return NewFormatError(types.FieldErrors{{Field: "name", Value: name,
+		Rule: types.RuleNamePattern, Message: "invalid name: '" + name + "'"}})
+}
+
+// codeError returns the error for an item whose only problem is the code.
+func codeError(code string) FormatError {
+	return NewFormatError(types.FieldErrors{{Field: "code", Value: code,
+		Rule:    types.RuleCodeFormat,
+		Message: "invalid code: '" + code + "' " + quartetRule}})
+}
+
 var (
 	dfltProduce = types.Produce{
 		Code:      "A12T-4GH7-QPL9-3N4M",
@@ -76,13 +95,13 @@ func TestAdd(t *testing.T) {
 			req: []types.Produce{dfltProduce, secondProduceBadName},
 			expRes: []AddResult{AddResult{Code: dfltProduce.Code},
 				AddResult{Code: secondProduceBadName.Code,
-					Err: FormatError{Message: "invalid name: 'Green-Pepper'"}}},
+					Err: nameError("Green-Pepper")}},
 		},
 		{
 			req: []types.Produce{dfltProduceBadCode},
 			expRes: []AddResult{AddResult{
 				Code: dfltProduceBadCode.Code,
-				Err:  FormatError{Message: "invalid code: 'A12T-4GH7-QP'"},
+				Err:  codeError("A12T-4GH7-QP"),
 			}},
 		},
 		{
@@ -92,7 +111,7 @@ func TestAdd(t *testing.T) {
 		{
 			req: []types.Produce{secondProduceBadNameLower},
 			expRes: []AddResult{AddResult{Code: secondProduce.Code,
-				Err: FormatError{Message: "invalid name: 'green-pepper'"}}},
+				Err: nameError("green-pepper")}},
 		},
 		{
 			req: []types.Produce{dfltProduce, secondProduce, secondProduceLower, secondProduceBadName},
@@ -102,14 +121,14 @@ func TestAdd(t *testing.T) {
 				AddResult{Code: secondProduce.Code,
 					Err: store.AlreadyExistsError{Code: secondProduce.Code}},
 				AddResult{Code: secondProduce.Code,
-					Err: FormatError{Message: "invalid name: 'Green-Pepper'"}}},
+					Err: nameError("Green-Pepper")}},
 		},
 	} {
 		d := DummyStore{store: store.New()}
 		service := New(d, newLogger(t))
 		res, err := service.Add(context.Background(), v.req)
 
-		if v.expErr != err {
+		if !reflect.DeepEqual(v.expErr, err) {
 			t.Fatalf("expected errors don't agree: %v, %v", v.expErr, err)
 		}
 		if len(v.expRes) != len(res) {
@@ -120,7 +139,7 @@ func TestAdd(t *testing.T) {
 			sort.Sort(resSorter{res: v.expRes})
 			sort.Sort(resSorter{res: res})
 			for j, w := range v.expRes {
-				if res[j] != w {
+				if !reflect.DeepEqual(res[j], w) {
 					t.Fatalf("(%d) sorted results differ at %d, %+v, %+v", i, j, res[j], w)
 				}
 			}
@@ -128,6 +147,131 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestAddGeneratedCode(t *testing.T) {
+	noCode := dfltProduce
+	noCode.Code = ""
+	badName := secondProduceBadName
+	badName.Code = ""
+
+	d := DummyStore{store: store.New()}
+	service := New(d, newLogger(t))
+	res, err := service.Add(context.Background(),
+		[]types.Produce{noCode, badName, secondProduce})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res[0].Err != nil || !res[0].Generated {
+		t.Fatalf("unexpected result: %+v", res[0])
+	}
+	if _, msg := types.ValidateAndConvertProduceCode(res[0].Code); msg != "" {
+		t.Fatalf("generated code is invalid: %s", msg)
+	}
+	exp := AddResult{Generated: true,
+		Err: nameError("Green-Pepper")}
+	if !reflect.DeepEqual(res[1], exp) {
+		t.Fatalf("unexpected result: %+v", res[1])
+	}
+	if res[2] != (AddResult{Code: secondProduce.Code}) {
+		t.Fatalf("unexpected result: %+v", res[2])
+	}
+
+	items, err := service.ListAll(context.Background())
+	if err != nil || len(items) != 2 {
+		t.Fatalf("unexpected list: %v, %v", items, err)
+	}
+
+	// Codes can't be generated if none of the formats support it.
+	if err = types.SetCodeFormats([]string{types.CodeFormatPLU}); err != nil {
+		t.Fatal(err)
+	}
+	defer types.SetCodeFormats([]string{types.CodeFormatQuartet})
+	res, err = service.Add(context.Background(), []types.Produce{noCode})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := res[0].Err.(FormatError); !ok || res[0].Code != "" {
+		t.Fatalf("unexpected result: %+v", res[0])
+	}
+}
+
+func TestAddBulk(t *testing.T) {
+	const count = 1000
+	d := DummyStore{store: store.New()}
+	service := New(d, newLogger(t))
+	items := make(chan BulkItem)
+	results := make(chan BulkResult)
+	go func() {
+		defer close(items)
+		for i := 0; i < count; i++ {
+			item := dfltProduce
+			item.Code = ""
+			if i == 10 {
+				item = secondProduceBadName
+			}
+			items <- BulkItem{Seq: i, Item: item}
+		}
+	}()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- service.AddBulk(context.Background(), items, results)
+		close(results)
+	}()
+
+	seen := make(map[int]bool)
+	for res := range results {
+		if seen[res.Seq] {
+			t.Fatalf("duplicate result for %d", res.Seq)
+		}
+		seen[res.Seq] = true
+		if res.Seq == 10 {
+			exp := nameError("Green-Pepper")
+			if !reflect.DeepEqual(res.Err, exp) || res.Generated {
+				t.Fatalf("unexpected result: %+v", res)
+			}
+			continue
+		}
+		if res.Err != nil || !res.Generated || res.Code == "" {
+			t.Fatalf("unexpected result: %+v", res)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(seen) != count {
+		t.Fatalf("expected %d results, got %d", count, len(seen))
+	}
+	list, err := service.ListAll(context.Background())
+	if err != nil || len(list) != count-1 {
+		t.Fatalf("unexpected list count: %d, %v", len(list), err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	noCode := secondProduceLower
+	noCode.Code = ""
+	d := DummyStore{store: store.New()}
+	service := New(d, newLogger(t))
+	items := []types.Produce{dfltProduce, secondProduceBadName, noCode}
+	res, err := service.Validate(context.Background(), items)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []error{nil,
+		nameError("Green-Pepper"), nil}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatalf("unexpected results: %v", res)
+	}
+	if items[2].Code != "" || items[2].Name != "Green Pepper" {
+		t.Fatalf("unexpected conversion: %+v", items[2])
+	}
+
+	// Nothing should have been added.
+	list, err := service.ListAll(context.Background())
+	if err != nil || len(list) != 0 {
+		t.Fatalf("unexpected list: %v, %v", list, err)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	for i, v := range []struct {
 		code   string
@@ -144,8 +288,9 @@ func TestDelete(t *testing.T) {
 			add:    &secondProduce,
 		},
 		{
-			code:   "badcode",
-			expErr: FormatError{"badcode"},
+			code: "badcode",
+			expErr: FormatError{Message: "invalid code: 'badcode' " + quartetRule,
+				Field: "code"},
 		},
 	} {
 		d := DummyStore{store: store.New()}
@@ -154,9 +299,44 @@ func TestDelete(t *testing.T) {
 			d.Add(context.Background(), *v.add)
 		}
 		err := service.Delete(context.Background(), v.code)
-		if v.expErr != err {
+		if !reflect.DeepEqual(v.expErr, err) {
+			t.Fatalf("(%d) expected error: %v, got %v", i, v.expErr, err)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	for i, v := range []struct {
+		code   string
+		expErr error
+		add    *types.Produce
+	}{
+		{
+			code:   "YRT6-72AS-K736-L4AR",
+			expErr: store.NotFoundError{Code: "YRT6-72AS-K736-L4AR"},
+		},
+		{
+			code: "yrt6-72as-k736-l4ar",
+			add:  &secondProduce,
+		},
+		{
+			code: "badcode",
+			expErr: FormatError{Message: "invalid code: 'badcode' " + quartetRule,
+				Field: "code"},
+		},
+	} {
+		d := DummyStore{store: store.New()}
+		service := New(d, newLogger(t))
+		if v.add != nil {
+			d.Add(context.Background(), *v.add)
+		}
+		prod, err := service.Get(context.Background(), v.code)
+		if !reflect.DeepEqual(v.expErr, err) {
 			t.Fatalf("(%d) expected error: %v, got %v", i, v.expErr, err)
 		}
+		if v.add != nil && !reflect.DeepEqual(*v.add, prod) {
+			t.Fatalf("(%d) expected %v, got %v", i, *v.add, prod)
+		}
 	}
 }
 
@@ -179,12 +359,55 @@ func TestList(t *testing.T) {
 	if len(items) != 2 {
 		t.Fatalf("unexpected list length: %d", len(items))
 	}
-	if !((items[0] == dfltProduce && items[1] == secondProduce) ||
-		(items[1] == dfltProduce && items[0] == secondProduce)) {
+	if !((reflect.DeepEqual(items[0], dfltProduce) &&
+		reflect.DeepEqual(items[1], secondProduce)) ||
+		(reflect.DeepEqual(items[1], dfltProduce) &&
+			reflect.DeepEqual(items[0], secondProduce))) {
 		t.Fatalf("unexpected list lcontents: %v", items)
 	}
 }
 
+func TestAbandoned(t *testing.T) {
+	// A store that never returns doesn't hold up a request past its
+	// deadline.
+	d := DummyStore{store: store.New(), wait: make(chan struct{})}
+	defer close(d.wait)
+	service := New(d, newLogger(t))
+	for i, call := range []func(context.Context) error{
+		func(ctx context.Context) error {
+			_, err := service.Add(ctx, []types.Produce{dfltProduce, secondProduce})
+			return err
+		},
+		func(ctx context.Context) error {
+			return service.Delete(ctx, dfltProduce.Code)
+		},
+		func(ctx context.Context) error {
+			_, err := service.ListAll(ctx)
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			10*time.Millisecond)
+		err := call(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("(%d) unexpected error: %v", i, err)
+		}
+	}
+
+	// The items of an add that was already cancelled aren't added.
+	d = DummyStore{store: store.New()}
+	service = New(d, newLogger(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := service.Add(ctx, []types.Produce{dfltProduce}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if items, _ := d.store.ListAll(context.Background()); len(items) != 0 {
+		t.Fatalf("unexpected items: %v", items)
+	}
+}
+
 func newLogger(t *testing.T) *zap.SugaredLogger {
 	lg, err := zap.NewDevelopment()
 	if err != nil {
@@ -195,21 +418,55 @@ func newLogger(t *testing.T) *zap.SugaredLogger {
 
 type DummyStore struct {
 	store store.ProduceStore
+
+	// If set, the adds, deletes and lists wait for it to be closed, as
+	// a slow store would.
+	wait chan struct{}
+}
+
+// slow waits for the store to be released, if it's slow.
+func (d DummyStore) slow() {
+	if d.wait != nil {
+		<-d.wait
+	}
 }
 
 func (d DummyStore) Add(ctx context.Context, item types.Produce) error {
+	d.slow()
 	return d.store.Add(ctx, item)
 }
 
+// AddWithNewCode adds an item under a newly generated code.
+func (d DummyStore) AddWithNewCode(ctx context.Context,
+	item types.Produce) (string, error) {
+	d.slow()
+	return d.store.AddWithNewCode(ctx, item)
+}
+
+// AddAll adds all of the items, or none of them.
+func (d DummyStore) AddAll(ctx context.Context,
+	items []types.Produce) ([]string, []error, error) {
+	d.slow()
+	return d.store.AddAll(ctx, items)
+}
+
 // Delete deletes single produce item from the store or returns an error
 // if it fails.
 func (d DummyStore) Delete(ctx context.Context, code string) error {
+	d.slow()
 	return d.store.Delete(ctx, code)
 }
 
+// Get fetches a single produce item.
+func (d DummyStore) Get(ctx context.Context, code string) (types.Produce,
+	error) {
+	return d.store.Get(ctx, code)
+}
+
 // ListAll fetches all produce items from the store or returns an error
 // if it fails.
 func (d DummyStore) ListAll(ctx context.Context) ([]types.Produce, error) {
+	d.slow()
 	return d.store.ListAll(ctx)
 }
 
@@ -217,3 +474,160 @@ func (d DummyStore) ListAll(ctx context.Context) ([]types.Produce, error) {
 func (d DummyStore) Clear(ctx context.Context) error {
 	return d.store.Clear(ctx)
 }
+
+// List fetches the produce items matching the filter.
+func (d DummyStore) List(ctx context.Context,
+	filter types.ProduceFilter) ([]types.Produce, error) {
+	return d.store.List(ctx, filter)
+}
+
+// Iterate calls the function for each produce item matching the filter.
+func (d DummyStore) Iterate(ctx context.Context, filter types.ProduceFilter,
+	fn func(types.Produce) error) error {
+	return d.store.Iterate(ctx, filter, fn)
+}
+
+// AddCategory adds a category to the hierarchy.
+func (d DummyStore) AddCategory(ctx context.Context, cat types.Category) error {
+	return d.store.AddCategory(ctx, cat)
+}
+
+// DeleteCategory deletes an unused category.
+func (d DummyStore) DeleteCategory(ctx context.Context, name string) error {
+	return d.store.DeleteCategory(ctx, name)
+}
+
+// ListCategories fetches all categories.
+func (d DummyStore) ListCategories(ctx context.Context) ([]types.Category,
+	error) {
+	return d.store.ListCategories(ctx)
+}
+
+// CategoryCounts fetches the item counts for each category.
+func (d DummyStore) CategoryCounts(ctx context.Context) (
+	[]types.CategoryCount, error) {
+	return d.store.CategoryCounts(ctx)
+}
+
+func TestCategoriesAndFilter(t *testing.T) {
+	d := DummyStore{store: store.New()}
+	service := New(d, newLogger(t))
+	ctx := context.Background()
+
+	for i, v := range []struct {
+		cat    types.Category
+		expErr error
+	}{
+		{
+			cat: types.Category{Name: "fruit"},
+		},
+		{
+			cat: types.Category{Name: "stone fruit", Parent: "FRUIT"},
+		},
+		{
+			cat:    types.Category{Name: "Fruit"},
+			expErr: store.CategoryExistsError{Name: "Fruit"},
+		},
+		{
+			cat:    types.Category{Name: "fruit-2"},
+			expErr: FormatError{Message: "invalid category name: 'fruit-2'"},
+		},
+	} {
+		if err := service.AddCategory(ctx, v.cat); !reflect.DeepEqual(err, v.expErr) {
+			t.Fatalf("(%d) expected error %v, got %v", i, v.expErr, err)
+		}
+	}
+
+	peach := types.Produce{Code: "E5T6-9UI3-TH15-QR88", Name: "peach",
+		UnitPrice: 299, Category: "stone fruit", Tags: []string{"local"}}
+	res, err := service.Add(ctx, []types.Produce{peach, dfltProduce})
+	if err != nil {
+		t.Fatalf("unexpected error adding items: %v", err)
+	}
+	for _, v := range res {
+		if v.Err != nil {
+			t.Fatalf("unexpected error adding item: %v", v.Err)
+		}
+	}
+
+	items, err := service.List(ctx,
+		types.ProduceFilter{Category: "FRUIT", Tags: []string{"LOCAL"}})
+	if err != nil {
+		t.Fatalf("unexpected error listing items: %v", err)
+	}
+	if len(items) != 1 || items[0].Code != peach.Code {
+		t.Fatalf("unexpected list contents: %v", items)
+	}
+
+	_, err = service.List(ctx, types.ProduceFilter{Tags: []string{"!"}})
+	if !reflect.DeepEqual(err,
+		FormatError{Message: "invalid tag: '!'", Field: "tags"}) {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+
+	err = service.DeleteCategory(ctx, "stone fruit")
+	if _, ok := err.(store.CategoryInUseError); !ok {
+		t.Fatalf("did not get expected error type, got %T", err)
+	}
+}
+
+// AddAttribute adds an attribute definition to the schema.
+func (d DummyStore) AddAttribute(ctx context.Context,
+	def types.AttributeDef) error {
+	return d.store.AddAttribute(ctx, def)
+}
+
+// DeleteAttribute deletes an unused attribute definition.
+func (d DummyStore) DeleteAttribute(ctx context.Context, name string) error {
+	return d.store.DeleteAttribute(ctx, name)
+}
+
+// ListAttributes fetches all attribute definitions.
+func (d DummyStore) ListAttributes(ctx context.Context) (
+	[]types.AttributeDef, error) {
+	return d.store.ListAttributes(ctx)
+}
+
+func TestAddWithAttributes(t *testing.T) {
+	d := DummyStore{store: store.New()}
+	service := New(d, newLogger(t))
+	ctx := context.Background()
+
+	err := service.AddAttribute(ctx,
+		types.AttributeDef{Name: "Organic", Type: types.AttributeBool,
+			Required: true})
+	if err != nil {
+		t.Fatalf("unexpected error adding attribute: %v", err)
+	}
+	err = service.AddAttribute(ctx,
+		types.AttributeDef{Name: "grade", Type: types.AttributeEnum})
+	if !reflect.DeepEqual(err,
+		FormatError{Message: "enum must have at least one value"}) {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+
+	good := dfltProduce
+	good.Attributes = map[string]interface{}{"ORGANIC": true}
+	bad := secondProduceBadName
+	res, err := service.Add(ctx, []types.Produce{good, bad})
+	if err != nil {
+		t.Fatalf("unexpected error adding items: %v", err)
+	}
+	if res[0].Err != nil {
+		t.Fatalf("unexpected error adding item: %v", res[0].Err)
+	}
+	expErr := NewFormatError(types.FieldErrors{
+		{Field: "name", Value: "Green-Pepper", Rule: types.RuleNamePattern,
+			Message: "invalid name: 'Green-Pepper'"},
+		{Field: "attributes.organic", Rule: types.RuleRequired,
+			Message: "missing attribute: 'organic'"},
+	})
+	if !reflect.DeepEqual(res[1].Err, expErr) {
+		t.Fatalf("did not get expected error, got %v", res[1].Err)
+	}
+
+	items, _ := service.ListAll(ctx)
+	if len(items) != 1 || items[0].Attributes["organic"] != true {
+		t.Fatalf("unexpected list contents: %v", items)
+	}
+}
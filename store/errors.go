@@ -23,3 +23,71 @@ type AlreadyExistsError struct {
 func (aee AlreadyExistsError) Error() string {
 	return fmt.Sprintf("produce code '%s' already exists", aee.Code)
 }
+
+// CategoryNotFoundError is used when an attempt is made to access a
+// non-existent category, either directly or by reference from a produce
+// item or child category.
+type CategoryNotFoundError struct {
+	Name string
+}
+
+// Error satisfies the error interface.
+func (cnf CategoryNotFoundError) Error() string {
+	return fmt.Sprintf("category '%s' was not found", cnf.Name)
+}
+
+// CategoryExistsError is used when an attempt is made to add a
+// category that already exists in the store.
+type CategoryExistsError struct {
+	Name string
+}
+
+// Error satisfies the error interface.
+func (cee CategoryExistsError) Error() string {
+	return fmt.Sprintf("category '%s' already exists", cee.Name)
+}
+
+// CategoryInUseError is used when an attempt is made to delete a
+// category that still has child categories or produce items.
+type CategoryInUseError struct {
+	Name   string
+	Reason string
+}
+
+// Error satisfies the error interface.
+func (ciu CategoryInUseError) Error() string {
+	return fmt.Sprintf("category '%s' is in use: %s", ciu.Name, ciu.Reason)
+}
+
+// AttributeNotFoundError is used when an attempt is made to access a
+// non-existent attribute definition.
+type AttributeNotFoundError struct {
+	Name string
+}
+
+// Error satisfies the error interface.
+func (anf AttributeNotFoundError) Error() string {
+	return fmt.Sprintf("attribute '%s' was not found", anf.Name)
+}
+
+// AttributeExistsError is used when an attempt is made to define an
+// attribute that already exists in the store.
+type AttributeExistsError struct {
+	Name string
+}
+
+// Error satisfies the error interface.
+func (aee AttributeExistsError) Error() string {
+	return fmt.Sprintf("attribute '%s' already exists", aee.Name)
+}
+
+// AttributeInUseError is used when an attempt is made to delete an
+// attribute definition that produce items still carry.
+type AttributeInUseError struct {
+	Name string
+}
+
+// Error satisfies the error interface.
+func (aiu AttributeInUseError) Error() string {
+	return fmt.Sprintf("attribute '%s' is in use by produce items", aiu.Name)
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// The kinds of change passed to a Journal.
+const (
+	ChangeAdd             = "add"
+	ChangeDelete          = "delete"
+	ChangeReset           = "reset"
+	ChangeAddCategory     = "add_category"
+	ChangeDeleteCategory  = "delete_category"
+	ChangeAddAttribute    = "add_attribute"
+	ChangeDeleteAttribute = "delete_attribute"
+)
+
+// Change is a change the store is about to make.  Code is the code of the
+// produce item added or deleted, After the item as it is added, and Before
+// the item as it is deleted.  A reset lists the items it removes in
+// Removed, and is followed by the deletes of the categories, children
+// first, and of the attributes, that it removes too.  The changes to
+// categories and attributes name them in Target, and those to attributes
+// carry the definition in Attribute.
+type Change struct {
+	Kind      string
+	Code      string
+	Target    string
+	Before    *types.Produce
+	After     *types.Produce
+	Removed   []types.Produce
+	Attribute *types.AttributeDef
+}
+
+// Journal is passed the changes each call to a journaled store is about to
+// make, with the store locked, so the journal sees the changes in the
+// order they are made, and the items exactly as they are when they are
+// changed.  If it returns an error, none of the changes are made, and the
+// error is returned, so a change is never made without being journaled.
+// As the store is locked, the journal must not call back into it.
+type Journal func(context.Context, []Change) error
+
+// NewJournaled creates a store, as New does, that passes each change to
+// the journal before making it.
+func NewJournaled(j Journal) ProduceStore {
+	lps := New().(*LockingProduceStore)
+	lps.journal = j
+	return lps
+}
+
+// record passes the changes to the journal, if the store has one, with
+// the lock already held.
+func (lps *LockingProduceStore) record(ctx context.Context,
+	changes ...Change) error {
+	if lps.journal == nil {
+		return nil
+	}
+	return lps.journal(ctx, changes)
+}
@@ -1,5 +1,7 @@
 // Package store defines an interface and implementation for performing
-// the produce storage operations: add item, delete item, list all items.
+// the produce storage operations: add item, delete item, list all items,
+// as well as maintaining the category hierarchy the items belong to and
+// the schema for the items' extended attributes.
 // Note, even though the external API allows for multiple adds in a single
 // request, they are processed individually as per the spec, so the store API
 // only needsto handle single adds.
@@ -7,6 +9,8 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/gdotgordon/produce-demo/types"
@@ -14,24 +18,86 @@ import (
 
 // ProduceStore is the interface for produce item storage and retrieval.
 // The use of an interface allows us to conveniently mock the storage in tests.
+// Every method returns the context's error, having changed nothing, if the
+// context is done before the store gets to the request.
 type ProduceStore interface {
 
 	// Add adds a single produce item to the store or returns an error
 	// if it fails.
 	Add(context.Context, types.Produce) error
 
+	// AddWithNewCode adds a single produce item to the store under a newly
+	// generated, unused code, and returns the code or an error if it fails.
+	// The item's own code is ignored.
+	AddWithNewCode(context.Context, types.Produce) (string, error)
+
+	// AddAll adds all of the produce items, or if any of them can't be
+	// added, none of them.  It returns the code of each item, including
+	// those generated for the items without one, and the error for each
+	// item that can't be added, or nil if they were all added.  A code
+	// that appears twice in the items is an error for the second.  The
+	// general error is for a failure to attempt the adds at all.
+	AddAll(context.Context, []types.Produce) ([]string, []error, error)
+
 	// Delete deletes single produce item from the store or returns an error
 	// if it fails.
 	Delete(context.Context, string) error
 
+	// Get fetches the produce item with the code, or returns a
+	// NotFoundError if there is none.
+	Get(context.Context, string) (types.Produce, error)
+
 	// ListAll fetches all produce items from the store or returns an error
 	// if it fails.
 	ListAll(context.Context) ([]types.Produce, error)
 
+	// List fetches the produce items that match the filter or returns an
+	// error if it fails.
+	List(context.Context, types.ProduceFilter) ([]types.Produce, error)
+
+	// Iterate calls the function for each produce item that matches the
+	// filter, stopping at the first error it returns, or when the context
+	// is done.  It returns the error that stopped it, if any.
+	Iterate(context.Context, types.ProduceFilter,
+		func(types.Produce) error) error
+
 	// Clear is a convenience API to reset the database, useful for testing.
 	Clear(context.Context) error
+
+	// AddCategory adds a single category to the hierarchy or returns an
+	// error if it fails.  The parent category, if any, must already exist.
+	AddCategory(context.Context, types.Category) error
+
+	// DeleteCategory deletes a category that has no children and no
+	// produce items assigned to it, or returns an error if it fails.
+	DeleteCategory(context.Context, string) error
+
+	// ListCategories fetches all categories from the store or returns an
+	// error if it fails.
+	ListCategories(context.Context) ([]types.Category, error)
+
+	// CategoryCounts fetches the number of produce items in each category
+	// or returns an error if it fails.
+	CategoryCounts(context.Context) ([]types.CategoryCount, error)
+
+	// AddAttribute adds a single attribute definition to the schema or
+	// returns an error if it fails.
+	AddAttribute(context.Context, types.AttributeDef) error
+
+	// DeleteAttribute deletes an attribute definition that no produce
+	// items carry, or returns an error if it fails.
+	DeleteAttribute(context.Context, string) error
+
+	// ListAttributes fetches all attribute definitions from the store or
+	// returns an error if it fails.
+	ListAttributes(context.Context) ([]types.AttributeDef, error)
 }
 
+// maxCodeAttempts is the number of codes AddWithNewCode generates looking
+// for an unused one before giving up.  With random quartets, even a single
+// collision is very unlikely.
+const maxCodeAttempts = 10
+
 // LockingProduceStore is the production implementaiton of the store.
 // Note, because it uses a sync.RWMutex, it should only be assigned
 // to a ProduceStore interface as a pointer.  The ProduceStore methods
@@ -44,15 +110,31 @@ type LockingProduceStore struct {
 	// copy in a whole new Produce.
 	store map[string]*types.Produce
 
+	// The categories are kept in a hash map of name to category.  Each
+	// category only knows its parent, which suffices for walking up the
+	// tree from a produce item, which is what the filters and counts need.
+	categories map[string]*types.Category
+
+	// The attribute schema is a hash map of attribute name to definition.
+	attributes map[string]*types.AttributeDef
+
 	// Multiple-reader, single writer seems reasonable given the API and
 	// the use of the hash map.
 	lock sync.RWMutex
+
+	// The journal that is passed each change before it is made, if the
+	// store has one.
+	journal Journal
 }
 
 // New creates an initialized instance of a concrete produce store.  We hide
 // the implementation under an interface, so we can easily swap in a new one.
 func New() ProduceStore {
-	ps := LockingProduceStore{store: make(map[string]*types.Produce)}
+	ps := LockingProduceStore{
+		store:      make(map[string]*types.Produce),
+		categories: make(map[string]*types.Category),
+		attributes: make(map[string]*types.AttributeDef),
+	}
 	return &ps
 }
 
@@ -60,49 +142,582 @@ func New() ProduceStore {
 // if it fails.
 func (lps *LockingProduceStore) Add(ctx context.Context,
 	prod types.Produce) error {
-	lps.lock.Lock()
+	if err := lps.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer lps.lock.Unlock()
+
+	if err := lps.check(prod); err != nil {
+		return err
+	}
+	if err := lps.record(ctx, Change{Kind: ChangeAdd, Code: prod.Code,
+		After: &prod}); err != nil {
+		return err
+	}
+	lps.insert(prod)
+	return nil
+}
+
+// AddWithNewCode adds a single produce item to the store under a newly
+// generated, unused code, and returns the code or an error if it fails.
+// The code is generated with the store locked, so no other add can take
+// it before the item is inserted.
+func (lps *LockingProduceStore) AddWithNewCode(ctx context.Context,
+	prod types.Produce) (string, error) {
+	if err := lps.lockWrite(ctx); err != nil {
+		return "", err
+	}
+	defer lps.lock.Unlock()
+
+	code, err := lps.unusedCode(nil)
+	if err != nil {
+		return "", err
+	}
+	prod.Code = code
+	if err := lps.check(prod); err != nil {
+		return "", err
+	}
+	if err := lps.record(ctx, Change{Kind: ChangeAdd, Code: code,
+		After: &prod}); err != nil {
+		return "", err
+	}
+	lps.insert(prod)
+	return code, nil
+}
+
+// AddAll adds all of the produce items, or none of them, as described for
+// the interface.  The items are checked and added with the lock held
+// throughout, so no other change can come in between.
+func (lps *LockingProduceStore) AddAll(ctx context.Context,
+	prods []types.Produce) ([]string, []error, error) {
+	if err := lps.lockWrite(ctx); err != nil {
+		return nil, nil, err
+	}
 	defer lps.lock.Unlock()
 
+	codes := make([]string, len(prods))
+	errs := make([]error, len(prods))
+	seen := make(map[string]bool, len(prods))
+	failed := false
+	for i, v := range prods {
+		code := v.Code
+		if code == "" {
+			var err error
+			if code, err = lps.unusedCode(seen); err != nil {
+				return nil, nil, err
+			}
+		}
+		codes[i] = code
+		switch {
+		case seen[code] || lps.store[code] != nil:
+			errs[i] = AlreadyExistsError{Code: code}
+		case v.Category != "" && lps.categories[v.Category] == nil:
+			errs[i] = CategoryNotFoundError{Name: v.Category}
+		default:
+			errs[i] = lps.checkAttributes(v)
+		}
+		seen[code] = true
+		failed = failed || errs[i] != nil
+	}
+	if failed {
+		return codes, errs, nil
+	}
+
+	added := make([]types.Produce, len(prods))
+	changes := make([]Change, len(prods))
+	for i, v := range prods {
+		added[i] = v
+		added[i].Code = codes[i]
+		changes[i] = Change{Kind: ChangeAdd, Code: codes[i], After: &added[i]}
+	}
+	if err := lps.record(ctx, changes...); err != nil {
+		return nil, nil, err
+	}
+	for _, v := range added {
+		lps.insert(v)
+	}
+	return codes, nil, nil
+}
+
+// unusedCode generates a code that is neither in the store nor among the
+// codes given, with the lock already held.
+func (lps *LockingProduceStore) unusedCode(taken map[string]bool) (string,
+	error) {
+	for i := 0; i < maxCodeAttempts; i++ {
+		code, err := types.NewProduceCode()
+		if err != nil {
+			return "", err
+		}
+		if lps.store[code] == nil && !taken[code] {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("no unused produce code found in %d attempts",
+		maxCodeAttempts)
+}
+
+// check returns the error for an item that can't be added, with the lock
+// already held.
+func (lps *LockingProduceStore) check(prod types.Produce) error {
 	_, ok := lps.store[prod.Code]
 	if ok {
 		return AlreadyExistsError{Code: prod.Code}
 	}
+	if prod.Category != "" && lps.categories[prod.Category] == nil {
+		return CategoryNotFoundError{Name: prod.Category}
+	}
+	return lps.checkAttributes(prod)
+}
+
+// checkAttributes returns an AttributeNotFoundError for the first of the
+// item's attributes that isn't defined, with the lock already held.  The
+// service validates the attributes against the schema before the store is
+// locked, so a definition may have been deleted since, and the item would
+// otherwise be stored with an attribute the schema no longer has.
+func (lps *LockingProduceStore) checkAttributes(prod types.Produce) error {
+	names := make([]string, 0, len(prod.Attributes))
+	for k := range prod.Attributes {
+		if lps.attributes[k] == nil {
+			names = append(names, k)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return AttributeNotFoundError{Name: names[0]}
+}
+
+// insert adds an item that has been checked, with the lock already held.
+func (lps *LockingProduceStore) insert(prod types.Produce) {
+	prod = copyProduce(prod)
 	lps.store[prod.Code] = &prod
-	return nil
+}
+
+// copyProduce returns a copy of the item that doesn't share its tags,
+// attributes or names, so items going into or out of the store can't be
+// changed through the caller's copy.
+func copyProduce(prod types.Produce) types.Produce {
+	if prod.Tags != nil {
+		prod.Tags = append([]string(nil), prod.Tags...)
+	}
+	if prod.Attributes != nil {
+		attrs := make(map[string]interface{}, len(prod.Attributes))
+		for k, v := range prod.Attributes {
+			attrs[k] = v
+		}
+		prod.Attributes = attrs
+	}
+	if prod.Names != nil {
+		names := make(map[string]string, len(prod.Names))
+		for k, v := range prod.Names {
+			names[k] = v
+		}
+		prod.Names = names
+	}
+	return prod
 }
 
 // Delete deletes single produce item from the store or returns an error
 // if it fails.
 func (lps *LockingProduceStore) Delete(ctx context.Context,
 	code string) error {
-	lps.lock.Lock()
+	if err := lps.lockWrite(ctx); err != nil {
+		return err
+	}
 	defer lps.lock.Unlock()
 
-	_, ok := lps.store[code]
+	prod, ok := lps.store[code]
 	if !ok {
 		return NotFoundError{Code: code}
 	}
+	before := *prod
+	if err := lps.record(ctx, Change{Kind: ChangeDelete, Code: code,
+		Before: &before}); err != nil {
+		return err
+	}
 
 	delete(lps.store, code)
 	return nil
 }
 
+// Get fetches the produce item with the code, or returns a NotFoundError
+// if there is none.
+func (lps *LockingProduceStore) Get(ctx context.Context,
+	code string) (types.Produce, error) {
+	if err := lps.lockRead(ctx); err != nil {
+		return types.Produce{}, err
+	}
+	defer lps.lock.RUnlock()
+
+	prod, ok := lps.store[code]
+	if !ok {
+		return types.Produce{}, NotFoundError{Code: code}
+	}
+	return copyProduce(*prod), nil
+}
+
 // ListAll fetches all produce items from the store or returns an error
 // if it fails.
 func (lps *LockingProduceStore) ListAll(ctx context.Context) (
 	[]types.Produce, error) {
-	lps.lock.RLock()
+	if err := lps.lockRead(ctx); err != nil {
+		return nil, err
+	}
 	defer lps.lock.RUnlock()
 
 	ret := make([]types.Produce, 0, len(lps.store))
 	for _, v := range lps.store {
-		ret = append(ret, *v)
+		ret = append(ret, copyProduce(*v))
+	}
+	return ret, nil
+}
+
+// List fetches the produce items that match the filter or returns an
+// error if it fails.  An item matches the category if it is assigned to
+// that category or any category below it.
+func (lps *LockingProduceStore) List(ctx context.Context,
+	filter types.ProduceFilter) ([]types.Produce, error) {
+	items, err := lps.matching(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]types.Produce, len(items))
+	for i, v := range items {
+		ret[i] = copyProduce(*v)
+	}
+	return ret, nil
+}
+
+// Iterate calls the function for each produce item that matches the
+// filter, stopping at the first error it returns, or when the context is
+// done.  It returns the error that stopped it, if any.
+//
+// Only the matching item pointers are gathered with the store locked, and
+// the function is called with the lock released, so a slow consumer doesn't
+// hold up other requests, nor does the store have to copy every item at
+// once.  This is safe because stored items are never modified in place,
+// and each is copied as it is passed to the function.  The items are the
+// ones that were in the store when the call was made.
+func (lps *LockingProduceStore) Iterate(ctx context.Context,
+	filter types.ProduceFilter, fn func(types.Produce) error) error {
+	items, err := lps.matching(ctx, filter)
+	if err != nil {
+		return err
+	}
+	for _, v := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(copyProduce(*v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matching returns the stored items that match the filter.
+func (lps *LockingProduceStore) matching(ctx context.Context,
+	filter types.ProduceFilter) ([]*types.Produce, error) {
+	if err := lps.lockRead(ctx); err != nil {
+		return nil, err
+	}
+	defer lps.lock.RUnlock()
+
+	if filter.Category != "" && lps.categories[filter.Category] == nil {
+		return nil, CategoryNotFoundError{Name: filter.Category}
+	}
+	ret := make([]*types.Produce, 0, len(lps.store))
+	for _, v := range lps.store {
+		if filter.Category != "" && !lps.inSubtree(v.Category, filter.Category) {
+			continue
+		}
+		if !hasAllTags(v.Tags, filter.Tags) {
+			continue
+		}
+		ret = append(ret, v)
 	}
 	return ret, nil
 }
 
 // Clear is a convenience API to reset the database, useful for testing.
-func (lps *LockingProduceStore) Clear(context.Context) error {
+func (lps *LockingProduceStore) Clear(ctx context.Context) error {
+	if err := lps.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer lps.lock.Unlock()
+
+	var removed []types.Produce
+	for _, v := range lps.store {
+		removed = append(removed, *v)
+	}
+	changes := []Change{{Kind: ChangeReset, Removed: removed}}
+
+	// The categories and attributes are removed too, so their deletes are
+	// recorded, with the children before their parents, as they would have
+	// to be deleted one by one.
+	cats := make([]string, 0, len(lps.categories))
+	depth := make(map[string]int, len(lps.categories))
+	for k := range lps.categories {
+		cats = append(cats, k)
+		for cat := lps.categories[k].Parent; cat != ""; {
+			depth[k]++
+			cat = lps.categories[cat].Parent
+		}
+	}
+	sort.Slice(cats, func(i, j int) bool {
+		if depth[cats[i]] != depth[cats[j]] {
+			return depth[cats[i]] > depth[cats[j]]
+		}
+		return cats[i] < cats[j]
+	})
+	for _, v := range cats {
+		changes = append(changes, Change{Kind: ChangeDeleteCategory,
+			Target: v})
+	}
+	attrs := make([]string, 0, len(lps.attributes))
+	for k := range lps.attributes {
+		attrs = append(attrs, k)
+	}
+	sort.Strings(attrs)
+	for _, v := range attrs {
+		def := *lps.attributes[v]
+		changes = append(changes, Change{Kind: ChangeDeleteAttribute,
+			Target: v, Attribute: &def})
+	}
+	if err := lps.record(ctx, changes...); err != nil {
+		return err
+	}
+
 	lps.store = make(map[string]*types.Produce)
+	lps.categories = make(map[string]*types.Category)
+	lps.attributes = make(map[string]*types.AttributeDef)
+	return nil
+}
+
+// AddCategory adds a single category to the hierarchy or returns an
+// error if it fails.
+func (lps *LockingProduceStore) AddCategory(ctx context.Context,
+	cat types.Category) error {
+	if err := lps.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer lps.lock.Unlock()
+
+	if _, ok := lps.categories[cat.Name]; ok {
+		return CategoryExistsError{Name: cat.Name}
+	}
+	if cat.Parent != "" && lps.categories[cat.Parent] == nil {
+		return CategoryNotFoundError{Name: cat.Parent}
+	}
+	if err := lps.record(ctx, Change{Kind: ChangeAddCategory,
+		Target: cat.Name}); err != nil {
+		return err
+	}
+	lps.categories[cat.Name] = &cat
+	return nil
+}
+
+// DeleteCategory deletes a category that has no children and no
+// produce items assigned to it, or returns an error if it fails.
+func (lps *LockingProduceStore) DeleteCategory(ctx context.Context,
+	name string) error {
+	if err := lps.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer lps.lock.Unlock()
+
+	if _, ok := lps.categories[name]; !ok {
+		return CategoryNotFoundError{Name: name}
+	}
+	for _, v := range lps.categories {
+		if v.Parent == name {
+			return CategoryInUseError{Name: name,
+				Reason: "it has child categories"}
+		}
+	}
+	for _, v := range lps.store {
+		if v.Category == name {
+			return CategoryInUseError{Name: name,
+				Reason: "it has produce items"}
+		}
+	}
+	if err := lps.record(ctx, Change{Kind: ChangeDeleteCategory,
+		Target: name}); err != nil {
+		return err
+	}
+
+	delete(lps.categories, name)
 	return nil
 }
+
+// ListCategories fetches all categories from the store or returns an
+// error if it fails.
+func (lps *LockingProduceStore) ListCategories(ctx context.Context) (
+	[]types.Category, error) {
+	if err := lps.lockRead(ctx); err != nil {
+		return nil, err
+	}
+	defer lps.lock.RUnlock()
+
+	ret := make([]types.Category, 0, len(lps.categories))
+	for _, v := range lps.categories {
+		ret = append(ret, *v)
+	}
+	return ret, nil
+}
+
+// CategoryCounts fetches the number of produce items in each category
+// or returns an error if it fails.  Each item is counted directly in its
+// own category, and in the total count of that category and all of its
+// ancestors.
+func (lps *LockingProduceStore) CategoryCounts(ctx context.Context) (
+	[]types.CategoryCount, error) {
+	if err := lps.lockRead(ctx); err != nil {
+		return nil, err
+	}
+	defer lps.lock.RUnlock()
+
+	counts := make(map[string]*types.CategoryCount, len(lps.categories))
+	for _, v := range lps.categories {
+		counts[v.Name] = &types.CategoryCount{Name: v.Name, Parent: v.Parent}
+	}
+	for _, v := range lps.store {
+		if v.Category == "" {
+			continue
+		}
+		counts[v.Category].Count++
+		for cat := v.Category; cat != ""; cat = lps.categories[cat].Parent {
+			counts[cat].TotalCount++
+		}
+	}
+
+	ret := make([]types.CategoryCount, 0, len(counts))
+	for _, v := range counts {
+		ret = append(ret, *v)
+	}
+	return ret, nil
+}
+
+// AddAttribute adds a single attribute definition to the schema or
+// returns an error if it fails.
+func (lps *LockingProduceStore) AddAttribute(ctx context.Context,
+	def types.AttributeDef) error {
+	if err := lps.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer lps.lock.Unlock()
+
+	if _, ok := lps.attributes[def.Name]; ok {
+		return AttributeExistsError{Name: def.Name}
+	}
+	if err := lps.record(ctx, Change{Kind: ChangeAddAttribute,
+		Target: def.Name, Attribute: &def}); err != nil {
+		return err
+	}
+	lps.attributes[def.Name] = &def
+	return nil
+}
+
+// DeleteAttribute deletes an attribute definition that no produce
+// items carry, or returns an error if it fails.
+func (lps *LockingProduceStore) DeleteAttribute(ctx context.Context,
+	name string) error {
+	if err := lps.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer lps.lock.Unlock()
+
+	def, ok := lps.attributes[name]
+	if !ok {
+		return AttributeNotFoundError{Name: name}
+	}
+	for _, v := range lps.store {
+		if _, ok := v.Attributes[name]; ok {
+			return AttributeInUseError{Name: name}
+		}
+	}
+	before := *def
+	if err := lps.record(ctx, Change{Kind: ChangeDeleteAttribute,
+		Target: name, Attribute: &before}); err != nil {
+		return err
+	}
+
+	delete(lps.attributes, name)
+	return nil
+}
+
+// ListAttributes fetches all attribute definitions from the store or
+// returns an error if it fails.
+func (lps *LockingProduceStore) ListAttributes(ctx context.Context) (
+	[]types.AttributeDef, error) {
+	if err := lps.lockRead(ctx); err != nil {
+		return nil, err
+	}
+	defer lps.lock.RUnlock()
+
+	ret := make([]types.AttributeDef, 0, len(lps.attributes))
+	for _, v := range lps.attributes {
+		ret = append(ret, *v)
+	}
+	return ret, nil
+}
+
+// lockWrite takes the write lock, unless the context is done before or
+// while waiting for it, in which case it returns the context's error
+// without holding the lock.  The wait for the lock itself can't be
+// interrupted, but the work of a request that was abandoned meanwhile
+// isn't done.
+func (lps *LockingProduceStore) lockWrite(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lps.lock.Lock()
+	if err := ctx.Err(); err != nil {
+		lps.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// lockRead takes the read lock, as lockWrite does the write lock.
+func (lps *LockingProduceStore) lockRead(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lps.lock.RLock()
+	if err := ctx.Err(); err != nil {
+		lps.lock.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// inSubtree returns whether the category is the root category or one of
+// its descendants.  The lock must be held by the caller.
+func (lps *LockingProduceStore) inSubtree(category, root string) bool {
+	for category != "" {
+		if category == root {
+			return true
+		}
+		category = lps.categories[category].Parent
+	}
+	return false
+}
+
+// hasAllTags returns whether every wanted tag is present in the tags.
+func hasAllTags(tags []string, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
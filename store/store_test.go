@@ -2,6 +2,8 @@ package store
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	"testing"
 
 	"github.com/gdotgordon/produce-demo/types"
@@ -33,7 +35,7 @@ func TestAdd(t *testing.T) {
 	}
 
 	prod := lps.store[dfltProduce.Code]
-	if prod == nil || *prod != dfltProduce {
+	if prod == nil || !reflect.DeepEqual(*prod, dfltProduce) {
 		t.Fatalf("expected produce not found")
 	}
 
@@ -56,11 +58,120 @@ func TestAdd(t *testing.T) {
 		t.Fatalf("unexpected store count: %d", len(lps.store))
 	}
 	prod = lps.store[secondProduce.Code]
-	if prod == nil || *prod != secondProduce {
+	if prod == nil || !reflect.DeepEqual(*prod, secondProduce) {
 		t.Fatalf("expected produce not found")
 	}
 }
 
+func TestAddWithNewCode(t *testing.T) {
+	var store = New()
+	lps := store.(*LockingProduceStore)
+	codes := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		code, err := store.AddWithNewCode(context.Background(), dfltProduce)
+		if err != nil {
+			t.Fatalf("(%d) error adding produce: %v", i, err)
+		}
+		if code == dfltProduce.Code || codes[code] {
+			t.Fatalf("(%d) code was not newly generated: %s", i, code)
+		}
+		codes[code] = true
+		prod := lps.store[code]
+		if prod == nil || prod.Code != code || prod.Name != dfltProduce.Name {
+			t.Fatalf("(%d) expected produce not found", i)
+		}
+	}
+	if len(lps.store) != 10 {
+		t.Fatalf("unexpected store count: %d", len(lps.store))
+	}
+
+	// The item is still checked as it would be for a regular add.
+	item := dfltProduce
+	item.Category = "Fruit"
+	code, err := store.AddWithNewCode(context.Background(), item)
+	if _, ok := err.(CategoryNotFoundError); !ok || code != "" {
+		t.Fatalf("did not get expected error, got '%s', %v", code, err)
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	var store = New()
+	lps := store.(*LockingProduceStore)
+	if err := store.Add(context.Background(), dfltProduce); err != nil {
+		t.Fatalf("error adding produce: %v", err)
+	}
+
+	// If any item can't be added, none are.
+	fruit := secondProduce
+	fruit.Code = "B12T-4GH7-QPL9-3N4M"
+	fruit.Category = "Fruit"
+	items := []types.Produce{secondProduce, dfltProduce, secondProduce, fruit,
+		{Name: "Peas", UnitPrice: types.USD(120)}}
+	codes, errs, err := store.AddAll(context.Background(), items)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, v := range []error{nil,
+		AlreadyExistsError{Code: dfltProduce.Code},
+		AlreadyExistsError{Code: secondProduce.Code},
+		CategoryNotFoundError{Name: "Fruit"}, nil} {
+		if errs[i] != v {
+			t.Fatalf("(%d) unexpected error: %v", i, errs[i])
+		}
+	}
+	if codes[0] != secondProduce.Code || codes[4] == "" {
+		t.Fatalf("unexpected codes: %v", codes)
+	}
+	if len(lps.store) != 1 {
+		t.Fatalf("unexpected store count: %d", len(lps.store))
+	}
+
+	// Otherwise all are.
+	codes, errs, err = store.AddAll(context.Background(), items[4:])
+	if err != nil || errs != nil {
+		t.Fatalf("unexpected errors: %v, %v", errs, err)
+	}
+	if prod := lps.store[codes[0]]; prod == nil || prod.Name != "Peas" {
+		t.Fatalf("expected produce not found")
+	}
+	if len(lps.store) != 2 {
+		t.Fatalf("unexpected store count: %d", len(lps.store))
+	}
+}
+
+func TestJournal(t *testing.T) {
+	var changes []Change
+	var fail error
+	store := NewJournaled(func(ctx context.Context, c []Change) error {
+		if fail != nil {
+			return fail
+		}
+		changes = append(changes, c...)
+		return nil
+	})
+	if err := store.Add(context.Background(), dfltProduce); err != nil {
+		t.Fatalf("error adding produce: %v", err)
+	}
+	if err := store.Delete(context.Background(), dfltProduce.Code); err != nil {
+		t.Fatalf("error deleting produce: %v", err)
+	}
+	if !reflect.DeepEqual(changes, []Change{
+		{Kind: ChangeAdd, Code: dfltProduce.Code, After: &dfltProduce},
+		{Kind: ChangeDelete, Code: dfltProduce.Code, Before: &dfltProduce},
+	}) {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+
+	// A change the journal fails isn't made.
+	fail = errors.New("disk full")
+	if err := store.Add(context.Background(), dfltProduce); err != fail {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	if items, _ := store.ListAll(context.Background()); len(items) != 0 {
+		t.Fatalf("unexpected store count: %d", len(items))
+	}
+}
+
 func TestDelete(t *testing.T) {
 	var store = New()
 
@@ -85,6 +196,102 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestGet(t *testing.T) {
+	var store = New()
+
+	_, err := store.Get(context.Background(), dfltProduce.Code)
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatalf("did not get expected error type, got %T", err)
+	}
+
+	var lps = store.(*LockingProduceStore)
+	lps.store[dfltProduce.Code] = &dfltProduce
+	prod, err := store.Get(context.Background(), dfltProduce.Code)
+	if err != nil {
+		t.Fatalf("error getting produce: %v", err)
+	}
+	if !reflect.DeepEqual(prod, dfltProduce) {
+		t.Fatalf("expected %v, got %v", dfltProduce, prod)
+	}
+}
+
+func TestCopies(t *testing.T) {
+	ctx := context.Background()
+	var store = New()
+	item := secondProduce
+	item.Tags = []string{"Green"}
+	item.Names = map[string]string{"fr": "Poivron Vert"}
+	item.Attributes = map[string]interface{}{"organic": true}
+	store.(*LockingProduceStore).attributes["organic"] =
+		&types.AttributeDef{Name: "organic", Type: types.AttributeBool}
+	if err := store.Add(ctx, item); err != nil {
+		t.Fatalf("error adding produce: %v", err)
+	}
+	item.Tags[0] = "Red"
+	item.Names["fr"] = "Poivron Rouge"
+	item.Attributes["organic"] = false
+
+	// Changing what is read, or what was added, leaves the store as it was.
+	read := func(i int) []types.Produce {
+		var items []types.Produce
+		switch i {
+		case 0:
+			prod, err := store.Get(ctx, item.Code)
+			if err != nil {
+				t.Fatalf("(%d) error getting produce: %v", i, err)
+			}
+			items = append(items, prod)
+		case 1:
+			items, _ = store.ListAll(ctx)
+		case 2:
+			items, _ = store.List(ctx, types.ProduceFilter{})
+		case 3:
+			store.Iterate(ctx, types.ProduceFilter{},
+				func(prod types.Produce) error {
+					items = append(items, prod)
+					return nil
+				})
+		}
+		return items
+	}
+	for i := 0; i < 4; i++ {
+		items := read(i)
+		if len(items) != 1 || items[0].Tags[0] != "Green" ||
+			items[0].Names["fr"] != "Poivron Vert" ||
+			items[0].Attributes["organic"] != true {
+			t.Fatalf("(%d) unexpected items: %+v", i, items)
+		}
+		items[0].Tags[0] = "Red"
+		items[0].Names["fr"] = "Poivron Rouge"
+		items[0].Attributes["organic"] = false
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	var store = New()
+	var lps = store.(*LockingProduceStore)
+	lps.store[secondProduce.Code] = &secondProduce
+
+	// Nothing is changed for a request that is already cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.Add(ctx, dfltProduce); err != context.Canceled {
+		t.Fatalf("unexpected add error: %v", err)
+	}
+	if _, err := store.AddWithNewCode(ctx, dfltProduce); err != context.Canceled {
+		t.Fatalf("unexpected add error: %v", err)
+	}
+	if err := store.Delete(ctx, secondProduce.Code); err != context.Canceled {
+		t.Fatalf("unexpected delete error: %v", err)
+	}
+	if _, err := store.ListAll(ctx); err != context.Canceled {
+		t.Fatalf("unexpected list error: %v", err)
+	}
+	if len(lps.store) != 1 || lps.store[secondProduce.Code] == nil {
+		t.Fatalf("store was changed: %v", lps.store)
+	}
+}
+
 func TestListAll(t *testing.T) {
 	var store = New()
 
@@ -107,8 +314,10 @@ func TestListAll(t *testing.T) {
 	if len(res) != 2 {
 		t.Fatalf("expected 2 items, got %d", len(res))
 	}
-	if !((res[0] == dfltProduce && res[1] == secondProduce) ||
-		(res[1] == dfltProduce && res[0] == secondProduce)) {
+	if !((reflect.DeepEqual(res[0], dfltProduce) &&
+		reflect.DeepEqual(res[1], secondProduce)) ||
+		(reflect.DeepEqual(res[1], dfltProduce) &&
+			reflect.DeepEqual(res[0], secondProduce))) {
 		t.Fatalf("did not receive expected item list")
 	}
 }
@@ -137,3 +346,304 @@ func TestClear(t *testing.T) {
 		t.Fatalf("store is not empty after clear")
 	}
 }
+
+func TestCategories(t *testing.T) {
+	var store = New()
+	ctx := context.Background()
+
+	for i, v := range []struct {
+		cat    types.Category
+		expErr error
+	}{
+		{
+			cat: types.Category{Name: "Fruit"},
+		},
+		{
+			cat: types.Category{Name: "Apples", Parent: "Fruit"},
+		},
+		{
+			cat:    types.Category{Name: "Apples", Parent: "Fruit"},
+			expErr: CategoryExistsError{Name: "Apples"},
+		},
+		{
+			cat:    types.Category{Name: "Kale", Parent: "Greens"},
+			expErr: CategoryNotFoundError{Name: "Greens"},
+		},
+	} {
+		if err := store.AddCategory(ctx, v.cat); err != v.expErr {
+			t.Fatalf("(%d) expected error %v, got %v", i, v.expErr, err)
+		}
+	}
+
+	cats, err := store.ListCategories(ctx)
+	if err != nil {
+		t.Fatalf("error listing categories: %v", err)
+	}
+	if len(cats) != 2 {
+		t.Fatalf("expected 2 categories, got %d", len(cats))
+	}
+
+	// An item may not refer to an unknown category.
+	item := secondProduce
+	item.Category = "Peppers"
+	err = store.Add(ctx, item)
+	if err != (CategoryNotFoundError{Name: "Peppers"}) {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	item.Category = "Apples"
+	if err = store.Add(ctx, item); err != nil {
+		t.Fatalf("error adding produce: %v", err)
+	}
+
+	// Neither a parent nor a category with items may be deleted.
+	err = store.DeleteCategory(ctx, "Fruit")
+	if _, ok := err.(CategoryInUseError); !ok {
+		t.Fatalf("did not get expected error type, got %T", err)
+	}
+	err = store.DeleteCategory(ctx, "Apples")
+	if _, ok := err.(CategoryInUseError); !ok {
+		t.Fatalf("did not get expected error type, got %T", err)
+	}
+	if err = store.Delete(ctx, item.Code); err != nil {
+		t.Fatalf("error deleting produce: %v", err)
+	}
+	if err = store.DeleteCategory(ctx, "Apples"); err != nil {
+		t.Fatalf("error deleting category: %v", err)
+	}
+	err = store.DeleteCategory(ctx, "Apples")
+	if err != (CategoryNotFoundError{Name: "Apples"}) {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+}
+
+func TestListFiltered(t *testing.T) {
+	var store = New()
+	ctx := context.Background()
+	for _, v := range []types.Category{
+		{Name: "Fruit"},
+		{Name: "Apples", Parent: "Fruit"},
+		{Name: "Vegetables"},
+	} {
+		if err := store.AddCategory(ctx, v); err != nil {
+			t.Fatalf("error adding category: %v", err)
+		}
+	}
+
+	gala := types.Produce{Code: "TQ4C-VV6T-75ZX-1RMR", Name: "Gala Apple",
+		UnitPrice: 359, Category: "Apples", Tags: []string{"Local", "Seasonal"}}
+	peach := types.Produce{Code: "E5T6-9UI3-TH15-QR88", Name: "Peach",
+		UnitPrice: 299, Category: "Fruit", Tags: []string{"Seasonal"}}
+	pepper := secondProduce
+	pepper.Category = "Vegetables"
+	pepper.Tags = []string{"Local"}
+	for _, v := range []types.Produce{gala, peach, pepper, dfltProduce} {
+		if err := store.Add(ctx, v); err != nil {
+			t.Fatalf("error adding produce: %v", err)
+		}
+	}
+
+	for i, v := range []struct {
+		filter   types.ProduceFilter
+		expCodes []string
+		expErr   error
+	}{
+		{
+			filter:   types.ProduceFilter{},
+			expCodes: []string{gala.Code, peach.Code, pepper.Code, dfltProduce.Code},
+		},
+		{
+			filter:   types.ProduceFilter{Category: "Fruit"},
+			expCodes: []string{gala.Code, peach.Code},
+		},
+		{
+			filter:   types.ProduceFilter{Category: "Apples"},
+			expCodes: []string{gala.Code},
+		},
+		{
+			filter:   types.ProduceFilter{Tags: []string{"Local"}},
+			expCodes: []string{gala.Code, pepper.Code},
+		},
+		{
+			filter:   types.ProduceFilter{Tags: []string{"Local", "Seasonal"}},
+			expCodes: []string{gala.Code},
+		},
+		{
+			filter:   types.ProduceFilter{Category: "Fruit", Tags: []string{"Local"}},
+			expCodes: []string{gala.Code},
+		},
+		{
+			filter: types.ProduceFilter{Category: "Herbs"},
+			expErr: CategoryNotFoundError{Name: "Herbs"},
+		},
+	} {
+		res, err := store.List(ctx, v.filter)
+		if err != v.expErr {
+			t.Fatalf("(%d) expected error %v, got %v", i, v.expErr, err)
+		}
+		if len(res) != len(v.expCodes) {
+			t.Fatalf("(%d) expected %d items, got %d", i, len(v.expCodes), len(res))
+		}
+		for _, c := range v.expCodes {
+			found := false
+			for _, p := range res {
+				if p.Code == c {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatalf("(%d) expected item %s not listed", i, c)
+			}
+		}
+	}
+
+	counts, err := store.CategoryCounts(ctx)
+	if err != nil {
+		t.Fatalf("error counting categories: %v", err)
+	}
+	expCounts := map[string]types.CategoryCount{
+		"Fruit":      {Name: "Fruit", Count: 1, TotalCount: 2},
+		"Apples":     {Name: "Apples", Parent: "Fruit", Count: 1, TotalCount: 1},
+		"Vegetables": {Name: "Vegetables", Count: 1, TotalCount: 1},
+	}
+	if len(counts) != len(expCounts) {
+		t.Fatalf("expected %d counts, got %d", len(expCounts), len(counts))
+	}
+	for _, v := range counts {
+		if expCounts[v.Name] != v {
+			t.Fatalf("unexpected count: %+v", v)
+		}
+	}
+}
+
+func TestIterate(t *testing.T) {
+	var store = New()
+	ctx := context.Background()
+	if err := store.AddCategory(ctx, types.Category{Name: "Vegetables"}); err != nil {
+		t.Fatalf("error adding category: %v", err)
+	}
+	pepper := secondProduce
+	pepper.Category = "Vegetables"
+	for _, v := range []types.Produce{pepper, dfltProduce} {
+		if err := store.Add(ctx, v); err != nil {
+			t.Fatalf("error adding produce: %v", err)
+		}
+	}
+
+	// The store isn't locked during the calls, so the function may even
+	// modify the store.
+	var codes []string
+	err := store.Iterate(ctx, types.ProduceFilter{},
+		func(item types.Produce) error {
+			codes = append(codes, item.Code)
+			return store.Delete(ctx, item.Code)
+		})
+	if err != nil || len(codes) != 2 {
+		t.Fatalf("unexpected iteration: %v, %v", codes, err)
+	}
+	for _, v := range []types.Produce{pepper, dfltProduce} {
+		if err := store.Add(ctx, v); err != nil {
+			t.Fatalf("error adding produce: %v", err)
+		}
+	}
+
+	codes = nil
+	err = store.Iterate(ctx, types.ProduceFilter{Category: "Vegetables"},
+		func(item types.Produce) error {
+			codes = append(codes, item.Code)
+			return nil
+		})
+	if err != nil || !reflect.DeepEqual(codes, []string{pepper.Code}) {
+		t.Fatalf("unexpected iteration: %v, %v", codes, err)
+	}
+
+	err = store.Iterate(ctx, types.ProduceFilter{Category: "Herbs"},
+		func(item types.Produce) error { return nil })
+	if err != (CategoryNotFoundError{Name: "Herbs"}) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The first error stops the iteration.
+	stop := errors.New("stop")
+	calls := 0
+	err = store.Iterate(ctx, types.ProduceFilter{},
+		func(item types.Produce) error {
+			calls++
+			return stop
+		})
+	if err != stop || calls != 1 {
+		t.Fatalf("unexpected stop: %d, %v", calls, err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	calls = 0
+	err = store.Iterate(cctx, types.ProduceFilter{},
+		func(item types.Produce) error {
+			calls++
+			cancel()
+			return nil
+		})
+	if err != context.Canceled || calls != 1 {
+		t.Fatalf("unexpected cancel: %d, %v", calls, err)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	var store = New()
+	ctx := context.Background()
+
+	def := types.AttributeDef{Name: "organic", Type: types.AttributeBool}
+	if err := store.AddAttribute(ctx, def); err != nil {
+		t.Fatalf("error adding attribute: %v", err)
+	}
+	err := store.AddAttribute(ctx, def)
+	if err != (AttributeExistsError{Name: "organic"}) {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	defs, err := store.ListAttributes(ctx)
+	if err != nil {
+		t.Fatalf("error listing attributes: %v", err)
+	}
+	if len(defs) != 1 || defs[0].Name != "organic" {
+		t.Fatalf("unexpected attributes: %+v", defs)
+	}
+
+	item := dfltProduce
+	item.Attributes = map[string]interface{}{"organic": true}
+	if err = store.Add(ctx, item); err != nil {
+		t.Fatalf("error adding produce: %v", err)
+	}
+
+	// The store keeps its own copy of the attributes.
+	item.Attributes["organic"] = false
+	res, _ := store.ListAll(ctx)
+	if res[0].Attributes["organic"] != true {
+		t.Fatalf("stored attributes were modified")
+	}
+
+	err = store.DeleteAttribute(ctx, "organic")
+	if err != (AttributeInUseError{Name: "organic"}) {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	if err = store.Delete(ctx, item.Code); err != nil {
+		t.Fatalf("error deleting produce: %v", err)
+	}
+	if err = store.DeleteAttribute(ctx, "organic"); err != nil {
+		t.Fatalf("error deleting attribute: %v", err)
+	}
+
+	// An item validated before the attribute was deleted isn't stored.
+	err = store.Add(ctx, item)
+	if err != (AttributeNotFoundError{Name: "organic"}) {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+	_, errs, err := store.AddAll(ctx, []types.Produce{item})
+	if err != nil || errs[0] != (AttributeNotFoundError{Name: "organic"}) {
+		t.Fatalf("did not get expected error, got %v, %v", errs, err)
+	}
+
+	err = store.DeleteAttribute(ctx, "organic")
+	if err != (AttributeNotFoundError{Name: "organic"}) {
+		t.Fatalf("did not get expected error, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+//go:build integration
+// +build integration
+
+// Run as: go test -tags=integration
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gdotgordon/produce-demo/client"
+	"github.com/gdotgordon/produce-demo/service"
+	"github.com/gdotgordon/produce-demo/store"
+	"github.com/gdotgordon/produce-demo/types"
+)
+
+// newAPIClient creates a client of the service under test.
+func newAPIClient(t *testing.T) *client.Client {
+	c, err := client.New(produceAddr, client.Options{})
+	if err != nil {
+		t.Fatalf("cannot create client: %v", err)
+	}
+	return c
+}
+
+func TestClientStatus(t *testing.T) {
+	status, err := newAPIClient(t).Status(context.Background())
+	if err != nil {
+		t.Fatalf("status failed: %s", err)
+	}
+	if status != "produce service is up and running" {
+		t.Fatal("unexpected status response", status)
+	}
+}
+
+func TestClientAddGetDelete(t *testing.T) {
+	invokeReset(t)
+	ctx := context.Background()
+	c := newAPIClient(t)
+
+	// The results of the items are converted back to the errors of the
+	// service and the store.
+	items := createRandomProduce(0, 2)
+	bad := items[1]
+	bad.Code = "bad"
+	res, err := c.Add(ctx, []types.Produce{items[0], items[0], bad})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if len(res) != 3 || res[0].Err != nil {
+		t.Fatalf("unexpected add results: %+v", res)
+	}
+	if _, ok := res[1].Err.(store.AlreadyExistsError); !ok {
+		t.Fatalf("expected the duplicate to exist, got %v", res[1].Err)
+	}
+	if _, ok := res[2].Err.(service.FormatError); !ok {
+		t.Fatalf("expected the bad code to be invalid, got %v", res[2].Err)
+	}
+
+	// An item without a code has one generated.
+	gen := items[1]
+	gen.Code = ""
+	code, err := c.AddOne(ctx, gen)
+	if err != nil || code == "" {
+		t.Fatalf("add of one item failed: %q, %v", code, err)
+	}
+
+	item, err := c.Get(ctx, code, client.ListOptions{})
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if item.Code != code || item.Name != toUpper(gen).Name {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+	if err := c.Delete(ctx, code); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err := c.Get(ctx, code, client.ListOptions{}); err !=
+		(store.NotFoundError{Code: code}) {
+		t.Fatalf("expected the item not to be found, got %v", err)
+	}
+	if err := c.Delete(ctx, code); err != (store.NotFoundError{Code: code}) {
+		t.Fatalf("expected the item not to be found, got %v", err)
+	}
+
+	if err := c.Reset(ctx); err != nil {
+		t.Fatalf("reset failed: %v", err)
+	}
+	list, err := c.ListAll(ctx)
+	if err != nil || len(list) != 0 {
+		t.Fatalf("unexpected items after reset: %v, %v", list, err)
+	}
+}
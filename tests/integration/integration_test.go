@@ -1,3 +1,4 @@
+//go:build integration
 // +build integration
 
 // Run as: go test -tags=integration
@@ -15,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
@@ -45,9 +47,8 @@ func TestRandGen(t *testing.T) {
 	}
 	for i := 5; i <= 29; i++ {
 		v := prods[i-5]
-		if types.ValidateAndConvertProduce(&v) != "" {
-			t.Fatalf("produce item not valid: %s",
-				types.ValidateAndConvertProduce(&v))
+		if errs := types.ValidateAndConvertProduce(&v); errs != nil {
+			t.Fatalf("produce item not valid: %v", errs)
 		}
 		if !strings.HasPrefix(v.Code, fmt.Sprintf("%04d", i)) {
 			t.Fatalf("code should begin with %04d, but has %s", i, v.Code[:4])
@@ -314,7 +315,7 @@ func TestAddListDelete(t *testing.T) {
 		sort.Sort(produceSorter{goodItems})
 		sort.Sort(produceSorter{litems})
 		for i, v := range goodItems {
-			if v != litems[i] {
+			if !reflect.DeepEqual(v, litems[i]) {
 				t.Fatalf("(%d) list items don't match: %+v, %+v", c, v, litems[i])
 			}
 		}
@@ -0,0 +1,313 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// AttributeType is the type of the value of an extended produce attribute.
+type AttributeType string
+
+// The supported attribute types.  Money values use the same string form
+// as the unit price, e.g. "$1.25".
+const (
+	AttributeString AttributeType = "string"
+	AttributeInt    AttributeType = "int"
+	AttributeBool   AttributeType = "bool"
+	AttributeEnum   AttributeType = "enum"
+	AttributeMoney  AttributeType = "money"
+)
+
+// AttributeDef defines an extended attribute that produce items may carry,
+// such as a country of origin or an organic flag.  The constraints that
+// apply depend on the type: strings may have a maximum length and a
+// pattern, ints and money may have a minimum and maximum, and enums must
+// list their allowed values.
+type AttributeDef struct {
+	Name      string        `json:"name" xml:"name"`
+	Type      AttributeType `json:"type" xml:"type"`
+	Required  bool          `json:"required,omitempty" xml:"required,omitempty"`
+	MaxLength int           `json:"max_length,omitempty" xml:"max_length,omitempty"`
+	Pattern   string        `json:"pattern,omitempty" xml:"pattern,omitempty"`
+	Min       *int64        `json:"min,omitempty" xml:"min,omitempty"`
+	Max       *int64        `json:"max,omitempty" xml:"max,omitempty"`
+	MinPrice  *USD          `json:"min_price,omitempty" xml:"min_price,omitempty"`
+	MaxPrice  *USD          `json:"max_price,omitempty" xml:"max_price,omitempty"`
+	Values    []string      `json:"values,omitempty" xml:"value,omitempty"`
+
+	// patternExp is the compiled pattern, set by NewAttributeSchema, so
+	// it isn't compiled again for each value.
+	patternExp *regexp.Regexp
+}
+
+// AttributeListResponse defines the JSON format for the request to list
+// all of the attribute definitions.
+type AttributeListResponse []AttributeDef
+
+// AttributeSchema is the set of attribute definitions, keyed by name,
+// that produce item attributes are validated against.
+type AttributeSchema map[string]AttributeDef
+
+// NewAttributeSchema creates a schema from a list of definitions,
+// compiling their patterns.  A pattern that doesn't compile, which the
+// validation of the definitions rules out, matches no values.
+func NewAttributeSchema(defs []AttributeDef) AttributeSchema {
+	schema := make(AttributeSchema, len(defs))
+	for _, v := range defs {
+		if v.Pattern != "" {
+			v.patternExp, _ = regexp.Compile(v.Pattern)
+		}
+		schema[v.Name] = v
+	}
+	return schema
+}
+
+var (
+	// Regular expression to validate an attribute name, which is an
+	// alphanumeric identifier with words separated by underscores, such
+	// as "country_of_origin".
+	attrNameExp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(_[A-Za-z0-9]+)*$`)
+)
+
+// ValidateAndConvertAttributeName returns whether the attribute name is
+// syntactically valid and if so, puts it in canonical form (lower case).
+func ValidateAndConvertAttributeName(name string) (string, bool) {
+	if !attrNameExp.MatchString(name) {
+		return name, false
+	}
+	return strings.ToLower(name), true
+}
+
+// ValidateAndConvertAttributeDef validates that the definition has a
+// valid name and type, and that its constraints make sense for the type.
+// The name is canonicalized.  It returns a description of any problems.
+func ValidateAndConvertAttributeDef(def *AttributeDef) string {
+	var problems []string
+	str, val := ValidateAndConvertAttributeName(def.Name)
+	if !val {
+		problems = append(problems,
+			fmt.Sprintf("invalid attribute name: '%s'", def.Name))
+	}
+	def.Name = str
+
+	switch def.Type {
+	case AttributeString:
+		if def.MaxLength < 0 {
+			problems = append(problems, "max_length may not be negative")
+		}
+		if def.Pattern != "" {
+			if _, err := regexp.Compile(def.Pattern); err != nil {
+				problems = append(problems,
+					fmt.Sprintf("invalid pattern: '%s'", def.Pattern))
+			}
+		}
+	case AttributeInt:
+		if def.Min != nil && def.Max != nil && *def.Min > *def.Max {
+			problems = append(problems, "min is greater than max")
+		}
+	case AttributeMoney:
+		if def.MinPrice != nil && def.MaxPrice != nil &&
+			*def.MinPrice > *def.MaxPrice {
+			problems = append(problems, "min_price is greater than max_price")
+		}
+	case AttributeEnum:
+		if len(def.Values) == 0 {
+			problems = append(problems, "enum must have at least one value")
+		}
+	case AttributeBool:
+	default:
+		problems = append(problems,
+			fmt.Sprintf("invalid attribute type: '%s'", def.Type))
+	}
+
+	// Reject the constraints that don't apply to the type, as they
+	// are most likely a mistake.
+	if def.Type != AttributeString && (def.MaxLength != 0 || def.Pattern != "") {
+		problems = append(problems,
+			"max_length and pattern only apply to string attributes")
+	}
+	if def.Type != AttributeInt && (def.Min != nil || def.Max != nil) {
+		problems = append(problems, "min and max only apply to int attributes")
+	}
+	if def.Type != AttributeMoney && (def.MinPrice != nil || def.MaxPrice != nil) {
+		problems = append(problems,
+			"min_price and max_price only apply to money attributes")
+	}
+	if def.Type != AttributeEnum && len(def.Values) != 0 {
+		problems = append(problems, "values only apply to enum attributes")
+	}
+	return strings.Join(problems, ", ")
+}
+
+// ValidateAndConvertProduceWithSchema performs the same validation and
+// conversion as ValidateAndConvertProduce, and additionally validates the
+// item's attributes against the schema, converting each value to its
+// canonical type: string, int64, bool or USD.  Unknown attributes and
+// missing required attributes are reported as problems.
+func ValidateAndConvertProduceWithSchema(item *Produce,
+	schema AttributeSchema) FieldErrors {
+	problems := ValidateAndConvertProduce(item)
+	attrs, errs := validateAndConvertAttributes(item.Attributes, schema)
+	item.Attributes = attrs
+	return append(problems, errs...)
+}
+
+// ValidateAndConvertAttributes validates the attribute values against
+// the schema and returns them in canonical form, along with a description
+// of any problems.  The problems are reported in attribute name order, so
+// the message is stable.
+func ValidateAndConvertAttributes(attrs map[string]interface{},
+	schema AttributeSchema) (map[string]interface{}, string) {
+	res, errs := validateAndConvertAttributes(attrs, schema)
+	return res, errs.Error()
+}
+
+// validateAndConvertAttributes validates and converts the attribute
+// values as ValidateAndConvertAttributes does, returning the problem with
+// each one.
+func validateAndConvertAttributes(attrs map[string]interface{},
+	schema AttributeSchema) (map[string]interface{}, FieldErrors) {
+	var problems FieldErrors
+	var res map[string]interface{}
+	if len(attrs) != 0 {
+		res = make(map[string]interface{}, len(attrs))
+	}
+
+	names := make([]string, 0, len(attrs))
+	for k := range attrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		name, val := ValidateAndConvertAttributeName(k)
+		def, ok := schema[name]
+		if !val || !ok {
+			problems = append(problems, FieldError{Field: "attributes." + k,
+				Value: fmt.Sprint(attrs[k]), Rule: RuleUnknownAttribute,
+				Message: fmt.Sprintf("unknown attribute: '%s'", k)})
+			res[k] = attrs[k]
+			continue
+		}
+		cv, rule, msg := convertAttribute(def, attrs[k])
+		if msg != "" {
+			problems = append(problems, FieldError{Field: "attributes." + k,
+				Value: fmt.Sprint(attrs[k]), Rule: rule,
+				Message: fmt.Sprintf("invalid attribute '%s': %s", name, msg)})
+			res[name] = attrs[k]
+			continue
+		}
+		res[name] = cv
+	}
+
+	required := make([]string, 0)
+	for k, v := range schema {
+		if _, ok := res[k]; v.Required && !ok {
+			required = append(required, k)
+		}
+	}
+	sort.Strings(required)
+	for _, k := range required {
+		problems = append(problems, FieldError{Field: "attributes." + k,
+			Rule: RuleRequired, Message: fmt.Sprintf("missing attribute: '%s'", k)})
+	}
+	return res, problems
+}
+
+// convertAttribute checks a single value against its definition and
+// converts it to the canonical Go type for the attribute type, or returns
+// the rule it breaks and a description of the problem.  Values
+// that came from JSON arrive as strings, float64s and bools, but values
+// set directly from Go are accepted as well.
+func convertAttribute(def AttributeDef, value interface{}) (interface{},
+	string, string) {
+	switch def.Type {
+	case AttributeString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, RuleType, "expected a string"
+		}
+		if def.MaxLength > 0 && len([]rune(s)) > def.MaxLength {
+			return nil, RuleMaxLength, fmt.Sprintf("longer than %d characters", def.MaxLength)
+		}
+		if def.Pattern != "" {
+			exp := def.patternExp
+			if exp == nil {
+				exp, _ = regexp.Compile(def.Pattern)
+			}
+			if exp == nil || !exp.MatchString(s) {
+				return nil, RulePattern, fmt.Sprintf("does not match pattern '%s'", def.Pattern)
+			}
+		}
+		return s, "", ""
+	case AttributeInt:
+		var n int64
+		switch v := value.(type) {
+		case float64:
+			if v != math.Trunc(v) || math.Abs(v) > 1<<53 {
+				return nil, RuleType, "expected an integer"
+			}
+			n = int64(v)
+		case json.Number:
+			i, err := v.Int64()
+			if err != nil {
+				return nil, RuleType, "expected an integer"
+			}
+			n = i
+		case int:
+			n = int64(v)
+		case int64:
+			n = v
+		default:
+			return nil, RuleType, "expected an integer"
+		}
+		if def.Min != nil && n < *def.Min {
+			return nil, RuleMin, fmt.Sprintf("less than %d", *def.Min)
+		}
+		if def.Max != nil && n > *def.Max {
+			return nil, RuleMax, fmt.Sprintf("greater than %d", *def.Max)
+		}
+		return n, "", ""
+	case AttributeBool:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, RuleType, "expected a boolean"
+		}
+		return b, "", ""
+	case AttributeEnum:
+		s, ok := value.(string)
+		if !ok {
+			return nil, RuleType, "expected a string"
+		}
+		for _, v := range def.Values {
+			if strings.EqualFold(s, v) {
+				return v, "", ""
+			}
+		}
+		return nil, RuleEnum, fmt.Sprintf("must be one of %s",
+			strings.Join(def.Values, ", "))
+	case AttributeMoney:
+		var d USD
+		switch v := value.(type) {
+		case USD:
+			d = v
+		case string:
+			if err := d.UnmarshalJSON([]byte(`"` + v + `"`)); err != nil {
+				return nil, RuleType, "expected a USD amount"
+			}
+		default:
+			return nil, RuleType, "expected a USD amount"
+		}
+		if def.MinPrice != nil && d < *def.MinPrice {
+			return nil, RuleMin, fmt.Sprintf("less than %s", *def.MinPrice)
+		}
+		if def.MaxPrice != nil && d > *def.MaxPrice {
+			return nil, RuleMax, fmt.Sprintf("greater than %s", *def.MaxPrice)
+		}
+		return d, "", ""
+	}
+	return nil, RuleType, fmt.Sprintf("unsupported type '%s'", def.Type)
+}
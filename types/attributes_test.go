@@ -0,0 +1,160 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAttributeDefConversion(t *testing.T) {
+	min, max := int64(10), int64(1)
+	for i, v := range []struct {
+		input   AttributeDef
+		expStr  string
+		expName string
+	}{
+		{
+			input:   AttributeDef{Name: "Country_Of_Origin", Type: AttributeString},
+			expName: "country_of_origin",
+		},
+		{
+			input:   AttributeDef{Name: "grade", Type: AttributeEnum, Values: []string{"A", "B"}},
+			expName: "grade",
+		},
+		{
+			input:  AttributeDef{Name: "grade", Type: AttributeEnum},
+			expStr: "enum must have at least one value",
+		},
+		{
+			input:  AttributeDef{Name: "plu", Type: AttributeInt, Min: &min, Max: &max},
+			expStr: "min is greater than max",
+		},
+		{
+			input:  AttributeDef{Name: "organic", Type: AttributeBool, MaxLength: 3},
+			expStr: "max_length and pattern only apply to string attributes",
+		},
+		{
+			input:  AttributeDef{Name: "_bad", Type: "float"},
+			expStr: "invalid attribute name: '_bad', invalid attribute type: 'float'",
+		},
+		{
+			input:  AttributeDef{Name: "notes", Type: AttributeString, Pattern: "("},
+			expStr: "invalid pattern: '('",
+		},
+	} {
+		def := v.input
+		str := ValidateAndConvertAttributeDef(&def)
+		if str != v.expStr {
+			t.Fatalf("(%d) Unexpected problem string: '%s'", i, str)
+		}
+		if str == "" && def.Name != v.expName {
+			t.Fatalf("(%d) Unexpected name: '%s'", i, def.Name)
+		}
+	}
+}
+
+func TestAttributeConversion(t *testing.T) {
+	min, max := int64(3000), int64(99999)
+	maxPrice := USD(500)
+	schema := NewAttributeSchema([]AttributeDef{
+		{Name: "country_of_origin", Type: AttributeString, MaxLength: 20},
+		{Name: "plu", Type: AttributeInt, Min: &min, Max: &max},
+		{Name: "organic", Type: AttributeBool, Required: true},
+		{Name: "grade", Type: AttributeEnum, Values: []string{"Extra", "Fancy"}},
+		{Name: "deposit", Type: AttributeMoney, MaxPrice: &maxPrice},
+		{Name: "lot", Type: AttributeString, Pattern: `^[A-Z]{2}[0-9]+$`},
+	})
+	if schema["lot"].patternExp == nil {
+		t.Fatalf("the pattern wasn't compiled")
+	}
+
+	for i, v := range []struct {
+		input    string
+		expStr   string
+		expAttrs map[string]interface{}
+	}{
+		{
+			input: `{"organic": true, "PLU": 4131, "grade": "fancy",
+				"deposit": "0.5", "country_of_origin": "Canada"}`,
+			expAttrs: map[string]interface{}{
+				"organic":           true,
+				"plu":               int64(4131),
+				"grade":             "Fancy",
+				"deposit":           USD(50),
+				"country_of_origin": "Canada",
+			},
+		},
+		{
+			input:  `{"plu": 4131}`,
+			expStr: "missing attribute: 'organic'",
+		},
+		{
+			input: `{"organic": "yes", "plu": 41.5, "grade": "Choice",
+				"deposit": "$6", "color": "red"}`,
+			expStr: "unknown attribute: 'color', " +
+				"invalid attribute 'deposit': greater than $5.00, " +
+				"invalid attribute 'grade': must be one of Extra, Fancy, " +
+				"invalid attribute 'organic': expected a boolean, " +
+				"invalid attribute 'plu': expected an integer",
+		},
+		{
+			input:  `{"organic": false, "plu": 12}`,
+			expStr: "invalid attribute 'plu': less than 3000",
+		},
+		{
+			input:    `{"organic": false, "lot": "AB12"}`,
+			expAttrs: map[string]interface{}{"organic": false, "lot": "AB12"},
+		},
+		{
+			input:  `{"organic": false, "lot": "ab12"}`,
+			expStr: "invalid attribute 'lot': does not match pattern '^[A-Z]{2}[0-9]+$'",
+		},
+	} {
+		var attrs map[string]interface{}
+		if err := json.Unmarshal([]byte(v.input), &attrs); err != nil {
+			t.Fatal(err)
+		}
+		res, str := ValidateAndConvertAttributes(attrs, schema)
+		if str != v.expStr {
+			t.Fatalf("(%d) Unexpected problem string: '%s'", i, str)
+		}
+		if v.expAttrs != nil && !reflect.DeepEqual(res, v.expAttrs) {
+			t.Fatalf("(%d) Unexpected attributes: %+v", i, res)
+		}
+	}
+}
+
+func TestProduceWithSchemaConversion(t *testing.T) {
+	schema := NewAttributeSchema([]AttributeDef{
+		{Name: "organic", Type: AttributeBool, Required: true},
+	})
+	item := dfltProduceBadName
+	errs := ValidateAndConvertProduceWithSchema(&item, schema)
+	if !reflect.DeepEqual(errs, FieldErrors{
+		{Field: "name", Value: "Lettuce+Cukes", Rule: RuleNamePattern,
+			Message: "invalid name: 'Lettuce+Cukes'"},
+		{Field: "attributes.organic", Rule: RuleRequired,
+			Message: "missing attribute: 'organic'"},
+	}) {
+		t.Fatalf("Unexpected problems: %+v", errs)
+	}
+
+	item = dfltLCProduce
+	item.Attributes = map[string]interface{}{"organic": true}
+	if errs = ValidateAndConvertProduceWithSchema(&item, schema); errs != nil {
+		t.Fatalf("Unexpected problems: '%s'", errs)
+	}
+	if item.Name != "Lettuce" || item.Attributes["organic"] != true {
+		t.Fatalf("Bad produce conversion: '%+v'", item)
+	}
+
+	// The money attributes keep the USD string format in JSON.
+	item.Attributes = map[string]interface{}{"deposit": USD(25)}
+	b, err := json.Marshal(item.Attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"deposit":"$0.25"}` {
+		t.Fatalf("Unexpected JSON: %s", string(b))
+	}
+}
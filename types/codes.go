@@ -0,0 +1,303 @@
+package types
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CodeFormat is a grammar that produce codes may follow, such as the
+// hyphenated quartets or a UPC-A barcode.  The set of formats that are
+// accepted is configured with SetCodeFormats, so new grammars can be
+// plugged in by registering them with RegisterCodeFormat.
+type CodeFormat interface {
+	// Name returns the name used to select the format in configuration.
+	Name() string
+
+	// ValidateAndConvert returns the code in canonical form if it conforms
+	// to the format, or an error describing the rule that failed.
+	ValidateAndConvert(code string) (string, error)
+}
+
+// CodeGenerator is implemented by the code formats that can generate new,
+// random codes, for items that are added without one.
+type CodeGenerator interface {
+	// GenerateCode returns a new random code in canonical form.
+	GenerateCode() (string, error)
+}
+
+// CodePatterner is implemented by the code formats that can describe the
+// codes they accept with a regular expression, so the grammar can be
+// published in the API description.  The pattern may accept codes the
+// format rejects, such as those with a bad check digit, but not the
+// reverse.
+type CodePatterner interface {
+	// Pattern returns the regular expression the codes must match.
+	Pattern() string
+}
+
+// The names of the built-in code formats.
+const (
+	CodeFormatQuartet = "quartet"
+	CodeFormatPLU     = "plu"
+	CodeFormatUPCA    = "upc-a"
+	CodeFormatEAN13   = "ean-13"
+)
+
+var (
+	// All of the known formats, keyed by name, and the ones currently
+	// accepted, in the order they are tried.  Like the name policy, the
+	// accepted formats are process-wide and are set up at startup.
+	codeLock     sync.RWMutex
+	codeRegistry = map[string]CodeFormat{
+		CodeFormatQuartet: quartetFormat{},
+		CodeFormatPLU:     pluFormat{},
+		CodeFormatUPCA:    gtinFormat{name: CodeFormatUPCA, length: 12},
+		CodeFormatEAN13:   gtinFormat{name: CodeFormatEAN13, length: 13},
+	}
+	codeFormats = []CodeFormat{quartetFormat{}}
+)
+
+// RegisterCodeFormat makes a code format available to SetCodeFormats.
+// Registering a format with the name of an existing one replaces it.
+func RegisterCodeFormat(f CodeFormat) {
+	codeLock.Lock()
+	defer codeLock.Unlock()
+	codeRegistry[f.Name()] = f
+}
+
+// SetCodeFormats sets the formats that produce codes are accepted in, by
+// name.  A code is valid if it conforms to any of them, and formats are
+// tried in the order given.  At least one format must be specified.
+func SetCodeFormats(names []string) error {
+	if len(names) == 0 {
+		return errors.New("at least one code format must be specified")
+	}
+
+	codeLock.Lock()
+	defer codeLock.Unlock()
+	formats := make([]CodeFormat, 0, len(names))
+	for _, v := range names {
+		f, ok := codeRegistry[strings.ToLower(v)]
+		if !ok {
+			known := make([]string, 0, len(codeRegistry))
+			for k := range codeRegistry {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown code format '%s', expected one of: %s",
+				v, strings.Join(known, ", "))
+		}
+		formats = append(formats, f)
+	}
+	codeFormats = formats
+	return nil
+}
+
+// CodeFormats returns the names of the formats that produce codes are
+// currently accepted in.
+func CodeFormats() []string {
+	codeLock.RLock()
+	defer codeLock.RUnlock()
+	res := make([]string, len(codeFormats))
+	for i, v := range codeFormats {
+		res[i] = v.Name()
+	}
+	return res
+}
+
+// NewProduceCode generates a random produce code using the first of the
+// configured formats that supports code generation.  Note the code is not
+// guaranteed to be unused, so it's up to the store to check that.
+func NewProduceCode() (string, error) {
+	for _, f := range currentCodeFormats() {
+		if gen, ok := f.(CodeGenerator); ok {
+			return gen.GenerateCode()
+		}
+	}
+	return "", errors.New("none of the configured code formats can " +
+		"generate codes, so a code must be specified")
+}
+
+// CodePattern returns a regular expression matching the codes accepted by
+// any of the configured formats, or an empty string if any of them can't
+// describe their codes with a pattern.
+func CodePattern() string {
+	formats := currentCodeFormats()
+	patterns := make([]string, len(formats))
+	for i, f := range formats {
+		cp, ok := f.(CodePatterner)
+		if !ok {
+			return ""
+		}
+		patterns[i] = cp.Pattern()
+	}
+	return strings.Join(patterns, "|")
+}
+
+func currentCodeFormats() []CodeFormat {
+	codeLock.RLock()
+	defer codeLock.RUnlock()
+	return codeFormats
+}
+
+// quartetFormat is the original produce code format: four hyphen-separated
+// quartets of alphanumerics, canonicalized to upper case.
+type quartetFormat struct{}
+
+// Name returns the name of the format.
+func (quartetFormat) Name() string {
+	return CodeFormatQuartet
+}
+
+// ValidateAndConvert validates and canonicalizes a quartet code.
+func (quartetFormat) ValidateAndConvert(code string) (string, error) {
+	if !codeExp.MatchString(code) {
+		return code, errors.New(
+			"expected four hyphen-separated groups of four letters or digits")
+	}
+	return strings.ToUpper(code), nil
+}
+
+// Pattern returns the regular expression for quartet codes.
+func (quartetFormat) Pattern() string {
+	return codeExp.String()
+}
+
+// GenerateCode returns four random quartets in canonical form, e.g.
+// "TQ4C-VV6T-75ZX-1RMR".  With 36 possible characters, there are about
+// 8e24 possible codes, so collisions are very unlikely.
+func (quartetFormat) GenerateCode() (string, error) {
+	const alnum = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	// Reject the random bytes above the largest multiple of the alphabet
+	// size, so every character is equally likely.
+	const limit = 256 - 256%len(alnum)
+	res := make([]byte, 0, 19)
+	buf := make([]byte, 32)
+	for len(res) < cap(res) {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if len(res) == cap(res) {
+				break
+			}
+			if len(res)%5 == 4 {
+				res = append(res, '-')
+			}
+			if int(b) < limit {
+				res = append(res, alnum[int(b)%len(alnum)])
+			}
+		}
+	}
+	return string(res), nil
+}
+
+// pluFormat is the IFPS price look-up code format.  Conventional PLUs are
+// four digits in the range 3000-4999, organic items are prefixed with a 9
+// and the newer five digit codes are in the range 83000-84999.  PLUs have
+// no check digit.  Spaces and hyphens are removed in canonical form.
+type pluFormat struct{}
+
+// Name returns the name of the format.
+func (pluFormat) Name() string {
+	return CodeFormatPLU
+}
+
+// Pattern returns a regular expression for 4 or 5 digits, which may be
+// separated by spaces and hyphens.  The ranges aren't checked.
+func (pluFormat) Pattern() string {
+	return `^[ -]*([0-9][ -]*){4,5}$`
+}
+
+// ValidateAndConvert validates and canonicalizes a PLU code.
+func (pluFormat) ValidateAndConvert(code string) (string, error) {
+	digits, err := stripDigits(code)
+	if err != nil {
+		return code, err
+	}
+	switch len(digits) {
+	case 4:
+		if digits < "3000" || digits > "4999" {
+			return code, errors.New("4-digit code must be in the range 3000-4999")
+		}
+	case 5:
+		organic := digits[0] == '9' && digits[1:] >= "3000" && digits[1:] <= "4999"
+		if !organic && (digits < "83000" || digits > "84999") {
+			return code, errors.New("5-digit code must be a 4-digit code " +
+				"with the organic prefix 9, or in the range 83000-84999")
+		}
+	default:
+		return code, errors.New("expected 4 or 5 digits")
+	}
+	return digits, nil
+}
+
+// gtinFormat is a GS1 barcode number with a trailing check digit, such as
+// a 12-digit UPC-A or a 13-digit EAN-13.  Spaces and hyphens are removed
+// in canonical form.
+type gtinFormat struct {
+	name   string
+	length int
+}
+
+// Name returns the name of the format.
+func (gf gtinFormat) Name() string {
+	return gf.name
+}
+
+// Pattern returns a regular expression for the number of digits in the
+// barcode, which may be separated by spaces and hyphens.  The check digit
+// isn't checked.
+func (gf gtinFormat) Pattern() string {
+	return fmt.Sprintf(`^[ -]*([0-9][ -]*){%d}$`, gf.length)
+}
+
+// ValidateAndConvert validates the length and check digit of a barcode
+// number and canonicalizes it.
+func (gf gtinFormat) ValidateAndConvert(code string) (string, error) {
+	digits, err := stripDigits(code)
+	if err != nil {
+		return code, err
+	}
+	if len(digits) != gf.length {
+		return code, fmt.Errorf("expected %d digits", gf.length)
+	}
+
+	// Working back from the digit before the check digit, the digits
+	// are weighted 3, 1, 3, 1 and so on.
+	sum := 0
+	for i := len(digits) - 2; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (len(digits)-2-i)%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	check := byte((10-sum%10)%10) + '0'
+	if digits[len(digits)-1] != check {
+		return code, fmt.Errorf("check digit is %c, expected %c",
+			digits[len(digits)-1], check)
+	}
+	return digits, nil
+}
+
+// stripDigits removes the spaces and hyphens from a numeric code, and
+// ensures what remains is all digits.
+func stripDigits(code string) (string, error) {
+	var sb strings.Builder
+	for _, r := range code {
+		switch {
+		case r == ' ' || r == '-':
+		case r >= '0' && r <= '9':
+			sb.WriteRune(r)
+		default:
+			return "", errors.New("expected only digits")
+		}
+	}
+	return sb.String(), nil
+}
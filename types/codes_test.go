@@ -0,0 +1,202 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestCodeFormats(t *testing.T) {
+	defer SetCodeFormats([]string{CodeFormatQuartet})
+
+	for i, v := range []struct {
+		formats  []string
+		input    string
+		expected string
+		expStr   string
+	}{
+		{
+			formats:  []string{CodeFormatPLU},
+			input:    "4011",
+			expected: "4011",
+		},
+		{
+			formats:  []string{CodeFormatPLU},
+			input:    "9-4011",
+			expected: "94011",
+		},
+		{
+			formats:  []string{CodeFormatPLU},
+			input:    "83001",
+			expected: "83001",
+		},
+		{
+			formats: []string{CodeFormatPLU},
+			input:   "2011",
+			expStr:  "invalid code: '2011' (plu: 4-digit code must be in the range 3000-4999)",
+		},
+		{
+			formats: []string{CodeFormatPLU},
+			input:   "54011",
+			expStr: "invalid code: '54011' (plu: 5-digit code must be a 4-digit " +
+				"code with the organic prefix 9, or in the range 83000-84999)",
+		},
+		{
+			formats: []string{CodeFormatPLU},
+			input:   "401",
+			expStr:  "invalid code: '401' (plu: expected 4 or 5 digits)",
+		},
+		{
+			formats:  []string{CodeFormatUPCA},
+			input:    "0 36000 29145 2",
+			expected: "036000291452",
+		},
+		{
+			formats: []string{CodeFormatUPCA},
+			input:   "036000291453",
+			expStr:  "invalid code: '036000291453' (upc-a: check digit is 3, expected 2)",
+		},
+		{
+			formats: []string{CodeFormatUPCA},
+			input:   "03600029145A",
+			expStr:  "invalid code: '03600029145A' (upc-a: expected only digits)",
+		},
+		{
+			formats:  []string{CodeFormatEAN13},
+			input:    "400-6381-333931",
+			expected: "4006381333931",
+		},
+		{
+			formats: []string{CodeFormatEAN13},
+			input:   "4006381333932",
+			expStr:  "invalid code: '4006381333932' (ean-13: check digit is 2, expected 1)",
+		},
+		{
+			formats: []string{CodeFormatEAN13},
+			input:   "036000291452",
+			expStr:  "invalid code: '036000291452' (ean-13: expected 13 digits)",
+		},
+		{
+			formats:  []string{CodeFormatQuartet, CodeFormatPLU, CodeFormatUPCA},
+			input:    "tq4c-vv6t-75zx-1rmr",
+			expected: "TQ4C-VV6T-75ZX-1RMR",
+		},
+		{
+			formats:  []string{CodeFormatQuartet, CodeFormatPLU, CodeFormatUPCA},
+			input:    "036000291452",
+			expected: "036000291452",
+		},
+		{
+			formats: []string{CodeFormatQuartet, CodeFormatPLU},
+			input:   "12345",
+			expStr: "invalid code: '12345' (" + quartetRule[1:len(quartetRule)-1] +
+				"; plu: 5-digit code must be a 4-digit code with the organic " +
+				"prefix 9, or in the range 83000-84999)",
+		},
+	} {
+		if err := SetCodeFormats(v.formats); err != nil {
+			t.Fatalf("(%d) Unexpected format error: %v", i, err)
+		}
+		str, msg := ValidateAndConvertProduceCode(v.input)
+		if msg != v.expStr {
+			t.Fatalf("(%d) Unexpected problem string: '%s'", i, msg)
+		}
+		if msg == "" && str != v.expected {
+			t.Fatalf("(%d) Unexpected converted string: '%s'", i, str)
+		}
+	}
+}
+
+type fixedFormat struct{}
+
+func (fixedFormat) Name() string {
+	return "fixed"
+}
+
+func (fixedFormat) ValidateAndConvert(code string) (string, error) {
+	return "FIXED", nil
+}
+
+func TestRegisterCodeFormat(t *testing.T) {
+	defer SetCodeFormats([]string{CodeFormatQuartet})
+
+	err := SetCodeFormats([]string{"fixed"})
+	if err == nil || err.Error() != "unknown code format 'fixed', expected "+
+		"one of: ean-13, plu, quartet, upc-a" {
+		t.Fatalf("Unexpected format error: %v", err)
+	}
+	if err = SetCodeFormats(nil); err == nil {
+		t.Fatalf("Expected an error for no formats")
+	}
+
+	RegisterCodeFormat(fixedFormat{})
+	if err = SetCodeFormats([]string{"FIXED"}); err != nil {
+		t.Fatalf("Unexpected format error: %v", err)
+	}
+	if str, msg := ValidateAndConvertProduceCode("anything"); str != "FIXED" ||
+		msg != "" {
+		t.Fatalf("Unexpected conversion: '%s', '%s'", str, msg)
+	}
+	if f := CodeFormats(); len(f) != 1 || f[0] != "fixed" {
+		t.Fatalf("Unexpected formats: %v", f)
+	}
+}
+
+func TestNewProduceCode(t *testing.T) {
+	defer SetCodeFormats([]string{CodeFormatQuartet})
+
+	if err := SetCodeFormats([]string{CodeFormatPLU, CodeFormatQuartet}); err != nil {
+		t.Fatal(err)
+	}
+	codes := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := NewProduceCode()
+		if err != nil {
+			t.Fatalf("(%d) Unexpected error: %v", i, err)
+		}
+		if str, msg := ValidateAndConvertProduceCode(code); str != code || msg != "" {
+			t.Fatalf("(%d) Generated code is not canonical: '%s', '%s'", i, code, msg)
+		}
+		if codes[code] {
+			t.Fatalf("(%d) Duplicate code generated: '%s'", i, code)
+		}
+		codes[code] = true
+	}
+
+	if err := SetCodeFormats([]string{CodeFormatPLU, CodeFormatUPCA}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewProduceCode(); err == nil {
+		t.Fatalf("Expected an error when no format generates codes")
+	}
+}
+
+func TestCodePattern(t *testing.T) {
+	defer SetCodeFormats([]string{CodeFormatQuartet})
+
+	for i, v := range []struct {
+		formats  []string
+		expected string
+	}{
+		{
+			formats:  []string{CodeFormatQuartet},
+			expected: `^([A-Za-z0-9]{4}-){3}([A-Za-z0-9]){4}$`,
+		},
+		{
+			formats: []string{CodeFormatPLU, CodeFormatEAN13},
+			expected: `^[ -]*([0-9][ -]*){4,5}$|` +
+				`^[ -]*([0-9][ -]*){13}$`,
+		},
+		{
+			// The fixed format has no pattern, so there can't be one at all.
+			formats:  []string{CodeFormatQuartet, "fixed"},
+			expected: "",
+		},
+	} {
+		RegisterCodeFormat(fixedFormat{})
+		if err := SetCodeFormats(v.formats); err != nil {
+			t.Fatalf("(%d) Unexpected format error: %v", i, err)
+		}
+		if p := CodePattern(); p != v.expected {
+			t.Fatalf("(%d) Unexpected pattern: '%s'", i, p)
+		}
+	}
+}
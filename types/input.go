@@ -0,0 +1,108 @@
+package types
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// produceFields are the names of the fields of a produce item in JSON.
+var produceFields = []string{"code", "name", "unit_price", "category", "tags",
+	"attributes", "names"}
+
+// ProduceInput is a produce item as decoded from a request.  The unit
+// price is decoded apart from the other fields, rather than by the USD
+// unmarshaller, so a bad price doesn't fail the decoding of the whole
+// request, and the names of any fields that aren't known are kept, so
+// both can be reported along with the other problems with the item.
+type ProduceInput struct {
+	Produce
+
+	priceErr *FieldError
+	unknown  []string
+}
+
+// Decode returns the item, along with the problem with its unit price, if
+// it couldn't be decoded, in which case the price is left at zero, and if
+// unknown fields are rejected, a problem for each of them.  It returns
+// nil if there are no problems, which doesn't mean the item is valid, as
+// the rest of its fields are yet to be validated.
+func (pi ProduceInput) Decode(rejectUnknown bool) (Produce, FieldErrors) {
+	var problems FieldErrors
+	if pi.priceErr != nil {
+		problems = append(problems, *pi.priceErr)
+	}
+	if rejectUnknown {
+		for _, v := range pi.unknown {
+			problems = append(problems, FieldError{Field: v,
+				Rule: RuleUnknownField, Message: fmt.Sprintf("unknown field: '%s'", v)})
+		}
+	}
+	return pi.Produce, problems
+}
+
+// UnmarshalJSON decodes the item, with the unit price decoded on its own.
+// The price must be a string, as for USD.
+func (pi *ProduceInput) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	// The price in the outer struct hides that of the item, so it is left
+	// alone, and plain has none of the item's methods.
+	type plain Produce
+	var v struct {
+		plain
+		UnitPrice json.RawMessage `json:"unit_price"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*pi = ProduceInput{Produce: Produce(v.plain)}
+
+	switch raw := string(v.UnitPrice); {
+	case raw == "" || raw == "null":
+	case strings.HasPrefix(raw, `"`):
+		var text string
+		if err := json.Unmarshal(v.UnitPrice, &text); err != nil {
+			return err
+		}
+		pi.UnitPrice, pi.priceErr = ParseUnitPrice(text)
+	default:
+		pi.priceErr = invalidPrice(raw)
+	}
+
+	// JSON field names are matched case insensitively.
+	for k := range fields {
+		known := false
+		for _, f := range produceFields {
+			if strings.EqualFold(k, f) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			pi.unknown = append(pi.unknown, k)
+		}
+	}
+	sort.Strings(pi.unknown)
+	return nil
+}
+
+// UnmarshalXML decodes the item from XML, as Produce does, but with the
+// unit price decoded on its own.
+func (pi *ProduceInput) UnmarshalXML(d *xml.Decoder,
+	start xml.StartElement) error {
+	var xp xmlProduce
+	if err := d.DecodeElement(&xp, &start); err != nil {
+		return err
+	}
+	*pi = ProduceInput{Produce: xp.produce()}
+	if xp.UnitPrice != "" {
+		pi.UnitPrice, pi.priceErr = ParseUnitPrice(xp.UnitPrice)
+	}
+	return nil
+}
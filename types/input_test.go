@@ -0,0 +1,97 @@
+package types
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestProduceInputJSON(t *testing.T) {
+	for i, v := range []struct {
+		input         string
+		rejectUnknown bool
+		expProd       Produce
+		expErrs       FieldErrors
+	}{
+		{
+			input:   `{"code": "A12T-4GH7-QPL9-3N4M", "name": "Lettuce", "unit_price": "$3.46"}`,
+			expProd: dfltProduce,
+		},
+		{
+			// A bad price doesn't stop the rest from being decoded.
+			input:   `{"code": "A12T-4GH7-QPL9-3N4M", "name": "Lettuce", "unit_price": "cheap"}`,
+			expProd: Produce{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce"},
+			expErrs: FieldErrors{{Field: "unit_price", Value: "cheap",
+				Rule: RulePriceFormat, Message: "invalid unit price: 'cheap'"}},
+		},
+		{
+			input:   `{"name": "Lettuce", "unit_price": 3.46}`,
+			expProd: Produce{Name: "Lettuce"},
+			expErrs: FieldErrors{{Field: "unit_price", Value: "3.46",
+				Rule: RulePriceFormat, Message: "invalid unit price: '3.46'"}},
+		},
+		{
+			input:   `{"name": "Lettuce", "unit_price": ""}`,
+			expProd: Produce{Name: "Lettuce"},
+			expErrs: FieldErrors{{Field: "unit_price", Rule: RulePriceFormat,
+				Message: "invalid unit price: ''"}},
+		},
+		{
+			// Unknown fields are only reported if they are rejected, and
+			// the known ones match case insensitively.
+			input:   `{"Name": "Lettuce", "unit_price": null, "colour": "green"}`,
+			expProd: Produce{Name: "Lettuce"},
+		},
+		{
+			input: `{"Name": "Lettuce", "unit_price": null, "colour": "green", ` +
+				`"aisle": 3}`,
+			rejectUnknown: true,
+			expProd:       Produce{Name: "Lettuce"},
+			expErrs: FieldErrors{
+				{Field: "aisle", Rule: RuleUnknownField,
+					Message: "unknown field: 'aisle'"},
+				{Field: "colour", Rule: RuleUnknownField,
+					Message: "unknown field: 'colour'"},
+			},
+		},
+	} {
+		var pi ProduceInput
+		if err := json.Unmarshal([]byte(v.input), &pi); err != nil {
+			t.Fatalf("(%d) unmarshal failed: %v", i, err)
+		}
+		item, errs := pi.Decode(v.rejectUnknown)
+		if !reflect.DeepEqual(item, v.expProd) {
+			t.Fatalf("(%d) unexpected item: %+v", i, item)
+		}
+		if !reflect.DeepEqual(errs, v.expErrs) {
+			t.Fatalf("(%d) unexpected problems: %+v", i, errs)
+		}
+	}
+
+	// Anything but an object is still an error.
+	var pi ProduceInput
+	if err := json.Unmarshal([]byte(`["Lettuce"]`), &pi); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestProduceInputXML(t *testing.T) {
+	var pi ProduceInput
+	err := xml.Unmarshal([]byte(`<produce><name>Lettuce</name>`+
+		`<unit_price>cheap</unit_price><tags><tag>Leafy</tag></tags></produce>`),
+		&pi)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	item, errs := pi.Decode(true)
+	if !reflect.DeepEqual(item, Produce{Name: "Lettuce",
+		Tags: []string{"Leafy"}}) {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+	if !reflect.DeepEqual(errs, FieldErrors{{Field: "unit_price",
+		Value: "cheap", Rule: RulePriceFormat,
+		Message: "invalid unit price: 'cheap'"}}) {
+		t.Fatalf("unexpected problems: %+v", errs)
+	}
+}
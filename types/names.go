@@ -0,0 +1,183 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NameCase selects how the words of a name are cased in canonical form.
+type NameCase string
+
+// The supported name casing modes.  Title case capitalizes the first
+// letter of each word and lower cases the rest, so "grEen pePper" becomes
+// "Green Pepper".  Preserve leaves the casing as it was given, and lower
+// converts the whole name to lower case.
+const (
+	NameCaseTitle    NameCase = "title"
+	NameCasePreserve NameCase = "preserve"
+	NameCaseLower    NameCase = "lower"
+)
+
+// NamePolicy defines how names are canonicalized.  This applies to
+// produce names, as well as to everything validated like them, such as
+// localized names, categories and tags.
+//
+// The locale, a BCP 47 language tag, selects language-specific casing
+// rules: Turkish and Azeri map between dotted and dotless i, and Dutch
+// title cases a leading "ij" digraph as "IJ".  The exceptions are words
+// that always keep the casing given in the list, regardless of the mode,
+// such as "McIntosh".  If normalize is set, names are converted to Unicode
+// NFC before being validated, so that decomposed accents are accepted.
+type NamePolicy struct {
+	Case       NameCase
+	Locale     string
+	Exceptions []string
+	Normalize  bool
+}
+
+// DefaultNamePolicy is the policy in effect until SetNamePolicy is called.
+var DefaultNamePolicy = NamePolicy{Case: NameCaseTitle, Normalize: true}
+
+// namePolicy is a NamePolicy prepared for use by ValidateAndConvertName.
+type namePolicy struct {
+	NamePolicy
+	special    unicode.SpecialCase
+	dutch      bool
+	exceptions map[string]string
+}
+
+var (
+	// Regular expression to match a single exception word: (Unicode)
+	// alphanumerics, without any white space.
+	exceptionExp = regexp.MustCompile(`^[\p{L}\p{N}]+$`)
+
+	// The name policy is process-wide, so the service, the api layer and
+	// the other validators all agree on the canonical form of a name.
+	policyLock sync.RWMutex
+	policy     = mustCompileNamePolicy(DefaultNamePolicy)
+)
+
+// SetNamePolicy validates the policy and makes it the one used to
+// canonicalize names.  It is meant to be called once at startup, before
+// any names are stored.
+func SetNamePolicy(p NamePolicy) error {
+	np, err := compileNamePolicy(p)
+	if err != nil {
+		return err
+	}
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	policy = np
+	return nil
+}
+
+// CurrentNamePolicy returns the name policy in effect.
+func CurrentNamePolicy() NamePolicy {
+	return currentNamePolicy().NamePolicy
+}
+
+func currentNamePolicy() *namePolicy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	return policy
+}
+
+func mustCompileNamePolicy(p NamePolicy) *namePolicy {
+	np, err := compileNamePolicy(p)
+	if err != nil {
+		panic(err)
+	}
+	return np
+}
+
+// compileNamePolicy checks the policy settings and sets up the casing
+// rules and exception lookup table.
+func compileNamePolicy(p NamePolicy) (*namePolicy, error) {
+	np := namePolicy{NamePolicy: p}
+	switch p.Case {
+	case NameCaseTitle, NameCasePreserve, NameCaseLower:
+	case "":
+		np.Case = NameCaseTitle
+	default:
+		return nil, fmt.Errorf("invalid name case: '%s'", p.Case)
+	}
+
+	if p.Locale != "" {
+		tag, ok := ValidateAndConvertLanguageTag(p.Locale)
+		if !ok {
+			return nil, fmt.Errorf("invalid name locale: '%s'", p.Locale)
+		}
+		np.Locale = tag
+		switch strings.Split(tag, "-")[0] {
+		case "tr":
+			np.special = unicode.TurkishCase
+		case "az":
+			np.special = unicode.AzeriCase
+		case "nl":
+			np.dutch = true
+		}
+	}
+
+	np.exceptions = make(map[string]string, len(p.Exceptions))
+	for _, v := range p.Exceptions {
+		if p.Normalize {
+			v = norm.NFC.String(v)
+		}
+		if !exceptionExp.MatchString(v) {
+			return nil, fmt.Errorf("invalid name exception: '%s'", v)
+		}
+		np.exceptions[strings.ToLowerSpecial(np.special, v)] = v
+	}
+	return &np, nil
+}
+
+// convert puts a valid name in canonical form, word by word, keeping the
+// white space between the words as is.
+func (np *namePolicy) convert(name string) string {
+	runes := []rune(name)
+	res := make([]rune, 0, len(runes))
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			res = append(res, runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && !unicode.IsSpace(runes[j]) {
+			j++
+		}
+		res = append(res, []rune(np.convertWord(string(runes[i:j])))...)
+		i = j
+	}
+	return string(res)
+}
+
+// convertWord puts a single word in canonical form.
+func (np *namePolicy) convertWord(word string) string {
+	lower := strings.ToLowerSpecial(np.special, word)
+	if exc, ok := np.exceptions[lower]; ok {
+		return exc
+	}
+
+	switch np.Case {
+	case NameCasePreserve:
+		return word
+	case NameCaseLower:
+		return lower
+	}
+
+	res := []rune(lower)
+	n := 1
+	if np.dutch && len(res) > 1 && res[0] == 'i' && res[1] == 'j' {
+		n = 2
+	}
+	for i := 0; i < n; i++ {
+		res[i] = np.special.ToTitle(res[i])
+	}
+	return string(res)
+}
@@ -0,0 +1,134 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestNamePolicy(t *testing.T) {
+	defer SetNamePolicy(DefaultNamePolicy)
+
+	for i, v := range []struct {
+		policy   NamePolicy
+		input    string
+		valid    bool
+		expected string
+	}{
+		{
+			policy:   DefaultNamePolicy,
+			input:    "mcintosh apple",
+			valid:    true,
+			expected: "Mcintosh Apple",
+		},
+		{
+			policy: NamePolicy{Case: NameCaseTitle,
+				Exceptions: []string{"McIntosh", "choy"}},
+			input:    "MCINTOSH apple",
+			valid:    true,
+			expected: "McIntosh Apple",
+		},
+		{
+			policy: NamePolicy{Case: NameCaseTitle,
+				Exceptions: []string{"McIntosh", "choy"}},
+			input:    "bok CHOY",
+			valid:    true,
+			expected: "Bok choy",
+		},
+		{
+			policy:   NamePolicy{Case: NameCasePreserve},
+			input:    "Bok choy",
+			valid:    true,
+			expected: "Bok choy",
+		},
+		{
+			policy:   NamePolicy{Case: NameCaseLower},
+			input:    "Green  PEPPER",
+			valid:    true,
+			expected: "green  pepper",
+		},
+		{
+			policy:   NamePolicy{Case: NameCaseTitle, Locale: "tr"},
+			input:    "incir",
+			valid:    true,
+			expected: "İncir",
+		},
+		{
+			policy:   NamePolicy{Case: NameCaseLower, Locale: "tr-TR"},
+			input:    "ISPANAK",
+			valid:    true,
+			expected: "ıspanak",
+		},
+		{
+			policy:   NamePolicy{Case: NameCaseTitle},
+			input:    "incir",
+			valid:    true,
+			expected: "Incir",
+		},
+		{
+			policy:   NamePolicy{Case: NameCaseTitle, Locale: "nl"},
+			input:    "ijsbergsla",
+			valid:    true,
+			expected: "IJsbergsla",
+		},
+		{
+			policy:   NamePolicy{Case: NameCaseTitle, Normalize: true},
+			input:    "jalapen\u0303o",
+			valid:    true,
+			expected: "Jalape\u00f1o",
+		},
+		{
+			policy:   NamePolicy{Case: NameCaseTitle},
+			input:    "jalapen\u0303o",
+			valid:    false,
+			expected: "jalapen\u0303o",
+		},
+		{
+			policy:   NamePolicy{Case: NameCaseTitle, Normalize: true},
+			input:    " jalapen\u0303o",
+			valid:    false,
+			expected: " jalapen\u0303o",
+		},
+	} {
+		if err := SetNamePolicy(v.policy); err != nil {
+			t.Fatalf("(%d) Unexpected policy error: %v", i, err)
+		}
+		str, valid := ValidateAndConvertName(v.input)
+		if v.valid != valid {
+			t.Fatalf("(%d) Unexpected validation result", i)
+		}
+		if str != v.expected {
+			t.Fatalf("(%d) Unexpected converted string: '%s'", i, str)
+		}
+	}
+}
+
+func TestInvalidNamePolicy(t *testing.T) {
+	defer SetNamePolicy(DefaultNamePolicy)
+
+	for i, v := range []struct {
+		policy NamePolicy
+		expErr string
+	}{
+		{
+			policy: NamePolicy{Case: "upper"},
+			expErr: "invalid name case: 'upper'",
+		},
+		{
+			policy: NamePolicy{Locale: "turkish"},
+			expErr: "invalid name locale: 'turkish'",
+		},
+		{
+			policy: NamePolicy{Exceptions: []string{"Bok choy"}},
+			expErr: "invalid name exception: 'Bok choy'",
+		},
+	} {
+		err := SetNamePolicy(v.policy)
+		if err == nil || err.Error() != v.expErr {
+			t.Fatalf("(%d) Unexpected policy error: %v", i, err)
+		}
+	}
+
+	// A failed update leaves the policy in effect unchanged.
+	if CurrentNamePolicy().Case != NameCaseTitle {
+		t.Fatalf("Unexpected policy: %+v", CurrentNamePolicy())
+	}
+}
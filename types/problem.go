@@ -0,0 +1,56 @@
+package types
+
+// The stable codes of the problems the service reports, which clients may
+// switch on, unlike the detail, which is meant for people and may change.
+const (
+	ProblemInvalidRequest       = "request.invalid"
+	ProblemMalformedBody        = "request.malformed_body"
+	ProblemUnsupportedMediaType = "request.unsupported_media_type"
+	ProblemNotAcceptable        = "request.not_acceptable"
+	ProblemNoRoute              = "request.not_found"
+	ProblemMethodNotAllowed     = "request.method_not_allowed"
+	ProblemRateLimited          = "request.rate_limited"
+	ProblemRequestCancelled     = "request.cancelled"
+	ProblemDeadlineExceeded     = "request.deadline_exceeded"
+	ProblemUnauthenticated      = "auth.unauthenticated"
+	ProblemForbidden            = "auth.forbidden"
+	ProblemIdempotencyKeyReused = "idempotency.key_reused"
+	ProblemIdempotencyBusy      = "idempotency.in_progress"
+	ProblemInvalidCode          = "produce.invalid_code"
+	ProblemInvalidCategory      = "produce.invalid_category"
+	ProblemInvalidTags          = "produce.invalid_tags"
+	ProblemProduceNotFound      = "produce.not_found"
+	ProblemProduceExists        = "produce.already_exists"
+	ProblemImportAborted        = "produce.import_aborted"
+	ProblemCategoryNotFound     = "category.not_found"
+	ProblemCategoryExists       = "category.already_exists"
+	ProblemCategoryInUse        = "category.in_use"
+	ProblemAttributeNotFound    = "attribute.not_found"
+	ProblemAttributeExists      = "attribute.already_exists"
+	ProblemAttributeInUse       = "attribute.in_use"
+	ProblemInternal             = "server.internal_error"
+	ProblemShuttingDown         = "server.shutting_down"
+	ProblemOverloaded           = "server.overloaded"
+)
+
+// ProblemContentType is the media type of a Problem.
+const ProblemContentType = "application/problem+json"
+
+// Problem is the body of every error response, in the form of RFC 7807
+// (Problem Details for HTTP APIs).  The type is always "about:blank", so
+// the title is the text of the HTTP status, and the problem is identified
+// by its Code instead.  Field names the request field or parameter that is
+// at fault, if there is one, and RequestID is the ID of the request, as in
+// the X-Request-ID header, to find it in the logs.  For an invalid item,
+// Errors holds the problem with each of its fields.
+type Problem struct {
+	Type      string      `json:"type"`
+	Title     string      `json:"title"`
+	Status    int         `json:"status"`
+	Detail    string      `json:"detail,omitempty"`
+	Instance  string      `json:"instance,omitempty"`
+	Code      string      `json:"code"`
+	Field     string      `json:"field,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	Errors    FieldErrors `json:"errors,omitempty"`
+}
@@ -8,18 +8,70 @@ import (
 	"bytes"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"unicode"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // Produce represents a code, name and unit price for an item in
 // the supermarket.  Note the unit price is a custom type that maps
 // as JSON string to an internal format that can be worked with
-// mathematically.
+// mathematically.  The category and tags are optional: the category
+// names a node in the category hierarchy, and the tags are free-form
+// labels such as "Local" or "Seasonal".  The attributes are also
+// optional, and must conform to the attribute schema.  The names are
+// localized translations of the default name, keyed by BCP 47 language
+// tag, such as "fr-CA".
 type Produce struct {
-	Code      string `json:"code"`
-	Name      string `json:"name"`
-	UnitPrice USD    `json:"unit_price"`
+	Code       string                 `json:"code"`
+	Name       string                 `json:"name"`
+	UnitPrice  USD                    `json:"unit_price"`
+	Category   string                 `json:"category,omitempty"`
+	Tags       []string               `json:"tags,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Names      map[string]string      `json:"names,omitempty"`
+}
+
+// Category is a single node in the produce category hierarchy, such as
+// "Apples" with parent "Fruit".  Top-level categories have no parent.
+// Category names are unique across the whole hierarchy, so an item only
+// needs the name of its category.
+type Category struct {
+	Name   string `json:"name" xml:"name"`
+	Parent string `json:"parent,omitempty" xml:"parent,omitempty"`
+}
+
+// CategoryListResponse defines the JSON format for the request to list
+// all of the categories.
+type CategoryListResponse []Category
+
+// CategoryCount reports the number of produce items in a category.  The
+// count is for items assigned directly to the category, whereas the total
+// count includes all of the items in the category's subtree.
+type CategoryCount struct {
+	Name       string `json:"name" xml:"name"`
+	Parent     string `json:"parent,omitempty" xml:"parent,omitempty"`
+	Count      int    `json:"count" xml:"count"`
+	TotalCount int    `json:"total_count" xml:"total_count"`
+}
+
+// CategoryCountResponse defines the JSON format for the request to count
+// the produce items in each category.
+type CategoryCountResponse []CategoryCount
+
+// ProduceFilter restricts a produce listing to the items within the subtree
+// of a category, and that carry all of the given tags.  The zero value
+// matches every item.
+type ProduceFilter struct {
+	Category string
+	Tags     []string
+}
+
+// IsEmpty returns whether the filter matches every item.
+func (pf ProduceFilter) IsEmpty() bool {
+	return pf.Category == "" && len(pf.Tags) == 0
 }
 
 // ProduceAddRequest defines the JSON format for the request to add
@@ -35,10 +87,19 @@ type ProduceListResponse []Produce
 // when multiple items are in the add request.  It contains the produce code
 // and the HTTP status for a single add operation.  This is useful in the case
 // of a partial success, so we can see exactly which ones succeeded and failed.
+//
+// For CSV imports, the row is the number of the data row, counting from 1
+// after the header row, and for NDJSON bulk adds, it is the line number,
+// so failures can be found in the file.  A failure carries the code of its
+// problem, as an error response would, along with the message, and for an
+// invalid item, the problem with each of its fields.
 type ProduceAddItemResponse struct {
-	Code       string `json:"code"`
-	StatusCode int    `json:"status_code"`
-	Error      string `json:"error,omitempty"`
+	Row        int         `json:"row,omitempty" xml:"row,omitempty"`
+	Code       string      `json:"code" xml:"code"`
+	StatusCode int         `json:"status_code" xml:"status_code"`
+	ErrorCode  string      `json:"error_code,omitempty" xml:"error_code,omitempty"`
+	Error      string      `json:"error,omitempty" xml:"error,omitempty"`
+	Errors     FieldErrors `json:"errors,omitempty" xml:"field_error,omitempty"`
 }
 
 // ProduceAddResponse is the repsonse to a Produce add request.  It
@@ -49,75 +110,249 @@ type ProduceAddResponse []ProduceAddItemResponse
 // StatusResponse is the JSON returned for a liveness check as well as
 // for other status notifications such as a successful delete.
 type StatusResponse struct {
-	Status string `json:"status"`
+	Status string `json:"status" xml:"status"`
 }
 
 var (
-	// Regular expression to validate a produce code, which is 4 sets of
-	// hyphen-separated quartets of alphanumerics.
+	// Regular expression to validate a produce code in the quartet format,
+	// which is 4 sets of hyphen-separated quartets of alphanumerics.
 	codeExp = regexp.MustCompile(`^([A-Za-z0-9]{4}-){3}([A-Za-z0-9]){4}$`)
 
 	// Regular expression to match produce name: (Unicode) alphanumerics
 	// plus white space.
 	nameExp = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}\s]*$`)
+
+	// Regular expression to match the commonly used subset of BCP 47
+	// language tags: a language, optionally followed by a script, a region
+	// and any number of variants, e.g. "fr", "fr-CA" or "zh-Hant-TW".
+	langTagExp = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z]{4})?` +
+		`(-[A-Za-z]{2}|-[0-9]{3})?(-[A-Za-z0-9]{5,8}|-[0-9][A-Za-z0-9]{3})*$`)
 )
 
-// ValidateAndConvertProduceCode returns whether the produce code is
-// syntactically valid and if so, puts it in canoncial for (upper case).
-func ValidateAndConvertProduceCode(code string) (string, bool) {
-	if !codeExp.Match([]byte(code)) {
-		return code, false
+// ValidateAndConvertProduceCode returns the produce code in canonical form
+// if it conforms to any of the configured code formats, along with an
+// empty string.  Otherwise, the code is returned unchanged with a
+// description of the rule each format found broken.
+func ValidateAndConvertProduceCode(code string) (string, string) {
+	formats := currentCodeFormats()
+	reasons := make([]string, 0, len(formats))
+	for _, f := range formats {
+		str, err := f.ValidateAndConvert(code)
+		if err == nil {
+			return str, ""
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %s", f.Name(), err))
 	}
-	return strings.ToUpper(code), true
+	return code, fmt.Sprintf("invalid code: '%s' (%s)", code,
+		strings.Join(reasons, "; "))
+}
+
+// NamePattern returns the regular expression that produce names, and the
+// other names that follow the same rules, such as categories, must match.
+func NamePattern() string {
+	return nameExp.String()
 }
 
 // ValidateAndConvertName returns whether the produce name is
-// syntactically valid and if so, puts it in canoncial form.  For
-// names, the canonical form is leading characters capitalized.  Also
-// note, the leading character cannot bne a space, but internal characters
-// may be white space.
+// syntactically valid and if so, puts it in canoncial form.  Note, the
+// leading character cannot be a space, but internal characters may be
+// white space.  The canonical form is determined by the name policy,
+// which by default capitalizes leading word characters and lower cases
+// the rest, after normalizing the name to Unicode NFC.
 func ValidateAndConvertName(name string) (string, bool) {
-	if !nameExp.Match([]byte(name)) {
-		return name, false
+	np := currentNamePolicy()
+	str := name
+	if np.Normalize {
+		str = norm.NFC.String(name)
 	}
-
-	var prev = ' '
-	runes := []rune(name)
-	var res []rune
-	for _, v := range runes {
-		if unicode.IsSpace(prev) {
-			res = append(res, unicode.ToUpper(v))
-		} else {
-			res = append(res, unicode.ToLower(v))
-		}
-		prev = v
+	if !nameExp.Match([]byte(str)) {
+		return name, false
 	}
-	return string(res), true
+	return np.convert(str), true
 }
 
 // ValidateAndConvertProduce validates that the code and name comform
 // to the grammar, and also canonicalize them as per the specified rules.
-func ValidateAndConvertProduce(item *Produce) string {
-	// The custom unmarshal of the USD field already validated it, but
-	// we must manually validate the other two fields and convert
-	// the to canonical format (upper case).
-	var problems bytes.Buffer
-	str, val := ValidateAndConvertProduceCode(item.Code)
+// It returns every problem with the item, or nil if there are none.
+func ValidateAndConvertProduce(item *Produce) FieldErrors {
+	// The unit price was already validated when it was decoded, but we
+	// must manually validate the other fields and convert them to
+	// canonical format (upper case).
+	var problems FieldErrors
+	str, msg := ValidateAndConvertProduceCode(item.Code)
+	if msg != "" {
+		problems = append(problems, FieldError{Field: "code",
+			Value: item.Code, Rule: RuleCodeFormat, Message: msg})
+	}
+	item.Code = str
+
+	str, val := ValidateAndConvertName(item.Name)
 	if !val {
-		if problems.Len() != 0 {
-			problems.WriteString(", ")
+		problems = append(problems, FieldError{Field: "name",
+			Value: item.Name, Rule: RuleNamePattern,
+			Message: fmt.Sprintf("invalid name: '%s'", item.Name)})
+	}
+	item.Name = str
+
+	if item.Category != "" {
+		str, val = ValidateAndConvertName(item.Category)
+		if !val {
+			problems = append(problems, FieldError{Field: "category",
+				Value: item.Category, Rule: RuleNamePattern,
+				Message: fmt.Sprintf("invalid category: '%s'", item.Category)})
 		}
-		problems.WriteString(fmt.Sprintf("invalid code: '%s'", item.Code))
+		item.Category = str
 	}
-	item.Code = str
 
-	str, val = ValidateAndConvertName(item.Name)
+	names, errs := validateAndConvertNames(item.Names)
+	problems = append(problems, errs...)
+	item.Names = names
+
+	tags, errs := validateAndConvertTags(item.Tags)
+	problems = append(problems, errs...)
+	item.Tags = tags
+	return problems
+}
+
+// ValidateAndConvertLanguageTag returns whether the language tag is
+// syntactically valid BCP 47 and if so, puts it in canonical form, in
+// which the language and variants are lower case, the script is title
+// case and the region is upper case, as in "zh-Hant-TW".
+func ValidateAndConvertLanguageTag(tag string) (string, bool) {
+	if !langTagExp.MatchString(tag) {
+		return tag, false
+	}
+	parts := strings.Split(tag, "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		switch {
+		case i == 1 && len(parts[i]) == 4 && unicode.IsLetter(rune(parts[i][0])):
+			parts[i] = strings.ToUpper(parts[i][:1]) + strings.ToLower(parts[i][1:])
+		case len(parts[i]) == 2 || (len(parts[i]) == 3 && unicode.IsDigit(rune(parts[i][0]))):
+			parts[i] = strings.ToUpper(parts[i])
+		default:
+			parts[i] = strings.ToLower(parts[i])
+		}
+	}
+	return strings.Join(parts, "-"), true
+}
+
+// ValidateAndConvertNames validates the localized names, where each
+// language tag must be valid BCP 47 and each name must follow the same
+// rules as the default name.  Both are converted to canonical form.  A
+// non-empty string describing the problems is returned if any are bad.
+func ValidateAndConvertNames(names map[string]string) (map[string]string,
+	string) {
+	res, errs := validateAndConvertNames(names)
+	return res, errs.Error()
+}
+
+// validateAndConvertNames validates and converts the localized names as
+// ValidateAndConvertNames does, returning the problem with each one.
+func validateAndConvertNames(names map[string]string) (map[string]string,
+	FieldErrors) {
+	if len(names) == 0 {
+		return names, nil
+	}
+
+	// Process in a fixed order, so the problem descriptions are stable.
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var problems FieldErrors
+	res := make(map[string]string, len(names))
+	for _, k := range keys {
+		tag, tval := ValidateAndConvertLanguageTag(k)
+		name, nval := ValidateAndConvertName(names[k])
+		fe := FieldError{Field: "names." + k, Value: k}
+		switch {
+		case !tval:
+			fe.Rule = RuleLanguageTag
+			fe.Message = fmt.Sprintf("invalid language tag: '%s'", k)
+		case !nval:
+			fe.Value, fe.Rule = names[k], RuleNamePattern
+			fe.Message = fmt.Sprintf("invalid name for '%s': '%s'", tag,
+				names[k])
+		default:
+			if _, ok := res[tag]; ok {
+				fe.Rule = RuleDuplicate
+				fe.Message = fmt.Sprintf("duplicate language tag: '%s'", k)
+			}
+		}
+		if fe.Message != "" {
+			problems = append(problems, fe)
+			continue
+		}
+		res[tag] = name
+	}
+	return res, problems
+}
+
+// ValidateAndConvertTags validates each tag using the same rules as
+// for names, and converts them to canonical form.  Duplicate tags are
+// removed, keeping the order of first appearance.  A non-empty string
+// describing the invalid tags is returned if any are bad.
+func ValidateAndConvertTags(tags []string) ([]string, string) {
+	res, errs := validateAndConvertTags(tags)
+	return res, errs.Error()
+}
+
+// validateAndConvertTags validates and converts the tags as
+// ValidateAndConvertTags does, returning the problem with each one.
+func validateAndConvertTags(tags []string) ([]string, FieldErrors) {
+	if len(tags) == 0 {
+		return tags, nil
+	}
+
+	var problems FieldErrors
+	res := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for i, v := range tags {
+		str, val := ValidateAndConvertName(v)
+		if !val {
+			problems = append(problems, FieldError{
+				Field: fmt.Sprintf("tags[%d]", i), Value: v,
+				Rule: RuleNamePattern, Message: fmt.Sprintf("invalid tag: '%s'", v)})
+			res = append(res, v)
+			continue
+		}
+		if !seen[str] {
+			seen[str] = true
+			res = append(res, str)
+		}
+	}
+	return res, problems
+}
+
+// ValidateAndConvertCategory validates that the category name and
+// its parent (if any) conform to the name grammar, and canonicalizes
+// them.  It returns a description of any problems found.
+func ValidateAndConvertCategory(cat *Category) string {
+	var problems bytes.Buffer
+	str, val := ValidateAndConvertName(cat.Name)
 	if !val {
-		if problems.Len() != 0 {
-			problems.WriteString(", ")
+		problems.WriteString(fmt.Sprintf("invalid category name: '%s'",
+			cat.Name))
+	}
+	cat.Name = str
+
+	if cat.Parent != "" {
+		str, val = ValidateAndConvertName(cat.Parent)
+		if !val {
+			if problems.Len() != 0 {
+				problems.WriteString(", ")
+			}
+			problems.WriteString(fmt.Sprintf("invalid parent category: '%s'",
+				cat.Parent))
 		}
-		problems.WriteString(fmt.Sprintf("invalid name: '%s'", item.Name))
+		cat.Parent = str
+	}
+	if problems.Len() == 0 && cat.Name == cat.Parent {
+		problems.WriteString(fmt.Sprintf("category '%s' cannot be its own parent",
+			cat.Name))
 	}
-	item.Name = str
 	return problems.String()
 }
@@ -1,9 +1,14 @@
 package types
 
 import (
+	"reflect"
 	"testing"
 )
 
+// The reason a code fails the default quartet code format.
+const quartetRule = "(quartet: expected four hyphen-separated groups of " +
+	"four letters or digits)"
+
 var (
 	dfltProduce = Produce{
 		Code:      "A12T-4GH7-QPL9-3N4M",
@@ -69,8 +74,8 @@ func TestProduceCodeConversion(t *testing.T) {
 			valid: false,
 		},
 	} {
-		str, valid := ValidateAndConvertProduceCode(v.input)
-		if v.valid != valid {
+		str, msg := ValidateAndConvertProduceCode(v.input)
+		if v.valid != (msg == "") {
 			t.Fatalf("(%d) Unexpected validation result", i)
 		}
 		if str != v.expected {
@@ -143,7 +148,7 @@ func TestProduceNameConversion(t *testing.T) {
 func TestProduceConversion(t *testing.T) {
 	for i, v := range []struct {
 		input   Produce
-		expStr  string
+		expErrs FieldErrors
 		expProd Produce
 	}{
 		{
@@ -155,23 +160,193 @@ func TestProduceConversion(t *testing.T) {
 			expProd: dfltProduce,
 		},
 		{
-			input:  dfltProduceBadCode,
-			expStr: "invalid code: 'A12T-4GH7-QP'",
+			input: dfltProduceBadCode,
+			expErrs: FieldErrors{{Field: "code", Value: "A12T-4GH7-QP",
+				Rule:    RuleCodeFormat,
+				Message: "invalid code: 'A12T-4GH7-QP' " + quartetRule}},
+		},
+		{
+			input: dfltProduceBadName,
+			expErrs: FieldErrors{{Field: "name", Value: "Lettuce+Cukes",
+				Rule: RuleNamePattern, Message: "invalid name: 'Lettuce+Cukes'"}},
 		},
 		{
-			input:  dfltProduceBadName,
-			expStr: "invalid name: 'Lettuce+Cukes'",
+			input: Produce{Code: "A12T", Name: "-", Category: "+",
+				Tags:  []string{"Local", "?"},
+				Names: map[string]string{"fr": "!", "x": "Laitue"}},
+			expErrs: FieldErrors{
+				{Field: "code", Value: "A12T", Rule: RuleCodeFormat,
+					Message: "invalid code: 'A12T' " + quartetRule},
+				{Field: "name", Value: "-", Rule: RuleNamePattern,
+					Message: "invalid name: '-'"},
+				{Field: "category", Value: "+", Rule: RuleNamePattern,
+					Message: "invalid category: '+'"},
+				{Field: "names.fr", Value: "!", Rule: RuleNamePattern,
+					Message: "invalid name for 'fr': '!'"},
+				{Field: "names.x", Value: "x", Rule: RuleLanguageTag,
+					Message: "invalid language tag: 'x'"},
+				{Field: "tags[1]", Value: "?", Rule: RuleNamePattern,
+					Message: "invalid tag: '?'"},
+			},
 		},
 	} {
 		citem := v.input
-		str := ValidateAndConvertProduce(&citem)
-		if str != v.expStr {
-			t.Fatalf("(%d) Unexpected converted string: '%s'", i, str)
+		errs := ValidateAndConvertProduce(&citem)
+		if !reflect.DeepEqual(errs, v.expErrs) {
+			t.Fatalf("(%d) Unexpected problems: %+v", i, errs)
 		}
-		if v.expProd != noProduce {
-			if citem != v.expProd {
+		if !reflect.DeepEqual(v.expProd, noProduce) {
+			if !reflect.DeepEqual(citem, v.expProd) {
 				t.Fatalf("(%d) Bad produce conversion: '%+v'", i, citem)
 			}
 		}
 	}
 }
+
+func TestTagConversion(t *testing.T) {
+	for i, v := range []struct {
+		input    []string
+		expected []string
+		expStr   string
+	}{
+		{
+			input:    nil,
+			expected: nil,
+		},
+		{
+			input:    []string{"local", "SEASONAL"},
+			expected: []string{"Local", "Seasonal"},
+		},
+		{
+			input:    []string{"local", "Local", "seasonal", "LOCAL"},
+			expected: []string{"Local", "Seasonal"},
+		},
+		{
+			input:    []string{"local", "-sale-"},
+			expected: []string{"Local", "-sale-"},
+			expStr:   "invalid tag: '-sale-'",
+		},
+	} {
+		tags, str := ValidateAndConvertTags(v.input)
+		if str != v.expStr {
+			t.Fatalf("(%d) Unexpected problem string: '%s'", i, str)
+		}
+		if !reflect.DeepEqual(tags, v.expected) {
+			t.Fatalf("(%d) Unexpected tags: %v", i, tags)
+		}
+	}
+}
+
+func TestCategoryConversion(t *testing.T) {
+	for i, v := range []struct {
+		input  Category
+		expStr string
+		expCat Category
+	}{
+		{
+			input:  Category{Name: "fruit"},
+			expCat: Category{Name: "Fruit"},
+		},
+		{
+			input:  Category{Name: "green apples", Parent: "fruit"},
+			expCat: Category{Name: "Green Apples", Parent: "Fruit"},
+		},
+		{
+			input:  Category{Name: "fruit", Parent: "Fruit"},
+			expStr: "category 'Fruit' cannot be its own parent",
+		},
+		{
+			input:  Category{Name: "+fruit", Parent: "*food"},
+			expStr: "invalid category name: '+fruit', invalid parent category: '*food'",
+		},
+	} {
+		cat := v.input
+		str := ValidateAndConvertCategory(&cat)
+		if str != v.expStr {
+			t.Fatalf("(%d) Unexpected problem string: '%s'", i, str)
+		}
+		if str == "" && cat != v.expCat {
+			t.Fatalf("(%d) Bad category conversion: '%+v'", i, cat)
+		}
+	}
+}
+
+func TestProduceCategoryTagConversion(t *testing.T) {
+	item := Produce{
+		Code:      "A12T-4GH7-QPL9-3N4M",
+		Name:      "Lettuce",
+		UnitPrice: (346),
+		Category:  "leafy greens",
+		Tags:      []string{"local", "LOCAL", "organic"},
+	}
+	if errs := ValidateAndConvertProduce(&item); errs != nil {
+		t.Fatalf("Unexpected problems: '%s'", errs)
+	}
+	if item.Category != "Leafy Greens" {
+		t.Fatalf("Unexpected category: '%s'", item.Category)
+	}
+	if !reflect.DeepEqual(item.Tags, []string{"Local", "Organic"}) {
+		t.Fatalf("Unexpected tags: %v", item.Tags)
+	}
+
+	item.Category = "leafy-greens"
+	item.Tags = []string{"?"}
+	errs := ValidateAndConvertProduce(&item)
+	if errs.Error() != "invalid category: 'leafy-greens', invalid tag: '?'" {
+		t.Fatalf("Unexpected problem string: '%s'", errs)
+	}
+}
+
+func TestLanguageTagConversion(t *testing.T) {
+	for i, v := range []struct {
+		input    string
+		valid    bool
+		expected string
+	}{
+		{input: "fr", valid: true, expected: "fr"},
+		{input: "FR-ca", valid: true, expected: "fr-CA"},
+		{input: "zh-hant-tw", valid: true, expected: "zh-Hant-TW"},
+		{input: "es-419", valid: true, expected: "es-419"},
+		{input: "de-CH-1996", valid: true, expected: "de-CH-1996"},
+		{input: "french", valid: false, expected: "french"},
+		{input: "fr_CA", valid: false, expected: "fr_CA"},
+		{input: "", valid: false},
+	} {
+		str, valid := ValidateAndConvertLanguageTag(v.input)
+		if v.valid != valid {
+			t.Fatalf("(%d) Unexpected validation result", i)
+		}
+		if str != v.expected {
+			t.Fatalf("(%d) Unexpected converted string: '%s'", i, str)
+		}
+	}
+}
+
+func TestNamesConversion(t *testing.T) {
+	for i, v := range []struct {
+		input    map[string]string
+		expected map[string]string
+		expStr   string
+	}{
+		{
+			input:    map[string]string{"fr-ca": "pomme gala", "EN": "gala apple"},
+			expected: map[string]string{"fr-CA": "Pomme Gala", "en": "Gala Apple"},
+		},
+		{
+			input:  map[string]string{"fr_CA": "Pomme", "fr": "Pomme-Gala"},
+			expStr: "invalid name for 'fr': 'Pomme-Gala', invalid language tag: 'fr_CA'",
+		},
+		{
+			input:  map[string]string{"fr-CA": "Pomme", "fr-ca": "Pomme"},
+			expStr: "duplicate language tag: 'fr-ca'",
+		},
+	} {
+		names, str := ValidateAndConvertNames(v.input)
+		if str != v.expStr {
+			t.Fatalf("(%d) Unexpected problem string: '%s'", i, str)
+		}
+		if str == "" && !reflect.DeepEqual(names, v.expected) {
+			t.Fatalf("(%d) Unexpected names: %v", i, names)
+		}
+	}
+}
@@ -31,9 +31,15 @@ func (d USD) String() string {
 	return fmt.Sprintf("$%d.%02d", d/100, d%100)
 }
 
+// USDPattern returns the regular expression that USD currency strings must
+// match, without the surrounding quotes of the JSON form.
+func USDPattern() string {
+	return strings.Replace(usdExp.String(), `\"`, "", -1)
+}
+
 // UnmarshalJSON is a custom JSON unmarshaller for USD currency.
 func (d *USD) UnmarshalJSON(b []byte) error {
-	if !usdExp.Match(b) {
+	if !usdExp.Match(b) || len(b) == 2 {
 		return errors.New("invalid USD format: " + string(b))
 	}
 
@@ -86,3 +92,15 @@ func (d USD) MarshalJSON() ([]byte, error) {
 	buf.WriteByte('"')
 	return buf.Bytes(), nil
 }
+
+// MarshalText renders USD currency in its string form, e.g. "$3.46".  This
+// is used by encodings other than JSON, such as XML.
+func (d USD) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText parses USD currency in the same string form as the JSON
+// unmarshaller, but without the quotes.
+func (d *USD) UnmarshalText(b []byte) error {
+	return d.UnmarshalJSON([]byte(`"` + string(b) + `"`))
+}
@@ -76,6 +76,10 @@ func TestUSDConversion(t *testing.T) {
 			input: "$",
 			uerr:  "invalid USD format",
 		},
+		{
+			input: "",
+			uerr:  "invalid USD format",
+		},
 		{
 			input: "-$4.56",
 			uerr:  "invalid USD format",
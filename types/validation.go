@@ -0,0 +1,72 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The rules a field value may break, as reported in a FieldError, which
+// clients may switch on.
+const (
+	RuleCodeFormat       = "code_format"
+	RuleNamePattern      = "name_pattern"
+	RulePriceFormat      = "price_format"
+	RuleLanguageTag      = "language_tag"
+	RuleDuplicate        = "duplicate"
+	RuleUnknownField     = "unknown_field"
+	RuleUnknownAttribute = "unknown_attribute"
+	RuleRequired         = "required"
+	RuleType             = "type"
+	RuleMaxLength        = "max_length"
+	RulePattern          = "pattern"
+	RuleMin              = "min"
+	RuleMax              = "max"
+	RuleEnum             = "enum"
+)
+
+// FieldError is a problem with a single field of an item.  The field is
+// its path in the JSON form of the item, such as "name", "tags[1]",
+// "names.fr" or "attributes.organic", and the value is the one given, as
+// text.  The rule is the one the value breaks, whereas the message is
+// meant for people.
+type FieldError struct {
+	Field   string `json:"field" xml:"field"`
+	Value   string `json:"value" xml:"value"`
+	Rule    string `json:"rule" xml:"rule"`
+	Message string `json:"message" xml:"message"`
+}
+
+// Error satisfies the error interface.
+func (fe FieldError) Error() string {
+	return fe.Message
+}
+
+// FieldErrors are all of the problems with an item, in the order they
+// were found.
+type FieldErrors []FieldError
+
+// Error satisfies the error interface, with the messages of the problems
+// joined together, as in "invalid code: 'x', invalid name: 'y'".
+func (fe FieldErrors) Error() string {
+	msgs := make([]string, len(fe))
+	for i, v := range fe {
+		msgs[i] = v.Message
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// ParseUnitPrice parses the text of a unit price, such as "$3.46" or
+// "0.79", returning the problem with it if it can't be parsed.
+func ParseUnitPrice(text string) (USD, *FieldError) {
+	var d USD
+	if err := d.UnmarshalText([]byte(text)); err != nil {
+		return 0, invalidPrice(text)
+	}
+	return d, nil
+}
+
+// invalidPrice returns the problem with a unit price that can't be parsed.
+func invalidPrice(text string) *FieldError {
+	return &FieldError{Field: "unit_price", Value: text,
+		Rule: RulePriceFormat, Message: fmt.Sprintf("invalid unit price: '%s'", text)}
+}
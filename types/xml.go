@@ -0,0 +1,164 @@
+package types
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// xmlProduce is the XML form of a produce item.  XML has no maps, so the
+// attributes and localized names are lists of elements, each keyed by an
+// XML attribute.
+type xmlProduce struct {
+	Code       string         `xml:"code"`
+	Name       string         `xml:"name"`
+	UnitPrice  string         `xml:"unit_price"`
+	Category   string         `xml:"category,omitempty"`
+	Tags       *xmlTags       `xml:"tags,omitempty"`
+	Attributes *xmlAttributes `xml:"attributes,omitempty"`
+	Names      *xmlNames      `xml:"names,omitempty"`
+}
+
+// The wrappers for the lists of tags, attributes and localized names,
+// which are pointers so that they are omitted when there are none.
+type xmlTags struct {
+	Tags []string `xml:"tag"`
+}
+
+type xmlAttributes struct {
+	Attributes []xmlAttribute `xml:"attribute"`
+}
+
+type xmlNames struct {
+	Names []xmlName `xml:"name"`
+}
+
+// xmlAttribute is the XML form of an attribute value, such as
+// <attribute name="plu" type="int">4011</attribute>.  As XML content is
+// all text, the type says how to convert the value back.
+type xmlAttribute struct {
+	Name  string        `xml:"name,attr"`
+	Type  AttributeType `xml:"type,attr,omitempty"`
+	Value string        `xml:",chardata"`
+}
+
+// xmlName is the XML form of a localized name, such as
+// <name lang="fr">Laitue</name>.
+type xmlName struct {
+	Lang  string `xml:"lang,attr"`
+	Value string `xml:",chardata"`
+}
+
+// MarshalXML is a custom XML marshaller for produce items, which writes
+// the attributes and localized names in key order.
+func (p Produce) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	xp := xmlProduce{
+		Code:      p.Code,
+		Name:      p.Name,
+		UnitPrice: p.UnitPrice.String(),
+		Category:  p.Category,
+	}
+	if len(p.Tags) != 0 {
+		xp.Tags = &xmlTags{Tags: p.Tags}
+	}
+
+	keys := make([]string, 0, len(p.Attributes))
+	for k := range p.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) != 0 {
+		xp.Attributes = &xmlAttributes{}
+	}
+	for _, k := range keys {
+		xa := xmlAttribute{Name: k}
+		switch v := p.Attributes[k].(type) {
+		case int64:
+			xa.Type, xa.Value = AttributeInt, strconv.FormatInt(v, 10)
+		case bool:
+			xa.Type, xa.Value = AttributeBool, strconv.FormatBool(v)
+		case USD:
+			xa.Type, xa.Value = AttributeMoney, v.String()
+		case string:
+			xa.Type, xa.Value = AttributeString, v
+		default:
+			xa.Value = fmt.Sprint(v)
+		}
+		xp.Attributes.Attributes = append(xp.Attributes.Attributes, xa)
+	}
+
+	keys = keys[:0]
+	for k := range p.Names {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) != 0 {
+		xp.Names = &xmlNames{}
+	}
+	for _, k := range keys {
+		xp.Names.Names = append(xp.Names.Names,
+			xmlName{Lang: k, Value: p.Names[k]})
+	}
+	return e.EncodeElement(xp, start)
+}
+
+// UnmarshalXML is a custom XML unmarshaller for produce items.  Attribute
+// values are converted according to their type, and if there is no type,
+// or the value doesn't parse as that type, the value is left as a string,
+// for validation to report on.
+func (p *Produce) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var xp xmlProduce
+	if err := d.DecodeElement(&xp, &start); err != nil {
+		return err
+	}
+	*p = xp.produce()
+	if xp.UnitPrice == "" {
+		return nil
+	}
+	return p.UnitPrice.UnmarshalText([]byte(xp.UnitPrice))
+}
+
+// produce converts the XML form of an item, apart from its unit price,
+// which is left to the caller.
+func (xp xmlProduce) produce() Produce {
+	p := Produce{
+		Code:     xp.Code,
+		Name:     xp.Name,
+		Category: xp.Category,
+	}
+	if xp.Tags != nil && len(xp.Tags.Tags) != 0 {
+		p.Tags = xp.Tags.Tags
+	}
+
+	if xp.Attributes != nil && len(xp.Attributes.Attributes) != 0 {
+		p.Attributes = make(map[string]interface{},
+			len(xp.Attributes.Attributes))
+		for _, v := range xp.Attributes.Attributes {
+			p.Attributes[v.Name] = xmlAttributeValue(v)
+		}
+	}
+
+	if xp.Names != nil && len(xp.Names.Names) != 0 {
+		p.Names = make(map[string]string, len(xp.Names.Names))
+		for _, v := range xp.Names.Names {
+			p.Names[v.Lang] = v.Value
+		}
+	}
+	return p
+}
+
+// xmlAttributeValue converts the text of an attribute value to its type.
+func xmlAttributeValue(v xmlAttribute) interface{} {
+	switch v.Type {
+	case AttributeInt:
+		if n, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+			return n
+		}
+	case AttributeBool:
+		if b, err := strconv.ParseBool(v.Value); err == nil {
+			return b
+		}
+	}
+	return v.Value
+}
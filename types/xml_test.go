@@ -0,0 +1,90 @@
+package types
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProduceXML(t *testing.T) {
+	for i, v := range []struct {
+		item Produce
+		xml  string
+	}{
+		{
+			item: Produce{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce",
+				UnitPrice: USD(346)},
+			xml: `<produce><code>A12T-4GH7-QPL9-3N4M</code><name>Lettuce</name>` +
+				`<unit_price>$3.46</unit_price></produce>`,
+		},
+		{
+			item: Produce{Code: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce",
+				UnitPrice: USD(346), Category: "Vegetables",
+				Tags: []string{"leafy", "local"},
+				Attributes: map[string]interface{}{
+					"plu": int64(4061), "organic": true,
+					"deposit": USD(5), "origin": "Salinas"},
+				Names: map[string]string{"fr": "Laitue", "es": "Lechuga"}},
+			xml: `<produce><code>A12T-4GH7-QPL9-3N4M</code><name>Lettuce</name>` +
+				`<unit_price>$3.46</unit_price><category>Vegetables</category>` +
+				`<tags><tag>leafy</tag><tag>local</tag></tags><attributes>` +
+				`<attribute name="deposit" type="money">$0.05</attribute>` +
+				`<attribute name="organic" type="bool">true</attribute>` +
+				`<attribute name="origin" type="string">Salinas</attribute>` +
+				`<attribute name="plu" type="int">4061</attribute></attributes>` +
+				`<names><name lang="es">Lechuga</name><name lang="fr">Laitue</name>` +
+				`</names></produce>`,
+		},
+	} {
+		var buf bytes.Buffer
+		err := xml.NewEncoder(&buf).EncodeElement(v.item,
+			xml.StartElement{Name: xml.Name{Local: "produce"}})
+		if err != nil {
+			t.Fatalf("(%d) marshal failed: %v", i, err)
+		}
+		b := buf.Bytes()
+		if string(b) != v.xml {
+			t.Fatalf("(%d) unexpected XML: %s", i, b)
+		}
+
+		// Money attributes are strings until they are validated, as they
+		// are when they come from JSON.
+		exp := v.item
+		if _, ok := exp.Attributes["deposit"]; ok {
+			exp.Attributes["deposit"] = "$0.05"
+		}
+		var item Produce
+		if err := xml.Unmarshal(b, &item); err != nil {
+			t.Fatalf("(%d) unmarshal failed: %v", i, err)
+		}
+		if !reflect.DeepEqual(item, exp) {
+			t.Fatalf("(%d) unexpected item: %+v", i, item)
+		}
+	}
+}
+
+func TestProduceXMLBadValues(t *testing.T) {
+	// Values that don't parse as their type are left as strings, for
+	// validation to report on, except for the unit price.
+	var item Produce
+	err := xml.Unmarshal([]byte(`<produce><name>Lettuce</name>`+
+		`<unit_price>$3.46</unit_price><attributes>`+
+		`<attribute name="plu" type="int">four</attribute>`+
+		`<attribute name="organic">true</attribute></attributes></produce>`),
+		&item)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	exp := map[string]interface{}{"plu": "four", "organic": "true"}
+	if !reflect.DeepEqual(item.Attributes, exp) {
+		t.Fatalf("unexpected attributes: %v", item.Attributes)
+	}
+
+	err = xml.Unmarshal([]byte(`<produce><name>Lettuce</name>`+
+		`<unit_price>lots</unit_price></produce>`), &item)
+	if err == nil || !strings.Contains(err.Error(), "lots") {
+		t.Fatalf("expected unit price error, got: %v", err)
+	}
+}